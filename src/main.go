@@ -1,12 +1,137 @@
 package main
 
 import (
+	"flag"
 	"log"
+	"memdb"
+	"net/http"
 	"os"
+	"raft"
+	"replica"
 	"rest"
+	"shard"
 )
 
 func main() {
-	server := rest.NewRestServerWithLogger(log.New(os.Stdout, "INFO: ", log.Ldate|log.Ltime|log.Lshortfile))
+	dataDir := flag.String("data-dir", "", "directory to persist the data in, keep the data in memory only if empty")
+	fsync := flag.String("fsync", "always", "when to flush the write-ahead log to the disk: always, interval or never")
+	fsyncInterval := flag.Duration("fsync-interval", memdb.DefaultSyncInterval, "how often to flush the write-ahead log with -fsync=interval")
+	compactSize := flag.Int64("compact-size", memdb.DefaultCompactSize, "size of the write-ahead log which triggers a snapshot, negative turns snapshots off")
+	raftID := flag.String("raft-id", "", "ID of this node in a replicated cluster, run a standalone server if empty")
+	raftPeers := flag.String("raft-peers", "", "all nodes of the cluster as comma separated ID=URL pairs, e.g. a=http://127.0.0.1:8081,b=http://127.0.0.1:8082")
+	raftDir := flag.String("raft-dir", "", "directory to keep the Raft log of the node in")
+	replicaOf := flag.String("replica-of", "", "URL of the primary to replicate, e.g. http://127.0.0.1:8080, run a primary if empty")
+	replicaAddr := flag.String("replica-addr", "127.0.0.1:8081", "address to serve the replica on")
+	shardID := flag.String("shard-id", "", "ID of this node in a sharded cluster, run a standalone server if empty")
+	shardNodes := flag.String("shard-nodes", "", "all nodes of the sharded cluster as comma separated ID=URL pairs, e.g. a=http://127.0.0.1:8081,b=http://127.0.0.1:8082")
+	shardRedirect := flag.Bool("shard-redirect", false, "redirect requests for the keys of other nodes instead of forwarding them")
+	flag.Parse()
+
+	logger := log.New(os.Stdout, "INFO: ", log.Ldate|log.Ltime|log.Lshortfile)
+
+	if *raftID != "" {
+		runReplicated(*raftID, *raftPeers, *raftDir, logger)
+		return
+	}
+
+	if *dataDir == "" && *replicaOf == "" && *shardID == "" {
+		server := rest.NewRestServerWithLogger(logger)
+		server.Run()
+		return
+	}
+
+	lockIdGen := memdb.NewLockIDSeqGenerator()
+	if *shardID != "" {
+		lockIdGen = shard.NewLockIDGenerator(*shardID)
+	}
+
+	mdb := memdb.NewMemDB("RestDB", lockIdGen)
+	if *dataDir != "" {
+		syncPolicy, err := memdb.ParseSyncPolicy(*fsync)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		mdb, err = memdb.Open(*dataDir, memdb.Options{Sync: syncPolicy, SyncInterval: *fsyncInterval, CompactSize: *compactSize, LockIDGenerator: lockIdGen})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	defer mdb.Close()
+
+	if *replicaOf != "" {
+		runReplica(mdb, *replicaOf, *replicaAddr, logger)
+		return
+	}
+
+	if *shardID != "" {
+		runSharded(mdb, *shardID, *shardNodes, *shardRedirect, logger)
+		return
+	}
+
+	server := rest.NewRestServerWithMemDB(mdb, logger)
 	server.Run()
 }
+
+// runReplica serves a replica of the primary, the replica takes writes once it's promoted by POST /admin/promote.
+func runReplica(mdb memdb.MemDB, primary, addr string, logger *log.Logger) {
+	rep, err := replica.Start(mdb, replica.Config{Primary: primary}, logger)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rep.Close()
+
+	server := rest.NewRestServerWithMemDB(mdb, logger)
+	logger.Printf("Replica of %s listens on %s...", primary, addr)
+	log.Fatal(http.ListenAndServe(addr, rep.Handler(server.Router())))
+}
+
+// runReplicated serves a node of a Raft cluster on the address of its URL.
+func runReplicated(id, peers, dir string, logger *log.Logger) {
+	if dir == "" {
+		log.Fatal("-raft-dir is required with -raft-id")
+	}
+
+	config := raft.Config{ID: id, Dir: dir}
+	var err error
+	if config.Peers, err = raft.ParsePeers(peers); err != nil {
+		log.Fatal(err)
+	}
+	addr, err := config.Addr()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db, err := raft.Open(config, logger)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	server := rest.NewRestServerWithMemDB(db, logger)
+	logger.Printf("Node %s of the cluster listens on %s...", id, addr)
+	log.Fatal(http.ListenAndServe(addr, db.Handler(server.Router())))
+}
+
+// runSharded serves a node of a sharded cluster on the address of its URL.
+func runSharded(mdb memdb.MemDB, id, nodes string, redirect bool, logger *log.Logger) {
+	config := shard.Config{ID: id, Redirect: redirect}
+	var err error
+	if config.Nodes, err = raft.ParsePeers(nodes); err != nil {
+		log.Fatal(err)
+	}
+	addr, err := config.Addr()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	node, err := shard.New(mdb, config, logger)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer node.Close()
+
+	server := rest.NewRestServerWithMemDB(mdb, logger)
+	logger.Printf("Node %s of the sharded cluster listens on %s...", id, addr)
+	log.Fatal(http.ListenAndServe(addr, node.Handler(server.Router())))
+}
@@ -0,0 +1,88 @@
+package memdb
+
+import (
+	"sort"
+	"time"
+)
+
+// LockInfo describes a key lock held by a LockID.
+type LockInfo struct {
+	LockID     LockID
+	Key        Key
+	Mode       LockMode
+	AcquiredAt time.Time
+	Token      FencingToken
+	// Deadline is the end of the lease, zero if the lock never expires
+	Deadline time.Time
+	// Waiters is the number of clients waiting for the key lock
+	Waiters int
+}
+
+// Locks returns all held key locks ordered by key, a shared key lock is listed once per holder.
+func (mdb *memDB) Locks() []LockInfo {
+	mdb.rlockAll()
+	defer mdb.runlockAll()
+
+	var locks []LockInfo
+	now := time.Now()
+	for i := range mdb.lockStripes {
+		for lockId, keys := range mdb.lockStripes[i].lockId2Keys {
+			if mdb.leaseExpired(lockId, now) {
+				continue
+			}
+			locks = append(locks, mdb.lockInfos(lockId, keys)...)
+		}
+	}
+
+	sort.Slice(locks, func(i, j int) bool {
+		if locks[i].Key != locks[j].Key {
+			return locks[i].Key < locks[j].Key
+		}
+		return locks[i].LockID < locks[j].LockID
+	})
+	return locks
+}
+
+// lockInfos describes the key locks held by lockId.
+// The caller must hold the stripes of lockId and of its keys.
+func (mdb *memDB) lockInfos(lockId LockID, keys []Key) []LockInfo {
+	locks := make([]LockInfo, 0, len(keys))
+	for _, key := range keys {
+		keyLock, exists := mdb.keyLock(key)
+		if !exists {
+			continue
+		}
+
+		info := LockInfo{LockID: lockId, Key: key, Deadline: mdb.lockStripe(lockId).leases[lockId], Waiters: keyLock.QueueLen()}
+		info.Mode, _ = keyLock.holderMode(lockId)
+		if info.Mode == Shared {
+			info.AcquiredAt = keyLock.sharedBy[lockId].acquiredAt
+			info.Token = keyLock.sharedBy[lockId].token
+		} else {
+			info.AcquiredAt = keyLock.acquiredAt
+			info.Token = keyLock.token
+		}
+		locks = append(locks, info)
+	}
+	return locks
+}
+
+// ForceRelease breaks the locks held by lockId no matter who holds them, and returns what has been released.
+// Unlike Release it's meant for operators to recover from stuck clients.
+func (mdb *memDB) ForceRelease(lockId LockID) ([]LockInfo, error) {
+	defer mdb.debugCheck()
+
+	keys, unlock, exists := mdb.lockHolder(lockId)
+	if !exists {
+		return nil, ErrLockIdNotFound
+	}
+	defer unlock()
+
+	if mdb.leaseExpired(lockId, time.Now()) {
+		return nil, ErrLockIdNotFound
+	}
+
+	released := mdb.lockInfos(lockId, keys)
+	mdb.releaseLock(lockId)
+	return released, nil
+}
@@ -0,0 +1,72 @@
+package memdb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocks(t *testing.T) {
+	memDB := newTestMemDB(t, "TestDB")
+	defer memDB.Close()
+
+	assert.Empty(t, memDB.Locks())
+
+	lockId := memDB.PutWithTTL(Key("key1"), Value("value1"), time.Minute)
+	assert.NoError(t, memDB.Release(memDB.Put(Key("key0"), Value("value0"))))
+	lockId2, _, _ := memDB.GetAndRLock(Key("key0"))
+	lockId3, _, _ := memDB.GetAndRLock(Key("key0"))
+
+	go memDB.GetAndLock(Key("key0"))
+	waitForWaiters(t, memDB, Key("key0"), 1)
+
+	locks := memDB.Locks()
+	assert.Equal(t, 3, len(locks))
+
+	assert.Equal(t, lockId2, locks[0].LockID)
+	assert.Equal(t, Key("key0"), locks[0].Key)
+	assert.Equal(t, Shared, locks[0].Mode)
+	assert.Equal(t, 1, locks[0].Waiters)
+	assert.True(t, locks[0].Deadline.IsZero())
+	assert.Equal(t, lockId3, locks[1].LockID)
+
+	assert.Equal(t, lockId, locks[2].LockID)
+	assert.Equal(t, Key("key1"), locks[2].Key)
+	assert.Equal(t, Exclusive, locks[2].Mode)
+	assert.Equal(t, FencingToken(1), locks[2].Token)
+	assert.Equal(t, 0, locks[2].Waiters)
+	assert.False(t, locks[2].Deadline.IsZero())
+	assert.False(t, locks[2].AcquiredAt.IsZero())
+}
+
+func TestForceRelease(t *testing.T) {
+	memDB := newTestMemDB(t, "TestDB")
+
+	_, err := memDB.ForceRelease(LockID("wronglock"))
+	assert.Equal(t, ErrLockIdNotFound, err)
+
+	assert.NoError(t, memDB.Release(memDB.Put(Key("key1"), Value("value1"))))
+	lockId := memDB.Put(Key("key0"), Value("value0"))
+	_, _, _, err = memDB.GetAndLockWithOptions(context.Background(), Key("key1"), LockOptions{Holder: lockId})
+	assert.NoError(t, err)
+
+	done := make(chan LockID)
+	go func() {
+		lockId, _, _ := memDB.GetAndLock(Key("key0"))
+		done <- lockId
+	}()
+	waitForWaiters(t, memDB, Key("key0"), 1)
+
+	released, err := memDB.ForceRelease(lockId)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(released))
+	assert.Equal(t, Key("key0"), released[0].Key)
+	assert.Equal(t, Key("key1"), released[1].Key)
+	assert.Equal(t, LockID("3"), <-done)
+
+	assert.Equal(t, ErrLockIdNotFound, memDB.Release(lockId))
+	_, _, err = memDB.TryGetAndLock(Key("key1"))
+	assert.NoError(t, err)
+}
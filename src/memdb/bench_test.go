@@ -0,0 +1,73 @@
+package memdb
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// The benchmarks run the clients in parallel on their own keys, run them with -cpu 1,2,4,8
+// to see how they scale with the cores.
+
+// parallelKeys runs fn in parallel, every goroutine gets its own keys.
+func parallelKeys(b *testing.B, fn func(keys []Key, i int)) {
+	var goroutines int64
+	b.RunParallel(func(pb *testing.PB) {
+		id := atomic.AddInt64(&goroutines, 1)
+		keys := make([]Key, 64)
+		for i := range keys {
+			keys[i] = Key("key" + strconv.FormatInt(id, 10) + "." + strconv.Itoa(i))
+		}
+
+		for i := 0; pb.Next(); i++ {
+			fn(keys, i)
+		}
+	})
+}
+
+func BenchmarkPutRelease(b *testing.B) {
+	mdb := NewMemDB("BenchmarkPutRelease", NewLockIDSeqGenerator())
+	defer mdb.Close()
+
+	parallelKeys(b, func(keys []Key, i int) {
+		if err := mdb.Release(mdb.Put(keys[i%len(keys)], Value("value"))); err != nil {
+			b.Fatal(err)
+		}
+	})
+}
+
+func BenchmarkGetAndLockUpdate(b *testing.B) {
+	mdb := NewMemDB("BenchmarkGetAndLockUpdate", NewLockIDSeqGenerator())
+	defer mdb.Close()
+
+	parallelKeys(b, func(keys []Key, i int) {
+		key := keys[i%len(keys)]
+		if i < len(keys) {
+			mdb.Release(mdb.Put(key, Value("value")))
+		}
+
+		lockId, value, err := mdb.GetAndLock(key)
+		if err == nil {
+			err = mdb.Update(lockId, key, value, true)
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	})
+}
+
+func BenchmarkPeek(b *testing.B) {
+	mdb := NewMemDB("BenchmarkPeek", NewLockIDSeqGenerator())
+	defer mdb.Close()
+
+	parallelKeys(b, func(keys []Key, i int) {
+		key := keys[i%len(keys)]
+		if i < len(keys) {
+			mdb.Release(mdb.Put(key, Value("value")))
+		}
+
+		if _, _, _, err := mdb.Peek(key); err != nil {
+			b.Fatal(err)
+		}
+	})
+}
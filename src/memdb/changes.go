@@ -0,0 +1,277 @@
+package memdb
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+var (
+	ErrUnknownChange = errors.New("Unknown change")
+	ErrKeyExists     = errors.New("Key already exists")
+)
+
+// changeBacklog is how many recent changes are kept for the replicas which fall behind.
+const changeBacklog = 4096
+
+// maxChangeBatch limits the changes returned by a single call of Changes.
+const maxChangeBatch = 1024
+
+// ChangeOp is the kind of a Change.
+type ChangeOp string
+
+const (
+	// ChangeSet sets the value of the key with the version it has on the primary
+	ChangeSet ChangeOp = "set"
+	// ChangeMove works like ChangeSet for a key moved from another database, but it keeps a newer copy of the key:
+	// it fails with ErrKeyExists if the key has Version or a later one, and with *LockedError if the key is reserved
+	ChangeMove ChangeOp = "move"
+	// ChangeDelete deletes the key
+	ChangeDelete ChangeOp = "delete"
+	// ChangeTokens raises the fencing tokens above Token, the primary may have handed out any token up to it
+	ChangeTokens ChangeOp = "tokens"
+	// ChangeReset replaces all values with Items, the replica starts over from the current state of the primary
+	ChangeReset ChangeOp = "reset"
+)
+
+// Change is a change of the values in the database. A replica follows its primary by applying
+// the changes of the primary in the order of their sequence numbers.
+type Change struct {
+	Seq     uint64
+	Op      ChangeOp
+	Key     Key
+	Value   Value
+	Version Version
+	Token   FencingToken
+
+	// Time is when the primary made the change, it's not set on Items
+	Time time.Time
+
+	// Items are the values of ChangeReset, Version and Token of the reset are the last ones of the primary
+	Items []Change
+}
+
+// initChanges starts the sequence of changes from the clock, so the positions a replica got
+// from an earlier run of the database are never mistaken for the current ones.
+func (mdb *memDB) initChanges() {
+	mdb.changeSeq = uint64(time.Now().UnixNano())
+	mdb.changesAfter = mdb.changeSeq
+	mdb.changed = make(chan struct{})
+}
+
+// publish records a change for the replicas and wakes up the ones waiting for it.
+// The caller must hold mdb.mu.
+func (mdb *memDB) publish(change Change) {
+	mdb.changeSeq++
+	change.Seq = mdb.changeSeq
+	change.Time = time.Now()
+	mdb.changes = append(mdb.changes, change)
+
+	if len(mdb.changes) >= 2*changeBacklog {
+		mdb.changes = append([]Change(nil), mdb.changes[len(mdb.changes)-changeBacklog:]...)
+		mdb.changesAfter = mdb.changes[0].Seq - 1
+	}
+
+	close(mdb.changed)
+	mdb.changed = make(chan struct{})
+}
+
+// resetChanges forgets the recent changes, every replica starts over with ChangeReset.
+// The caller must hold mdb.mu.
+func (mdb *memDB) resetChanges() {
+	mdb.changeSeq++
+	mdb.changesAfter = mdb.changeSeq
+	mdb.changes = nil
+
+	close(mdb.changed)
+	mdb.changed = make(chan struct{})
+}
+
+// Changes returns the changes after the one with sequence number seq, at most maxChangeBatch of them,
+// and a channel which is closed when there is a newer change. When the changes after seq are no longer
+// kept, e.g. seq is zero or the replica has fallen too far behind, a single ChangeReset is returned instead.
+func (mdb *memDB) Changes(seq uint64) ([]Change, <-chan struct{}, error) {
+	mdb.mu.Lock()
+	if seq >= mdb.changesAfter && seq <= mdb.changeSeq {
+		changes := mdb.changes[seq-mdb.changesAfter:]
+		if len(changes) > maxChangeBatch {
+			changes = changes[:maxChangeBatch]
+		}
+		defer mdb.mu.Unlock()
+		return append([]Change(nil), changes...), mdb.changed, nil
+	}
+	mdb.mu.Unlock()
+
+	// the values change under the stripe locks, so they must be held for the copy to match the sequence
+	mdb.rlockAll()
+	defer mdb.runlockAll()
+	mdb.mu.Lock()
+	defer mdb.mu.Unlock()
+
+	state, err := mdb.copyState()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	reset := Change{Seq: mdb.changeSeq, Op: ChangeReset, Version: state.lastVersion, Token: state.lastToken, Time: time.Now()}
+	if mdb.publishedTokens > reset.Token {
+		reset.Token = mdb.publishedTokens
+	}
+	for key, item := range state.items {
+		reset.Items = append(reset.Items, Change{Op: ChangeSet, Key: key, Value: item.value, Version: item.version})
+	}
+	sort.Slice(reset.Items, func(i, j int) bool {
+		return reset.Items[i].Key < reset.Items[j].Key
+	})
+	return []Change{reset}, mdb.changed, nil
+}
+
+// ApplyChange applies a change of the primary this database replicates. Values keep the versions
+// they have on the primary, so versions read from the primary can be used with CompareAndSwap here
+// once the replica is promoted. Locks are not replicated, a key deleted on the primary is deleted here
+// even if it's locked. The applied changes are published to the replicas of this database in turn.
+func (mdb *memDB) ApplyChange(change Change) error {
+	defer mdb.debugCheck()
+
+	switch change.Op {
+	case ChangeSet, ChangeMove:
+		s := mdb.keyStripe(change.Key)
+		s.Lock()
+		defer s.Unlock()
+
+		if keyLock, exists := s.key2Lock[change.Key]; exists && change.Op == ChangeMove {
+			_, version, err := mdb.storage.Get(change.Key)
+			if err != nil {
+				return err
+			}
+			if version >= change.Version {
+				return ErrKeyExists
+			}
+			if keyLock.Locked() {
+				return &LockedError{Key: change.Key, HeldFor: keyLock.heldFor(time.Now())}
+			}
+		}
+		return mdb.applySet(change.Key, change.Value, change.Version)
+
+	case ChangeDelete:
+		s := mdb.keyStripe(change.Key)
+		s.Lock()
+		defer s.Unlock()
+
+		keyLock, exists := s.key2Lock[change.Key]
+		if !exists {
+			return nil
+		}
+
+		unlock := mdb.lockHolders(keyLock.holders())
+		defer unlock()
+		return mdb.applyDelete(change.Key)
+
+	case ChangeTokens:
+		return mdb.raiseTokens(change.Token)
+
+	case ChangeReset:
+		mdb.lockAll()
+		defer mdb.unlockAll()
+
+		values := make(map[Key]bool, len(change.Items))
+		for _, item := range change.Items {
+			values[item.Key] = true
+		}
+
+		for i := range mdb.keyStripes {
+			for key := range mdb.keyStripes[i].key2Lock {
+				if !values[key] {
+					if err := mdb.applyDelete(key); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		for _, item := range change.Items {
+			if err := mdb.applySet(item.Key, item.Value, item.Version); err != nil {
+				return err
+			}
+		}
+
+		mdb.mu.Lock()
+		if change.Version > mdb.lastVersion {
+			mdb.lastVersion = change.Version
+		}
+		mdb.mu.Unlock()
+		return mdb.raiseTokens(change.Token)
+	}
+
+	return ErrUnknownChange
+}
+
+// applySet stores the value of the key with the version of the primary.
+// The caller must hold the stripe of the key.
+func (mdb *memDB) applySet(key Key, value Value, version Version) error {
+	if err := mdb.writeLog(&record{op: opSet, key: key, value: value, version: version}); err != nil {
+		return err
+	}
+
+	if err := mdb.storage.Set(key, value, version); err != nil {
+		return err
+	}
+	if _, exists := mdb.keyLock(key); !exists {
+		mdb.setKeyLock(key, newFreeLock())
+	}
+
+	mdb.mu.Lock()
+	defer mdb.mu.Unlock()
+	if version > mdb.lastVersion {
+		mdb.lastVersion = version
+	}
+	return mdb.storeMarks()
+}
+
+// applyDelete deletes the key and breaks its locks, the waiters find the lock deleted.
+// The caller must hold the stripes of the key and of its holders.
+func (mdb *memDB) applyDelete(key Key) error {
+	keyLock, exists := mdb.keyLock(key)
+	if !exists {
+		return nil
+	}
+
+	if err := mdb.writeLog(&record{op: opDelete, key: key}); err != nil {
+		return err
+	}
+
+	if err := mdb.storage.Delete(key); err != nil {
+		return err
+	}
+
+	keyLock.deleted = true
+	for _, lockId := range keyLock.holders() {
+		mdb.releaseKey(lockId, key)
+	}
+	mdb.setKeyLock(key, nil)
+	return nil
+}
+
+// raiseTokens makes sure the fencing tokens handed out from now on are greater than token.
+func (mdb *memDB) raiseTokens(token FencingToken) error {
+	mdb.mu.Lock()
+	defer mdb.mu.Unlock()
+
+	if token > mdb.lastToken {
+		mdb.lastToken = token
+	}
+	if err := mdb.storeMarks(); err != nil {
+		return err
+	}
+
+	if mdb.wal != nil && token > mdb.reservedTokens {
+		if err := mdb.appendLog(&record{op: opReserveTokens, token: token}); err != nil {
+			return err
+		}
+		mdb.reservedTokens = token
+	}
+	if token > mdb.publishedTokens {
+		mdb.publishedTokens = token
+		mdb.publish(Change{Op: ChangeTokens, Token: token})
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package memdb
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// follow applies the changes of primary after seq to replica and returns the last applied seq.
+func follow(t *testing.T, primary, replica MemDB, seq uint64) uint64 {
+	for {
+		changes, _, err := primary.Changes(seq)
+		assert.NoError(t, err)
+		if len(changes) == 0 {
+			return seq
+		}
+		for _, change := range changes {
+			assert.NoError(t, replica.ApplyChange(change))
+			seq = change.Seq
+		}
+	}
+}
+
+func TestChanges(t *testing.T) {
+	memDB := newTestMemDB(t, "TestDB")
+
+	// a new replica starts with the whole database
+	lockId := memDB.Put(Key("key0"), Value("value0"))
+	changes, changed, err := memDB.Changes(0)
+	assert.NoError(t, err)
+	assert.Len(t, changes, 1)
+	assert.Equal(t, ChangeReset, changes[0].Op)
+	assert.Equal(t, []Change{{Op: ChangeSet, Key: Key("key0"), Value: Value("value0"), Version: 1}}, changes[0].Items)
+	assert.Equal(t, Version(1), changes[0].Version)
+	assert.True(t, changes[0].Token > 1)
+	seq := changes[0].Seq
+
+	changes, _, err = memDB.Changes(seq)
+	assert.NoError(t, err)
+	assert.Empty(t, changes)
+
+	assert.NoError(t, memDB.Update(lockId, Key("key0"), Value("value00"), false))
+	assert.NoError(t, memDB.Delete(lockId, Key("key0")))
+	select {
+	case <-changed:
+	default:
+		t.Error("Waiters for changes are not woken up")
+	}
+
+	changes, _, err = memDB.Changes(seq)
+	assert.NoError(t, err)
+	for i := range changes {
+		assert.WithinDuration(t, time.Now(), changes[i].Time, time.Second)
+		changes[i].Time = time.Time{}
+	}
+	assert.Equal(t, []Change{
+		{Seq: seq + 1, Op: ChangeSet, Key: Key("key0"), Value: Value("value00"), Version: 2},
+		{Seq: seq + 2, Op: ChangeDelete, Key: Key("key0")},
+	}, changes)
+
+	// a replica which fell too far behind starts over
+	for i := 0; i < 2*changeBacklog; i++ {
+		memDB.Release(memDB.Put(Key("key1"), Value("value1")))
+	}
+	changes, _, err = memDB.Changes(seq)
+	assert.NoError(t, err)
+	assert.Equal(t, ChangeReset, changes[0].Op)
+
+	changes, _, err = memDB.Changes(changes[0].Seq - changeBacklog)
+	assert.NoError(t, err)
+	assert.Len(t, changes, maxChangeBatch)
+	assert.NotEqual(t, ChangeReset, changes[0].Op)
+}
+
+func TestApplyChange(t *testing.T) {
+	primary := newTestMemDB(t, "PrimaryDB")
+	replica := newTestMemDB(t, "ReplicaDB")
+
+	primary.Release(primary.Put(Key("key0"), Value("value0")))
+	primary.Release(primary.Put(Key("key1"), Value("value1")))
+	lockId := replica.Put(Key("key2"), Value("value2"))
+	seq := follow(t, primary, replica, 0)
+
+	// keys the primary doesn't have are deleted, even if they're locked
+	assert.Equal(t, ErrLockIdNotFound, replica.Release(lockId))
+	_, _, _, err := replica.Peek(Key("key2"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	lockId, _, err = primary.GetAndLock(Key("key0"))
+	assert.NoError(t, err)
+	assert.NoError(t, primary.Delete(lockId, Key("key0")))
+	version, err := primary.CompareAndSwap(Key("key1"), 2, Value("value11"))
+	assert.NoError(t, err)
+	seq = follow(t, primary, replica, seq)
+
+	_, _, _, err = replica.Peek(Key("key0"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	value, replicaVersion, reserved, err := replica.Peek(Key("key1"))
+	assert.NoError(t, err)
+	assert.Equal(t, Value("value11"), value)
+	assert.Equal(t, version, replicaVersion)
+	assert.False(t, reserved)
+
+	// the promoted replica continues the versions and fencing tokens of the primary
+	_, primaryToken, err := primary.PutWithOptions(context.Background(), Key("key3"), Value("value3"), LockOptions{})
+	assert.NoError(t, err)
+	follow(t, primary, replica, seq)
+
+	replicaVersion, err = replica.CompareAndSwap(Key("key1"), version, Value("value111"))
+	assert.NoError(t, err)
+	assert.True(t, replicaVersion > version+1)
+	_, _, replicaToken, err := replica.GetAndLockWithOptions(context.Background(), Key("key1"), LockOptions{})
+	assert.NoError(t, err)
+	assert.True(t, replicaToken > primaryToken)
+
+	// a moved key doesn't replace a newer or a reserved one
+	assert.Equal(t, ErrKeyExists, replica.ApplyChange(Change{Op: ChangeMove, Key: Key("key1"), Value: Value("value1"), Version: 1}))
+	assert.IsType(t, &LockedError{}, replica.ApplyChange(Change{Op: ChangeMove, Key: Key("key1"), Value: Value("value1"), Version: replicaVersion + 1}))
+	assert.NoError(t, replica.ApplyChange(Change{Op: ChangeMove, Key: Key("key4"), Value: Value("value4"), Version: 1}))
+	value, _, _, err = replica.Peek(Key("key4"))
+	assert.NoError(t, err)
+	assert.Equal(t, Value("value4"), value)
+	assert.NoError(t, replica.ApplyChange(Change{Op: ChangeMove, Key: Key("key4"), Value: Value("value44"), Version: 2}))
+	value, _, _, err = replica.Peek(Key("key4"))
+	assert.NoError(t, err)
+	assert.Equal(t, Value("value44"), value)
+
+	assert.Equal(t, ErrUnknownChange, replica.ApplyChange(Change{Op: ChangeOp("unknown")}))
+}
+
+func TestChangesRestore(t *testing.T) {
+	memDB := newTestMemDB(t, "TestDB")
+	replica := newTestMemDB(t, "ReplicaDB")
+
+	memDB.Release(memDB.Put(Key("key0"), Value("value0")))
+	snapshot := &bytes.Buffer{}
+	assert.NoError(t, memDB.Snapshot(snapshot))
+	memDB.Release(memDB.Put(Key("key1"), Value("value1")))
+	seq := follow(t, memDB, replica, 0)
+
+	// the replicas start over after a restore
+	assert.NoError(t, memDB.Restore(snapshot, false))
+	changes, _, err := memDB.Changes(seq)
+	assert.NoError(t, err)
+	assert.Len(t, changes, 1)
+	assert.Equal(t, ChangeReset, changes[0].Op)
+
+	follow(t, memDB, replica, seq)
+	_, _, _, err = replica.Peek(Key("key1"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	value, _, _, err := replica.Peek(Key("key0"))
+	assert.NoError(t, err)
+	assert.Equal(t, Value("value0"), value)
+}
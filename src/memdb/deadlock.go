@@ -0,0 +1,133 @@
+package memdb
+
+import (
+	"fmt"
+	"strings"
+)
+
+// WaitFor is an edge of the wait-for graph: LockID waits for Key held by HeldBy.
+type WaitFor struct {
+	LockID LockID
+	Key    Key
+	HeldBy LockID
+}
+
+func (e WaitFor) String() string {
+	return fmt.Sprintf("%s waits for %s held by %s", e.LockID, e.Key, e.HeldBy)
+}
+
+// DeadlockError is returned to the waiter which would close a cycle of holders waiting for each other.
+// The waiter is always the youngest one in the cycle.
+type DeadlockError struct {
+	Cycle []WaitFor
+}
+
+func (e *DeadlockError) Error() string {
+	edges := make([]string, len(e.Cycle))
+	for i, edge := range e.Cycle {
+		edges[i] = edge.String()
+	}
+	return fmt.Sprintf("%v: %s", ErrDeadlock, strings.Join(edges, ", "))
+}
+
+func (e *DeadlockError) Unwrap() error {
+	return ErrDeadlock
+}
+
+// waitEntry is a waiter which holds some locks already, so it's a node of the wait-for graph.
+type waitEntry struct {
+	key     Key
+	keyLock *lock
+	w       *waiter
+}
+
+// startWaiting registers that owner waits for key, it fails if the wait would close a cycle.
+// The holders of the keys in the cycle may be in any stripe, so all of them are locked.
+func (mdb *memDB) startWaiting(owner LockID, key Key, keyLock *lock, w *waiter) error {
+	mdb.rlockAll()
+	defer mdb.runlockAll()
+	mdb.mu.Lock()
+	defer mdb.mu.Unlock()
+
+	mdb.waitingFor[owner] = &waitEntry{key: key, keyLock: keyLock, w: w}
+
+	if cycle := mdb.findCycle(owner); cycle != nil {
+		delete(mdb.waitingFor, owner)
+		return &DeadlockError{Cycle: cycle}
+	}
+	return nil
+}
+
+func (mdb *memDB) stopWaiting(owner LockID) {
+	mdb.mu.Lock()
+	defer mdb.mu.Unlock()
+	delete(mdb.waitingFor, owner)
+}
+
+// waitsFor returns the edges of the wait-for graph going out of lockId: the holders of the key
+// it waits for and the waiters ahead of it in the queue it can't be granted together with.
+// The caller must hold all stripes and mdb.mu.
+func (mdb *memDB) waitsFor(lockId LockID) []WaitFor {
+	entry, waiting := mdb.waitingFor[lockId]
+	if !waiting {
+		return nil
+	}
+
+	var edges []WaitFor
+	add := func(heldBy LockID) {
+		if heldBy != "" && heldBy != lockId {
+			edges = append(edges, WaitFor{LockID: lockId, Key: entry.key, HeldBy: heldBy})
+		}
+	}
+
+	l := entry.keyLock
+	add(l.lockId)
+	for sharedBy := range l.sharedBy {
+		add(sharedBy)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if entry.w.granted {
+		return nil
+	}
+
+	for _, w := range l.queue {
+		if w == entry.w {
+			break
+		}
+		if w.mode == Exclusive || entry.w.mode == Exclusive {
+			add(w.owner)
+		}
+	}
+	return edges
+}
+
+// findCycle looks for a path in the wait-for graph leading from lockId back to it.
+// The caller must hold all stripes and mdb.mu.
+func (mdb *memDB) findCycle(lockId LockID) []WaitFor {
+	visited := make(map[LockID]bool)
+
+	var path []WaitFor
+	var visit func(node LockID) bool
+	visit = func(node LockID) bool {
+		visited[node] = true
+		for _, edge := range mdb.waitsFor(node) {
+			path = append(path, edge)
+			if edge.HeldBy == lockId {
+				return true
+			}
+			if !visited[edge.HeldBy] && visit(edge.HeldBy) {
+				return true
+			}
+			path = path[:len(path)-1]
+		}
+		return false
+	}
+
+	if visit(lockId) {
+		return path
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package memdb
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeadlockDetection(t *testing.T) {
+	memDB := newTestMemDB(t, "TestDB")
+
+	a := memDB.Put(Key("key0"), Value("value0"))
+	b := memDB.Put(Key("key1"), Value("value1"))
+
+	// a waits for key1 held by b
+	done := make(chan error)
+	go func() {
+		_, value, _, err := memDB.GetAndLockWithOptions(context.Background(), Key("key1"), LockOptions{Holder: a})
+		assert.Equal(t, Value("value1"), value)
+		done <- err
+	}()
+	waitForWaiters(t, memDB, Key("key1"), 1)
+
+	// b waiting for key0 held by a closes the cycle
+	_, _, _, err := memDB.GetAndLockWithOptions(context.Background(), Key("key0"), LockOptions{Holder: b})
+	assert.True(t, errors.Is(err, ErrDeadlock))
+	assert.IsType(t, &DeadlockError{}, err)
+	assert.Equal(t, []WaitFor{
+		{LockID: b, Key: Key("key0"), HeldBy: a},
+		{LockID: a, Key: Key("key1"), HeldBy: b},
+	}, err.(*DeadlockError).Cycle)
+
+	// b gives up, a gets key1
+	waiters, _ := memDB.Waiters(Key("key0"))
+	assert.Empty(t, waiters)
+	assert.NoError(t, memDB.Release(b))
+	assert.NoError(t, <-done)
+
+	assert.NoError(t, memDB.Update(a, Key("key1"), Value("value11"), false))
+	assert.NoError(t, memDB.Release(a))
+	_, _, err = memDB.TryGetAndLock(Key("key0"))
+	assert.NoError(t, err)
+	_, _, err = memDB.TryGetAndLock(Key("key1"))
+	assert.NoError(t, err)
+}
+
+func TestDeadlockDetectionLongCycle(t *testing.T) {
+	memDB := newTestMemDB(t, "TestDB")
+
+	a := memDB.Put(Key("key0"), Value("value0"))
+	b := memDB.Put(Key("key1"), Value("value1"))
+	c := memDB.Put(Key("key2"), Value("value2"))
+
+	done := make(chan error, 2)
+	go func() {
+		_, _, _, err := memDB.GetAndLockWithOptions(context.Background(), Key("key1"), LockOptions{Holder: a})
+		done <- err
+	}()
+	waitForWaiters(t, memDB, Key("key1"), 1)
+
+	go func() {
+		_, _, _, err := memDB.GetAndLockWithOptions(context.Background(), Key("key2"), LockOptions{Holder: b})
+		done <- err
+	}()
+	waitForWaiters(t, memDB, Key("key2"), 1)
+
+	_, _, _, err := memDB.GetAndLockWithOptions(context.Background(), Key("key0"), LockOptions{Holder: c})
+	assert.IsType(t, &DeadlockError{}, err)
+	assert.Equal(t, 3, len(err.(*DeadlockError).Cycle))
+
+	assert.NoError(t, memDB.Release(c))
+	assert.NoError(t, <-done)
+	assert.NoError(t, memDB.Release(b))
+	assert.NoError(t, <-done)
+}
+
+func TestDeadlockDetectionPartialMultiKey(t *testing.T) {
+	memDB := newTestMemDB(t, "TestDB")
+
+	assert.NoError(t, memDB.Release(memDB.Put(Key("key0"), Value("value0"))))
+	a := memDB.Put(Key("key1"), Value("value1"))
+
+	// multi-key reservation gets key0 and waits for key1 held by a
+	done := make(chan error)
+	go func() {
+		_, _, err := memDB.GetAndLockMany([]Key{"key0", "key1"})
+		done <- err
+	}()
+	waitForWaiters(t, memDB, Key("key1"), 1)
+
+	_, _, _, err := memDB.GetAndLockWithOptions(context.Background(), Key("key0"), LockOptions{Holder: a})
+	assert.IsType(t, &DeadlockError{}, err)
+
+	assert.NoError(t, memDB.Release(a))
+	assert.NoError(t, <-done)
+}
+
+func TestHolderExtendsLock(t *testing.T) {
+	memDB := newTestMemDB(t, "TestDB")
+
+	a := memDB.Put(Key("key0"), Value("value0"))
+	assert.NoError(t, memDB.Release(memDB.Put(Key("key1"), Value("value1"))))
+
+	_, _, _, err := memDB.GetAndLockWithOptions(context.Background(), Key("key1"), LockOptions{Holder: LockID("wronglock")})
+	assert.Equal(t, ErrLockIdNotFound, err)
+
+	// key already held by a
+	lockId, value, _, err := memDB.GetAndLockWithOptions(context.Background(), Key("key0"), LockOptions{Holder: a})
+	assert.NoError(t, err)
+	assert.Equal(t, a, lockId)
+	assert.Equal(t, Value("value0"), value)
+
+	lockId, value, _, err = memDB.GetAndLockWithOptions(context.Background(), Key("key1"), LockOptions{Holder: a})
+	assert.NoError(t, err)
+	assert.Equal(t, a, lockId)
+	assert.Equal(t, Value("value1"), value)
+
+	assert.NoError(t, memDB.Update(a, Key("key1"), Value("value11"), false))
+	_, _, err = memDB.TryGetAndLock(Key("key1"))
+	assert.IsType(t, &LockedError{}, err)
+
+	assert.NoError(t, memDB.Release(a))
+	_, _, err = memDB.TryGetAndLock(Key("key1"))
+	assert.NoError(t, err)
+}
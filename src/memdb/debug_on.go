@@ -0,0 +1,7 @@
+//go:build memdb_debug
+
+package memdb
+
+// debugChecks turns on the invariant checks after every operation, see checkInvariants.
+// They are built in with the memdb_debug build tag.
+const debugChecks = true
@@ -0,0 +1,362 @@
+package memdb
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// diskCompactGarbage is the size of replaced records which lets the data file be compacted,
+// once they also outweigh the live ones.
+const diskCompactGarbage = 4 << 20
+
+// DiskOptions configure a storage opened by OpenDiskStorage.
+type DiskOptions struct {
+	// Sync is the fsync policy of the data file
+	Sync SyncPolicy
+
+	// SyncInterval is how often the data file is flushed with SyncInterval policy, zero means DefaultSyncInterval
+	SyncInterval time.Duration
+}
+
+// diskEntry locates the latest record of a key in the data file.
+type diskEntry struct {
+	offset  int64
+	size    int
+	version Version
+}
+
+// diskStorage is a log-structured storage: every write is appended to a data file
+// and an in-memory index points to the latest record of each key, so only the keys are kept in memory.
+// The file is rewritten without the replaced records when they take more space than the live ones.
+type diskStorage struct {
+	mu    sync.RWMutex
+	path  string
+	file  *os.File
+	size  int64
+	index map[Key]diskEntry
+	// garbage is the size of the replaced and delete records
+	garbage int64
+	policy  SyncPolicy
+
+	// the high-water marks and the size of the records they were stored with
+	marks     Marks
+	marksSize int
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// DiskStorage is the storage opened by OpenDiskStorage, it keeps the high-water marks of the database
+// with the values. The database closes it when it's closed.
+type DiskStorage interface {
+	MarkStorage
+	Close() error
+}
+
+// OpenDiskStorage opens the storage kept in the data file at path, the file is created if it doesn't exist.
+// Writes are flushed to the disk according to the sync policy of opts, like the write-ahead log of Open:
+// with SyncAlways a write returns after it's on the disk. A crash may lose the writes which haven't been
+// flushed yet, but it doesn't damage the older ones.
+func OpenDiskStorage(path string, opts DiskOptions) (DiskStorage, error) {
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = DefaultSyncInterval
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &diskStorage{path: path, file: file, index: make(map[Key]diskEntry), policy: opts.Sync, done: make(chan struct{})}
+	if err := s.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if opts.Sync == SyncInterval {
+		s.wg.Add(1)
+		go s.syncer(opts.SyncInterval)
+	}
+	return s, nil
+}
+
+// load builds the index from the data file. A torn record at the end left by a crash is cut off,
+// but a damaged record before the end fails the load, the records after it aren't dropped.
+func (s *diskStorage) load() error {
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(s.file)
+	for {
+		rec, n, err := readRecord(reader)
+		if err == io.EOF {
+			return nil
+		} else if err == io.ErrUnexpectedEOF || (err == ErrCorruptRecord && s.size+int64(n) >= info.Size()) {
+			return s.file.Truncate(s.size)
+		} else if err != nil {
+			return fmt.Errorf("Data file %s at %d: %v", s.path, s.size, err)
+		}
+
+		switch rec.op {
+		case opMeta:
+			// the LockID counter follows in a record of its own
+			s.garbage += int64(s.marksSize)
+			s.marks, s.marksSize = Marks{Version: rec.version, Token: rec.token}, n
+		case opReserveLockIDs:
+			s.marks.LockID = uint64(rec.version)
+			s.marksSize += n
+		case opSet:
+			if old, exists := s.index[rec.key]; exists {
+				s.garbage += int64(old.size)
+			}
+			s.index[rec.key] = diskEntry{offset: s.size, size: n, version: rec.version}
+		default:
+			if old, exists := s.index[rec.key]; exists {
+				s.garbage += int64(old.size)
+			}
+			delete(s.index, rec.key)
+			s.garbage += int64(n)
+		}
+		s.size += int64(n)
+	}
+}
+
+func (s *diskStorage) Get(key Key) (Value, Version, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entry, exists := s.index[key]
+	if !exists {
+		return EmptyValue, 0, ErrKeyNotFound
+	}
+
+	buf := make([]byte, entry.size)
+	if _, err := s.file.ReadAt(buf, entry.offset); err != nil {
+		return EmptyValue, 0, err
+	}
+
+	rec, _, err := readRecord(bytes.NewReader(buf))
+	if err != nil {
+		return EmptyValue, 0, err
+	}
+	return rec.value, rec.version, nil
+}
+
+func (s *diskStorage) Set(key Key, value Value, version Version) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	offset, n, err := s.append(&record{op: opSet, key: key, value: value, version: version})
+	if err != nil {
+		return err
+	}
+
+	if old, exists := s.index[key]; exists {
+		s.garbage += int64(old.size)
+	}
+	s.index[key] = diskEntry{offset: offset, size: n, version: version}
+
+	s.compactIfNeeded()
+	return nil
+}
+
+func (s *diskStorage) Delete(key Key) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, exists := s.index[key]
+	if !exists {
+		return nil
+	}
+
+	_, n, err := s.append(&record{op: opDelete, key: key})
+	if err != nil {
+		return err
+	}
+
+	delete(s.index, key)
+	s.garbage += int64(old.size + n)
+
+	s.compactIfNeeded()
+	return nil
+}
+
+// SetMarks appends the marks to the data file and flushes them whatever the sync policy is,
+// they're stored once in a while only.
+func (s *diskStorage) SetMarks(marks Marks) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, n, err := s.appendBuf(encodeMarks(marks))
+	if err == nil && s.policy != SyncAlways {
+		err = s.file.Sync()
+	}
+	if err != nil {
+		return err
+	}
+
+	s.garbage += int64(s.marksSize)
+	s.marks, s.marksSize = marks, n
+
+	s.compactIfNeeded()
+	return nil
+}
+
+func (s *diskStorage) Marks() Marks {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.marks
+}
+
+// encodeMarks encodes the records the marks are stored with.
+func encodeMarks(marks Marks) []byte {
+	buf := (&record{op: opMeta, version: marks.Version, token: marks.Token}).encode()
+	return append(buf, (&record{op: opReserveLockIDs, version: Version(marks.LockID)}).encode()...)
+}
+
+// append writes rec at the end of the data file, with SyncAlways it returns after rec is on the disk.
+// A failed write is overwritten by the next one. The caller must hold s.mu.
+func (s *diskStorage) append(rec *record) (int64, int, error) {
+	return s.appendBuf(rec.encode())
+}
+
+// appendBuf writes the encoded records at the end of the data file like append.
+func (s *diskStorage) appendBuf(buf []byte) (int64, int, error) {
+	offset := s.size
+	if _, err := s.file.WriteAt(buf, offset); err != nil {
+		return 0, 0, err
+	}
+	if s.policy == SyncAlways {
+		if err := s.file.Sync(); err != nil {
+			return 0, 0, err
+		}
+	}
+	s.size += int64(len(buf))
+	return offset, len(buf), nil
+}
+
+func (s *diskStorage) Iterate(fn func(key Key, version Version) bool) error {
+	// fn may call Get
+	s.mu.RLock()
+	entries := make(map[Key]Version, len(s.index))
+	for key, entry := range s.index {
+		entries[key] = entry.version
+	}
+	s.mu.RUnlock()
+
+	for key, version := range entries {
+		if !fn(key, version) {
+			break
+		}
+	}
+	return nil
+}
+
+// compactIfNeeded rewrites the data file when the replaced records outweigh the live ones.
+// The caller must hold s.mu.
+func (s *diskStorage) compactIfNeeded() {
+	if s.garbage < diskCompactGarbage || s.garbage < s.size-s.garbage {
+		return
+	}
+
+	// a failed compaction keeps the data file as it is, it's tried again after the next write
+	s.compact()
+}
+
+// compact copies the live records to a new data file which replaces the current one.
+// The caller must hold s.mu.
+func (s *diskStorage) compact() error {
+	tmpPath := s.path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	index := make(map[Key]diskEntry, len(s.index))
+	var size int64
+	for key, entry := range s.index {
+		buf := make([]byte, entry.size)
+		if _, err = s.file.ReadAt(buf, entry.offset); err != nil {
+			break
+		}
+		if _, err = file.WriteAt(buf, size); err != nil {
+			break
+		}
+		index[key] = diskEntry{offset: size, size: entry.size, version: entry.version}
+		size += int64(entry.size)
+	}
+
+	var marksSize int
+	if err == nil && s.marksSize > 0 {
+		buf := encodeMarks(s.marks)
+		if _, err = file.WriteAt(buf, size); err == nil {
+			marksSize = len(buf)
+			size += int64(marksSize)
+		}
+	}
+
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, s.path)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	s.file.Close()
+	s.file = file
+	s.size = size
+	s.index = index
+	s.garbage = 0
+	s.marksSize = marksSize
+
+	return syncDir(filepath.Dir(s.path))
+}
+
+func (s *diskStorage) sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Sync()
+}
+
+func (s *diskStorage) syncer(interval time.Duration) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.sync()
+		}
+	}
+}
+
+func (s *diskStorage) Close() error {
+	close(s.done)
+	s.wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.file.Sync()
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,79 @@
+package memdb
+
+// FencingToken comes with every grant of a key lock. Tokens of the same key only grow,
+// so a downstream system which remembers the highest token it has seen for the key
+// can reject writes of a holder whose lock has already expired or been released.
+//
+// Tokens are drawn from a single sequence of the database, this way they keep growing
+// even when the key is deleted and created again.
+type FencingToken uint64
+
+// nextToken returns a fencing token for a new grant, it fails if the token can't be reserved in the log
+// or in the storage. The caller must hold the stripe of the key the token is for.
+func (mdb *memDB) nextToken() (FencingToken, error) {
+	mdb.mu.Lock()
+	defer mdb.mu.Unlock()
+
+	mdb.lastToken++
+	if mdb.wal != nil && mdb.lastToken > mdb.reservedTokens {
+		// the reservation is written under mdb.mu, no token of the block is handed out before it's logged
+		reserved := mdb.lastToken + tokenReserveBlock
+		if err := mdb.appendLog(&record{op: opReserveTokens, token: reserved}); err != nil {
+			mdb.lastToken--
+			return 0, err
+		}
+		mdb.reservedTokens = reserved
+	}
+	if err := mdb.storeMarks(); err != nil {
+		mdb.lastToken--
+		return 0, err
+	}
+	if mdb.lastToken > mdb.publishedTokens {
+		// the replicas learn about the tokens a block at a time too
+		mdb.publishedTokens = mdb.lastToken + tokenReserveBlock
+		mdb.publish(Change{Op: ChangeTokens, Token: mdb.publishedTokens})
+	}
+	return mdb.lastToken, nil
+}
+
+// UpdateWithToken works like Update, but rejects the write with ErrStaleToken if token is older
+// than the latest grant of the key. Zero token skips the check. A holder whose lease has expired
+// or whose lock has been broken learns this way that somebody else has been granted the key since,
+// instead of getting ErrLockIdNotFound.
+func (mdb *memDB) UpdateWithToken(lockId LockID, key Key, value Value, releaseLock bool, token FencingToken) error {
+	defer mdb.debugCheck()
+
+	s, ls := mdb.keyStripe(key), mdb.lockStripe(lockId)
+	s.Lock()
+	defer s.Unlock()
+	ls.Lock()
+	defer ls.Unlock()
+
+	keyLock, exists := s.key2Lock[key]
+	if !exists {
+		return ErrKeyNotFound
+	}
+
+	if token != 0 && token < keyLock.lastToken {
+		return ErrStaleToken
+	}
+
+	lockKeys, exists := mdb.lookupLock(lockId)
+	if !exists || !containsKey(lockKeys, key) {
+		return ErrLockIdNotFound
+	}
+
+	if mode, _ := keyLock.holderMode(lockId); mode == Shared {
+		return ErrLockIsShared
+	}
+
+	if _, err := mdb.setValue(key, value); err != nil {
+		return err
+	}
+
+	if releaseLock {
+		mdb.releaseKey(lockId, key)
+	}
+
+	return nil
+}
@@ -0,0 +1,142 @@
+package memdb
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFencingTokensGrow(t *testing.T) {
+	memDB := newTestMemDB(t, "TestDB")
+
+	k := Key("key0")
+	lockId, token, err := memDB.PutWithOptions(context.Background(), k, Value("value0"), LockOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, memDB.Release(lockId))
+
+	lockId2, value, token2, err := memDB.GetAndLockWithOptions(context.Background(), k, LockOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, Value("value0"), value)
+	assert.True(t, token2 > token)
+
+	// tokens keep growing after the key is deleted and created again
+	assert.NoError(t, memDB.Delete(lockId2, k))
+	_, token3, err := memDB.PutWithOptions(context.Background(), k, Value("value1"), LockOptions{})
+	assert.NoError(t, err)
+	assert.True(t, token3 > token2)
+}
+
+func TestFencingTokensShared(t *testing.T) {
+	memDB := newTestMemDB(t, "TestDB")
+
+	k := Key("key0")
+	assert.NoError(t, memDB.Release(memDB.Put(k, Value("value0"))))
+
+	_, _, token, err := memDB.GetAndLockWithOptions(context.Background(), k, LockOptions{Mode: Shared})
+	assert.NoError(t, err)
+	_, _, token2, err := memDB.GetAndLockWithOptions(context.Background(), k, LockOptions{Mode: Shared})
+	assert.NoError(t, err)
+	assert.True(t, token2 > token)
+}
+
+func TestFencingTokensMany(t *testing.T) {
+	memDB := newTestMemDB(t, "TestDB")
+
+	assert.NoError(t, memDB.Release(memDB.Put(Key("key0"), Value("value0"))))
+	lockId, token, err := memDB.PutWithOptions(context.Background(), Key("key1"), Value("value1"), LockOptions{})
+	assert.NoError(t, err)
+
+	// the key already held by lockId keeps its token
+	lockId2, _, tokens, err := memDB.GetAndLockManyWithOptions(context.Background(), []Key{"key0", "key1"}, LockOptions{Holder: lockId})
+	assert.NoError(t, err)
+	assert.Equal(t, lockId, lockId2)
+	assert.Equal(t, token, tokens[Key("key1")])
+	assert.True(t, tokens[Key("key0")] > token)
+}
+
+func TestUpdateWithToken(t *testing.T) {
+	memDB := newTestMemDB(t, "TestDB")
+
+	k := Key("key0")
+	lockId, token, err := memDB.PutWithOptions(context.Background(), k, Value("value0"), LockOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, memDB.Release(lockId))
+
+	lockId2, _, token2, err := memDB.GetAndLockWithOptions(context.Background(), k, LockOptions{})
+	assert.NoError(t, err)
+
+	// the write carries the token of the previous grant
+	assert.Equal(t, ErrStaleToken, memDB.UpdateWithToken(lockId2, k, Value("stale"), false, token))
+	value, _ := memDB.DirectGet(k)
+	assert.Equal(t, Value("value0"), value)
+
+	assert.NoError(t, memDB.UpdateWithToken(lockId2, k, Value("value1"), false, 0))
+	assert.NoError(t, memDB.UpdateWithToken(lockId2, k, Value("value2"), true, token2))
+	value, _ = memDB.DirectGet(k)
+	assert.Equal(t, Value("value2"), value)
+}
+
+func TestUpdateWithTokenExpiredHolder(t *testing.T) {
+	memDB := newTestMemDBWithReapInterval(t, 10*time.Millisecond)
+	defer memDB.Close()
+
+	k := Key("key0")
+	lockId, token, err := memDB.PutWithOptions(context.Background(), k, Value("value0"), LockOptions{TTL: 20 * time.Millisecond})
+	assert.NoError(t, err)
+
+	// the lease expires and the key is granted to somebody else
+	lockId2, _, token2, err := memDB.GetAndLockWithOptions(context.Background(), k, LockOptions{})
+	assert.NoError(t, err)
+
+	// the old holder is told that its token is stale, without the token its LockID isn't found
+	assert.Equal(t, ErrStaleToken, memDB.UpdateWithToken(lockId, k, Value("stale"), false, token))
+	assert.Equal(t, ErrLockIdNotFound, memDB.Update(lockId, k, Value("stale"), false))
+	value, _ := memDB.DirectGet(k)
+	assert.Equal(t, Value("value0"), value)
+
+	assert.NoError(t, memDB.UpdateWithToken(lockId2, k, Value("value1"), true, token2))
+
+	// the token stays stale once the new holder has released the key
+	assert.Equal(t, ErrStaleToken, memDB.UpdateWithToken(lockId, k, Value("stale"), false, token))
+	value, _ = memDB.DirectGet(k)
+	assert.Equal(t, Value("value1"), value)
+}
+
+func TestFencingTokensReservationFails(t *testing.T) {
+	db, err := Open(t.TempDir(), Options{})
+	assert.NoError(t, err)
+	defer db.Close()
+	mdb := db.(*memDB)
+	mdb.Put(Key("key0"), Value("value0"))
+
+	// a token past the logged reservation isn't handed out while the log fails
+	mdb.lastToken = mdb.reservedTokens
+	reserved := mdb.reservedTokens
+	mdb.wal.err = errors.New("Disk is full")
+	_, err = mdb.nextToken()
+	assert.Error(t, err)
+	_, err = mdb.nextToken()
+	assert.Error(t, err)
+	assert.Equal(t, reserved, mdb.reservedTokens)
+	assert.Equal(t, reserved, mdb.lastToken)
+
+	mdb.wal.err = nil
+	token, err := mdb.nextToken()
+	assert.NoError(t, err)
+	assert.Equal(t, reserved+1, token)
+	assert.True(t, mdb.reservedTokens > token)
+
+	// neither do the tokens raised by a change of the primary
+	reserved = mdb.reservedTokens
+	mdb.wal.err = errors.New("Disk is full")
+	assert.Error(t, mdb.ApplyChange(Change{Op: ChangeTokens, Token: reserved + 10}))
+	assert.Equal(t, reserved, mdb.reservedTokens)
+	mdb.wal.err = nil
+	token, err = mdb.nextToken()
+	assert.NoError(t, err)
+	assert.True(t, token > reserved+10)
+	assert.True(t, mdb.reservedTokens >= token)
+}
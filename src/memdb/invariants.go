@@ -0,0 +1,137 @@
+package memdb
+
+import (
+	"errors"
+	"fmt"
+)
+
+// debugCheck panics in debug mode if the database breaks any of its invariants,
+// it's deferred by every operation which changes the database.
+func (mdb *memDB) debugCheck() {
+	if !debugChecks {
+		return
+	}
+	if err := mdb.checkInvariants(); err != nil {
+		panic("memdb: " + err.Error())
+	}
+}
+
+// checkInvariants verifies that the key locks, the LockIDs holding them, the leases and the storage
+// agree with each other. Concurrent operations may have acquired key locks they haven't recorded yet,
+// so only the recorded holders are checked against the grants of the key locks.
+func (mdb *memDB) checkInvariants() error {
+	mdb.rlockAll()
+	defer mdb.runlockAll()
+	mdb.mu.Lock()
+	defer mdb.mu.Unlock()
+
+	for i := range mdb.keyStripes {
+		if err := mdb.keyStripes[i].checkKeys(); err != nil {
+			return fmt.Errorf("Stripe %d: %v", i, err)
+		}
+		for key, keyLock := range mdb.keyStripes[i].key2Lock {
+			if stripeOf(string(key)) != i {
+				return fmt.Errorf("Key %s is in stripe %d", key, i)
+			}
+			if err := mdb.checkKeyLock(key, keyLock); err != nil {
+				return fmt.Errorf("Key %s: %v", key, err)
+			}
+		}
+	}
+
+	for i := range mdb.lockStripes {
+		ls := &mdb.lockStripes[i]
+		for lockId, keys := range ls.lockId2Keys {
+			if stripeOf(string(lockId)) != i {
+				return fmt.Errorf("LockID %s is in stripe %d", lockId, i)
+			}
+			if err := mdb.checkHolder(lockId, keys); err != nil {
+				return fmt.Errorf("LockID %s: %v", lockId, err)
+			}
+		}
+		for lockId := range ls.leases {
+			if _, exists := ls.lockId2Keys[lockId]; !exists {
+				return fmt.Errorf("LockID %s has a lease, but no keys", lockId)
+			}
+		}
+	}
+
+	var err error
+	iterErr := mdb.storage.Iterate(func(key Key, version Version) bool {
+		if _, exists := mdb.keyLock(key); !exists {
+			err = fmt.Errorf("Key %s is stored, but has no lock", key)
+		}
+		return err == nil
+	})
+	if err == nil {
+		err = iterErr
+	}
+	return err
+}
+
+// checkKeyLock verifies the key lock and the value of the key.
+// The caller must hold all stripes and mdb.mu.
+func (mdb *memDB) checkKeyLock(key Key, keyLock *lock) error {
+	if keyLock.deleted {
+		return errors.New("Deleted lock")
+	}
+
+	if _, version, err := mdb.storage.Get(key); err != nil {
+		return err
+	} else if version > mdb.lastVersion {
+		return fmt.Errorf("Version %d is newer than the last one %d", version, mdb.lastVersion)
+	}
+
+	keyLock.mu.Lock()
+	defer keyLock.mu.Unlock()
+
+	if err := keyLock.check(); err != nil {
+		return err
+	}
+	for _, lockId := range keyLock.holders() {
+		if token, _ := keyLock.holderToken(lockId); token > mdb.lastToken {
+			return fmt.Errorf("Token %d of %s is newer than the last one %d", token, lockId, mdb.lastToken)
+		}
+	}
+	return nil
+}
+
+// checkHolder verifies that lockId holds its keys.
+// The caller must hold all stripes and mdb.mu.
+func (mdb *memDB) checkHolder(lockId LockID, keys []Key) error {
+	if len(keys) == 0 {
+		return errors.New("No keys")
+	}
+
+	for i, key := range keys {
+		if containsKey(keys[:i], key) {
+			return fmt.Errorf("Key %s is held twice", key)
+		}
+
+		keyLock, exists := mdb.keyLock(key)
+		if !exists {
+			return fmt.Errorf("Key %s doesn't exist", key)
+		}
+		if _, held := keyLock.holderMode(lockId); !held {
+			return fmt.Errorf("Key %s isn't held", key)
+		}
+	}
+	return nil
+}
+
+// checkKeys verifies that the sorted keys of the stripe are the keys of its locks.
+// The caller must hold the stripe.
+func (s *keyStripe) checkKeys() error {
+	if len(s.keys) != len(s.key2Lock) {
+		return fmt.Errorf("%d sorted keys for %d locks", len(s.keys), len(s.key2Lock))
+	}
+	for i, key := range s.keys {
+		if _, exists := s.key2Lock[key]; !exists {
+			return fmt.Errorf("Sorted key %s has no lock", key)
+		}
+		if i > 0 && s.keys[i-1] >= key {
+			return fmt.Errorf("Key %s is sorted after %s", key, s.keys[i-1])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package memdb
+
+import (
+	"time"
+)
+
+// DefaultReapInterval is how often expired leases are looked for.
+const DefaultReapInterval = 100 * time.Millisecond
+
+// setLease limits lifetime of lockId by ttl, zero ttl means no lease.
+// The caller must hold the stripe of lockId.
+func (mdb *memDB) setLease(lockId LockID, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+
+	mdb.lockStripe(lockId).leases[lockId] = time.Now().Add(ttl)
+	mdb.reaperOnce.Do(func() {
+		go mdb.reaper()
+	})
+}
+
+// leaseExpired reports whether lockId has a lease which is over at the moment now.
+// The caller must hold the stripe of lockId.
+func (mdb *memDB) leaseExpired(lockId LockID, now time.Time) bool {
+	deadline, exists := mdb.lockStripe(lockId).leases[lockId]
+	return exists && !now.Before(deadline)
+}
+
+// Renew moves the lease deadline of lockId to extendBy from now and returns the new deadline.
+// Locks acquired without ttl can't be renewed.
+func (mdb *memDB) Renew(lockId LockID, extendBy time.Duration) (time.Time, error) {
+	defer mdb.debugCheck()
+
+	ls := mdb.lockStripe(lockId)
+	ls.Lock()
+	defer ls.Unlock()
+
+	if _, exists := mdb.lookupLock(lockId); !exists {
+		return time.Time{}, ErrLockIdNotFound
+	}
+
+	if _, leased := ls.leases[lockId]; !leased {
+		return time.Time{}, ErrNoLease
+	}
+
+	deadline := time.Now().Add(extendBy)
+	ls.leases[lockId] = deadline
+	return deadline, nil
+}
+
+func (mdb *memDB) reaper() {
+	ticker := time.NewTicker(mdb.reapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-mdb.done:
+			return
+		case now := <-ticker.C:
+			mdb.reapExpired(now)
+		}
+	}
+}
+
+// reapExpired invalidates LockIDs with expired leases and unlocks their keys.
+func (mdb *memDB) reapExpired(now time.Time) {
+	defer mdb.debugCheck()
+
+	for i := range mdb.lockStripes {
+		ls := &mdb.lockStripes[i]
+
+		var expired []LockID
+		ls.RLock()
+		for lockId := range ls.leases {
+			if mdb.leaseExpired(lockId, now) {
+				expired = append(expired, lockId)
+			}
+		}
+		ls.RUnlock()
+
+		for _, lockId := range expired {
+			// the lease might have been renewed since
+			if _, unlock, exists := mdb.lockHolder(lockId); exists {
+				if mdb.leaseExpired(lockId, now) {
+					mdb.releaseLock(lockId)
+				}
+				unlock()
+			}
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package memdb
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestMemDBWithReapInterval(t *testing.T, interval time.Duration) MemDB {
+	mdb := newTestMemDB(t, "TestDB")
+	mdb.reapInterval = interval
+	return mdb
+}
+
+func TestPutWithTTLExpires(t *testing.T) {
+	memDB := newTestMemDBWithReapInterval(t, 10*time.Millisecond)
+	defer memDB.Close()
+
+	k := Key("key0")
+	lockId := memDB.PutWithTTL(k, Value("value0"), 50*time.Millisecond)
+
+	value, err := memDB.Get(lockId, k)
+	assert.NoError(t, err)
+	assert.Equal(t, Value("value0"), value)
+
+	// blocks until the lease is over
+	start := time.Now()
+	lockId2, value2, err2 := memDB.GetAndLock(k)
+	assert.NoError(t, err2)
+	assert.Equal(t, LockID("2"), lockId2)
+	assert.Equal(t, Value("value0"), value2)
+	assert.True(t, time.Since(start) >= 40*time.Millisecond)
+
+	// expired LockID is invalidated
+	_, err = memDB.Get(lockId, k)
+	assert.Equal(t, ErrLockIdNotFound, err)
+	assert.Equal(t, ErrLockIdNotFound, memDB.Update(lockId, k, Value("stale"), true))
+	assert.Equal(t, ErrLockIdNotFound, memDB.Release(lockId))
+
+	// lock without lease is still held
+	assert.NoError(t, memDB.Update(lockId2, k, Value("value1"), false))
+	value, err = memDB.Get(lockId2, k)
+	assert.NoError(t, err)
+	assert.Equal(t, Value("value1"), value)
+}
+
+func TestGetAndLockWithTTLExpires(t *testing.T) {
+	wga := &sync.WaitGroup{}
+	wga.Add(1)
+
+	memDB := newTestMemDBWithReapInterval(t, 10*time.Millisecond)
+	defer memDB.Close()
+
+	k := Key("key0")
+	lockId := memDB.Put(k, Value("value0"))
+
+	go func() {
+		lockId2, _, err := memDB.GetAndLockWithTTL(k, 50*time.Millisecond)
+		assert.NoError(t, err)
+		assert.Equal(t, LockID("2"), lockId2)
+
+		// nobody releases lockId2, the reaper does
+		lockId3 := memDB.Put(k, Value("value3"))
+		assert.Equal(t, LockID("3"), lockId3)
+		assert.Equal(t, ErrLockIdNotFound, memDB.Release(lockId2))
+		assert.NoError(t, memDB.Release(lockId3))
+
+		wga.Done()
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	assert.NoError(t, memDB.Release(lockId))
+
+	wga.Wait()
+}
+
+func TestLeaseExpiredBeforeReap(t *testing.T) {
+	memDB := newTestMemDBWithReapInterval(t, time.Hour)
+	defer memDB.Close()
+
+	k := Key("key0")
+	lockId := memDB.PutWithTTL(k, Value("value0"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	// the reaper didn't run yet, but the lease is over
+	_, err := memDB.Get(lockId, k)
+	assert.Equal(t, ErrLockIdNotFound, err)
+	assert.False(t, memDB.Holds(lockId))
+	assert.Equal(t, ErrLockIdNotFound, memDB.Release(lockId))
+}
+
+func TestRenew(t *testing.T) {
+	memDB := newTestMemDBWithReapInterval(t, 10*time.Millisecond)
+	defer memDB.Close()
+
+	k := Key("key0")
+	lockId := memDB.PutWithTTL(k, Value("value0"), 50*time.Millisecond)
+
+	// keep the lock alive longer than the initial ttl
+	for i := 0; i < 5; i++ {
+		time.Sleep(20 * time.Millisecond)
+		deadline, err := memDB.Renew(lockId, 50*time.Millisecond)
+		assert.NoError(t, err)
+		assert.True(t, deadline.After(time.Now()))
+	}
+
+	value, err := memDB.Get(lockId, k)
+	assert.NoError(t, err)
+	assert.Equal(t, Value("value0"), value)
+
+	// stop renewing, the lease expires
+	time.Sleep(100 * time.Millisecond)
+	_, err = memDB.Renew(lockId, time.Minute)
+	assert.Equal(t, ErrLockIdNotFound, err)
+
+	// lock without lease
+	lockId2, _, err := memDB.GetAndLock(k)
+	assert.NoError(t, err)
+	_, err = memDB.Renew(lockId2, time.Minute)
+	assert.Equal(t, ErrNoLease, err)
+
+	_, err = memDB.Renew(LockID("wronglock"), time.Minute)
+	assert.Equal(t, ErrLockIdNotFound, err)
+}
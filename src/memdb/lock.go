@@ -0,0 +1,415 @@
+package memdb
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LockMode is the mode of a key lock.
+type LockMode int
+
+const (
+	// Exclusive lock is held by a single client which can read and write the key.
+	Exclusive LockMode = iota
+	// Shared lock can be held by many clients at once, they can only read the key.
+	Shared
+)
+
+func (m LockMode) String() string {
+	if m == Shared {
+		return "shared"
+	}
+	return "exclusive"
+}
+
+// WaiterInfo describes a client waiting for the key lock.
+type WaiterInfo struct {
+	// Position in the queue, the waiter at position 0 is granted the lock next
+	Position   int
+	Priority   int
+	Mode       LockMode
+	WaitingFor time.Duration
+}
+
+// lockState is the state of a key lock, the database tracks which LockIDs hold it on top of it.
+type lockState int
+
+const (
+	// lockFree isn't held by anybody and nobody waits for it
+	lockFree lockState = iota
+	// lockHeld is held exclusively or shared by some clients, nobody waits for it
+	lockHeld
+	// lockHeldWaiters is held and other clients wait for it in the queue
+	lockHeldWaiters
+)
+
+func (s lockState) String() string {
+	switch s {
+	case lockFree:
+		return "free"
+	case lockHeld:
+		return "held"
+	}
+	return "held+waiters"
+}
+
+// lockTransitions are the states a single operation on a lock in the state of the key can move it to.
+// A held lock takes more shared holders or waiters, or it's unlocked. A lock with waiters is never freed,
+// unlocking it hands it over to the next waiters, it's held without waiters once the last of them
+// is granted the lock or gives up. Nobody waits for a free lock, it's acquired right away.
+var lockTransitions = map[lockState][]lockState{
+	lockFree:        {lockHeld},
+	lockHeld:        {lockFree, lockHeld, lockHeldWaiters},
+	lockHeldWaiters: {lockHeld, lockHeldWaiters},
+}
+
+// grant describes a shared holder of the lock.
+type grant struct {
+	acquiredAt time.Time
+	token      FencingToken
+}
+
+type waiter struct {
+	seq        uint64
+	owner      LockID
+	mode       LockMode
+	priority   int
+	enqueuedAt time.Time
+
+	// closed when the lock is handed over to the waiter
+	ready   chan struct{}
+	granted bool
+}
+
+// lock is a per-key readers-writer lock with an explicit wait queue: the lock is handed over to
+// waiters by priority class, and in FIFO order within the class. Shared waiters at the head of
+// the queue are granted the lock together, a shared waiter never overtakes a queued exclusive one.
+// Unlike sync.RWMutex waiting for it can be cancelled.
+type lock struct {
+	mu      sync.Mutex
+	writer  bool
+	readers int
+	seq     uint64
+	queue   []*waiter
+
+	// guarded by the stripe of the key
+	lockId     LockID
+	acquiredAt time.Time
+	token      FencingToken
+	sharedBy   map[LockID]grant
+	deleted    bool
+
+	// the token of the latest grant, it stays when the lock is released
+	lastToken FencingToken
+}
+
+// newLock returns a lock which is already exclusively held by the caller.
+func newLock() *lock {
+	return &lock{writer: true, sharedBy: make(map[LockID]grant)}
+}
+
+// newFreeLock returns a lock which isn't held by anybody.
+func newFreeLock() *lock {
+	return &lock{sharedBy: make(map[LockID]grant)}
+}
+
+// state returns the state of the lock, the caller must hold l.mu.
+func (l *lock) state() lockState {
+	switch {
+	case !l.writer && l.readers == 0:
+		return lockFree
+	case len(l.queue) == 0:
+		return lockHeld
+	}
+	return lockHeldWaiters
+}
+
+// transition panics in debug mode if the lock has moved from the state from to a state it can't get to
+// in a single operation. The caller must hold l.mu.
+func (l *lock) transition(from lockState) {
+	if !debugChecks {
+		return
+	}
+
+	to := l.state()
+	for _, allowed := range lockTransitions[from] {
+		if to == allowed {
+			return
+		}
+	}
+	panic(fmt.Sprintf("memdb: key lock moved from %v to %v", from, to))
+}
+
+// check verifies the invariants of the lock, the caller must hold l.mu.
+func (l *lock) check() error {
+	switch {
+	case l.readers < 0:
+		return fmt.Errorf("%d shared holders", l.readers)
+	case l.writer && l.readers > 0:
+		return fmt.Errorf("Held exclusively and by %d shared holders", l.readers)
+	case len(l.queue) > 0 && l.state() == lockFree:
+		return fmt.Errorf("Free with %d waiters", len(l.queue))
+	}
+
+	for i, w := range l.queue {
+		if w.granted {
+			return fmt.Errorf("Granted waiter %d is still queued", w.seq)
+		}
+		if i > 0 {
+			prev := l.queue[i-1]
+			if prev.priority < w.priority || (prev.priority == w.priority && prev.seq > w.seq) {
+				return fmt.Errorf("Waiter %d is queued after waiter %d", w.seq, prev.seq)
+			}
+		}
+	}
+
+	// the holders recorded by the database must have been granted the lock, the grants of
+	// the clients which haven't recorded themselves yet are not known
+	if l.lockId != "" {
+		if !l.writer {
+			return fmt.Errorf("Exclusive holder %s without exclusive grant", l.lockId)
+		}
+		if _, shared := l.sharedBy[l.lockId]; shared {
+			return fmt.Errorf("%s holds the lock exclusively and shared", l.lockId)
+		}
+	}
+	if len(l.sharedBy) > l.readers {
+		return fmt.Errorf("%d shared holders with %d shared grants", len(l.sharedBy), l.readers)
+	}
+	return nil
+}
+
+func (l *lock) enqueue(owner LockID, mode LockMode, priority int) *waiter {
+	l.seq++
+	w := &waiter{seq: l.seq, owner: owner, mode: mode, priority: priority, enqueuedAt: time.Now(), ready: make(chan struct{})}
+
+	// keep the queue ordered by priority, FIFO within the same priority
+	i := sort.Search(len(l.queue), func(i int) bool {
+		return l.queue[i].priority < priority
+	})
+	l.queue = append(l.queue, nil)
+	copy(l.queue[i+1:], l.queue[i:])
+	l.queue[i] = w
+	return w
+}
+
+func (l *lock) dequeue(w *waiter) {
+	for i, qw := range l.queue {
+		if qw == w {
+			l.queue = append(l.queue[:i], l.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// tryAcquire takes the lock in the given mode if it's compatible with the current holders.
+func (l *lock) tryAcquire(mode LockMode) bool {
+	switch {
+	case l.writer:
+		return false
+	case mode == Shared:
+		l.readers++
+		return true
+	case l.readers == 0:
+		l.writer = true
+		return true
+	}
+	return false
+}
+
+// LockOrEnqueue takes the lock in the given mode if it's free, otherwise it puts a waiter
+// to the queue (unless enqueue is false). owner identifies the waiter for deadlock detection,
+// it's empty when the waiter holds no locks.
+func (l *lock) LockOrEnqueue(owner LockID, mode LockMode, priority int, enqueue bool) (bool, *waiter) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	defer l.transition(l.state())
+
+	if len(l.queue) == 0 && l.tryAcquire(mode) {
+		return true, nil
+	}
+
+	if !enqueue {
+		return false, nil
+	}
+	return false, l.enqueue(owner, mode, priority)
+}
+
+// Wait waits until the lock is handed over to w, it gives up with false when the wait budget runs out
+// and with ctx error when ctx is done. Zero wait means no budget.
+func (l *lock) Wait(ctx context.Context, w *waiter, wait time.Duration) (bool, error) {
+	var timeout <-chan time.Time
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var err error
+	select {
+	case <-w.ready:
+		return true, nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timeout:
+	}
+
+	l.Cancel(w)
+	return false, err
+}
+
+// Cancel removes w from the queue.
+func (l *lock) Cancel(w *waiter) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	defer l.transition(l.state())
+
+	if w.granted {
+		// the lock was handed over while we were giving up, pass it to the next waiter
+		l.unlock(w.mode)
+	} else {
+		l.dequeue(w)
+		// a queued exclusive waiter might have held back shared waiters behind it
+		l.grantWaiters()
+	}
+}
+
+func (l *lock) Unlock(mode LockMode) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	defer l.transition(l.state())
+	l.unlock(mode)
+}
+
+func (l *lock) unlock(mode LockMode) {
+	if mode == Shared {
+		if l.readers == 0 {
+			panic("memdb: shared unlock of unlocked key lock")
+		}
+		l.readers--
+	} else {
+		if !l.writer {
+			panic("memdb: unlock of unlocked key lock")
+		}
+		l.writer = false
+	}
+
+	l.grantWaiters()
+}
+
+// grantWaiters hands the lock over to the waiters at the head of the queue.
+func (l *lock) grantWaiters() {
+	for len(l.queue) > 0 {
+		w := l.queue[0]
+		if !l.tryAcquire(w.mode) {
+			return
+		}
+
+		l.queue = l.queue[1:]
+		w.granted = true
+		close(w.ready)
+	}
+}
+
+// Locked reports whether the lock is held in any mode.
+func (l *lock) Locked() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.writer || l.readers > 0
+}
+
+// QueueLen returns the number of waiters.
+func (l *lock) QueueLen() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.queue)
+}
+
+func (l *lock) Waiters(now time.Time) []WaiterInfo {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	waiters := make([]WaiterInfo, len(l.queue))
+	for i, w := range l.queue {
+		waiters[i] = WaiterInfo{Position: i, Priority: w.priority, Mode: w.mode, WaitingFor: now.Sub(w.enqueuedAt)}
+	}
+	return waiters
+}
+
+// The methods below track the holders of the lock, the caller must hold the stripe of the key.
+
+func (l *lock) setHolder(lockId LockID, mode LockMode, now time.Time, token FencingToken) {
+	if token > l.lastToken {
+		l.lastToken = token
+	}
+	if mode == Shared {
+		l.sharedBy[lockId] = grant{acquiredAt: now, token: token}
+		return
+	}
+	l.lockId = lockId
+	l.acquiredAt = now
+	l.token = token
+}
+
+func (l *lock) holderMode(lockId LockID) (LockMode, bool) {
+	if lockId == l.lockId && lockId != "" {
+		return Exclusive, true
+	}
+	_, shared := l.sharedBy[lockId]
+	return Shared, shared
+}
+
+// holderToken returns the fencing token lockId was granted the lock with.
+func (l *lock) holderToken(lockId LockID) (FencingToken, bool) {
+	mode, held := l.holderMode(lockId)
+	if !held {
+		return 0, false
+	} else if mode == Shared {
+		return l.sharedBy[lockId].token, true
+	}
+	return l.token, true
+}
+
+// release unlocks the lock held by lockId.
+func (l *lock) release(lockId LockID) {
+	mode, held := l.holderMode(lockId)
+	if !held {
+		return
+	}
+
+	if mode == Shared {
+		delete(l.sharedBy, lockId)
+	} else {
+		l.lockId = ""
+	}
+	l.Unlock(mode)
+}
+
+// holders returns the LockIDs which hold the lock.
+func (l *lock) holders() []LockID {
+	var lockIds []LockID
+	if l.lockId != "" {
+		lockIds = append(lockIds, l.lockId)
+	}
+	for lockId := range l.sharedBy {
+		lockIds = append(lockIds, lockId)
+	}
+	return lockIds
+}
+
+// heldFor returns the age of the oldest holder of the lock.
+func (l *lock) heldFor(now time.Time) time.Duration {
+	oldest := now
+	if l.lockId != "" {
+		oldest = l.acquiredAt
+	}
+	for _, g := range l.sharedBy {
+		if g.acquiredAt.Before(oldest) {
+			oldest = g.acquiredAt
+		}
+	}
+	return now.Sub(oldest)
+}
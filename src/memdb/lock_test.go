@@ -0,0 +1,214 @@
+package memdb
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// waitForWaiters blocks until there are n clients waiting for the key
+func waitForWaiters(t *testing.T, memDB MemDB, key Key, n int) {
+	for i := 0; i < 1000; i++ {
+		waiters, err := memDB.Waiters(key)
+		assert.NoError(t, err)
+		if len(waiters) == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("expected %d waiters for %s", n, key)
+}
+
+func TestLockFIFO(t *testing.T) {
+	totalWaiters := 10
+
+	wga := &sync.WaitGroup{}
+	wga.Add(totalWaiters)
+
+	memDB := newTestMemDB(t, "TestDB")
+
+	k := Key("key0")
+	lockId := memDB.Put(k, Value("value0"))
+
+	order := make(chan int, totalWaiters)
+	for i := 0; i < totalWaiters; i++ {
+		go func(i int) {
+			lockId, _, err := memDB.GetAndLock(k)
+			assert.NoError(t, err)
+			order <- i
+			memDB.Release(lockId)
+			wga.Done()
+		}(i)
+		waitForWaiters(t, memDB, k, i+1)
+	}
+
+	memDB.Release(lockId)
+	wga.Wait()
+
+	close(order)
+	expected := 0
+	for i := range order {
+		assert.Equal(t, expected, i)
+		expected++
+	}
+}
+
+func TestLockPriority(t *testing.T) {
+	wga := &sync.WaitGroup{}
+	wga.Add(4)
+
+	memDB := newTestMemDB(t, "TestDB")
+
+	k := Key("key0")
+	lockId := memDB.Put(k, Value("value0"))
+
+	order := make(chan int, 4)
+	for i, priority := range []int{0, 1, 0, 1} {
+		go func(i, priority int) {
+			lockId, _, _, err := memDB.GetAndLockWithOptions(context.Background(), k, LockOptions{Priority: priority})
+			assert.NoError(t, err)
+			order <- i
+			memDB.Release(lockId)
+			wga.Done()
+		}(i, priority)
+		waitForWaiters(t, memDB, k, i+1)
+	}
+
+	waiters, err := memDB.Waiters(k)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(waiters))
+	for i, priority := range []int{1, 1, 0, 0} {
+		assert.Equal(t, i, waiters[i].Position)
+		assert.Equal(t, priority, waiters[i].Priority)
+		assert.True(t, waiters[i].WaitingFor > 0)
+	}
+
+	memDB.Release(lockId)
+	wga.Wait()
+
+	assert.Equal(t, 1, <-order)
+	assert.Equal(t, 3, <-order)
+	assert.Equal(t, 0, <-order)
+	assert.Equal(t, 2, <-order)
+}
+
+func TestLockCancelledWaiterLeavesQueue(t *testing.T) {
+	memDB := newTestMemDB(t, "TestDB")
+
+	k := Key("key0")
+	lockId := memDB.Put(k, Value("value0"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, _, err := memDB.GetAndLockContext(ctx, k)
+		done <- err
+	}()
+
+	waitForWaiters(t, memDB, k, 1)
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+	waitForWaiters(t, memDB, k, 0)
+
+	_, err := memDB.Waiters(Key("wrongkey"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	memDB.Release(lockId)
+	lockId2, _, err := memDB.TryGetAndLock(k)
+	assert.NoError(t, err)
+	assert.Equal(t, LockID("2"), lockId2)
+}
+
+func TestSharedLock(t *testing.T) {
+	memDB := newTestMemDB(t, "TestDB")
+
+	k := Key("key0")
+	lockId := memDB.Put(k, Value("value0"))
+	assert.NoError(t, memDB.Release(lockId))
+
+	// many readers at once
+	readLockId1, value1, err1 := memDB.GetAndRLock(k)
+	assert.NoError(t, err1)
+	assert.Equal(t, Value("value0"), value1)
+	readLockId2, value2, err2 := memDB.GetAndRLock(k)
+	assert.NoError(t, err2)
+	assert.Equal(t, Value("value0"), value2)
+
+	value, err := memDB.Get(readLockId1, k)
+	assert.NoError(t, err)
+	assert.Equal(t, Value("value0"), value)
+
+	// readers can't write
+	assert.Equal(t, ErrLockIsShared, memDB.Update(readLockId1, k, Value("value1"), false))
+	assert.Equal(t, ErrLockIsShared, memDB.Delete(readLockId2, k))
+
+	// writers wait for all readers
+	_, _, err = memDB.TryGetAndLock(k)
+	assert.IsType(t, &LockedError{}, err)
+
+	done := make(chan LockID)
+	go func() {
+		done <- memDB.Put(k, Value("value1"))
+	}()
+	waitForWaiters(t, memDB, k, 1)
+
+	// new readers queue up behind the writer
+	_, _, _, err = memDB.GetAndLockWithOptions(context.Background(), k, LockOptions{Mode: Shared, Wait: NoWait})
+	assert.IsType(t, &LockedError{}, err)
+
+	assert.NoError(t, memDB.Release(readLockId1))
+	select {
+	case <-done:
+		t.Fatal("writer got the lock while a reader holds it")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	assert.NoError(t, memDB.Release(readLockId2))
+	writeLockId := <-done
+	assert.Equal(t, LockID("4"), writeLockId)
+
+	value, err = memDB.Get(writeLockId, k)
+	assert.NoError(t, err)
+	assert.Equal(t, Value("value1"), value)
+}
+
+func TestSharedLockWaitersGrantedTogether(t *testing.T) {
+	totalReaders := 3
+
+	wga := &sync.WaitGroup{}
+	wga.Add(totalReaders)
+
+	memDB := newTestMemDB(t, "TestDB")
+
+	k := Key("key0")
+	lockId := memDB.Put(k, Value("value0"))
+
+	readers := make(chan LockID, totalReaders)
+	for i := 0; i < totalReaders; i++ {
+		go func() {
+			readLockId, _, err := memDB.GetAndRLock(k)
+			assert.NoError(t, err)
+			readers <- readLockId
+			wga.Done()
+		}()
+		waitForWaiters(t, memDB, k, i+1)
+	}
+
+	waiters, err := memDB.Waiters(k)
+	assert.NoError(t, err)
+	assert.Equal(t, Shared, waiters[0].Mode)
+
+	// all readers get the lock at once, nobody releases it
+	memDB.Update(lockId, k, Value("value1"), true)
+	wga.Wait()
+
+	close(readers)
+	for readLockId := range readers {
+		value, err := memDB.Get(readLockId, k)
+		assert.NoError(t, err)
+		assert.Equal(t, Value("value1"), value)
+	}
+}
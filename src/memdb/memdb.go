@@ -1,18 +1,39 @@
 package memdb
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io"
 	"math/rand"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
 )
 
 var (
-	ErrLockIdNotFound = errors.New("LockID not found")
-	ErrKeyNotFound    = errors.New("Key not found")
+	ErrLockIdNotFound    = errors.New("LockID not found")
+	ErrKeyNotFound       = errors.New("Key not found")
+	ErrNoLease           = errors.New("LockID has no lease")
+	ErrLockIsShared      = errors.New("LockID is a shared lock")
+	ErrNoKeys            = errors.New("No keys to lock")
+	ErrDeadlock          = errors.New("Deadlock detected")
+	ErrStaleToken        = errors.New("Fencing token is stale")
+	ErrVersionMismatch   = errors.New("Version mismatch")
+	ErrUnsupportedOption = errors.New("Lock option is not supported")
 )
 
+// LockedError is returned when the key is still locked by somebody else after the wait budget runs out.
+type LockedError struct {
+	Key     Key
+	HeldFor time.Duration
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("Key %s is locked for %v", e.Key, e.HeldFor)
+}
+
 func init() {
 	rand.Seed(time.Now().UnixNano())
 }
@@ -25,6 +46,18 @@ type LockIDGenerator interface {
 	Next() LockID
 }
 
+// LockIDSequence is a LockIDGenerator which draws LockIDs from a counter. A persistent database reserves
+// the counter in its log, so a LockID handed out before a restart is never handed out again.
+type LockIDSequence interface {
+	LockIDGenerator
+
+	// Seq returns the counter of the last LockID
+	Seq() uint64
+
+	// Skip moves the counter up to seq, the next LockID follows seq
+	Skip(seq uint64)
+}
+
 type lockIdSeqGenerator struct {
 	currentId uint64
 }
@@ -34,25 +67,89 @@ func (g *lockIdSeqGenerator) Next() LockID {
 	return LockID(strconv.FormatUint(g.currentId, 10))
 }
 
+func (g *lockIdSeqGenerator) Seq() uint64 {
+	return g.currentId
+}
+
+func (g *lockIdSeqGenerator) Skip(seq uint64) {
+	if seq > g.currentId {
+		g.currentId = seq
+	}
+}
+
 func NewLockIDSeqGenerator() LockIDGenerator {
 	return &lockIdSeqGenerator{}
 }
 
 var EmptyValue = Value("")
 
-type lock struct {
-	sync.Mutex
-	lockId LockID
+// NoWait makes lock acquisition fail immediately if the key is locked.
+const NoWait time.Duration = -1
+
+// LockOptions tune lock acquisition of PutWithOptions, GetAndLockWithOptions and GetAndLockManyWithOptions.
+type LockOptions struct {
+	// TTL is the lease of the acquired lock, zero means the lock never expires.
+	TTL time.Duration
+
+	// Wait limits how long to wait for the key locks, zero means wait until ctx is done.
+	// When the budget runs out, *LockedError is returned.
+	Wait time.Duration
+
+	// Mode is the mode of the acquired lock, PutWithOptions always acquires an exclusive lock.
+	Mode LockMode
+
+	// Priority is the priority class of the waiter, waiters of higher classes are granted the key lock first.
+	// Within the same class the key lock is granted in FIFO order.
+	Priority int
+
+	// Holder adds the keys to the ones already held by this LockID instead of creating a new LockID,
+	// keys it already holds are left as they are. Holder keeps its own lease, TTL is ignored.
+	// A waiter which would close a cycle of holders waiting for each other fails with *DeadlockError.
+	// PutWithOptions ignores Holder.
+	Holder LockID
 }
 
+// memDB spreads its keys and LockIDs over stripes, see stripe.go. mu guards the state shared by all keys:
+// the sequences, the wait-for graph, the change feed and the lock ID generator, it's never held while waiting.
 type memDB struct {
-	sync.RWMutex
-
-	name       string
-	lockIdGen  LockIDGenerator
-	storage    map[Key]Value
-	key2Lock   map[Key]*lock
-	lockId2Key map[LockID]Key
+	name        string
+	storage     Storage
+	keyStripes  [stripeCount]keyStripe
+	lockStripes [stripeCount]lockStripe
+
+	mu          sync.Mutex
+	lockIdGen   LockIDGenerator
+	waitingFor  map[LockID]*waitEntry
+	lastToken   FencingToken
+	lastVersion Version
+
+	// versions follow the clock, see UseClockVersions
+	clockVersions bool
+
+	// the high-water marks stored in a MarkStorage, see storeMarks
+	storedMarks Marks
+
+	// write-ahead log of a persistent database, see Open
+	wal             *wal
+	reservedTokens  FencingToken
+	reservedLockIds uint64
+	compactSize     int64
+	compacting      bool
+	closing         bool
+	compactMu       sync.Mutex
+	compactions     sync.WaitGroup
+
+	// recent changes for the replicas, see Changes
+	changes         []Change
+	changesAfter    uint64
+	changeSeq       uint64
+	changed         chan struct{}
+	publishedTokens FencingToken
+
+	reapInterval time.Duration
+	reaperOnce   sync.Once
+	closeOnce    sync.Once
+	done         chan struct{}
 }
 
 func (mdb *memDB) Name() string {
@@ -60,133 +157,640 @@ func (mdb *memDB) Name() string {
 }
 
 func (mdb *memDB) getLockByKey(key Key) (*lock, bool) {
-	mdb.RLock()
-	defer mdb.RUnlock()
-	v, exists := mdb.key2Lock[key]
+	s := mdb.keyStripe(key)
+	s.RLock()
+	defer s.RUnlock()
+	v, exists := s.key2Lock[key]
 	return v, exists
 }
 
-func (mdb *memDB) getKeyByLockID(lockId LockID) (Key, bool) {
-	mdb.RLock()
-	defer mdb.RUnlock()
-	v, exists := mdb.lockId2Key[lockId]
-	return v, exists
+func containsKey(keys []Key, key Key) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalKeys returns sorted keys without duplicates, locks are always acquired in this order.
+func canonicalKeys(keys []Key) []Key {
+	sorted := append([]Key(nil), keys...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+
+	unique := sorted[:0]
+	for i, key := range sorted {
+		if i == 0 || key != sorted[i-1] {
+			unique = append(unique, key)
+		}
+	}
+	return unique
+}
+
+// lookupLock returns the keys locked by lockId, expired leases are treated as not found.
+// The caller must hold the stripe of lockId.
+func (mdb *memDB) lookupLock(lockId LockID) ([]Key, bool) {
+	keys, exists := mdb.lockStripe(lockId).lockId2Keys[lockId]
+	if !exists || mdb.leaseExpired(lockId, time.Now()) {
+		return nil, false
+	}
+	return keys, true
+}
+
+// forgetKey removes key from the keys held by lockId, lockId is invalidated when it holds no more keys.
+// The caller must hold the stripe of lockId.
+func (mdb *memDB) forgetKey(lockId LockID, key Key) {
+	ls := mdb.lockStripe(lockId)
+
+	var keys []Key
+	for _, k := range ls.lockId2Keys[lockId] {
+		if k != key {
+			keys = append(keys, k)
+		}
+	}
+
+	if len(keys) > 0 {
+		ls.lockId2Keys[lockId] = keys
+	} else {
+		delete(ls.lockId2Keys, lockId)
+		delete(ls.leases, lockId)
+	}
+}
+
+// releaseKey unlocks the key held by lockId, other keys held by lockId stay locked.
+// The caller must hold the stripes of the key and of lockId.
+func (mdb *memDB) releaseKey(lockId LockID, key Key) {
+	if keyLock, exists := mdb.keyLock(key); exists {
+		keyLock.release(lockId)
+	}
+	mdb.forgetKey(lockId, key)
+}
+
+// releaseLock unlocks all keys held by lockId and invalidates lockId.
+// The caller must hold the stripes of lockId and of all its keys, see lockHolder.
+func (mdb *memDB) releaseLock(lockId LockID) {
+	ls := mdb.lockStripe(lockId)
+	for _, key := range ls.lockId2Keys[lockId] {
+		if keyLock, exists := mdb.keyLock(key); exists {
+			keyLock.release(lockId)
+		}
+	}
+	delete(ls.lockId2Keys, lockId)
+	delete(ls.leases, lockId)
+}
+
+// lockKey waits for keyLock within the wait budget, owner is the LockID the waiter already holds locks by.
+func (mdb *memDB) lockKey(ctx context.Context, key Key, keyLock *lock, opts LockOptions, owner LockID) error {
+	acquired, w := keyLock.LockOrEnqueue(owner, opts.Mode, opts.Priority, opts.Wait >= 0)
+	if acquired {
+		return nil
+	}
+
+	if w != nil {
+		if owner != "" {
+			if err := mdb.startWaiting(owner, key, keyLock, w); err != nil {
+				keyLock.Cancel(w)
+				return err
+			}
+			defer mdb.stopWaiting(owner)
+		}
+
+		acquired, err := keyLock.Wait(ctx, w, opts.Wait)
+		if err != nil || acquired {
+			return err
+		}
+	}
+
+	s := mdb.keyStripe(key)
+	s.RLock()
+	defer s.RUnlock()
+	return &LockedError{Key: key, HeldFor: keyLock.heldFor(time.Now())}
 }
 
 func (mdb *memDB) Put(key Key, value Value) LockID {
+	lockId, _, _ := mdb.PutWithOptions(context.Background(), key, value, LockOptions{})
+	return lockId
+}
+
+// PutWithTTL works like Put, but the acquired lock is released automatically
+// when ttl expires. Zero ttl means the lock never expires.
+func (mdb *memDB) PutWithTTL(key Key, value Value, ttl time.Duration) LockID {
+	lockId, _, _ := mdb.PutWithOptions(context.Background(), key, value, LockOptions{TTL: ttl})
+	return lockId
+}
+
+// PutContext works like Put, but gives up waiting for the key lock when ctx is done.
+func (mdb *memDB) PutContext(ctx context.Context, key Key, value Value) (LockID, error) {
+	lockId, _, err := mdb.PutWithOptions(ctx, key, value, LockOptions{})
+	return lockId, err
+}
+
+// PutWithOptions works like Put and also returns the fencing token of the acquired lock.
+func (mdb *memDB) PutWithOptions(ctx context.Context, key Key, value Value, opts LockOptions) (LockID, FencingToken, error) {
+	defer mdb.debugCheck()
+
+	opts.Mode = Exclusive
+	opts.Holder = ""
+	for {
+		lockId, token, ok, err := mdb.tryPut(ctx, key, value, opts)
+		if err != nil || ok {
+			return lockId, token, err
+		}
+	}
+}
+
+// tryPut returns false when the key lock it waited for was deleted (or the key was created
+// by somebody else in the meantime), so the caller has to start over.
+func (mdb *memDB) tryPut(ctx context.Context, key Key, value Value, opts LockOptions) (LockID, FencingToken, bool, error) {
 	keyLock, hasLock := mdb.getLockByKey(key)
 	if hasLock {
-		keyLock.Lock()
+		if err := mdb.lockKey(ctx, key, keyLock, opts, ""); err != nil {
+			return "", 0, false, err
+		}
 	}
 
-	mdb.Lock()
-	defer mdb.Unlock()
+	s := mdb.keyStripe(key)
+	s.Lock()
+	defer s.Unlock()
 
-	lockId := mdb.lockIdGen.Next()
-	mdb.lockId2Key[lockId] = key
+	if hasLock && keyLock.deleted {
+		// pass the wake up to the next waiter
+		keyLock.Unlock(Exclusive)
+		return "", 0, false, nil
+	}
 
-	if hasLock {
-		// update exists keyLock
-		keyLock.lockId = lockId
-	} else {
-		// create a new keyLock for the key
-		mdb.key2Lock[key] = &lock{lockId: lockId}
-		mdb.key2Lock[key].Lock()
+	if _, exists := s.key2Lock[key]; !hasLock && exists {
+		return "", 0, false, nil
 	}
 
-	mdb.storage[key] = value
+	token, err := mdb.nextToken()
+	var lockId LockID
+	if err == nil {
+		lockId, err = mdb.nextLockId()
+	}
+	if err == nil {
+		_, err = mdb.setValue(key, value)
+	}
+	if err != nil {
+		if hasLock {
+			keyLock.Unlock(Exclusive)
+		}
+		return "", 0, false, err
+	}
 
-	return lockId
+	ls := mdb.lockStripe(lockId)
+	ls.Lock()
+	defer ls.Unlock()
+
+	ls.lockId2Keys[lockId] = []Key{key}
+	mdb.setLease(lockId, opts.TTL)
 
+	if !hasLock {
+		// create a new keyLock for the key, it's held from the start
+		keyLock = newLock()
+		mdb.setKeyLock(key, keyLock)
+	}
+	keyLock.setHolder(lockId, Exclusive, time.Now(), token)
+
+	return lockId, token, true, nil
 }
 
 func (mdb *memDB) Get(lockId LockID, key Key) (Value, error) {
-	mdb.RLock()
-	defer mdb.RUnlock()
+	s, ls := mdb.keyStripe(key), mdb.lockStripe(lockId)
+	s.RLock()
+	defer s.RUnlock()
+	ls.RLock()
+	defer ls.RUnlock()
 
-	lockKey, exists := mdb.getKeyByLockID(lockId)
+	lockKeys, exists := mdb.lookupLock(lockId)
 	if !exists {
 		return EmptyValue, ErrLockIdNotFound
 	}
 
-	if key != lockKey {
-		return EmptyValue, ErrKeyNotFound
-	}
-
-	value, exists := mdb.storage[key]
-	if !exists {
-		// Dead code
-		// TBD: Delete should be implemented
+	if !containsKey(lockKeys, key) {
 		return EmptyValue, ErrKeyNotFound
 	}
 
-	return value, nil
+	value, _, err := mdb.storage.Get(key)
+	return value, err
 }
 
 func (mdb *memDB) Update(lockId LockID, key Key, value Value, releaseLock bool) error {
-	keyLock, exists := mdb.getLockByKey(key)
+	return mdb.UpdateWithToken(lockId, key, value, releaseLock, 0)
+}
+
+func (mdb *memDB) Release(lockId LockID) error {
+	defer mdb.debugCheck()
+
+	_, unlock, exists := mdb.lockHolder(lockId)
 	if !exists {
-		return ErrKeyNotFound
+		return ErrLockIdNotFound
 	}
+	defer unlock()
 
-	lockKey, exists := mdb.getKeyByLockID(lockId)
-	if !exists || key != lockKey {
+	if mdb.leaseExpired(lockId, time.Now()) {
 		return ErrLockIdNotFound
 	}
 
-	mdb.Lock()
-	defer mdb.Unlock()
+	mdb.releaseLock(lockId)
+	return nil
+}
+
+// ReleaseKey gives up the lock of a single key held by lockId, other keys held by lockId stay locked.
+// lockId is invalidated when it holds no more keys.
+func (mdb *memDB) ReleaseKey(lockId LockID, key Key) error {
+	defer mdb.debugCheck()
 
-	if releaseLock {
-		keyLock.Unlock()
-		delete(mdb.lockId2Key, lockId)
+	s, ls := mdb.keyStripe(key), mdb.lockStripe(lockId)
+	s.Lock()
+	defer s.Unlock()
+	ls.Lock()
+	defer ls.Unlock()
+
+	if _, exists := s.key2Lock[key]; !exists {
+		return ErrKeyNotFound
 	}
 
-	mdb.storage[key] = value
+	lockKeys, exists := mdb.lookupLock(lockId)
+	if !exists || !containsKey(lockKeys, key) {
+		return ErrLockIdNotFound
+	}
 
+	mdb.releaseKey(lockId, key)
 	return nil
 }
 
-func (mdb *memDB) Release(lockId LockID) error {
-	key, exists := mdb.getKeyByLockID(lockId)
+// Holds reports whether lockId holds any key, a lock whose lease has ended holds none.
+func (mdb *memDB) Holds(lockId LockID) bool {
+	ls := mdb.lockStripe(lockId)
+	ls.RLock()
+	defer ls.RUnlock()
+
+	_, exists := mdb.lookupLock(lockId)
+	return exists
+}
+
+func (mdb *memDB) Delete(lockId LockID, key Key) error {
+	defer mdb.debugCheck()
+
+	keyLock, exists := mdb.getLockByKey(key)
 	if !exists {
+		return ErrKeyNotFound
+	}
+
+	s, ls := mdb.keyStripe(key), mdb.lockStripe(lockId)
+	s.Lock()
+	defer s.Unlock()
+	ls.Lock()
+	defer ls.Unlock()
+
+	lockKeys, exists := mdb.lookupLock(lockId)
+	if !exists || !containsKey(lockKeys, key) {
 		return ErrLockIdNotFound
 	}
 
-	keyLock, exists := mdb.getLockByKey(key)
-	if exists {
-		keyLock.Unlock()
+	if mode, _ := keyLock.holderMode(lockId); mode == Shared {
+		return ErrLockIsShared
+	}
+
+	if err := mdb.writeLog(&record{op: opDelete, key: key}); err != nil {
+		return err
+	}
+
+	if err := mdb.storage.Delete(key); err != nil {
+		return err
 	}
+	mdb.setKeyLock(key, nil)
+	mdb.forgetKey(lockId, key)
 
-	mdb.Lock()
-	defer mdb.Unlock()
+	// wake up the waiters, they will find the lock deleted
+	keyLock.deleted = true
+	keyLock.lockId = ""
+	keyLock.Unlock(Exclusive)
 
-	delete(mdb.lockId2Key, lockId)
 	return nil
 }
 
 func (mdb *memDB) GetAndLock(key Key) (LockID, Value, error) {
-	keyLock, exists := mdb.getLockByKey(key)
-	if !exists {
-		return "", EmptyValue, ErrKeyNotFound
+	lockId, value, _, err := mdb.GetAndLockWithOptions(context.Background(), key, LockOptions{})
+	return lockId, value, err
+}
+
+// GetAndLockWithTTL works like GetAndLock, but the acquired lock is released automatically
+// when ttl expires. Zero ttl means the lock never expires.
+func (mdb *memDB) GetAndLockWithTTL(key Key, ttl time.Duration) (LockID, Value, error) {
+	lockId, value, _, err := mdb.GetAndLockWithOptions(context.Background(), key, LockOptions{TTL: ttl})
+	return lockId, value, err
+}
+
+// GetAndLockContext works like GetAndLock, but gives up waiting for the key lock when ctx is done.
+func (mdb *memDB) GetAndLockContext(ctx context.Context, key Key) (LockID, Value, error) {
+	lockId, value, _, err := mdb.GetAndLockWithOptions(ctx, key, LockOptions{})
+	return lockId, value, err
+}
+
+// GetAndRLock acquires a shared lock on the key, many clients can hold it at once
+// while Put and GetAndLock wait for all of them to release it.
+func (mdb *memDB) GetAndRLock(key Key) (LockID, Value, error) {
+	lockId, value, _, err := mdb.GetAndLockWithOptions(context.Background(), key, LockOptions{Mode: Shared})
+	return lockId, value, err
+}
+
+// TryGetAndLock works like GetAndLock, but doesn't wait if the key is locked.
+func (mdb *memDB) TryGetAndLock(key Key) (LockID, Value, error) {
+	lockId, value, _, err := mdb.GetAndLockWithOptions(context.Background(), key, LockOptions{Wait: NoWait})
+	return lockId, value, err
+}
+
+// GetAndLockTimeout works like GetAndLock, but waits for the key lock at most d.
+func (mdb *memDB) GetAndLockTimeout(key Key, d time.Duration) (LockID, Value, error) {
+	if d <= 0 {
+		return mdb.TryGetAndLock(key)
 	}
+	lockId, value, _, err := mdb.GetAndLockWithOptions(context.Background(), key, LockOptions{Wait: d})
+	return lockId, value, err
+}
 
-	keyLock.Lock()
+// GetAndLockWithOptions works like GetAndLock and also returns the fencing token of the acquired lock.
+func (mdb *memDB) GetAndLockWithOptions(ctx context.Context, key Key, opts LockOptions) (LockID, Value, FencingToken, error) {
+	lockId, values, tokens, err := mdb.getAndLock(ctx, []Key{key}, opts)
+	if err != nil {
+		return "", EmptyValue, 0, err
+	}
+	return lockId, values[0], tokens[0], nil
+}
 
-	mdb.Lock()
-	defer mdb.Unlock()
+// GetAndLockMany locks all keys at once and returns a single LockID covering them.
+// Key locks are acquired in canonical order, so concurrent GetAndLockMany calls never deadlock.
+// Update with release=true and Delete give up a single key, Release gives up all of them.
+func (mdb *memDB) GetAndLockMany(keys []Key) (LockID, map[Key]Value, error) {
+	lockId, values, _, err := mdb.GetAndLockManyWithOptions(context.Background(), keys, LockOptions{})
+	return lockId, values, err
+}
 
-	lockId := mdb.lockIdGen.Next()
-	keyLock.lockId = lockId
-	mdb.lockId2Key[lockId] = key
-	return lockId, mdb.storage[key], nil
+// GetAndLockManyWithOptions works like GetAndLockMany and also returns the fencing tokens of the acquired key locks.
+func (mdb *memDB) GetAndLockManyWithOptions(ctx context.Context, keys []Key, opts LockOptions) (LockID, map[Key]Value, map[Key]FencingToken, error) {
+	if len(keys) == 0 {
+		return "", nil, nil, ErrNoKeys
+	}
+
+	keys = canonicalKeys(keys)
+	lockId, values, tokens, err := mdb.getAndLock(ctx, keys, opts)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	keyValues := make(map[Key]Value, len(keys))
+	keyTokens := make(map[Key]FencingToken, len(keys))
+	for i, key := range keys {
+		keyValues[key] = values[i]
+		keyTokens[key] = tokens[i]
+	}
+	return lockId, keyValues, keyTokens, nil
+}
+
+// getAndLock acquires locks of keys one by one in the given order, the wait budget covers all of them.
+// If any of the keys can't be locked, the already acquired ones are unlocked. The keys acquired before
+// the last one are held by the LockID right away, if it's force-released meanwhile ErrLockIdNotFound is returned.
+func (mdb *memDB) getAndLock(ctx context.Context, keys []Key, opts LockOptions) (LockID, []Value, []FencingToken, error) {
+	defer mdb.debugCheck()
+
+	var deadline time.Time
+	if opts.Wait > 0 {
+		deadline = time.Now().Add(opts.Wait)
+	}
+
+	// the LockID the acquired key locks are registered to, it's assigned as soon as
+	// we hold a key lock and have to wait for another one
+	requested := keys
+	owner := opts.Holder
+	if owner != "" {
+		ls := mdb.lockStripe(owner)
+		ls.RLock()
+		heldKeys, exists := mdb.lookupLock(owner)
+		ls.RUnlock()
+		if !exists {
+			return "", nil, nil, ErrLockIdNotFound
+		}
+
+		var newKeys []Key
+		for _, key := range keys {
+			if !containsKey(heldKeys, key) {
+				newKeys = append(newKeys, key)
+			}
+		}
+		keys = newKeys
+	}
+
+	// don't wait for any key if some of them doesn't exist
+	toLock := make([]*lock, len(keys))
+	for i, key := range keys {
+		keyLock, exists := mdb.getLockByKey(key)
+		if !exists {
+			return "", nil, nil, ErrKeyNotFound
+		}
+		toLock[i] = keyLock
+	}
+
+	keyLocks := make([]*lock, 0, len(keys))
+	registered := 0
+
+	// abandon unlocks the acquired key locks and forgets the registered ones, the caller must hold
+	// the stripes of their keys and the stripe of owner. The registered keys may have been
+	// released by ForceRelease already.
+	abandon := func() {
+		for i, keyLock := range keyLocks {
+			if i < registered {
+				keyLock.release(owner)
+				mdb.forgetKey(owner, keys[i])
+			} else {
+				keyLock.Unlock(opts.Mode)
+			}
+		}
+	}
+
+	// lockAcquired locks the stripes of the acquired keys and of owner
+	lockAcquired := func(keys []Key) func() {
+		unlockKeys := mdb.lockKeys(keys)
+		if owner == "" {
+			return unlockKeys
+		}
+		ls := mdb.lockStripe(owner)
+		ls.Lock()
+		return func() {
+			ls.Unlock()
+			unlockKeys()
+		}
+	}
+
+	for i, key := range keys {
+		keyLock := toLock[i]
+
+		keyOpts := opts
+		if !deadline.IsZero() {
+			if keyOpts.Wait = time.Until(deadline); keyOpts.Wait <= 0 {
+				keyOpts.Wait = NoWait
+			}
+		}
+
+		if err := mdb.lockKey(ctx, key, keyLock, keyOpts, owner); err != nil {
+			unlock := lockAcquired(keys[:len(keyLocks)])
+			abandon()
+			unlock()
+			return "", nil, nil, err
+		}
+		keyLocks = append(keyLocks, keyLock)
+
+		if i < len(keys)-1 {
+			// register the acquired key lock before waiting for the next one, so deadlocks can be detected
+			// and Locks and ForceRelease see it. The lease of a new LockID starts when all keys are locked.
+			if owner == "" {
+				var err error
+				if owner, err = mdb.nextLockId(); err != nil {
+					unlock := lockAcquired(keys[:len(keyLocks)])
+					abandon()
+					unlock()
+					return "", nil, nil, err
+				}
+			}
+			unlock := lockAcquired([]Key{key})
+			var err error
+			if _, exists := mdb.lookupLock(owner); !exists && (opts.Holder != "" || registered > 0) {
+				// released, expired or force-released while we were waiting, the key must not bring it back
+				err = ErrLockIdNotFound
+			} else if token, tokenErr := mdb.nextToken(); tokenErr != nil {
+				err = tokenErr
+			} else {
+				keyLock.setHolder(owner, opts.Mode, time.Now(), token)
+				ls := mdb.lockStripe(owner)
+				ls.lockId2Keys[owner] = append(ls.lockId2Keys[owner], key)
+				registered++
+			}
+			unlock()
+
+			if err != nil {
+				unlock := lockAcquired(keys[:len(keyLocks)])
+				abandon()
+				unlock()
+				return "", nil, nil, err
+			}
+		}
+	}
+
+	// the requested keys held already are read too
+	lockId := owner
+	if lockId == "" {
+		var err error
+		if lockId, err = mdb.nextLockId(); err != nil {
+			unlock := lockAcquired(keys)
+			abandon()
+			unlock()
+			return "", nil, nil, err
+		}
+	}
+	owner = lockId
+	unlock := lockAcquired(requested)
+	defer unlock()
+	ls := mdb.lockStripe(lockId)
+
+	for _, keyLock := range keyLocks {
+		if keyLock.deleted {
+			abandon()
+			return "", nil, nil, ErrKeyNotFound
+		}
+	}
+
+	if opts.Holder != "" || registered > 0 {
+		// released, expired or force-released while we were waiting
+		heldKeys, exists := mdb.lookupLock(lockId)
+		for _, key := range keys[:registered] {
+			exists = exists && containsKey(heldKeys, key)
+		}
+		if !exists {
+			abandon()
+			return "", nil, nil, ErrLockIdNotFound
+		}
+	}
+
+	values := make([]Value, len(requested))
+	for i, key := range requested {
+		value, _, err := mdb.storage.Get(key)
+		if err != nil {
+			abandon()
+			return "", nil, nil, err
+		}
+		values[i] = value
+	}
+
+	grants := make([]FencingToken, len(keyLocks)-registered)
+	for i := range grants {
+		var err error
+		if grants[i], err = mdb.nextToken(); err != nil {
+			abandon()
+			return "", nil, nil, err
+		}
+	}
+
+	now := time.Now()
+	for i, keyLock := range keyLocks[registered:] {
+		keyLock.setHolder(lockId, opts.Mode, now, grants[i])
+	}
+
+	ls.lockId2Keys[lockId] = append(ls.lockId2Keys[lockId], keys[registered:]...)
+	if opts.Holder == "" {
+		mdb.setLease(lockId, opts.TTL)
+	}
+
+	tokens := make([]FencingToken, len(requested))
+	for i, key := range requested {
+		keyLock, _ := mdb.keyLock(key)
+		tokens[i], _ = keyLock.holderToken(lockId)
+	}
+	return lockId, values, tokens, nil
+}
+
+// Waiters returns the queue of clients waiting for the key lock in grant order.
+func (mdb *memDB) Waiters(key Key) ([]WaiterInfo, error) {
+	keyLock, exists := mdb.getLockByKey(key)
+	if !exists {
+		return nil, ErrKeyNotFound
+	}
+	return keyLock.Waiters(time.Now()), nil
+}
+
+func (mdb *memDB) Close() error {
+	var err error
+	mdb.closeOnce.Do(func() {
+		close(mdb.done)
+
+		// let a running compaction finish
+		mdb.mu.Lock()
+		mdb.closing = true
+		mdb.mu.Unlock()
+		mdb.compactions.Wait()
+
+		mdb.lockAll()
+		defer mdb.unlockAll()
+		if mdb.wal != nil {
+			err = mdb.wal.Close()
+		}
+		if closer, ok := mdb.storage.(io.Closer); ok {
+			if closeErr := closer.Close(); err == nil {
+				err = closeErr
+			}
+		}
+	})
+	return err
 }
 
 func (mdb *memDB) DirectGet(key Key) (Value, bool) {
-	mdb.RLock()
-	defer mdb.RUnlock()
-	value, hasKey := mdb.storage[key]
-	return value, hasKey
+	s := mdb.keyStripe(key)
+	s.RLock()
+	defer s.RUnlock()
+	value, _, err := mdb.storage.Get(key)
+	return value, err == nil
 }
 
 type MemDB interface {
@@ -194,19 +798,86 @@ type MemDB interface {
 	Put(key Key, value Value) LockID
 	Get(lockId LockID, key Key) (Value, error)
 	Update(lockId LockID, key Key, value Value, releaseLock bool) error
+	UpdateWithToken(lockId LockID, key Key, value Value, releaseLock bool, token FencingToken) error
 	Release(lockId LockID) error
+	ReleaseKey(lockId LockID, key Key) error
+	Delete(lockId LockID, key Key) error
+	Holds(lockId LockID) bool
+
+	GetWithVersion(lockId LockID, key Key) (Value, Version, error)
+	Peek(key Key) (value Value, version Version, reserved bool, err error)
+	Scan(prefix Key, startAfter Key, limit int) (keys []Key, more bool)
+	CompareAndSwap(key Key, expectedVersion Version, value Value) (Version, error)
 
 	GetAndLock(key Key) (LockID, Value, error)
 
-	// for tests
+	PutWithTTL(key Key, value Value, ttl time.Duration) LockID
+	GetAndLockWithTTL(key Key, ttl time.Duration) (LockID, Value, error)
+	Renew(lockId LockID, extendBy time.Duration) (time.Time, error)
+
+	PutContext(ctx context.Context, key Key, value Value) (LockID, error)
+	GetAndLockContext(ctx context.Context, key Key) (LockID, Value, error)
+
+	GetAndRLock(key Key) (LockID, Value, error)
+	GetAndLockMany(keys []Key) (LockID, map[Key]Value, error)
+
+	TryGetAndLock(key Key) (LockID, Value, error)
+	GetAndLockTimeout(key Key, d time.Duration) (LockID, Value, error)
+
+	Waiters(key Key) ([]WaiterInfo, error)
+	Locks() []LockInfo
+	ForceRelease(lockId LockID) ([]LockInfo, error)
+
+	PutWithOptions(ctx context.Context, key Key, value Value, opts LockOptions) (LockID, FencingToken, error)
+	GetAndLockWithOptions(ctx context.Context, key Key, opts LockOptions) (LockID, Value, FencingToken, error)
+	GetAndLockManyWithOptions(ctx context.Context, keys []Key, opts LockOptions) (LockID, map[Key]Value, map[Key]FencingToken, error)
+
+	// Close stops background activity of the database and closes its log
+	Close() error
+
+	Snapshot(w io.Writer) error
+	Restore(r io.Reader, force bool) error
+	Compact() error
+
+	Changes(seq uint64) ([]Change, <-chan struct{}, error)
+	ApplyChange(change Change) error
+
+	// for tests, use Peek otherwise
 	DirectGet(key Key) (Value, bool)
 }
 
-func NewMemDB(name string, lockIdGen LockIDGenerator) MemDB {
-	return &memDB{
+// NewMemDB creates a database which keeps its values in storage, a map storage if none is given.
+// The keys storage already has, e.g. a disk storage opened by OpenDiskStorage, are available right away.
+// Locks are not kept in the storage, but the versions, fencing tokens and LockIDs of a MarkStorage continue
+// from its high-water marks, so the database created on it again never hands out any of them twice.
+// NewMemDB panics if the keys of storage can't be read, they always can with the storages of this package.
+// See Open for a database persisted by a write-ahead log.
+func NewMemDB(name string, lockIdGen LockIDGenerator, storage ...Storage) MemDB {
+	mdb := newMemDB(name, lockIdGen)
+	if len(storage) > 0 {
+		mdb.storage = storage[0]
+		if err := mdb.loadKeys(); err != nil {
+			panic(err)
+		}
+		mdb.loadMarks()
+	}
+	return mdb
+}
+
+func newMemDB(name string, lockIdGen LockIDGenerator) *memDB {
+	mdb := &memDB{
 		name:       name,
 		lockIdGen:  lockIdGen,
-		storage:    make(map[Key]Value),
-		key2Lock:   make(map[Key]*lock),
-		lockId2Key: make(map[LockID]Key)}
+		storage:    NewMapStorage(),
+		waitingFor: make(map[LockID]*waitEntry),
+
+		reapInterval: DefaultReapInterval,
+		done:         make(chan struct{})}
+	mdb.resetKeyLocks()
+	for i := range mdb.lockStripes {
+		mdb.lockStripes[i].lockId2Keys = make(map[LockID][]Key)
+		mdb.lockStripes[i].leases = make(map[LockID]time.Time)
+	}
+	mdb.initChanges()
+	return mdb
 }
@@ -1,6 +1,7 @@
 package memdb
 
 import (
+	"context"
 	"math/rand"
 	"strconv"
 	"sync"
@@ -18,20 +19,20 @@ func TestLockIDSeqGenerator(t *testing.T) {
 }
 
 func TestMemDBCreate(t *testing.T) {
-	memDB := NewMemDB("TestDB", NewLockIDSeqGenerator())
+	memDB := newTestMemDB(t, "TestDB")
 	assert.NotNil(t, memDB)
 	assert.Equal(t, "TestDB", memDB.Name())
 }
 
 func TestMemDBPut(t *testing.T) {
-	memDB := NewMemDB("TestDB", NewLockIDSeqGenerator())
+	memDB := newTestMemDB(t, "TestDB")
 	lid := memDB.Put("key", "unused")
 	assert.NotEmpty(t, lid)
 	assert.Equal(t, LockID("1"), lid)
 }
 
 func TestMemDBGet(t *testing.T) {
-	memDB := NewMemDB("TestDB", NewLockIDSeqGenerator())
+	memDB := newTestMemDB(t, "TestDB")
 	lid := memDB.Put("key", "value")
 	value, err := memDB.Get(lid, "key")
 	assert.Nil(t, err)
@@ -39,11 +40,21 @@ func TestMemDBGet(t *testing.T) {
 }
 
 func TestMemDBReleaseUnexistsLock(t *testing.T) {
-	memDB := NewMemDB("TestDB", NewLockIDSeqGenerator())
+	memDB := newTestMemDB(t, "TestDB")
 	err := memDB.Release("WrongLockId")
 	assert.Equal(t, ErrLockIdNotFound, err)
 }
 
+func TestMemDBHolds(t *testing.T) {
+	memDB := newTestMemDB(t, "TestDB")
+	lid := memDB.Put("key", "value")
+	assert.True(t, memDB.Holds(lid))
+	assert.False(t, memDB.Holds("WrongLockId"))
+
+	assert.NoError(t, memDB.Release(lid))
+	assert.False(t, memDB.Holds(lid))
+}
+
 func TestMemDBPutMany(t *testing.T) {
 
 	totalConcurrentPuts := 10
@@ -51,7 +62,7 @@ func TestMemDBPutMany(t *testing.T) {
 	wga := &sync.WaitGroup{}
 	wga.Add(totalConcurrentPuts)
 
-	memDB := NewMemDB("TestDB", NewLockIDSeqGenerator())
+	memDB := newTestMemDB(t, "TestDB")
 
 	for i := 0; i < totalConcurrentPuts; i++ {
 		go func(i int, prefix string) {
@@ -84,7 +95,7 @@ func TestMemDBPutManySameKey(t *testing.T) {
 	wga := &sync.WaitGroup{}
 	wga.Add(totalConcurrentPuts)
 
-	memDB := NewMemDB("TestDB", NewLockIDSeqGenerator())
+	memDB := newTestMemDB(t, "TestDB")
 
 	for i := 0; i < totalConcurrentPuts; i++ {
 		go func(i int, prefix string) {
@@ -115,7 +126,7 @@ func TestMemDBPutManySameKeyWithRandomRelease(t *testing.T) {
 	wga := &sync.WaitGroup{}
 	wga.Add(totalConcurrentPuts)
 
-	memDB := NewMemDB("TestDB", NewLockIDSeqGenerator())
+	memDB := newTestMemDB(t, "TestDB")
 
 	lst := rand.Perm(totalConcurrentPuts)
 	for _, i := range lst {
@@ -147,7 +158,7 @@ func TestMemDBPutDifferentKey(t *testing.T) {
 	wga := &sync.WaitGroup{}
 	wga.Add(1)
 
-	memDB := NewMemDB("TestDB", NewLockIDSeqGenerator())
+	memDB := newTestMemDB(t, "TestDB")
 
 	lockId := memDB.Put(Key("key0"), Value("value0"))
 	go func() {
@@ -176,7 +187,7 @@ func TestGetKeyLock(t *testing.T) {
 	wga := &sync.WaitGroup{}
 	wga.Add(1)
 
-	memDB := NewMemDB("TestDB", NewLockIDSeqGenerator())
+	memDB := newTestMemDB(t, "TestDB")
 
 	lockId := memDB.Put(Key("key0"), Value("value0"))
 
@@ -205,7 +216,7 @@ func TestUpdate(t *testing.T) {
 	wga := &sync.WaitGroup{}
 	wga.Add(1)
 
-	memDB := NewMemDB("TestDB", NewLockIDSeqGenerator())
+	memDB := newTestMemDB(t, "TestDB")
 
 	k := Key("key0")
 	lockId := memDB.Put(Key("key0"), Value("value0"))
@@ -241,7 +252,7 @@ func TestUpdate(t *testing.T) {
 
 func TestUpdateWithOldLockId(t *testing.T) {
 
-	memDB := NewMemDB("TestDB", NewLockIDSeqGenerator())
+	memDB := newTestMemDB(t, "TestDB")
 
 	k := Key("key0")
 	lockId0 := memDB.Put(Key("key0"), Value("value0"))
@@ -259,7 +270,7 @@ func TestUpdateWithOldLockId(t *testing.T) {
 }
 
 func TestWebCase(t *testing.T) {
-	memDB := NewMemDB("TestDB", NewLockIDSeqGenerator())
+	memDB := newTestMemDB(t, "TestDB")
 
 	lockId := memDB.Put(Key("key"), Value("value"))
 	assert.Equal(t, LockID("1"), lockId)
@@ -275,3 +286,143 @@ func TestWebCase(t *testing.T) {
 	assert.Equal(t, Value("value"), value2)
 
 }
+
+func TestDelete(t *testing.T) {
+	memDB := newTestMemDB(t, "TestDB")
+
+	k := Key("key0")
+	lockId := memDB.Put(k, Value("value0"))
+
+	assert.Equal(t, ErrKeyNotFound, memDB.Delete(lockId, Key("wrongkey")))
+	assert.Equal(t, ErrLockIdNotFound, memDB.Delete(LockID("wronglock"), k))
+
+	assert.NoError(t, memDB.Delete(lockId, k))
+	_, exists := memDB.DirectGet(k)
+	assert.False(t, exists)
+
+	assert.Equal(t, ErrKeyNotFound, memDB.Delete(lockId, k))
+	assert.Equal(t, ErrLockIdNotFound, memDB.Release(lockId))
+
+	_, _, err := memDB.GetAndLock(k)
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// the key can be created again
+	lockId2 := memDB.Put(k, Value("value1"))
+	assert.Equal(t, LockID("2"), lockId2)
+	value, err := memDB.Get(lockId2, k)
+	assert.NoError(t, err)
+	assert.Equal(t, Value("value1"), value)
+}
+
+func TestDeleteWakesUpWaiters(t *testing.T) {
+	wga := &sync.WaitGroup{}
+	wga.Add(3)
+
+	memDB := newTestMemDB(t, "TestDB")
+
+	k := Key("key0")
+	lockId := memDB.Put(k, Value("value0"))
+
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, _, err := memDB.GetAndLock(k)
+			assert.Equal(t, ErrKeyNotFound, err)
+			wga.Done()
+		}()
+	}
+
+	var putLockId LockID
+	go func() {
+		time.Sleep(time.Duration(50) * time.Millisecond)
+		putLockId = memDB.Put(k, Value("value1"))
+		wga.Done()
+	}()
+
+	time.Sleep(time.Duration(100+rand.Int31n(300)) * time.Millisecond)
+	assert.NoError(t, memDB.Delete(lockId, k))
+
+	wga.Wait()
+
+	// Put waiter created the key from scratch
+	value, err := memDB.Get(putLockId, k)
+	assert.NoError(t, err)
+	assert.Equal(t, Value("value1"), value)
+}
+
+func TestGetAndLockContext(t *testing.T) {
+	memDB := newTestMemDB(t, "TestDB")
+
+	k := Key("key0")
+	lockId := memDB.Put(k, Value("value0"))
+
+	// give up waiting
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, _, err := memDB.GetAndLockContext(ctx, k)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	cancel2()
+	_, err = memDB.PutContext(ctx2, k, Value("value1"))
+	assert.Equal(t, context.Canceled, err)
+
+	// cancelled waiters don't hold the key
+	assert.NoError(t, memDB.Release(lockId))
+	lockId2, value, err := memDB.GetAndLockContext(context.Background(), k)
+	assert.NoError(t, err)
+	assert.Equal(t, LockID("2"), lockId2)
+	assert.Equal(t, Value("value0"), value)
+
+	// new key never blocks
+	lockId3, err := memDB.PutContext(ctx2, Key("key1"), Value("value1"))
+	assert.NoError(t, err)
+	assert.Equal(t, LockID("3"), lockId3)
+
+	_, _, err = memDB.GetAndLockContext(context.Background(), Key("wrongkey"))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestTryGetAndLock(t *testing.T) {
+	memDB := newTestMemDB(t, "TestDB")
+
+	k := Key("key0")
+	lockId := memDB.Put(k, Value("value0"))
+	time.Sleep(20 * time.Millisecond)
+
+	_, _, err := memDB.TryGetAndLock(k)
+	assert.IsType(t, &LockedError{}, err)
+	lockedErr := err.(*LockedError)
+	assert.Equal(t, k, lockedErr.Key)
+	assert.True(t, lockedErr.HeldFor >= 20*time.Millisecond)
+
+	_, _, err = memDB.TryGetAndLock(Key("wrongkey"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	assert.NoError(t, memDB.Release(lockId))
+	lockId2, value, err := memDB.TryGetAndLock(k)
+	assert.NoError(t, err)
+	assert.Equal(t, LockID("2"), lockId2)
+	assert.Equal(t, Value("value0"), value)
+}
+
+func TestGetAndLockTimeout(t *testing.T) {
+	memDB := newTestMemDB(t, "TestDB")
+
+	k := Key("key0")
+	lockId := memDB.Put(k, Value("value0"))
+
+	start := time.Now()
+	_, _, err := memDB.GetAndLockTimeout(k, 50*time.Millisecond)
+	assert.IsType(t, &LockedError{}, err)
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		memDB.Release(lockId)
+	}()
+
+	lockId2, value, err := memDB.GetAndLockTimeout(k, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, LockID("2"), lockId2)
+	assert.Equal(t, Value("value0"), value)
+}
@@ -0,0 +1,401 @@
+package memdb
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// model is the reference the database is compared with: plain maps changed by one operation at a time.
+// Nobody waits for a key in the model, the operations are run with NoWait.
+type model struct {
+	values      map[Key]Value
+	versions    map[Key]Version
+	lastVersion Version
+	holders     map[Key]map[LockID]LockMode
+	locks       map[LockID][]Key
+}
+
+func newModel() *model {
+	return &model{
+		values:   make(map[Key]Value),
+		versions: make(map[Key]Version),
+		holders:  make(map[Key]map[LockID]LockMode),
+		locks:    make(map[LockID][]Key),
+	}
+}
+
+func (m *model) set(key Key, value Value) {
+	m.lastVersion++
+	m.values[key] = value
+	m.versions[key] = m.lastVersion
+}
+
+func (m *model) holds(lockId LockID, key Key) (LockMode, bool) {
+	mode, held := m.holders[key][lockId]
+	return mode, held
+}
+
+// free reports whether the key can be locked in the given mode by somebody else than holder.
+func (m *model) free(key Key, mode LockMode, holder LockID) bool {
+	for lockId, held := range m.holders[key] {
+		if lockId != holder && (mode == Exclusive || held == Exclusive) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *model) grant(lockId LockID, key Key, mode LockMode) {
+	if m.holders[key] == nil {
+		m.holders[key] = make(map[LockID]LockMode)
+	}
+	m.holders[key][lockId] = mode
+	m.locks[lockId] = append(m.locks[lockId], key)
+}
+
+func (m *model) releaseKey(lockId LockID, key Key) {
+	delete(m.holders[key], lockId)
+	var keys []Key
+	for _, k := range m.locks[lockId] {
+		if k != key {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) > 0 {
+		m.locks[lockId] = keys
+	} else {
+		delete(m.locks, lockId)
+	}
+}
+
+func (m *model) release(lockId LockID) {
+	for _, key := range m.locks[lockId] {
+		delete(m.holders[key], lockId)
+	}
+	delete(m.locks, lockId)
+}
+
+// modelRun runs random operations on the database and the model side by side.
+type modelRun struct {
+	t       *testing.T
+	random  *rand.Rand
+	mdb     *memDB
+	m       *model
+	keys    []Key
+	lockIds []LockID
+}
+
+func (r *modelRun) key() Key {
+	return r.keys[r.random.Intn(len(r.keys))]
+}
+
+// lockId picks a LockID the database has handed out, it may have been released already.
+func (r *modelRun) lockId() LockID {
+	if len(r.lockIds) == 0 || r.random.Intn(10) == 0 {
+		return "unknown"
+	}
+	return r.lockIds[r.random.Intn(len(r.lockIds))]
+}
+
+func (r *modelRun) mode() LockMode {
+	if r.random.Intn(3) == 0 {
+		return Shared
+	}
+	return Exclusive
+}
+
+// assertErr checks err against the error expected by the model, *LockedError is matched by its type.
+func assertErr(t *testing.T, expected, err error, op string) bool {
+	if _, locked := expected.(*LockedError); locked {
+		_, ok := err.(*LockedError)
+		return assert.True(t, ok, "%s: expected *LockedError, got %v", op, err)
+	}
+	return assert.Equal(t, expected, err, op)
+}
+
+func (r *modelRun) step(value Value) string {
+	ctx := context.Background()
+	m := r.m
+
+	switch r.random.Intn(8) {
+	case 0:
+		key := r.key()
+		op := fmt.Sprintf("Put(%s)", key)
+		var expected error
+		if !m.free(key, Exclusive, "") {
+			expected = &LockedError{}
+		}
+
+		lockId, _, err := r.mdb.PutWithOptions(ctx, key, value, LockOptions{Wait: NoWait})
+		if assertErr(r.t, expected, err, op) && err == nil {
+			assert.NotContains(r.t, m.locks, lockId, op)
+			r.lockIds = append(r.lockIds, lockId)
+			m.set(key, value)
+			m.grant(lockId, key, Exclusive)
+		}
+		return op
+
+	case 1:
+		keys := canonicalKeys([]Key{r.key(), r.key()})
+		opts := LockOptions{Wait: NoWait, Mode: r.mode()}
+		if r.random.Intn(3) == 0 {
+			opts.Holder = r.lockId()
+		}
+		op := fmt.Sprintf("GetAndLockMany(%v, %v, holder %q)", keys, opts.Mode, opts.Holder)
+
+		var expected error
+		var newKeys []Key
+		if _, exists := m.locks[opts.Holder]; opts.Holder != "" && !exists {
+			expected = ErrLockIdNotFound
+		} else {
+			for _, key := range keys {
+				if _, held := m.holds(opts.Holder, key); !held || opts.Holder == "" {
+					newKeys = append(newKeys, key)
+				}
+			}
+			for _, key := range newKeys {
+				if _, exists := m.values[key]; !exists {
+					expected = ErrKeyNotFound
+				}
+			}
+			for _, key := range newKeys {
+				if expected == nil && !m.free(key, opts.Mode, opts.Holder) {
+					expected = &LockedError{}
+				}
+			}
+		}
+
+		lockId, values, tokens, err := r.mdb.GetAndLockManyWithOptions(ctx, keys, opts)
+		if assertErr(r.t, expected, err, op) && err == nil {
+			if opts.Holder == "" {
+				assert.NotContains(r.t, m.locks, lockId, op)
+				r.lockIds = append(r.lockIds, lockId)
+			} else {
+				assert.Equal(r.t, opts.Holder, lockId, op)
+			}
+			for _, key := range keys {
+				assert.Equal(r.t, m.values[key], values[key], op)
+				assert.NotZero(r.t, tokens[key], op)
+			}
+			for _, key := range newKeys {
+				m.grant(lockId, key, opts.Mode)
+			}
+		}
+		return op
+
+	case 2:
+		lockId, key, release := r.lockId(), r.key(), r.random.Intn(2) == 0
+		op := fmt.Sprintf("Update(%s, %s, release %v)", lockId, key, release)
+		var expected error
+		mode, held := m.holds(lockId, key)
+		if _, exists := m.values[key]; !exists {
+			expected = ErrKeyNotFound
+		} else if !held {
+			expected = ErrLockIdNotFound
+		} else if mode == Shared {
+			expected = ErrLockIsShared
+		}
+
+		if assertErr(r.t, expected, r.mdb.Update(lockId, key, value, release), op) && expected == nil {
+			m.set(key, value)
+			if release {
+				m.releaseKey(lockId, key)
+			}
+		}
+		return op
+
+	case 3:
+		lockId := r.lockId()
+		op := fmt.Sprintf("Release(%s)", lockId)
+		var expected error
+		if _, exists := m.locks[lockId]; !exists {
+			expected = ErrLockIdNotFound
+		}
+
+		if assertErr(r.t, expected, r.mdb.Release(lockId), op) && expected == nil {
+			m.release(lockId)
+		}
+		return op
+
+	case 4:
+		lockId, key := r.lockId(), r.key()
+		op := fmt.Sprintf("ReleaseKey(%s, %s)", lockId, key)
+		var expected error
+		if _, exists := m.values[key]; !exists {
+			expected = ErrKeyNotFound
+		} else if _, held := m.holds(lockId, key); !held {
+			expected = ErrLockIdNotFound
+		}
+
+		if assertErr(r.t, expected, r.mdb.ReleaseKey(lockId, key), op) && expected == nil {
+			m.releaseKey(lockId, key)
+		}
+		return op
+
+	case 5:
+		lockId, key := r.lockId(), r.key()
+		op := fmt.Sprintf("Delete(%s, %s)", lockId, key)
+		var expected error
+		mode, held := m.holds(lockId, key)
+		if _, exists := m.values[key]; !exists {
+			expected = ErrKeyNotFound
+		} else if !held {
+			expected = ErrLockIdNotFound
+		} else if mode == Shared {
+			expected = ErrLockIsShared
+		}
+
+		if assertErr(r.t, expected, r.mdb.Delete(lockId, key), op) && expected == nil {
+			m.releaseKey(lockId, key)
+			delete(m.values, key)
+			delete(m.versions, key)
+			delete(m.holders, key)
+		}
+		return op
+
+	case 6:
+		lockId, key := r.lockId(), r.key()
+		op := fmt.Sprintf("Get(%s, %s)", lockId, key)
+		var expected error
+		if _, exists := m.locks[lockId]; !exists {
+			expected = ErrLockIdNotFound
+		} else if _, held := m.holds(lockId, key); !held {
+			expected = ErrKeyNotFound
+		}
+
+		value, err := r.mdb.Get(lockId, key)
+		if assertErr(r.t, expected, err, op) && expected == nil {
+			assert.Equal(r.t, m.values[key], value, op)
+		}
+		return op
+
+	default:
+		key := r.key()
+		version := m.versions[key]
+		if r.random.Intn(4) == 0 {
+			version++
+		}
+		op := fmt.Sprintf("CompareAndSwap(%s, %d)", key, version)
+		var expected error
+		if _, exists := m.values[key]; !exists {
+			expected = ErrKeyNotFound
+		} else if len(m.holders[key]) > 0 {
+			expected = &LockedError{}
+		} else if version != m.versions[key] {
+			expected = ErrVersionMismatch
+		}
+
+		newVersion, err := r.mdb.CompareAndSwap(key, version, value)
+		if assertErr(r.t, expected, err, op) && expected == nil {
+			m.set(key, value)
+			assert.Equal(r.t, m.lastVersion, newVersion, op)
+		}
+		return op
+	}
+}
+
+// compare checks that the database has the values and the locks of the model.
+func (r *modelRun) compare(op string) bool {
+	ok := assert.NoError(r.t, r.mdb.checkInvariants(), op)
+	for _, key := range r.keys {
+		value, version, reserved, err := r.mdb.Peek(key)
+		if _, exists := r.m.values[key]; !exists {
+			ok = assert.Equal(r.t, ErrKeyNotFound, err, op) && ok
+			continue
+		}
+		ok = assert.Equal(r.t, r.m.values[key], value, op) && ok
+		ok = assert.Equal(r.t, r.m.versions[key], version, op) && ok
+		ok = assert.Equal(r.t, len(r.m.holders[key]) > 0, reserved, op) && ok
+	}
+
+	var expected, actual []string
+	for lockId, keys := range r.m.locks {
+		for _, key := range keys {
+			expected = append(expected, fmt.Sprintf("%s %s %v", lockId, key, r.m.holders[key][lockId]))
+		}
+	}
+	for _, info := range r.mdb.Locks() {
+		actual = append(actual, fmt.Sprintf("%s %s %v", info.LockID, info.Key, info.Mode))
+	}
+	sort.Strings(expected)
+	sort.Strings(actual)
+	return assert.Equal(r.t, expected, actual, op) && ok
+}
+
+func TestModel(t *testing.T) {
+	for seed := int64(0); seed < 20; seed++ {
+		r := &modelRun{
+			t:      t,
+			random: rand.New(rand.NewSource(seed)),
+			mdb:    newTestMemDB(t, "TestModel"),
+			m:      newModel(),
+			keys:   []Key{"key0", "key1", "key2", "key3"},
+		}
+
+		var history []string
+		for i := 0; i < 500; i++ {
+			history = append(history, r.step(Value(fmt.Sprintf("value%d", i))))
+			if !r.compare(history[len(history)-1]) {
+				t.Fatalf("seed %d diverged from the model after %v", seed, history)
+			}
+		}
+		r.mdb.Close()
+	}
+}
+
+func TestCheckInvariants(t *testing.T) {
+	mdb := newTestMemDB(t, "TestCheckInvariants")
+	defer mdb.Close()
+
+	lockId := mdb.Put(Key("key0"), Value("value0"))
+	assert.NoError(t, mdb.checkInvariants())
+
+	// the key lock is unlocked behind the back of its holder
+	keyLock, _ := mdb.getLockByKey(Key("key0"))
+	keyLock.Unlock(Exclusive)
+	assert.Error(t, mdb.checkInvariants())
+
+	keyLock.LockOrEnqueue("", Exclusive, 0, false)
+	assert.NoError(t, mdb.checkInvariants())
+
+	// the key lock is handed over to somebody else while lockId still holds the key
+	mdb.keyStripe(Key("key0")).Lock()
+	keyLock.lockId = LockID("other")
+	mdb.keyStripe(Key("key0")).Unlock()
+	assert.Error(t, mdb.checkInvariants())
+
+	// the new holder may not have recorded its keys yet
+	mdb.lockStripe(lockId).Lock()
+	delete(mdb.lockStripe(lockId).lockId2Keys, lockId)
+	mdb.lockStripe(lockId).Unlock()
+	assert.NoError(t, mdb.checkInvariants())
+}
+
+func TestLockTransitions(t *testing.T) {
+	l := newFreeLock()
+	assert.Equal(t, lockFree, l.state())
+
+	acquired, _ := l.LockOrEnqueue("", Shared, 0, true)
+	assert.True(t, acquired)
+	assert.Equal(t, lockHeld, l.state())
+
+	_, w := l.LockOrEnqueue("", Exclusive, 0, true)
+	assert.Equal(t, lockHeldWaiters, l.state())
+
+	l.Unlock(Shared)
+	assert.Equal(t, lockHeld, l.state())
+	assert.True(t, w.granted)
+
+	l.Unlock(Exclusive)
+	assert.Equal(t, lockFree, l.state())
+	assert.NoError(t, l.check())
+
+	// a lock with waiters is never freed in a single step
+	assert.NotContains(t, lockTransitions[lockHeldWaiters], lockFree)
+	assert.NotContains(t, lockTransitions[lockFree], lockHeldWaiters)
+}
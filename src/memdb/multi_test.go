@@ -0,0 +1,208 @@
+package memdb
+
+import (
+	"context"
+	"math/rand"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetAndLockMany(t *testing.T) {
+	memDB := newTestMemDB(t, "TestDB")
+
+	assert.NoError(t, memDB.Release(memDB.Put(Key("account"), Value("100"))))
+	assert.NoError(t, memDB.Release(memDB.Put(Key("ledger"), Value("[]"))))
+	assert.NoError(t, memDB.Release(memDB.Put(Key("other"), Value("other"))))
+
+	_, _, err := memDB.GetAndLockMany(nil)
+	assert.Equal(t, ErrNoKeys, err)
+
+	// missing key, nothing stays locked
+	_, _, err = memDB.GetAndLockMany([]Key{"account", "missing"})
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	lockId, values, err := memDB.GetAndLockMany([]Key{"ledger", "account", "ledger"})
+	assert.NoError(t, err)
+	assert.Equal(t, LockID("4"), lockId)
+	assert.Equal(t, map[Key]Value{"account": "100", "ledger": "[]"}, values)
+
+	// both keys are locked by the same LockID
+	_, _, err = memDB.TryGetAndLock(Key("account"))
+	assert.IsType(t, &LockedError{}, err)
+	_, _, err = memDB.TryGetAndLock(Key("ledger"))
+	assert.IsType(t, &LockedError{}, err)
+
+	_, err = memDB.Get(lockId, Key("other"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, ErrLockIdNotFound, memDB.Update(lockId, Key("other"), Value("x"), false))
+
+	// give up a single key
+	assert.NoError(t, memDB.Update(lockId, Key("account"), Value("90"), true))
+	account, _, err := memDB.TryGetAndLock(Key("account"))
+	assert.NoError(t, err)
+	assert.NoError(t, memDB.Release(account))
+
+	assert.NoError(t, memDB.Update(lockId, Key("ledger"), Value("[10]"), false))
+	value, err := memDB.Get(lockId, Key("ledger"))
+	assert.NoError(t, err)
+	assert.Equal(t, Value("[10]"), value)
+
+	// release the rest
+	assert.NoError(t, memDB.Release(lockId))
+	assert.Equal(t, ErrLockIdNotFound, memDB.Release(lockId))
+	_, _, err = memDB.TryGetAndLock(Key("ledger"))
+	assert.NoError(t, err)
+}
+
+func TestGetAndLockManyReleaseAll(t *testing.T) {
+	memDB := newTestMemDB(t, "TestDB")
+
+	assert.NoError(t, memDB.Release(memDB.Put(Key("key0"), Value("value0"))))
+	assert.NoError(t, memDB.Release(memDB.Put(Key("key1"), Value("value1"))))
+
+	lockId, _, err := memDB.GetAndLockMany([]Key{"key0", "key1"})
+	assert.NoError(t, err)
+	assert.NoError(t, memDB.Release(lockId))
+
+	lockId2, _, _, err := memDB.GetAndLockManyWithOptions(context.Background(), []Key{"key1", "key0"}, LockOptions{Wait: NoWait})
+	assert.NoError(t, err)
+
+	// wait budget covers all keys
+	start := time.Now()
+	_, _, _, err = memDB.GetAndLockManyWithOptions(context.Background(), []Key{"key0", "key1"}, LockOptions{Wait: 50 * time.Millisecond})
+	assert.IsType(t, &LockedError{}, err)
+	assert.True(t, time.Since(start) < time.Second)
+
+	assert.NoError(t, memDB.Release(lockId2))
+}
+
+func TestGetAndLockManyNoDeadlock(t *testing.T) {
+	totalKeys := 5
+	totalClients := 20
+
+	memDB := newTestMemDB(t, "TestDB")
+	for i := 0; i < totalKeys; i++ {
+		assert.NoError(t, memDB.Release(memDB.Put(Key("key"+strconv.Itoa(i)), Value("0"))))
+	}
+
+	wga := &sync.WaitGroup{}
+	wga.Add(totalClients)
+
+	for i := 0; i < totalClients; i++ {
+		go func() {
+			// random keys in random order
+			var keys []Key
+			for _, k := range rand.Perm(totalKeys)[:2+rand.Intn(totalKeys-1)] {
+				keys = append(keys, Key("key"+strconv.Itoa(k)))
+			}
+
+			lockId, values, err := memDB.GetAndLockMany(keys)
+			assert.NoError(t, err)
+
+			time.Sleep(time.Duration(rand.Int31n(5)) * time.Millisecond)
+			for _, key := range keys {
+				n, _ := strconv.Atoi(string(values[key]))
+				assert.NoError(t, memDB.Update(lockId, key, Value(strconv.Itoa(n+1)), false))
+			}
+
+			assert.NoError(t, memDB.Release(lockId))
+			wga.Done()
+		}()
+	}
+
+	wga.Wait()
+}
+
+func TestReleaseKey(t *testing.T) {
+	memDB := newTestMemDB(t, "TestDB")
+
+	for _, key := range []Key{"key0", "key1"} {
+		assert.NoError(t, memDB.Release(memDB.Put(key, Value("value"))))
+	}
+
+	lockId, _, err := memDB.GetAndLockMany([]Key{"key0", "key1"})
+	assert.NoError(t, err)
+
+	assert.Equal(t, ErrKeyNotFound, memDB.ReleaseKey(lockId, Key("key2")))
+	assert.Equal(t, ErrLockIdNotFound, memDB.ReleaseKey(LockID("wronglock"), Key("key0")))
+
+	assert.NoError(t, memDB.ReleaseKey(lockId, Key("key0")))
+	assert.Equal(t, ErrLockIdNotFound, memDB.ReleaseKey(lockId, Key("key0")))
+	value, _ := memDB.DirectGet(Key("key0"))
+	assert.Equal(t, Value("value"), value)
+
+	_, _, err = memDB.TryGetAndLock(Key("key0"))
+	assert.NoError(t, err)
+	_, _, err = memDB.TryGetAndLock(Key("key1"))
+	assert.IsType(t, &LockedError{}, err)
+
+	// the last key invalidates lockId
+	assert.NoError(t, memDB.ReleaseKey(lockId, Key("key1")))
+	assert.Equal(t, ErrLockIdNotFound, memDB.Release(lockId))
+}
+
+func TestGetAndLockManyRegistersAcquired(t *testing.T) {
+	memDB := newTestMemDB(t, "TestDB")
+
+	assert.NoError(t, memDB.Release(memDB.Put(Key("a"), Value("a"))))
+	b := memDB.Put(Key("b"), Value("b"))
+
+	done := make(chan error)
+	go func() {
+		_, _, err := memDB.GetAndLockMany([]Key{"a", "b"})
+		done <- err
+	}()
+
+	// a is held while b is waited for, it's seen and can be broken
+	var locks []LockInfo
+	for len(locks) < 2 {
+		time.Sleep(time.Millisecond)
+		locks = memDB.Locks()
+	}
+	assert.Equal(t, Key("a"), locks[0].Key)
+	waiting := locks[0].LockID
+
+	released, err := memDB.ForceRelease(waiting)
+	assert.NoError(t, err)
+	assert.Len(t, released, 1)
+	_, _, err = memDB.TryGetAndLock(Key("a"))
+	assert.NoError(t, err)
+
+	// the broken reservation fails once b is granted, b is given back
+	assert.NoError(t, memDB.Release(b))
+	assert.Equal(t, ErrLockIdNotFound, <-done)
+	_, _, err = memDB.TryGetAndLock(Key("b"))
+	assert.NoError(t, err)
+}
+
+func TestGetAndLockManyHolderReleased(t *testing.T) {
+	memDB := newTestMemDB(t, "TestDB")
+
+	holder := memDB.Put(Key("a"), Value("a"))
+	b := memDB.Put(Key("b"), Value("b"))
+	assert.NoError(t, memDB.Release(memDB.Put(Key("c"), Value("c"))))
+
+	done := make(chan error)
+	go func() {
+		_, _, _, err := memDB.GetAndLockManyWithOptions(context.Background(), []Key{"b", "c"}, LockOptions{Holder: holder})
+		done <- err
+	}()
+	for {
+		if waiters, _ := memDB.Waiters(Key("b")); len(waiters) > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// the holder is gone by the time b is granted, b doesn't bring it back
+	assert.NoError(t, memDB.Release(holder))
+	assert.NoError(t, memDB.Release(b))
+	assert.Equal(t, ErrLockIdNotFound, <-done)
+	assert.Equal(t, ErrLockIdNotFound, memDB.Release(holder))
+	_, _, err := memDB.TryGetAndLock(Key("b"))
+	assert.NoError(t, err)
+}
@@ -0,0 +1,226 @@
+package memdb
+
+import (
+	"os"
+	"time"
+)
+
+// DefaultSyncInterval is how often the log is flushed with SyncInterval policy.
+const DefaultSyncInterval = time.Second
+
+// DefaultCompactSize is the size of the log which triggers compaction.
+const DefaultCompactSize = 64 << 20
+
+// tokenReserveBlock is how many fencing tokens are reserved in the log or the storage at once.
+const tokenReserveBlock = 1024
+
+// lockIdReserveBlock is how many LockIDs of a LockIDSequence are reserved in the log or the storage at once.
+const lockIdReserveBlock = 1024
+
+// versionReserveBlock is how many versions are reserved in the storage at once.
+const versionReserveBlock = 1024
+
+// Options configure a database opened by Open.
+type Options struct {
+	// Sync is the fsync policy of the write-ahead log
+	Sync SyncPolicy
+
+	// SyncInterval is how often the log is flushed with SyncInterval policy, zero means DefaultSyncInterval
+	SyncInterval time.Duration
+
+	// CompactSize is the size of the log which triggers compaction, zero means DefaultCompactSize
+	// and negative size turns automatic compaction off
+	CompactSize int64
+
+	// LockIDGenerator generates LockIDs, nil means NewLockIDSeqGenerator(). The LockIDs of a LockIDSequence
+	// are reserved in the log, other generators must never repeat a LockID of an earlier run by themselves
+	LockIDGenerator LockIDGenerator
+}
+
+// Open opens the database persisted in dir, dir is created if it doesn't exist.
+// Put, Update, Delete and CompareAndSwap are recorded in a write-ahead log before they're applied,
+// the log is replayed when the database is opened again. The log is compacted into a snapshot
+// from time to time, then the database is restored from the snapshot and the log written after it.
+// Locks don't survive a restart, but fencing tokens, versions and LockIDs keep growing, so a LockID
+// of a lock lost in the restart is never granted again.
+func Open(dir string, opts Options) (MemDB, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = DefaultSyncInterval
+	}
+	if opts.CompactSize == 0 {
+		opts.CompactSize = DefaultCompactSize
+	}
+	if opts.LockIDGenerator == nil {
+		opts.LockIDGenerator = NewLockIDSeqGenerator()
+	}
+
+	mdb := newMemDB(dir, opts.LockIDGenerator)
+	mdb.compactSize = opts.CompactSize
+
+	// the latest snapshot replaces all the log segments before it
+	snapshots, err := listFiles(dir, snapshotPrefix, snapshotSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	var first uint64
+	if len(snapshots) > 0 {
+		first = snapshots[len(snapshots)-1]
+		if err := loadSnapshotFile(dir, first, mdb.apply); err != nil {
+			return nil, err
+		}
+	}
+
+	wal, err := openWAL(dir, first, opts.Sync, opts.SyncInterval, mdb.apply)
+	if err != nil {
+		return nil, err
+	}
+	mdb.wal = wal
+
+	// any of the reserved tokens might have been handed out before the restart
+	mdb.lastToken = mdb.reservedTokens
+	if seq, ok := opts.LockIDGenerator.(LockIDSequence); ok {
+		seq.Skip(mdb.reservedLockIds)
+	}
+	mdb.loadMarks()
+
+	return mdb, nil
+}
+
+// apply replays a record of the log or a snapshot, it's only called before the database is used.
+func (mdb *memDB) apply(rec *record) {
+	switch rec.op {
+	case opSet:
+		// a persistent database keeps its values in the map storage, which never fails
+		mdb.storage.Set(rec.key, rec.value, rec.version)
+		if _, exists := mdb.keyLock(rec.key); !exists {
+			mdb.setKeyLock(rec.key, newFreeLock())
+		}
+		if rec.version > mdb.lastVersion {
+			mdb.lastVersion = rec.version
+		}
+	case opDelete:
+		mdb.storage.Delete(rec.key)
+		mdb.setKeyLock(rec.key, nil)
+	case opReserveTokens, opMeta:
+		if rec.token > mdb.reservedTokens {
+			mdb.reservedTokens = rec.token
+		}
+		if rec.version > mdb.lastVersion {
+			mdb.lastVersion = rec.version
+		}
+	case opReserveLockIDs:
+		if uint64(rec.version) > mdb.reservedLockIds {
+			mdb.reservedLockIds = uint64(rec.version)
+		}
+	}
+}
+
+// loadKeys creates the locks of the keys the storage has.
+// The caller must hold all stripes and mdb.mu, unless the database isn't used yet.
+func (mdb *memDB) loadKeys() error {
+	mdb.resetKeyLocks()
+	return mdb.storage.Iterate(func(key Key, version Version) bool {
+		mdb.setKeyLock(key, newFreeLock())
+		if version > mdb.lastVersion {
+			mdb.lastVersion = version
+		}
+		return true
+	})
+}
+
+// loadMarks continues the versions, the fencing tokens and the LockIDs from the high-water marks
+// of a MarkStorage. It's only called before the database is used.
+func (mdb *memDB) loadMarks() {
+	storage, ok := mdb.storage.(MarkStorage)
+	if !ok {
+		return
+	}
+
+	marks := storage.Marks()
+	if marks.Version > mdb.lastVersion {
+		mdb.lastVersion = marks.Version
+	}
+	if marks.Token > mdb.lastToken {
+		mdb.lastToken = marks.Token
+	}
+	if seq, ok := mdb.lockIdGen.(LockIDSequence); ok {
+		seq.Skip(marks.LockID)
+	}
+	mdb.storedMarks = marks
+}
+
+// storeMarks stores the high-water marks in a MarkStorage a block ahead, once the database has got past
+// the stored ones. The caller must hold mdb.mu and mustn't hand out the version, the token or the LockID
+// it has taken if storeMarks fails.
+func (mdb *memDB) storeMarks() error {
+	storage, ok := mdb.storage.(MarkStorage)
+	if !ok {
+		return nil
+	}
+
+	versionBlock := Version(versionReserveBlock)
+	if mdb.clockVersions {
+		// the clock moves the versions on by itself, a block of them must last for a while
+		versionBlock = clockVersionReserve
+	}
+
+	marks := Marks{
+		Version: mdb.lastVersion + versionBlock,
+		Token:   mdb.lastToken + tokenReserveBlock,
+		LockID:  mdb.storedMarks.LockID,
+	}
+	lockIdsStored := true
+	if seq, ok := mdb.lockIdGen.(LockIDSequence); ok {
+		// the counter is of the last LockID, the next one must be stored already
+		lockIdsStored = seq.Seq() < mdb.storedMarks.LockID
+		marks.LockID = seq.Seq() + lockIdReserveBlock
+	}
+	if mdb.lastVersion <= mdb.storedMarks.Version && mdb.lastToken <= mdb.storedMarks.Token && lockIdsStored {
+		return nil
+	}
+
+	if err := storage.SetMarks(marks); err != nil {
+		return err
+	}
+	mdb.storedMarks = marks
+	return nil
+}
+
+// writeLog appends rec to the log of a persistent database and publishes the change of a value to the replicas.
+// The caller must hold the stripe of the key, but not mdb.mu.
+func (mdb *memDB) writeLog(rec *record) error {
+	if mdb.wal != nil {
+		if err := mdb.wal.Append(rec); err != nil {
+			return err
+		}
+	}
+
+	mdb.mu.Lock()
+	defer mdb.mu.Unlock()
+	if mdb.wal != nil {
+		mdb.compactInBackground()
+	}
+
+	switch rec.op {
+	case opSet:
+		mdb.publish(Change{Op: ChangeSet, Key: rec.key, Value: rec.value, Version: rec.version})
+	case opDelete:
+		mdb.publish(Change{Op: ChangeDelete, Key: rec.key})
+	}
+	return nil
+}
+
+// appendLog appends rec, which changes no value, to the log of a persistent database.
+// The caller must hold mdb.mu.
+func (mdb *memDB) appendLog(rec *record) error {
+	if err := mdb.wal.Append(rec); err != nil {
+		return err
+	}
+	mdb.compactInBackground()
+	return nil
+}
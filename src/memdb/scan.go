@@ -0,0 +1,46 @@
+package memdb
+
+import (
+	"sort"
+	"strings"
+)
+
+// Scan returns up to limit keys starting with prefix in ascending order, beginning right after startAfter
+// (empty startAfter starts from the first key). More reports whether there are further keys to scan,
+// pass the last returned key as startAfter to get them. Zero limit means no limit.
+//
+// Like Peek, Scan doesn't wait for key locks, keys created or deleted between the calls may be missed.
+func (mdb *memDB) Scan(prefix Key, startAfter Key, limit int) (keys []Key, more bool) {
+	// every stripe keeps its keys sorted, a page is merged from the first limit+1 keys of every stripe
+	for i := range mdb.keyStripes {
+		keys = append(keys, mdb.keyStripes[i].scan(prefix, startAfter, limit)...)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i] < keys[j]
+	})
+
+	if limit > 0 && len(keys) > limit {
+		return keys[:limit], true
+	}
+	return keys, false
+}
+
+// scan returns up to limit+1 keys of the stripe starting with prefix after startAfter, zero limit means no limit.
+func (s *keyStripe) scan(prefix Key, startAfter Key, limit int) []Key {
+	s.RLock()
+	defer s.RUnlock()
+
+	i := sort.Search(len(s.keys), func(i int) bool {
+		return s.keys[i] > startAfter && s.keys[i] >= prefix
+	})
+
+	var keys []Key
+	for ; i < len(s.keys) && strings.HasPrefix(string(s.keys[i]), string(prefix)); i++ {
+		if limit > 0 && len(keys) > limit {
+			break
+		}
+		keys = append(keys, s.keys[i])
+	}
+	return keys
+}
@@ -0,0 +1,70 @@
+package memdb
+
+import (
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScan(t *testing.T) {
+	memDB := newTestMemDB(t, "TestDB")
+
+	keys, more := memDB.Scan(Key(""), Key(""), 0)
+	assert.Empty(t, keys)
+	assert.False(t, more)
+
+	for _, key := range []Key{"user/2", "order/1", "user/1", "user/10", "user/3"} {
+		memDB.Put(key, Value("value"))
+	}
+
+	keys, more = memDB.Scan(Key(""), Key(""), 0)
+	assert.Equal(t, []Key{"order/1", "user/1", "user/10", "user/2", "user/3"}, keys)
+	assert.False(t, more)
+
+	keys, more = memDB.Scan(Key("user/"), Key(""), 2)
+	assert.Equal(t, []Key{"user/1", "user/10"}, keys)
+	assert.True(t, more)
+
+	keys, more = memDB.Scan(Key("user/"), keys[len(keys)-1], 2)
+	assert.Equal(t, []Key{"user/2", "user/3"}, keys)
+	assert.False(t, more)
+
+	keys, more = memDB.Scan(Key("user/"), Key("user/3"), 2)
+	assert.Empty(t, keys)
+	assert.False(t, more)
+}
+
+func TestScanPages(t *testing.T) {
+	memDB := newTestMemDB(t, "TestDB")
+
+	var all []Key
+	for i := 0; i < 500; i++ {
+		key := Key("key" + strconv.Itoa(i))
+		lockId := memDB.Put(key, Value("value"))
+		if i%3 == 0 {
+			assert.NoError(t, memDB.Delete(lockId, key))
+		} else {
+			all = append(all, key)
+		}
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i] < all[j]
+	})
+
+	var scanned []Key
+	for startAfter, more := Key(""), true; more; {
+		var keys []Key
+		keys, more = memDB.Scan(Key("key"), startAfter, 7)
+		assert.True(t, len(keys) <= 7)
+		if len(keys) > 0 {
+			startAfter = keys[len(keys)-1]
+		}
+		scanned = append(scanned, keys...)
+	}
+	assert.Equal(t, all, scanned)
+
+	keys, _ := memDB.Scan(Key("key49"), Key(""), 0)
+	assert.Equal(t, []Key{"key49", "key490", "key491", "key493", "key494", "key496", "key497", "key499"}, keys)
+}
@@ -0,0 +1,455 @@
+package memdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+var (
+	ErrCorruptSnapshot     = errors.New("Corrupt snapshot")
+	ErrUnsupportedSnapshot = errors.New("Unsupported snapshot format version")
+	ErrNotPersistent       = errors.New("Database is not persistent")
+	ErrLocksHeld           = errors.New("Locks are held")
+)
+
+// SnapshotFormatVersion is the version of the snapshot format written by Snapshot.
+const SnapshotFormatVersion = 1
+
+// snapshotMagic starts every snapshot, it's followed by the format version.
+const snapshotMagic = "MEMDBSNP"
+
+const (
+	snapshotPrefix = "snapshot-"
+	snapshotSuffix = ".snap"
+)
+
+// snapshotState is a consistent image of the database to be written as a snapshot, either a copy of its values
+// or its storage, which mustn't change until the snapshot is written.
+type snapshotState struct {
+	items       map[Key]item
+	storage     Storage
+	lastVersion Version
+	lastToken   FencingToken
+	lockIds     uint64
+}
+
+// stateMarks returns the image of the database without any values. The caller must hold mdb.mu.
+func (mdb *memDB) stateMarks() *snapshotState {
+	state := &snapshotState{
+		lastVersion: mdb.lastVersion,
+		lastToken:   mdb.lastToken,
+		lockIds:     mdb.reservedLockIds,
+	}
+	if mdb.reservedTokens > state.lastToken {
+		state.lastToken = mdb.reservedTokens
+	}
+	return state
+}
+
+// copyState copies the values of the database, locks are not part of the copy.
+// The caller must hold all stripes and mdb.mu.
+func (mdb *memDB) copyState() (*snapshotState, error) {
+	state := mdb.stateMarks()
+	state.items = make(map[Key]item)
+
+	var err error
+	iterErr := mdb.storage.Iterate(func(key Key, version Version) bool {
+		var value Value
+		if value, _, err = mdb.storage.Get(key); err != nil {
+			return false
+		}
+		state.items[key] = item{value: value, version: version}
+		return true
+	})
+	if err == nil {
+		err = iterErr
+	}
+	return state, err
+}
+
+// Snapshot writes a consistent image of the values in the database to w. The values of the map storage are
+// copied, the database is only locked while they're copied. The values of other storages, which may not fit
+// into memory, are read from the storage as the image is written, writes wait until it's written.
+// The image is checksummed, a damaged one is refused when it's read back.
+func (mdb *memDB) Snapshot(w io.Writer) error {
+	mdb.rlockAll()
+	mdb.mu.Lock()
+
+	if _, inMemory := mdb.storage.(*mapStorage); !inMemory {
+		state := mdb.stateMarks()
+		state.storage = mdb.storage
+		mdb.mu.Unlock()
+		defer mdb.runlockAll()
+		return state.write(w)
+	}
+
+	state, err := mdb.copyState()
+	mdb.mu.Unlock()
+	mdb.runlockAll()
+	if err != nil {
+		return err
+	}
+
+	return state.write(w)
+}
+
+// keys returns the keys of the image in order.
+func (state *snapshotState) keys() ([]Key, error) {
+	var keys []Key
+	if state.storage != nil {
+		if err := state.storage.Iterate(func(key Key, version Version) bool {
+			keys = append(keys, key)
+			return true
+		}); err != nil {
+			return nil, err
+		}
+	} else {
+		keys = make([]Key, 0, len(state.items))
+		for key := range state.items {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i] < keys[j]
+	})
+	return keys, nil
+}
+
+// write writes the header, a meta record, the LockIDs reserved by a persistent database, a record per value
+// in key order and an end record with the number of values. crc32 of all of it comes last.
+func (state *snapshotState) write(w io.Writer) error {
+	keys, err := state.keys()
+	if err != nil {
+		return err
+	}
+
+	hash := crc32.NewIEEE()
+	bw := bufio.NewWriter(io.MultiWriter(w, hash))
+
+	header := make([]byte, len(snapshotMagic)+4)
+	copy(header, snapshotMagic)
+	binary.LittleEndian.PutUint32(header[len(snapshotMagic):], SnapshotFormatVersion)
+	bw.Write(header)
+
+	meta := &record{op: opMeta, version: state.lastVersion, token: state.lastToken}
+	bw.Write(meta.encode())
+	if state.lockIds > 0 {
+		reserve := &record{op: opReserveLockIDs, version: Version(state.lockIds)}
+		bw.Write(reserve.encode())
+	}
+
+	for _, key := range keys {
+		rec := &record{op: opSet, key: key}
+		if state.storage != nil {
+			if rec.value, rec.version, err = state.storage.Get(key); err != nil {
+				return err
+			}
+		} else {
+			rec.value, rec.version = state.items[key].value, state.items[key].version
+		}
+		if _, err := bw.Write(rec.encode()); err != nil {
+			return err
+		}
+	}
+
+	end := &record{op: opEnd, version: Version(len(keys))}
+	bw.Write(end.encode())
+
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.LittleEndian, hash.Sum32())
+}
+
+// readSnapshot verifies the snapshot read from r and passes its records to apply.
+// apply may see some records of a damaged snapshot before it's refused.
+func readSnapshot(r io.Reader, apply func(*record)) error {
+	hash := crc32.NewIEEE()
+	br := bufio.NewReader(r)
+	reader := io.TeeReader(br, hash)
+
+	header := make([]byte, len(snapshotMagic)+4)
+	if _, err := io.ReadFull(reader, header); err != nil || string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return ErrCorruptSnapshot
+	}
+	if binary.LittleEndian.Uint32(header[len(snapshotMagic):]) != SnapshotFormatVersion {
+		return ErrUnsupportedSnapshot
+	}
+
+	var count Version
+	for {
+		rec, _, err := readRecord(reader)
+		if err != nil {
+			return ErrCorruptSnapshot
+		}
+
+		if rec.op == opEnd {
+			if rec.version != count {
+				return ErrCorruptSnapshot
+			}
+			break
+		} else if rec.op == opSet {
+			count++
+		} else if rec.op != opMeta && rec.op != opReserveLockIDs {
+			return ErrCorruptSnapshot
+		}
+
+		apply(rec)
+	}
+
+	var checksum uint32
+	if err := binary.Read(br, binary.LittleEndian, &checksum); err != nil || checksum != hash.Sum32() {
+		return ErrCorruptSnapshot
+	}
+	return nil
+}
+
+// Restore replaces all values of the database with the snapshot read from r, the snapshot is verified
+// before anything is replaced. Restored values get new versions, fencing tokens keep growing.
+// Restore fails with ErrLocksHeld if any key is locked, unless it's forced: then all locks are broken,
+// their LockIDs are invalidated and the clients waiting for the keys fail with ErrKeyNotFound.
+// A persistent database starts its log over from the restored snapshot. The values are written
+// to the storage one by one, a storage failure may leave only some of them restored.
+func (mdb *memDB) Restore(r io.Reader, force bool) error {
+	defer mdb.debugCheck()
+
+	state := &snapshotState{items: make(map[Key]item)}
+	err := readSnapshot(r, func(rec *record) {
+		if rec.op == opSet {
+			state.items[rec.key] = item{value: rec.value}
+		} else if rec.op == opMeta {
+			state.lastToken = rec.token
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if mdb.wal != nil {
+		mdb.compactMu.Lock()
+		defer mdb.compactMu.Unlock()
+	}
+
+	mdb.lockAll()
+	defer mdb.unlockAll()
+	mdb.mu.Lock()
+	defer mdb.mu.Unlock()
+
+	if !force {
+		for i := range mdb.keyStripes {
+			for _, keyLock := range mdb.keyStripes[i].key2Lock {
+				if keyLock.Locked() {
+					return ErrLocksHeld
+				}
+			}
+		}
+	}
+
+	keys := make([]Key, 0, len(state.items))
+	for key := range state.items {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i] < keys[j]
+	})
+
+	// versions of this database must not be reused for different values
+	for _, key := range keys {
+		mdb.lastVersion++
+		state.items[key] = item{value: state.items[key].value, version: mdb.lastVersion}
+	}
+	state.lastVersion = mdb.lastVersion
+
+	if mdb.lastToken > state.lastToken {
+		state.lastToken = mdb.lastToken
+	}
+	if mdb.reservedTokens > state.lastToken {
+		state.lastToken = mdb.reservedTokens
+	}
+	state.lockIds = mdb.reservedLockIds
+
+	// the marks are raised before anything is replaced
+	mdb.lastToken = state.lastToken
+	if err := mdb.storeMarks(); err != nil {
+		return err
+	}
+
+	var segment uint64
+	if mdb.wal != nil {
+		if segment, err = mdb.wal.Rotate(); err != nil {
+			return err
+		}
+		if err := writeSnapshotFile(mdb.wal.dir, segment, state); err != nil {
+			return err
+		}
+		mdb.reservedTokens = state.lastToken
+	}
+	mdb.resetChanges()
+
+	// waiters for the old keys find their locks deleted
+	for i := range mdb.keyStripes {
+		for _, keyLock := range mdb.keyStripes[i].key2Lock {
+			keyLock.deleted = true
+		}
+	}
+	for i := range mdb.lockStripes {
+		for lockId := range mdb.lockStripes[i].lockId2Keys {
+			mdb.releaseLock(lockId)
+		}
+	}
+
+	if mdb.wal != nil {
+		// leftovers are removed by the next compaction
+		removeBefore(mdb.wal.dir, segment)
+	}
+
+	for i := 0; i < len(mdb.keyStripes) && err == nil; i++ {
+		for key := range mdb.keyStripes[i].key2Lock {
+			if _, exists := state.items[key]; !exists {
+				if err = mdb.storage.Delete(key); err != nil {
+					break
+				}
+			}
+		}
+	}
+	if err == nil {
+		for _, key := range keys {
+			if err = mdb.storage.Set(key, state.items[key].value, state.items[key].version); err != nil {
+				break
+			}
+		}
+	}
+
+	// the locks must match the keys the storage has, whatever has been restored
+	if loadErr := mdb.loadKeys(); err == nil {
+		err = loadErr
+	}
+	return err
+}
+
+func snapshotPath(dir string, segment uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%016d%s", snapshotPrefix, segment, snapshotSuffix))
+}
+
+// writeSnapshotFile atomically writes the snapshot which precedes log segment.
+func writeSnapshotFile(dir string, segment uint64, state *snapshotState) error {
+	path := snapshotPath(dir, segment)
+	tmpPath := path + ".tmp"
+
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	err = state.write(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// loadSnapshotFile passes the records of the snapshot which precedes log segment to apply.
+func loadSnapshotFile(dir string, segment uint64, apply func(*record)) error {
+	file, err := os.Open(snapshotPath(dir, segment))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := readSnapshot(file, apply); err != nil {
+		return fmt.Errorf("Snapshot %d: %v", segment, err)
+	}
+	return nil
+}
+
+// removeBefore removes the snapshots and log segments replaced by the snapshot which precedes log segment.
+func removeBefore(dir string, segment uint64) error {
+	for _, kind := range [][2]string{{snapshotPrefix, snapshotSuffix}, {walPrefix, walSuffix}} {
+		numbers, err := listFiles(dir, kind[0], kind[1])
+		if err != nil {
+			return err
+		}
+
+		for _, number := range numbers {
+			if number >= segment {
+				break
+			}
+			if err := os.Remove(filepath.Join(dir, fmt.Sprintf("%s%016d%s", kind[0], number, kind[1]))); err != nil {
+				return err
+			}
+		}
+	}
+	return syncDir(dir)
+}
+
+// Compact writes a snapshot of a persistent database and removes the log it replaces,
+// the database is restored from the snapshot and the rest of the log when it's opened again.
+// It's done automatically when the log grows over Options.CompactSize.
+func (mdb *memDB) Compact() error {
+	if mdb.wal == nil {
+		return ErrNotPersistent
+	}
+
+	mdb.compactMu.Lock()
+	defer mdb.compactMu.Unlock()
+
+	// the copy and the new log segment must start at the same write, the values are written under
+	// the stripe locks and the token reservations under mdb.mu
+	mdb.rlockAll()
+	mdb.mu.Lock()
+	state, err := mdb.copyState()
+	var segment uint64
+	if err == nil {
+		segment, err = mdb.wal.Rotate()
+	}
+	mdb.mu.Unlock()
+	mdb.runlockAll()
+	if err != nil {
+		return err
+	}
+
+	if err := writeSnapshotFile(mdb.wal.dir, segment, state); err != nil {
+		return err
+	}
+	return removeBefore(mdb.wal.dir, segment)
+}
+
+// compactInBackground starts Compact if the log has grown over the limit.
+// The caller must hold mdb.mu.
+func (mdb *memDB) compactInBackground() {
+	if mdb.compactSize <= 0 || mdb.compacting || mdb.closing || mdb.wal.Size() < mdb.compactSize {
+		return
+	}
+
+	mdb.compacting = true
+	mdb.compactions.Add(1)
+	go func() {
+		defer mdb.compactions.Done()
+
+		// a failed compaction keeps the log as it is, it's tried again after the next write
+		mdb.Compact()
+
+		mdb.mu.Lock()
+		mdb.compacting = false
+		mdb.mu.Unlock()
+	}()
+}
@@ -0,0 +1,189 @@
+package memdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// storedItems returns the values of the storage and their versions.
+func storedItems(t *testing.T, storage Storage) map[Key]item {
+	items := make(map[Key]item)
+	assert.NoError(t, storage.Iterate(func(key Key, version Version) bool {
+		value, _, err := storage.Get(key)
+		assert.NoError(t, err)
+		items[key] = item{value: value, version: version}
+		return true
+	}))
+	return items
+}
+
+func TestSnapshot(t *testing.T) {
+	mdb := newTestMemDB(t, "TestDB")
+	var memDB MemDB = mdb
+
+	lockId := memDB.Put(Key("key1"), Value("value1"))
+	assert.NoError(t, memDB.Update(lockId, Key("key1"), Value("value11"), false))
+	memDB.Put(Key("key0"), Value("value0"))
+
+	snapshot := &bytes.Buffer{}
+	assert.NoError(t, memDB.Snapshot(snapshot))
+
+	restored := newTestMemDB(t, "RestoredDB")
+	assert.NoError(t, readSnapshot(bytes.NewReader(snapshot.Bytes()), restored.apply))
+	assert.Equal(t, storedItems(t, mdb.storage), storedItems(t, restored.storage))
+	assert.Equal(t, Version(3), restored.lastVersion)
+	assert.Equal(t, FencingToken(2), restored.reservedTokens)
+
+	// restored keys aren't locked
+	_, _, reserved, err := restored.Peek(Key("key1"))
+	assert.NoError(t, err)
+	assert.False(t, reserved)
+}
+
+func TestSnapshotCorrupt(t *testing.T) {
+	memDB := newTestMemDB(t, "TestDB")
+	memDB.Put(Key("key0"), Value("value0"))
+	memDB.Put(Key("key1"), Value("value1"))
+
+	snapshot := &bytes.Buffer{}
+	assert.NoError(t, memDB.Snapshot(snapshot))
+	image := snapshot.Bytes()
+
+	nop := func(*record) {}
+	for i := range image {
+		damaged := append([]byte(nil), image...)
+		damaged[i] ^= 0xff
+		assert.Error(t, readSnapshot(bytes.NewReader(damaged), nop), "byte %d", i)
+	}
+
+	for _, size := range []int{0, 4, len(image) / 2, len(image) - 1} {
+		assert.Equal(t, ErrCorruptSnapshot, readSnapshot(bytes.NewReader(image[:size]), nop), "size %d", size)
+	}
+
+	future := append([]byte(nil), image...)
+	binary.LittleEndian.PutUint32(future[len(snapshotMagic):], SnapshotFormatVersion+1)
+	assert.Equal(t, ErrUnsupportedSnapshot, readSnapshot(bytes.NewReader(future), nop))
+}
+
+func TestCompact(t *testing.T) {
+	dir := t.TempDir()
+
+	assert.Equal(t, ErrNotPersistent, newTestMemDB(t, "TestDB").Compact())
+
+	memDB, err := Open(dir, Options{CompactSize: -1})
+	assert.NoError(t, err)
+
+	lockId := memDB.Put(Key("key0"), Value("value0"))
+	memDB.Put(Key("key1"), Value("value1"))
+	assert.NoError(t, memDB.Compact())
+
+	assert.NoError(t, memDB.Update(lockId, Key("key0"), Value("value00"), true))
+	memDB.Put(Key("key2"), Value("value2"))
+	assert.NoError(t, memDB.Compact())
+	memDB.Put(Key("key3"), Value("value3"))
+	assert.NoError(t, memDB.Close())
+
+	// only the last snapshot and the log after it are kept
+	snapshots, _ := listFiles(dir, snapshotPrefix, snapshotSuffix)
+	assert.Equal(t, []uint64{2}, snapshots)
+	segments, _ := listFiles(dir, walPrefix, walSuffix)
+	assert.Equal(t, []uint64{2}, segments)
+
+	memDB, err = Open(dir, Options{})
+	assert.NoError(t, err)
+	defer memDB.Close()
+
+	for key, value := range map[Key]Value{"key0": "value00", "key1": "value1", "key2": "value2", "key3": "value3"} {
+		v, _, reserved, err := memDB.Peek(key)
+		assert.NoError(t, err)
+		assert.Equal(t, value, v)
+		assert.False(t, reserved)
+	}
+}
+
+func TestCompactAutomatically(t *testing.T) {
+	dir := t.TempDir()
+
+	memDB, err := Open(dir, Options{Sync: SyncNever, CompactSize: 1024})
+	assert.NoError(t, err)
+
+	for i := 0; i < 200; i++ {
+		key := Key(fmt.Sprintf("key%d", i%20))
+		lockId := memDB.Put(key, Value(fmt.Sprintf("value%d", i)))
+		assert.NoError(t, memDB.Release(lockId))
+	}
+	assert.NoError(t, memDB.Close())
+
+	snapshots, _ := listFiles(dir, snapshotPrefix, snapshotSuffix)
+	assert.Equal(t, 1, len(snapshots))
+
+	memDB, err = Open(dir, Options{Sync: SyncNever, CompactSize: 1024})
+	assert.NoError(t, err)
+	defer memDB.Close()
+
+	keys, _ := memDB.Scan(Key(""), Key(""), 0)
+	assert.Equal(t, 20, len(keys))
+	for i := 180; i < 200; i++ {
+		value, _, _, err := memDB.Peek(Key(fmt.Sprintf("key%d", i%20)))
+		assert.NoError(t, err)
+		assert.Equal(t, Value(fmt.Sprintf("value%d", i)), value)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	source := newTestMemDB(t, "TestDB")
+	source.Put(Key("key0"), Value("value0"))
+	source.Put(Key("key1"), Value("value1"))
+	var backup bytes.Buffer
+	assert.NoError(t, source.Snapshot(&backup))
+
+	dir := t.TempDir()
+	memDB, err := Open(dir, Options{CompactSize: -1})
+	assert.NoError(t, err)
+
+	lockId, token, _ := memDB.PutWithOptions(context.Background(), Key("key0"), Value("old"), LockOptions{})
+	memDB.Put(Key("key2"), Value("value2"))
+	_, version, _, _ := memDB.Peek(Key("key2"))
+
+	// damaged snapshots are refused before anything is replaced
+	damaged := append([]byte{}, backup.Bytes()...)
+	damaged[len(damaged)/2] ^= 0xff
+	assert.Equal(t, ErrCorruptSnapshot, memDB.Restore(bytes.NewReader(damaged), true))
+
+	assert.Equal(t, ErrLocksHeld, memDB.Restore(bytes.NewReader(backup.Bytes()), false))
+	v, _, reserved, _ := memDB.Peek(Key("key0"))
+	assert.Equal(t, Value("old"), v)
+	assert.True(t, reserved)
+
+	assert.NoError(t, memDB.Restore(bytes.NewReader(backup.Bytes()), true))
+
+	// the lock is broken
+	assert.Equal(t, ErrLockIdNotFound, memDB.Update(lockId, Key("key0"), Value("new"), true))
+	_, _, _, err = memDB.Peek(Key("key2"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// versions and fencing tokens keep growing
+	v, restoredVersion, reserved, _ := memDB.Peek(Key("key0"))
+	assert.Equal(t, Value("value0"), v)
+	assert.False(t, reserved)
+	assert.True(t, restoredVersion > version)
+	_, _, newToken, _ := memDB.GetAndLockWithOptions(context.Background(), Key("key1"), LockOptions{})
+	assert.True(t, newToken > token)
+	assert.NoError(t, memDB.Close())
+
+	// the restored values are persistent
+	memDB, err = Open(dir, Options{})
+	assert.NoError(t, err)
+	defer memDB.Close()
+
+	v, _, _, err = memDB.Peek(Key("key1"))
+	assert.NoError(t, err)
+	assert.Equal(t, Value("value1"), v)
+	_, _, _, err = memDB.Peek(Key("key2"))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
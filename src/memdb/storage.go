@@ -0,0 +1,119 @@
+package memdb
+
+import (
+	"sync"
+)
+
+// Storage keeps the values of a database and their versions, the database keeps its locks on top of it.
+// A storage must be safe for concurrent use: the database calls Get, Set and Delete of different keys
+// concurrently, but never writes a key concurrently with any other call for the same key.
+// Iterate is called only while no key is written. The database closes a storage which is an io.Closer
+// when it's closed.
+type Storage interface {
+	// Get returns the value of the key and its version, or ErrKeyNotFound
+	Get(key Key) (Value, Version, error)
+
+	// Set stores the value of the key with its version
+	Set(key Key, value Value, version Version) error
+
+	// Delete removes the key, a missing key is not an error
+	Delete(key Key) error
+
+	// Iterate calls fn for every key and the version of its value in no particular order, until fn returns false
+	Iterate(fn func(key Key, version Version) bool) error
+}
+
+// Marks are the high-water marks of a database: no version, fencing token or LockID counter
+// of a LockIDSequence above them has been handed out.
+type Marks struct {
+	Version Version
+	Token   FencingToken
+	LockID  uint64
+}
+
+// MarkStorage is a persistent Storage which keeps the high-water marks of the database too,
+// so the database created on it again never hands out a version, a fencing token or a LockID twice.
+type MarkStorage interface {
+	Storage
+
+	// SetMarks stores the marks, they must be on the disk when SetMarks returns
+	SetMarks(marks Marks) error
+
+	// Marks returns the marks stored last, zeros if there are none
+	Marks() Marks
+}
+
+// mapStorage keeps everything in memory, it's the default storage of a database.
+// Its keys are spread over stripes like the keys of the database, so the writes of different keys
+// rarely wait for each other.
+type mapStorage struct {
+	stripes [stripeCount]mapStripe
+}
+
+type mapStripe struct {
+	sync.RWMutex
+	items map[Key]item
+}
+
+// NewMapStorage returns an empty in-memory storage.
+func NewMapStorage() Storage {
+	s := &mapStorage{}
+	for i := range s.stripes {
+		s.stripes[i].items = make(map[Key]item)
+	}
+	return s
+}
+
+func (s *mapStorage) stripe(key Key) *mapStripe {
+	return &s.stripes[stripeOf(string(key))]
+}
+
+func (s *mapStorage) Get(key Key) (Value, Version, error) {
+	stripe := s.stripe(key)
+	stripe.RLock()
+	defer stripe.RUnlock()
+
+	item, exists := stripe.items[key]
+	if !exists {
+		return EmptyValue, 0, ErrKeyNotFound
+	}
+	return item.value, item.version, nil
+}
+
+func (s *mapStorage) Set(key Key, value Value, version Version) error {
+	stripe := s.stripe(key)
+	stripe.Lock()
+	defer stripe.Unlock()
+
+	stripe.items[key] = item{value: value, version: version}
+	return nil
+}
+
+func (s *mapStorage) Delete(key Key) error {
+	stripe := s.stripe(key)
+	stripe.Lock()
+	defer stripe.Unlock()
+
+	delete(stripe.items, key)
+	return nil
+}
+
+func (s *mapStorage) Iterate(fn func(key Key, version Version) bool) error {
+	for i := range s.stripes {
+		// fn may call Get, so it's called after the stripe is unlocked
+		stripe := &s.stripes[i]
+		stripe.RLock()
+		versions := make(map[Key]Version, len(stripe.items))
+		for key, item := range stripe.items {
+			versions[key] = item.version
+		}
+		stripe.RUnlock()
+
+		for key, version := range versions {
+			if !fn(key, version) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
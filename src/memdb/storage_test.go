@@ -0,0 +1,358 @@
+package memdb
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testStorage is the storage the databases of the tests are created on, see newTestMemDB.
+var testStorage = "map"
+
+// TestMain runs the tests with the map storage first, then with the disk storage.
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if code == 0 {
+		testStorage = "disk"
+		code = m.Run()
+	}
+	os.Exit(code)
+}
+
+// newTestMemDB creates a database on the storage the tests run with, it's closed when the test ends.
+func newTestMemDB(t testing.TB, name string) *memDB {
+	storage := NewMapStorage()
+	if testStorage == "disk" {
+		var err error
+		if storage, err = OpenDiskStorage(filepath.Join(t.TempDir(), "data"), DiskOptions{Sync: SyncNever}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mdb := NewMemDB(name, NewLockIDSeqGenerator(), storage)
+	t.Cleanup(func() {
+		mdb.Close()
+	})
+	return mdb.(*memDB)
+}
+
+// storages runs the test for every Storage implementation.
+func storages(t *testing.T, test func(t *testing.T, newStorage func() Storage)) {
+	t.Run("map", func(t *testing.T) {
+		test(t, NewMapStorage)
+	})
+	t.Run("disk", func(t *testing.T) {
+		dir := t.TempDir()
+		test(t, func() Storage {
+			storage, err := OpenDiskStorage(filepath.Join(dir, "data"), DiskOptions{})
+			assert.NoError(t, err)
+			return storage
+		})
+	})
+}
+
+func TestStorage(t *testing.T) {
+	storages(t, func(t *testing.T, newStorage func() Storage) {
+		storage := newStorage()
+		if closer, ok := storage.(io.Closer); ok {
+			defer closer.Close()
+		}
+
+		_, _, err := storage.Get(Key("key0"))
+		assert.Equal(t, ErrKeyNotFound, err)
+		assert.NoError(t, storage.Delete(Key("key0")))
+
+		assert.NoError(t, storage.Set(Key("key0"), Value("value0"), 1))
+		assert.NoError(t, storage.Set(Key("key1"), Value("value1"), 2))
+		assert.NoError(t, storage.Set(Key("key0"), Value("value00"), 3))
+		assert.NoError(t, storage.Set(Key("key2"), EmptyValue, 4))
+
+		value, version, err := storage.Get(Key("key0"))
+		assert.NoError(t, err)
+		assert.Equal(t, Value("value00"), value)
+		assert.Equal(t, Version(3), version)
+
+		value, version, err = storage.Get(Key("key2"))
+		assert.NoError(t, err)
+		assert.Equal(t, EmptyValue, value)
+		assert.Equal(t, Version(4), version)
+
+		assert.NoError(t, storage.Delete(Key("key1")))
+		_, _, err = storage.Get(Key("key1"))
+		assert.Equal(t, ErrKeyNotFound, err)
+
+		versions := make(map[Key]Version)
+		assert.NoError(t, storage.Iterate(func(key Key, version Version) bool {
+			versions[key] = version
+			return true
+		}))
+		assert.Equal(t, map[Key]Version{"key0": 3, "key2": 4}, versions)
+
+		calls := 0
+		assert.NoError(t, storage.Iterate(func(key Key, version Version) bool {
+			calls++
+			return false
+		}))
+		assert.Equal(t, 1, calls)
+	})
+}
+
+func TestMemDBWithStorageMarks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data")
+	open := func() MemDB {
+		storage, err := OpenDiskStorage(path, DiskOptions{})
+		assert.NoError(t, err)
+		return NewMemDB("TestDB", NewLockIDSeqGenerator(), storage)
+	}
+
+	memDB := open()
+	lockId, token, err := memDB.PutWithOptions(context.Background(), Key("key0"), Value("value0"), LockOptions{})
+	assert.NoError(t, err)
+	staleId := memDB.Put(Key("key1"), Value("value1"))
+	_, version, _, err := memDB.Peek(Key("key0"))
+	assert.NoError(t, err)
+	assert.NoError(t, memDB.Delete(lockId, Key("key0")))
+	assert.NoError(t, memDB.Close())
+
+	// neither the version of the deleted key nor the token nor the LockIDs come back
+	memDB = open()
+	defer memDB.Close()
+	lockId, token2, err := memDB.PutWithOptions(context.Background(), Key("key0"), Value("value1"), LockOptions{})
+	assert.NoError(t, err)
+	assert.True(t, token2 > token)
+	assert.NotEqual(t, staleId, lockId)
+	_, _, err = memDB.GetAndLock(Key("key1"))
+	assert.NoError(t, err)
+	assert.Equal(t, ErrLockIdNotFound, memDB.Update(staleId, Key("key1"), Value("stale"), false))
+	_, version2, _, err := memDB.Peek(Key("key0"))
+	assert.NoError(t, err)
+	assert.True(t, version2 > version)
+
+	_, err = memDB.CompareAndSwap(Key("key0"), version, Value("value2"))
+	assert.Error(t, err)
+}
+
+func TestMemDBWithStorage(t *testing.T) {
+	storages(t, func(t *testing.T, newStorage func() Storage) {
+		memDB := NewMemDB("TestDB", NewLockIDSeqGenerator(), newStorage())
+
+		lockId0 := memDB.Put(Key("key0"), Value("value0"))
+		assert.NoError(t, memDB.Update(lockId0, Key("key0"), Value("value00"), true))
+		lockId1 := memDB.Put(Key("key1"), Value("value1"))
+		assert.NoError(t, memDB.Delete(lockId1, Key("key1")))
+		assert.NoError(t, memDB.Release(memDB.Put(Key("key2"), Value("value2"))))
+
+		lockId, value, err := memDB.TryGetAndLock(Key("key0"))
+		assert.NoError(t, err)
+		assert.Equal(t, Value("value00"), value)
+		assert.NoError(t, memDB.Release(lockId))
+
+		keys, more := memDB.Scan(Key("key"), Key(""), 0)
+		assert.Equal(t, []Key{"key0", "key2"}, keys)
+		assert.False(t, more)
+
+		_, version, _, err := memDB.Peek(Key("key2"))
+		assert.NoError(t, err)
+		_, err = memDB.CompareAndSwap(Key("key2"), version, Value("value22"))
+		assert.NoError(t, err)
+		assert.NoError(t, memDB.Close())
+
+		// a memory storage starts empty, a disk storage keeps the values
+		memDB = NewMemDB("TestDB", NewLockIDSeqGenerator(), newStorage())
+		defer memDB.Close()
+
+		keys, _ = memDB.Scan(Key(""), Key(""), 0)
+		if len(keys) == 0 {
+			return
+		}
+		assert.Equal(t, []Key{"key0", "key2"}, keys)
+
+		lockId, value, err = memDB.TryGetAndLock(Key("key2"))
+		assert.NoError(t, err)
+		assert.Equal(t, Value("value22"), value)
+
+		// versions keep growing
+		_, newVersion, err := memDB.GetWithVersion(lockId, Key("key2"))
+		assert.NoError(t, err)
+		assert.NoError(t, memDB.Update(lockId, Key("key2"), Value("value222"), false))
+		_, newerVersion, err := memDB.GetWithVersion(lockId, Key("key2"))
+		assert.NoError(t, err)
+		assert.True(t, newerVersion > newVersion)
+	})
+}
+
+func TestDiskStorageTornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data")
+
+	storage, err := OpenDiskStorage(path, DiskOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, storage.Set(Key("key0"), Value("value0"), 1))
+	assert.NoError(t, storage.Set(Key("key1"), Value("value1"), 2))
+	assert.NoError(t, storage.Close())
+
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.NoError(t, os.Truncate(path, info.Size()-1))
+
+	storage, err = OpenDiskStorage(path, DiskOptions{})
+	assert.NoError(t, err)
+	defer storage.Close()
+
+	value, _, err := storage.Get(Key("key0"))
+	assert.NoError(t, err)
+	assert.Equal(t, Value("value0"), value)
+	_, _, err = storage.Get(Key("key1"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// the torn record is overwritten
+	assert.NoError(t, storage.Set(Key("key2"), Value("value2"), 3))
+	value, _, err = storage.Get(Key("key2"))
+	assert.NoError(t, err)
+	assert.Equal(t, Value("value2"), value)
+}
+
+func TestDiskStorageCorruptRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data")
+
+	storage, err := OpenDiskStorage(path, DiskOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, storage.Set(Key("key0"), Value("value0"), 1))
+	assert.NoError(t, storage.Set(Key("key1"), Value("value1"), 2))
+	assert.NoError(t, storage.Set(Key("key2"), Value("value2"), 3))
+	assert.NoError(t, storage.Close())
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	size := len(data) / 3
+
+	// a damaged record in the middle fails the open, nothing is cut off
+	damaged := append([]byte(nil), data...)
+	damaged[size+size/2] ^= 0xff
+	assert.NoError(t, os.WriteFile(path, damaged, 0644))
+	_, err = OpenDiskStorage(path, DiskOptions{})
+	assert.Error(t, err)
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(data)), info.Size())
+
+	// a damaged last record is cut off like a torn one
+	damaged = append([]byte(nil), data...)
+	damaged[len(data)-1] ^= 0xff
+	assert.NoError(t, os.WriteFile(path, damaged, 0644))
+	storage, err = OpenDiskStorage(path, DiskOptions{})
+	assert.NoError(t, err)
+	defer storage.Close()
+
+	value, _, err := storage.Get(Key("key1"))
+	assert.NoError(t, err)
+	assert.Equal(t, Value("value1"), value)
+	_, _, err = storage.Get(Key("key2"))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestDiskStorageCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data")
+
+	storage, err := OpenDiskStorage(path, DiskOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, Marks{}, storage.Marks())
+	assert.NoError(t, storage.SetMarks(Marks{Version: 1, Token: 2, LockID: 3}))
+	assert.NoError(t, storage.SetMarks(Marks{Version: 1000, Token: 2000, LockID: 3000}))
+
+	big := Value(strings.Repeat("x", 64<<10))
+	for i := 0; i < 4*diskCompactGarbage/len(big); i++ {
+		assert.NoError(t, storage.Set(Key("key0"), big, Version(i+1)))
+	}
+	assert.NoError(t, storage.Set(Key("key1"), Value("value1"), 1000))
+
+	// the replaced values don't pile up
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.True(t, info.Size() < 2*diskCompactGarbage)
+	assert.NoError(t, storage.Close())
+
+	storage, err = OpenDiskStorage(path, DiskOptions{})
+	assert.NoError(t, err)
+	defer storage.Close()
+
+	var keys []Key
+	storage.Iterate(func(key Key, version Version) bool {
+		keys = append(keys, key)
+		return true
+	})
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i] < keys[j]
+	})
+	assert.Equal(t, []Key{"key0", "key1"}, keys)
+
+	value, version, err := storage.Get(Key("key0"))
+	assert.NoError(t, err)
+	assert.Equal(t, big, value)
+	assert.Equal(t, Version(4*diskCompactGarbage/len(big)), version)
+
+	// the marks survive the compaction
+	assert.Equal(t, Marks{Version: 1000, Token: 2000, LockID: 3000}, storage.Marks())
+}
+
+func TestDiskStorageSyncPolicies(t *testing.T) {
+	for _, policy := range []SyncPolicy{SyncAlways, SyncInterval, SyncNever} {
+		t.Run(policy.String(), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "data")
+
+			storage, err := OpenDiskStorage(path, DiskOptions{Sync: policy, SyncInterval: time.Millisecond})
+			assert.NoError(t, err)
+			assert.NoError(t, storage.Set(Key("key0"), Value("value0"), 1))
+			assert.NoError(t, storage.Delete(Key("key0")))
+			assert.NoError(t, storage.Set(Key("key1"), Value("value1"), 2))
+			time.Sleep(5 * time.Millisecond)
+			assert.NoError(t, storage.Close())
+
+			storage, err = OpenDiskStorage(path, DiskOptions{Sync: policy})
+			assert.NoError(t, err)
+			defer storage.Close()
+
+			_, _, err = storage.Get(Key("key0"))
+			assert.Equal(t, ErrKeyNotFound, err)
+			value, _, err := storage.Get(Key("key1"))
+			assert.NoError(t, err)
+			assert.Equal(t, Value("value1"), value)
+		})
+	}
+}
+
+// countingStorage counts the marks stored in the storage it wraps.
+type countingStorage struct {
+	DiskStorage
+	setMarks int
+}
+
+func (s *countingStorage) SetMarks(marks Marks) error {
+	s.setMarks++
+	return s.DiskStorage.SetMarks(marks)
+}
+
+func TestClockVersionsMarks(t *testing.T) {
+	disk, err := OpenDiskStorage(filepath.Join(t.TempDir(), "data"), DiskOptions{Sync: SyncNever})
+	assert.NoError(t, err)
+	storage := &countingStorage{DiskStorage: disk}
+	memDB := NewMemDB("TestDB", NewLockIDSeqGenerator(), storage)
+	defer memDB.Close()
+	assert.True(t, UseClockVersions(memDB))
+
+	// the marks run ahead of the clock, they aren't stored with every write
+	lockId := memDB.Put(Key("key0"), Value("value0"))
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, memDB.Update(lockId, Key("key0"), Value(strconv.Itoa(i)), false))
+	}
+	assert.True(t, storage.setMarks <= 2)
+	_, version, _, _ := memDB.Peek(Key("key0"))
+	assert.True(t, storage.Marks().Version > version)
+}
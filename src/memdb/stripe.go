@@ -0,0 +1,246 @@
+package memdb
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// stripeCount is how many stripes the keys and the LockIDs of a database are spread over,
+// operations on keys of different stripes don't wait for each other.
+const stripeCount = 64
+
+// keyStripe keeps the locks of the keys hashed to it.
+type keyStripe struct {
+	sync.RWMutex
+	key2Lock map[Key]*lock
+
+	// the keys of key2Lock in ascending order, see Scan
+	keys []Key
+
+	// keeps the stripes on separate cache lines
+	_ [8]byte
+}
+
+// lockStripe keeps the keys and the leases of the LockIDs hashed to it.
+type lockStripe struct {
+	sync.RWMutex
+	lockId2Keys map[LockID][]Key
+	leases      map[LockID]time.Time
+
+	// keeps the stripes on separate cache lines
+	_ [24]byte
+}
+
+// Stripes are locked in this order: the key stripes by index, the lock stripes by index, then mdb.mu
+// and the key lock itself. The database-wide operations lock all stripes at once.
+
+// stripeOf returns the stripe of s, it's the inlined fnv-1a hash of s.
+func stripeOf(s string) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(s); i++ {
+		h ^= uint32(s[i])
+		h *= 16777619
+	}
+	return int(h % stripeCount)
+}
+
+func (mdb *memDB) keyStripe(key Key) *keyStripe {
+	return &mdb.keyStripes[stripeOf(string(key))]
+}
+
+func (mdb *memDB) lockStripe(lockId LockID) *lockStripe {
+	return &mdb.lockStripes[stripeOf(string(lockId))]
+}
+
+// keyLock returns the lock of the key.
+// The caller must hold the stripe of the key.
+func (mdb *memDB) keyLock(key Key) (*lock, bool) {
+	keyLock, exists := mdb.keyStripe(key).key2Lock[key]
+	return keyLock, exists
+}
+
+// setKeyLock sets the lock of the key, nil lock removes it. The sorted keys of the stripe follow.
+// The caller must hold the stripe of the key.
+func (mdb *memDB) setKeyLock(key Key, keyLock *lock) {
+	s := mdb.keyStripe(key)
+	_, exists := s.key2Lock[key]
+	i := sort.Search(len(s.keys), func(i int) bool {
+		return s.keys[i] >= key
+	})
+
+	if keyLock == nil {
+		if exists {
+			delete(s.key2Lock, key)
+			s.keys = append(s.keys[:i], s.keys[i+1:]...)
+		}
+		return
+	}
+
+	s.key2Lock[key] = keyLock
+	if !exists {
+		s.keys = append(s.keys, "")
+		copy(s.keys[i+1:], s.keys[i:])
+		s.keys[i] = key
+	}
+}
+
+// resetKeyLocks removes the locks of all keys.
+// The caller must hold all stripes, unless the database isn't used yet.
+func (mdb *memDB) resetKeyLocks() {
+	for i := range mdb.keyStripes {
+		mdb.keyStripes[i].key2Lock = make(map[Key]*lock)
+		mdb.keyStripes[i].keys = nil
+	}
+}
+
+// lockKeys locks the stripes of the keys in index order and returns the function which unlocks them.
+func (mdb *memDB) lockKeys(keys []Key) func() {
+	stripes := make([]int, 0, len(keys))
+	for _, key := range keys {
+		stripes = append(stripes, stripeOf(string(key)))
+	}
+	unique := sortedStripes(stripes)
+	for _, stripe := range unique {
+		mdb.keyStripes[stripe].Lock()
+	}
+
+	return func() {
+		for _, stripe := range unique {
+			mdb.keyStripes[stripe].Unlock()
+		}
+	}
+}
+
+// lockHolders locks the stripes of the LockIDs in index order and returns the function which unlocks them.
+// The caller may hold key stripes, but no lock stripes.
+func (mdb *memDB) lockHolders(lockIds []LockID) func() {
+	stripes := make([]int, 0, len(lockIds))
+	for _, lockId := range lockIds {
+		stripes = append(stripes, stripeOf(string(lockId)))
+	}
+	unique := sortedStripes(stripes)
+	for _, stripe := range unique {
+		mdb.lockStripes[stripe].Lock()
+	}
+
+	return func() {
+		for _, stripe := range unique {
+			mdb.lockStripes[stripe].Unlock()
+		}
+	}
+}
+
+// sortedStripes sorts the stripe indexes and removes duplicates, stripes are always locked in this order.
+func sortedStripes(stripes []int) []int {
+	sort.Ints(stripes)
+	unique := stripes[:0]
+	for i, stripe := range stripes {
+		if i == 0 || stripe != stripes[i-1] {
+			unique = append(unique, stripe)
+		}
+	}
+	return unique
+}
+
+// lockAll locks all stripes, nothing else runs until unlockAll.
+func (mdb *memDB) lockAll() {
+	for i := range mdb.keyStripes {
+		mdb.keyStripes[i].Lock()
+	}
+	for i := range mdb.lockStripes {
+		mdb.lockStripes[i].Lock()
+	}
+}
+
+func (mdb *memDB) unlockAll() {
+	for i := range mdb.lockStripes {
+		mdb.lockStripes[i].Unlock()
+	}
+	for i := range mdb.keyStripes {
+		mdb.keyStripes[i].Unlock()
+	}
+}
+
+// rlockAll read-locks all stripes, nothing is written until runlockAll.
+func (mdb *memDB) rlockAll() {
+	for i := range mdb.keyStripes {
+		mdb.keyStripes[i].RLock()
+	}
+	for i := range mdb.lockStripes {
+		mdb.lockStripes[i].RLock()
+	}
+}
+
+func (mdb *memDB) runlockAll() {
+	for i := range mdb.lockStripes {
+		mdb.lockStripes[i].RUnlock()
+	}
+	for i := range mdb.keyStripes {
+		mdb.keyStripes[i].RUnlock()
+	}
+}
+
+// lockHolder locks the stripe of lockId and the stripes of the keys it holds, and returns the keys
+// and the function which unlocks the stripes. Nothing is locked if lockId doesn't exist, leases
+// are not checked. The keys are looked up before their stripes are locked, so it starts over
+// if they have changed in the meantime.
+func (mdb *memDB) lockHolder(lockId LockID) ([]Key, func(), bool) {
+	ls := mdb.lockStripe(lockId)
+	for {
+		ls.RLock()
+		keys, exists := ls.lockId2Keys[lockId]
+		ls.RUnlock()
+		if !exists {
+			return nil, nil, false
+		}
+
+		unlockKeys := mdb.lockKeys(keys)
+		ls.Lock()
+		current, exists := ls.lockId2Keys[lockId]
+		if exists && sameKeys(current, keys) {
+			return current, func() {
+				ls.Unlock()
+				unlockKeys()
+			}, true
+		}
+
+		ls.Unlock()
+		unlockKeys()
+		if !exists {
+			return nil, nil, false
+		}
+	}
+}
+
+func sameKeys(a, b []Key) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// nextLockId returns a new LockID, generators don't have to be safe for concurrent use.
+// A persistent database reserves the LockIDs of a LockIDSequence in the log or the storage a block
+// at a time, it fails if the block can't be reserved.
+func (mdb *memDB) nextLockId() (LockID, error) {
+	mdb.mu.Lock()
+	defer mdb.mu.Unlock()
+
+	if seq, ok := mdb.lockIdGen.(LockIDSequence); ok && mdb.wal != nil && seq.Seq() >= mdb.reservedLockIds {
+		reserved := seq.Seq() + lockIdReserveBlock
+		if err := mdb.appendLog(&record{op: opReserveLockIDs, version: Version(reserved)}); err != nil {
+			return "", err
+		}
+		mdb.reservedLockIds = reserved
+	}
+	if err := mdb.storeMarks(); err != nil {
+		return "", err
+	}
+	return mdb.lockIdGen.Next(), nil
+}
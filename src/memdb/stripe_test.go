@@ -0,0 +1,84 @@
+package memdb
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStripeOf(t *testing.T) {
+	stripes := make(map[int]int)
+	for i := 0; i < 64*stripeCount; i++ {
+		stripe := stripeOf("key" + strconv.Itoa(i))
+		assert.True(t, stripe >= 0 && stripe < stripeCount)
+		stripes[stripe]++
+	}
+	assert.Len(t, stripes, stripeCount)
+	assert.Equal(t, stripeOf("key0"), stripeOf("key0"))
+}
+
+func TestStripesConcurrent(t *testing.T) {
+	mdb := newTestMemDB(t, "TestStripesConcurrent")
+	defer mdb.Close()
+
+	keys := make([]Key, 32)
+	for i := range keys {
+		keys[i] = Key("key" + strconv.Itoa(i))
+		mdb.Release(mdb.Put(keys[i], Value("0")))
+	}
+
+	// every client adds one to a couple of keys at a time, the keys are spread over the stripes
+	const clients, rounds = 8, 200
+	var added int64
+	var wg sync.WaitGroup
+	for c := 0; c < clients; c++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			random := rand.New(rand.NewSource(seed))
+			for i := 0; i < rounds; i++ {
+				lockKeys := []Key{keys[random.Intn(len(keys))], keys[random.Intn(len(keys))]}
+				lockId, values, _, err := mdb.GetAndLockManyWithOptions(context.Background(), lockKeys, LockOptions{})
+				if !assert.NoError(t, err) {
+					return
+				}
+				for key, value := range values {
+					n, _ := strconv.Atoi(string(value))
+					assert.NoError(t, mdb.Update(lockId, key, Value(strconv.Itoa(n+1)), false))
+				}
+				atomic.AddInt64(&added, int64(len(values)))
+				assert.NoError(t, mdb.Release(lockId))
+			}
+		}(int64(c))
+	}
+
+	// the operations on the whole database run along
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			var snapshot bytes.Buffer
+			assert.NoError(t, mdb.Snapshot(&snapshot))
+			mdb.Locks()
+			mdb.Scan("", "", 0)
+		}
+	}()
+	wg.Wait()
+
+	var total int64
+	for _, key := range keys {
+		value, _, reserved, err := mdb.Peek(key)
+		assert.NoError(t, err)
+		assert.False(t, reserved)
+		n, _ := strconv.Atoi(string(value))
+		total += int64(n)
+	}
+	assert.Equal(t, added, total)
+	assert.Empty(t, mdb.Locks())
+}
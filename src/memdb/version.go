@@ -0,0 +1,129 @@
+package memdb
+
+import (
+	"time"
+)
+
+// Version of a value, it changes with every write of the key.
+// Versions are drawn from a single sequence of the database, so a key deleted and created again
+// never gets a version it had before.
+type Version uint64
+
+type item struct {
+	value   Value
+	version Version
+}
+
+// clockVersionReserve is how far ahead of the clock the versions are stored in the storage
+// by a database whose versions follow the clock.
+const clockVersionReserve = Version(time.Second)
+
+// UseClockVersions makes the versions db hands out from now on follow the clock: a write takes the current
+// time in nanoseconds as its version, unless the version after the last one is greater. This way the versions
+// of different databases tell which write is newer, as long as their clocks agree. It returns false if db
+// isn't created by NewMemDB or Open.
+func UseClockVersions(db MemDB) bool {
+	mdb, ok := db.(*memDB)
+	if !ok {
+		return false
+	}
+
+	mdb.mu.Lock()
+	defer mdb.mu.Unlock()
+	mdb.clockVersions = true
+	return true
+}
+
+// setValue logs and stores value of the key with a new version, a failed write wastes the version.
+// The caller must hold the stripe of the key.
+func (mdb *memDB) setValue(key Key, value Value) (Version, error) {
+	mdb.mu.Lock()
+	mdb.lastVersion++
+	if now := Version(time.Now().UnixNano()); mdb.clockVersions && now > mdb.lastVersion {
+		mdb.lastVersion = now
+	}
+	version := mdb.lastVersion
+	err := mdb.storeMarks()
+	mdb.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := mdb.writeLog(&record{op: opSet, key: key, value: value, version: version}); err != nil {
+		return 0, err
+	}
+
+	if err := mdb.storage.Set(key, value, version); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// GetWithVersion works like Get and also returns the version of the value.
+func (mdb *memDB) GetWithVersion(lockId LockID, key Key) (Value, Version, error) {
+	s, ls := mdb.keyStripe(key), mdb.lockStripe(lockId)
+	s.RLock()
+	defer s.RUnlock()
+	ls.RLock()
+	defer ls.RUnlock()
+
+	lockKeys, exists := mdb.lookupLock(lockId)
+	if !exists {
+		return EmptyValue, 0, ErrLockIdNotFound
+	}
+
+	if !containsKey(lockKeys, key) {
+		return EmptyValue, 0, ErrKeyNotFound
+	}
+
+	return mdb.storage.Get(key)
+}
+
+// Peek reads the value of the key and its version without locking the key, it never waits.
+// Reserved reports whether somebody holds the key lock at the moment.
+//
+// Peek sees every completed write, but nothing stops the holder of the key lock from changing
+// the value right after it has been read. Take a shared lock with GetAndRLock if the value
+// must not change while it's used.
+func (mdb *memDB) Peek(key Key) (value Value, version Version, reserved bool, err error) {
+	s := mdb.keyStripe(key)
+	s.RLock()
+	defer s.RUnlock()
+
+	value, version, err = mdb.storage.Get(key)
+	if err != nil {
+		return EmptyValue, 0, false, err
+	}
+
+	// a key missing from the locks, e.g. after a failed Restore, isn't reserved by anybody
+	keyLock, exists := s.key2Lock[key]
+	return value, version, exists && keyLock.Locked(), nil
+}
+
+// CompareAndSwap sets the value of an existing key without locking it, if the key is still at expectedVersion.
+// It returns the new version, or ErrVersionMismatch if the key has been written since.
+// A key held by a reservation can't be swapped, *LockedError is returned instead.
+func (mdb *memDB) CompareAndSwap(key Key, expectedVersion Version, value Value) (Version, error) {
+	defer mdb.debugCheck()
+
+	s := mdb.keyStripe(key)
+	s.Lock()
+	defer s.Unlock()
+
+	keyLock, exists := s.key2Lock[key]
+	if !exists {
+		return 0, ErrKeyNotFound
+	}
+
+	if keyLock.Locked() {
+		return 0, &LockedError{Key: key, HeldFor: keyLock.heldFor(time.Now())}
+	}
+
+	if _, version, err := mdb.storage.Get(key); err != nil {
+		return 0, err
+	} else if version != expectedVersion {
+		return 0, ErrVersionMismatch
+	}
+
+	return mdb.setValue(key, value)
+}
@@ -0,0 +1,132 @@
+package memdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVersions(t *testing.T) {
+	memDB := newTestMemDB(t, "TestDB")
+
+	k := Key("key0")
+	lockId := memDB.Put(k, Value("value0"))
+	value, version, err := memDB.GetWithVersion(lockId, k)
+	assert.NoError(t, err)
+	assert.Equal(t, Value("value0"), value)
+	assert.Equal(t, Version(1), version)
+
+	assert.NoError(t, memDB.Update(lockId, k, Value("value1"), false))
+	_, version2, err := memDB.GetWithVersion(lockId, k)
+	assert.NoError(t, err)
+	assert.True(t, version2 > version)
+
+	_, _, err = memDB.GetWithVersion(LockID("wronglock"), k)
+	assert.Equal(t, ErrLockIdNotFound, err)
+	_, _, err = memDB.GetWithVersion(lockId, Key("key1"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// the key created again doesn't reuse the old versions
+	assert.NoError(t, memDB.Delete(lockId, k))
+	lockId = memDB.Put(k, Value("value0"))
+	_, version3, err := memDB.GetWithVersion(lockId, k)
+	assert.NoError(t, err)
+	assert.True(t, version3 > version2)
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	memDB := newTestMemDB(t, "TestDB")
+
+	k := Key("key0")
+	_, err := memDB.CompareAndSwap(k, 1, Value("value0"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	lockId := memDB.Put(k, Value("value0"))
+	_, version, _ := memDB.GetWithVersion(lockId, k)
+
+	// reserved keys can't be swapped
+	_, err = memDB.CompareAndSwap(k, version, Value("value1"))
+	assert.IsType(t, &LockedError{}, err)
+	assert.NoError(t, memDB.Release(lockId))
+
+	version2, err := memDB.CompareAndSwap(k, version, Value("value1"))
+	assert.NoError(t, err)
+	assert.True(t, version2 > version)
+	value, _ := memDB.DirectGet(k)
+	assert.Equal(t, Value("value1"), value)
+
+	// the second writer with the same version loses
+	_, err = memDB.CompareAndSwap(k, version, Value("value2"))
+	assert.Equal(t, ErrVersionMismatch, err)
+	value, _ = memDB.DirectGet(k)
+	assert.Equal(t, Value("value1"), value)
+
+	// lock-based writers see the swapped value
+	lockId, value, err = memDB.GetAndLock(k)
+	assert.NoError(t, err)
+	assert.Equal(t, Value("value1"), value)
+	_, version3, _ := memDB.GetWithVersion(lockId, k)
+	assert.Equal(t, version2, version3)
+}
+
+func TestPeek(t *testing.T) {
+	memDB := newTestMemDB(t, "TestDB")
+
+	k := Key("key0")
+	_, _, _, err := memDB.Peek(k)
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	lockId := memDB.Put(k, Value("value0"))
+	value, version, reserved, err := memDB.Peek(k)
+	assert.NoError(t, err)
+	assert.Equal(t, Value("value0"), value)
+	assert.Equal(t, Version(1), version)
+	assert.True(t, reserved)
+
+	assert.NoError(t, memDB.Update(lockId, k, Value("value1"), true))
+	value, version, reserved, err = memDB.Peek(k)
+	assert.NoError(t, err)
+	assert.Equal(t, Value("value1"), value)
+	assert.Equal(t, Version(2), version)
+	assert.False(t, reserved)
+
+	_, _, err = memDB.GetAndRLock(k)
+	assert.NoError(t, err)
+	_, _, reserved, _ = memDB.Peek(k)
+	assert.True(t, reserved)
+}
+
+func TestPeekWithoutLock(t *testing.T) {
+	mdb := newTestMemDB(t, "TestDB")
+
+	// the storage has a key the locks don't know about
+	assert.NoError(t, mdb.storage.Set(Key("key0"), Value("value0"), 1))
+	value, _, reserved, err := mdb.Peek(Key("key0"))
+	assert.NoError(t, err)
+	assert.Equal(t, Value("value0"), value)
+	assert.False(t, reserved)
+}
+
+func TestClockVersions(t *testing.T) {
+	memDB := newTestMemDB(t, "TestDB")
+	assert.False(t, UseClockVersions(nil))
+
+	lockId := memDB.Put(Key("key0"), Value("value0"))
+	_, version, _, _ := memDB.Peek(Key("key0"))
+	assert.Equal(t, Version(1), version)
+
+	// the versions jump to the clock and keep growing within the same nanosecond
+	assert.True(t, UseClockVersions(memDB))
+	before := Version(time.Now().UnixNano())
+	assert.NoError(t, memDB.Update(lockId, Key("key0"), Value("value1"), false))
+	_, version, _, _ = memDB.Peek(Key("key0"))
+	assert.True(t, version >= before)
+	assert.True(t, version <= Version(time.Now().UnixNano()))
+
+	memDB.lastVersion += Version(time.Hour)
+	assert.NoError(t, memDB.Update(lockId, Key("key0"), Value("value2"), false))
+	_, version2, _, _ := memDB.Peek(Key("key0"))
+	assert.Equal(t, memDB.lastVersion, version2)
+	assert.True(t, version2 > version+Version(time.Hour))
+}
@@ -0,0 +1,430 @@
+package memdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrCorruptRecord = errors.New("Corrupt log record")
+
+// SyncPolicy tells when writes to the log are flushed to the disk.
+type SyncPolicy int
+
+const (
+	// SyncAlways flushes every write before it's acknowledged, nothing is lost on a crash.
+	SyncAlways SyncPolicy = iota
+	// SyncInterval flushes writes in the background every SyncInterval, a crash loses at most the last interval.
+	SyncInterval
+	// SyncNever leaves flushing to the operating system, a crash of the machine may lose any recent writes.
+	SyncNever
+)
+
+func (p SyncPolicy) String() string {
+	switch p {
+	case SyncInterval:
+		return "interval"
+	case SyncNever:
+		return "never"
+	}
+	return "always"
+}
+
+// ParseSyncPolicy parses the name of a SyncPolicy: always, interval or never.
+func ParseSyncPolicy(name string) (SyncPolicy, error) {
+	for _, p := range []SyncPolicy{SyncAlways, SyncInterval, SyncNever} {
+		if p.String() == name {
+			return p, nil
+		}
+	}
+	return SyncAlways, fmt.Errorf("Unknown sync policy %q", name)
+}
+
+type opCode byte
+
+const (
+	opSet opCode = iota + 1
+	opDelete
+	// opReserveTokens records the highest fencing token which may have been handed out
+	opReserveTokens
+	// opMeta starts a snapshot with the last version and fencing token of the database
+	opMeta
+	// opEnd ends a snapshot with the number of its values
+	opEnd
+	// opReserveLockIDs records in its version the highest LockID counter which may have been handed out
+	opReserveLockIDs
+)
+
+const (
+	walPrefix = "wal-"
+	walSuffix = ".log"
+)
+
+// record is an entry of the write-ahead log.
+type record struct {
+	op      opCode
+	key     Key
+	value   Value
+	version Version
+	token   FencingToken
+}
+
+// recordHeaderSize is the size of crc32 and length preceding every record payload.
+const recordHeaderSize = 8
+
+func (r *record) encode() []byte {
+	payload := []byte{byte(r.op)}
+	payload = binary.AppendUvarint(payload, uint64(r.version))
+	payload = binary.AppendUvarint(payload, uint64(r.token))
+	payload = binary.AppendUvarint(payload, uint64(len(r.key)))
+	payload = append(payload, r.key...)
+	payload = binary.AppendUvarint(payload, uint64(len(r.value)))
+	payload = append(payload, r.value...)
+
+	buf := make([]byte, recordHeaderSize, recordHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(buf[0:4], crc32.ChecksumIEEE(payload))
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(len(payload)))
+	return append(buf, payload...)
+}
+
+func decodeRecord(payload []byte) (*record, error) {
+	if len(payload) == 0 {
+		return nil, ErrCorruptRecord
+	}
+
+	r := &record{op: opCode(payload[0])}
+	payload = payload[1:]
+
+	readUvarint := func() uint64 {
+		v, n := binary.Uvarint(payload)
+		if n <= 0 {
+			payload = nil
+			return 0
+		}
+		payload = payload[n:]
+		return v
+	}
+	readString := func() (string, bool) {
+		n := readUvarint()
+		if uint64(len(payload)) < n {
+			return "", false
+		}
+		s := string(payload[:n])
+		payload = payload[n:]
+		return s, true
+	}
+
+	r.version = Version(readUvarint())
+	r.token = FencingToken(readUvarint())
+	key, ok := readString()
+	if !ok {
+		return nil, ErrCorruptRecord
+	}
+	value, ok := readString()
+	if !ok || len(payload) != 0 {
+		return nil, ErrCorruptRecord
+	}
+
+	r.key = Key(key)
+	r.value = Value(value)
+	return r, nil
+}
+
+// readRecord reads the next record, it returns io.EOF at the end of the log
+// and io.ErrUnexpectedEOF or ErrCorruptRecord for a torn or damaged record.
+// The size of a damaged record is returned with ErrCorruptRecord.
+func readRecord(r io.Reader) (*record, int, error) {
+	var header [recordHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, 0, err
+	}
+
+	checksum := binary.LittleEndian.Uint32(header[0:4])
+	size := int64(binary.LittleEndian.Uint32(header[4:8]))
+
+	// the buffer grows with the data actually read, a damaged size doesn't allocate gigabytes
+	payload, err := io.ReadAll(io.LimitReader(r, size))
+	if err != nil {
+		return nil, 0, err
+	} else if int64(len(payload)) < size {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return nil, recordHeaderSize + len(payload), ErrCorruptRecord
+	}
+
+	rec, err := decodeRecord(payload)
+	return rec, recordHeaderSize + len(payload), err
+}
+
+// replayLog passes the complete records read from r to apply and returns their total size. It fails with
+// io.ErrUnexpectedEOF or ErrCorruptRecord if the log ends with a torn record, the size is still valid then.
+func replayLog(r io.Reader, apply func(*record)) (int64, error) {
+	var size int64
+	reader := bufio.NewReader(r)
+	for {
+		rec, n, err := readRecord(reader)
+		if err == io.EOF {
+			return size, nil
+		} else if err != nil {
+			return size, err
+		}
+
+		apply(rec)
+		size += int64(n)
+	}
+}
+
+func segmentPath(dir string, segment uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%016d%s", walPrefix, segment, walSuffix))
+}
+
+// listFiles returns the numbers of files in dir named prefix, number and suffix in ascending order.
+func listFiles(dir, prefix, suffix string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var numbers []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+			continue
+		}
+
+		number, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, prefix), suffix), 10, 64)
+		if err == nil {
+			numbers = append(numbers, number)
+		}
+	}
+
+	sort.Slice(numbers, func(i, j int) bool {
+		return numbers[i] < numbers[j]
+	})
+	return numbers, nil
+}
+
+// syncDir makes creating, renaming and removing files in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// wal is an append-only log of writes to the database, split into numbered segment files.
+// A new segment is started for every snapshot, so the segments the snapshot replaces can be removed.
+type wal struct {
+	mu      sync.Mutex
+	dir     string
+	segment uint64
+	file    *os.File
+	size    int64
+	policy  SyncPolicy
+	// err is the first write error, the log refuses further writes after it
+	err error
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// openWAL opens the log in dir starting from segment first, passing its records to apply first.
+// A torn record at the end of the last segment, left by a crash in the middle of a write, is cut off.
+func openWAL(dir string, first uint64, policy SyncPolicy, syncInterval time.Duration, apply func(*record)) (*wal, error) {
+	segments, err := listFiles(dir, walPrefix, walSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	// segments before first are leftovers of an interrupted compaction
+	var replay []uint64
+	for _, segment := range segments {
+		if segment >= first {
+			replay = append(replay, segment)
+		}
+	}
+	if len(replay) == 0 {
+		if first > 0 {
+			return nil, fmt.Errorf("Log segment %d is missing", first)
+		}
+		replay = []uint64{first}
+	}
+
+	for i, segment := range replay {
+		if segment != first+uint64(i) {
+			return nil, fmt.Errorf("Log segment %d is missing", first+uint64(i))
+		}
+	}
+
+	last := len(replay) - 1
+	for _, segment := range replay[:last] {
+		if err := replaySegment(dir, segment, apply); err != nil {
+			return nil, err
+		}
+	}
+
+	path := segmentPath(dir, replay[last])
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := replayLog(file, apply)
+	if err == io.ErrUnexpectedEOF || err == ErrCorruptRecord {
+		err = file.Truncate(size)
+	}
+	if err == nil {
+		_, err = file.Seek(size, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	w := &wal{dir: dir, segment: replay[last], file: file, size: size, policy: policy, done: make(chan struct{})}
+	if policy == SyncInterval {
+		w.wg.Add(1)
+		go w.syncer(syncInterval)
+	}
+	return w, nil
+}
+
+// replaySegment passes the records of a finished segment to apply, the segment must be complete.
+func replaySegment(dir string, segment uint64, apply func(*record)) error {
+	file, err := os.Open(segmentPath(dir, segment))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := replayLog(file, apply); err != nil {
+		return fmt.Errorf("Log segment %d: %v", segment, err)
+	}
+	return nil
+}
+
+// Append writes rec to the log, with SyncAlways it returns after rec is on the disk.
+func (w *wal) Append(rec *record) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return w.err
+	}
+
+	buf := rec.encode()
+	if _, err := w.file.Write(buf); err != nil {
+		w.err = err
+		return err
+	}
+	w.size += int64(len(buf))
+
+	if w.policy == SyncAlways {
+		if err := w.file.Sync(); err != nil {
+			w.err = err
+			return err
+		}
+	}
+	return nil
+}
+
+// Size returns the size of the current segment.
+func (w *wal) Size() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.size
+}
+
+// Rotate flushes the current segment to the disk and starts the next one, it returns the number of the new segment.
+func (w *wal) Rotate() (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	// only the last segment may end with a torn record
+	if err := w.file.Sync(); err != nil {
+		w.err = err
+		return 0, err
+	}
+
+	file, err := os.OpenFile(segmentPath(w.dir, w.segment+1), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+	w.file.Close()
+
+	w.segment++
+	w.file = file
+	w.size = 0
+
+	if err := syncDir(w.dir); err != nil {
+		w.err = err
+		return 0, err
+	}
+	return w.segment, nil
+}
+
+func (w *wal) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return w.err
+	}
+
+	if err := w.file.Sync(); err != nil {
+		w.err = err
+	}
+	return w.err
+}
+
+func (w *wal) syncer(interval time.Duration) {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			w.Sync()
+		}
+	}
+}
+
+// Close flushes the log to the disk and closes it.
+func (w *wal) Close() error {
+	close(w.done)
+	w.wg.Wait()
+
+	err := w.Sync()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	if w.err == nil {
+		w.err = os.ErrClosed
+	}
+	return err
+}
@@ -0,0 +1,156 @@
+package memdb
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenReplaysLog(t *testing.T) {
+	dir := t.TempDir()
+
+	memDB, err := Open(dir, Options{})
+	assert.NoError(t, err)
+
+	lockId := memDB.Put(Key("key0"), Value("value0"))
+	assert.NoError(t, memDB.Update(lockId, Key("key0"), Value("value1"), true))
+	lockId = memDB.Put(Key("key1"), Value("value1"))
+	assert.NoError(t, memDB.Delete(lockId, Key("key1")))
+	memDB.Put(Key("key2"), Value("value2"))
+	_, version, _, _ := memDB.Peek(Key("key0"))
+	_, err = memDB.CompareAndSwap(Key("key0"), version, Value("value2"))
+	assert.NoError(t, err)
+	_, _, token, err := memDB.GetAndLockWithOptions(context.Background(), Key("key0"), LockOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, memDB.Close())
+
+	memDB, err = Open(dir, Options{})
+	assert.NoError(t, err)
+	defer memDB.Close()
+
+	value, version2, reserved, err := memDB.Peek(Key("key0"))
+	assert.NoError(t, err)
+	assert.Equal(t, Value("value2"), value)
+	assert.True(t, version2 > version)
+	assert.False(t, reserved)
+
+	_, _, _, err = memDB.Peek(Key("key1"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// locks don't survive the restart
+	lockId, value, token2, err := memDB.GetAndLockWithOptions(context.Background(), Key("key2"), LockOptions{Wait: NoWait})
+	assert.NoError(t, err)
+	assert.Equal(t, Value("value2"), value)
+	assert.True(t, token2 > token)
+
+	// new writes go on with higher versions
+	assert.NoError(t, memDB.Update(lockId, Key("key2"), Value("value3"), true))
+	_, version3, _, _ := memDB.Peek(Key("key2"))
+	assert.True(t, version3 > version2)
+}
+
+func TestOpenKeepsLockIDs(t *testing.T) {
+	dir := t.TempDir()
+
+	memDB, err := Open(dir, Options{CompactSize: -1})
+	assert.NoError(t, err)
+	staleId := memDB.Put(Key("key0"), Value("value0"))
+	assert.NoError(t, memDB.Close())
+
+	// a lock lost in the restart isn't granted again
+	memDB, err = Open(dir, Options{CompactSize: -1})
+	assert.NoError(t, err)
+	lockId, _, err := memDB.GetAndLock(Key("key0"))
+	assert.NoError(t, err)
+	assert.NotEqual(t, staleId, lockId)
+	assert.Equal(t, ErrLockIdNotFound, memDB.Update(staleId, Key("key0"), Value("stale"), false))
+
+	// the reservation is kept by the snapshot too
+	for i := 0; i < 2*lockIdReserveBlock; i++ {
+		assert.NoError(t, memDB.Release(memDB.Put(Key("key1"), Value("value1"))))
+	}
+	assert.NoError(t, memDB.Compact())
+	lastId := memDB.Put(Key("key2"), Value("value2"))
+	assert.NoError(t, memDB.Close())
+
+	memDB, err = Open(dir, Options{CompactSize: -1})
+	assert.NoError(t, err)
+	defer memDB.Close()
+	_, err = memDB.Get(lastId, Key("key2"))
+	assert.Equal(t, ErrLockIdNotFound, err)
+	lockId = memDB.Put(Key("key2"), Value("value2"))
+	last, _ := strconv.ParseUint(string(lastId), 10, 64)
+	next, _ := strconv.ParseUint(string(lockId), 10, 64)
+	assert.True(t, next > last)
+}
+
+func TestOpenCutsTornRecord(t *testing.T) {
+	dir := t.TempDir()
+
+	memDB, err := Open(dir, Options{Sync: SyncNever})
+	assert.NoError(t, err)
+	memDB.Put(Key("key0"), Value("value0"))
+	memDB.Put(Key("key1"), Value("value1"))
+	assert.NoError(t, memDB.Close())
+
+	// crash in the middle of the last write
+	path := segmentPath(dir, 0)
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.NoError(t, os.Truncate(path, info.Size()-3))
+
+	memDB, err = Open(dir, Options{Sync: SyncNever})
+	assert.NoError(t, err)
+
+	value, _, _, err := memDB.Peek(Key("key0"))
+	assert.NoError(t, err)
+	assert.Equal(t, Value("value0"), value)
+	_, _, _, err = memDB.Peek(Key("key1"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// the log goes on after the last complete record
+	memDB.Put(Key("key2"), Value("value2"))
+	assert.NoError(t, memDB.Close())
+
+	memDB, err = Open(dir, Options{Sync: SyncNever})
+	assert.NoError(t, err)
+	defer memDB.Close()
+	keys, _ := memDB.Scan(Key(""), Key(""), 0)
+	assert.Equal(t, []Key{"key0", "key2"}, keys)
+}
+
+func TestOpenSyncInterval(t *testing.T) {
+	dir := t.TempDir()
+
+	memDB, err := Open(dir, Options{Sync: SyncInterval, SyncInterval: 10 * time.Millisecond})
+	assert.NoError(t, err)
+	memDB.Put(Key("key0"), Value("value0"))
+	time.Sleep(30 * time.Millisecond)
+	assert.NoError(t, memDB.Close())
+
+	// writes after Close fail
+	_, _, err = memDB.PutWithOptions(context.Background(), Key("key1"), Value("value1"), LockOptions{})
+	assert.Error(t, err)
+
+	memDB, err = Open(dir, Options{Sync: SyncInterval})
+	assert.NoError(t, err)
+	defer memDB.Close()
+	value, _, _, err := memDB.Peek(Key("key0"))
+	assert.NoError(t, err)
+	assert.Equal(t, Value("value0"), value)
+}
+
+func TestParseSyncPolicy(t *testing.T) {
+	for _, p := range []SyncPolicy{SyncAlways, SyncInterval, SyncNever} {
+		parsed, err := ParseSyncPolicy(p.String())
+		assert.NoError(t, err)
+		assert.Equal(t, p, parsed)
+	}
+
+	_, err := ParseSyncPolicy("sometimes")
+	assert.Error(t, err)
+}
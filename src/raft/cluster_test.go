@@ -0,0 +1,202 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"rest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The cluster test runs every node in its own process, the test binary started again
+// with the node in the environment.
+const (
+	nodeEnv  = "RAFT_TEST_NODE"
+	peersEnv = "RAFT_TEST_PEERS"
+	dirEnv   = "RAFT_TEST_DIR"
+)
+
+func TestMain(m *testing.M) {
+	if id := os.Getenv(nodeEnv); id != "" {
+		runTestNode(id)
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// runTestNode serves a node until the process is killed, like main does.
+func runTestNode(id string) {
+	peers, err := ParsePeers(os.Getenv(peersEnv))
+	if err != nil {
+		log.Fatal(err)
+	}
+	config := testConfig(id, peers)
+	config.Dir = os.Getenv(dirEnv)
+
+	addr, err := config.Addr()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db, err := Open(config, rest.NoLog)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server := rest.NewRestServerWithMemDB(db, rest.NoLog)
+	log.Fatal(http.ListenAndServe(addr, db.Handler(server.Router())))
+}
+
+// processCluster runs the nodes of a cluster on loopback ports.
+type processCluster struct {
+	t     *testing.T
+	peers map[string]string
+	dirs  map[string]string
+	procs map[string]*exec.Cmd
+}
+
+func newProcessCluster(t *testing.T, size int) *processCluster {
+	c := &processCluster{t: t, peers: make(map[string]string), dirs: make(map[string]string), procs: make(map[string]*exec.Cmd)}
+
+	for i := 0; i < size; i++ {
+		// the port is free again when the node starts, unless somebody takes it in the meantime
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		id := fmt.Sprintf("node%d", i)
+		c.peers[id] = "http://" + listener.Addr().String()
+		c.dirs[id] = filepath.Join(t.TempDir(), id)
+		listener.Close()
+	}
+
+	for id := range c.peers {
+		c.start(id)
+	}
+	t.Cleanup(func() {
+		for id := range c.procs {
+			c.kill(id)
+		}
+	})
+	return c
+}
+
+func (c *processCluster) start(id string) {
+	var pairs []string
+	for peer, url := range c.peers {
+		pairs = append(pairs, peer+"="+url)
+	}
+
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), nodeEnv+"="+id, peersEnv+"="+strings.Join(pairs, ","), dirEnv+"="+c.dirs[id])
+	cmd.Stderr = os.Stderr
+	assert.NoError(c.t, cmd.Start())
+	c.procs[id] = cmd
+}
+
+func (c *processCluster) kill(id string) {
+	if cmd, running := c.procs[id]; running {
+		cmd.Process.Kill()
+		cmd.Wait()
+		delete(c.procs, id)
+	}
+}
+
+// leader waits until the running nodes agree on a leader.
+func (c *processCluster) leader() string {
+	var leader string
+	assert.Eventually(c.t, func() bool {
+		leader = ""
+		for id := range c.procs {
+			var status Status
+			if !c.getJSON(id, statusPath, &status) || status.Leader == "" || (leader != "" && status.Leader != leader) {
+				return false
+			}
+			leader = status.Leader
+		}
+		_, running := c.procs[leader]
+		return running
+	}, 10*time.Second, 20*time.Millisecond)
+	return leader
+}
+
+func (c *processCluster) getJSON(id, path string, v interface{}) bool {
+	resp, err := http.Get(c.peers[id] + path)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode == http.StatusOK && json.NewDecoder(resp.Body).Decode(v) == nil
+}
+
+// eventuallyValue waits until the node serves the value of the key.
+func (c *processCluster) eventuallyValue(id, key, value string) {
+	assert.Eventually(c.t, func() bool {
+		var response rest.ValueResponse
+		return c.getJSON(id, "/values/"+key, &response) && response.Value == value
+	}, 10*time.Second, 20*time.Millisecond, "node %s, key %s", id, key)
+}
+
+// request sends a write to the node, the client follows the redirect to the leader.
+func (c *processCluster) request(id, method, path, body string, v interface{}) int {
+	req, err := http.NewRequest(method, c.peers[id]+path, bytes.NewReader([]byte(body)))
+	assert.NoError(c.t, err)
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.NoError(c.t, err) {
+		return 0
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		json.NewDecoder(resp.Body).Decode(v)
+	}
+	return resp.StatusCode
+}
+
+func TestCluster(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a cluster of processes")
+	}
+
+	c := newProcessCluster(t, 3)
+	leader := c.leader()
+
+	var follower string
+	for id := range c.peers {
+		if id != leader {
+			follower = id
+		}
+	}
+
+	// writes sent to a follower are redirected to the leader
+	var lock rest.LockResponse
+	assert.Equal(t, http.StatusOK, c.request(follower, "PUT", "/values/key0", "value0", &lock))
+	assert.Equal(t, http.StatusNoContent, c.request(follower, "POST", "/values/key0/"+lock.LockId+"?release=true", "value1", nil))
+	for id := range c.peers {
+		c.eventuallyValue(id, "key0", "value1")
+	}
+
+	// the cluster survives the loss of the leader
+	c.kill(leader)
+	newLeader := c.leader()
+	assert.NotEqual(t, leader, newLeader)
+
+	var lockValue rest.LockValueResponse
+	assert.Equal(t, http.StatusOK, c.request(newLeader, "POST", "/reservations/key0", "", &lockValue))
+	assert.Equal(t, "value1", lockValue.Value)
+	assert.Equal(t, http.StatusNoContent, c.request(newLeader, "POST", "/values/key0/"+lockValue.LockId+"?release=true", "value2", nil))
+	assert.Equal(t, http.StatusOK, c.request(newLeader, "PUT", "/values/key1", "value1", nil))
+
+	// the restarted node catches up
+	c.start(leader)
+	for id := range c.peers {
+		c.eventuallyValue(id, "key0", "value2")
+		c.eventuallyValue(id, "key1", "value1")
+	}
+}
@@ -0,0 +1,608 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"memdb"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultCommitTimeout limits how long a write waits for the cluster to commit it.
+const DefaultCommitTimeout = 5 * time.Second
+
+// DefaultGrantLease is the lease of a lock granted without a TTL until its requester confirms it has the lock.
+// The lock command may commit after the requester stopped waiting for it, nobody would release such a lock.
+const DefaultGrantLease = 2 * DefaultCommitTimeout
+
+const (
+	opPut            = "put"
+	opLock           = "lock"
+	opUpdate         = "update"
+	opRelease        = "release"
+	opReleaseKey     = "release_key"
+	opDelete         = "delete"
+	opCompareAndSwap = "compare_and_swap"
+	opRenew          = "renew"
+	opConfirm        = "confirm"
+	opExpire         = "expire"
+	opForceRelease   = "force_release"
+	opRestore        = "restore"
+)
+
+// command is a write to the database in the Raft log. Everything which depends on the clock
+// of the leader, like the end of a lease, is decided before it's proposed.
+type command struct {
+	Op       string             `json:"op"`
+	Keys     []memdb.Key        `json:"keys,omitempty"`
+	Value    memdb.Value        `json:"value,omitempty"`
+	LockID   memdb.LockID       `json:"lock_id,omitempty"`
+	Mode     memdb.LockMode     `json:"mode,omitempty"`
+	Release  bool               `json:"release,omitempty"`
+	Token    memdb.FencingToken `json:"token,omitempty"`
+	Version  memdb.Version      `json:"version,omitempty"`
+	Deadline time.Time          `json:"deadline"`
+	Snapshot []byte             `json:"snapshot,omitempty"`
+	Force    bool               `json:"force,omitempty"`
+}
+
+// result is what a command returned when it was applied on the leader.
+type result struct {
+	lockId  memdb.LockID
+	values  map[memdb.Key]memdb.Value
+	tokens  map[memdb.Key]memdb.FencingToken
+	version memdb.Version
+	infos   []memdb.LockInfo
+	err     error
+}
+
+// DB is a memdb.MemDB replicated by Raft. Writes are committed through the Raft log and applied
+// to a copy of the database on every node, reads are served by the copy of the node.
+// Only the leader accepts writes, they fail with ErrNotLeader on the other nodes, Handler redirects them.
+//
+// Reads of a follower may lag behind the leader. Locks are acquired without waiting in the log,
+// the leader retries a lock held by somebody else whenever a command is applied, so waiters are
+// not served in FIFO order and deadlocks are not detected, use a wait budget. Lock priorities are refused.
+// Leases are kept in the replicated state and ended by the leader. A write larger than MaxCommandSize
+// is refused with ErrCommandTooLarge.
+// A lock without a TTL is granted with a lease of DefaultGrantLease, it's dropped once the requester gets the lock.
+type DB struct {
+	raft       *Raft
+	local      memdb.MemDB
+	logger     *log.Logger
+	grantLease time.Duration
+
+	mu     sync.Mutex
+	leases map[memdb.LockID]time.Time
+	// changed is closed when a command is applied
+	changed chan struct{}
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Open starts the node config.ID of the replicated database.
+func Open(config Config, logger *log.Logger) (*DB, error) {
+	db := &DB{
+		local:      memdb.NewMemDB(config.ID, memdb.NewLockIDSeqGenerator()),
+		logger:     logger,
+		grantLease: DefaultGrantLease,
+		leases:     make(map[memdb.LockID]time.Time),
+		changed:    make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+
+	r, err := New(config, db, logger)
+	if err != nil {
+		return nil, err
+	}
+	db.raft = r
+
+	db.wg.Add(1)
+	go db.reaper()
+	return db, nil
+}
+
+// Raft returns the Raft node of the database.
+func (db *DB) Raft() *Raft {
+	return db.raft
+}
+
+// Handler serves the Raft RPCs and passes the other requests to next. A follower redirects
+// the writes (anything but GET and HEAD) to the leader with 307 Temporary Redirect,
+// or responds with 503 Service Unavailable while there's no leader.
+func (db *DB) Handler(next http.Handler) http.Handler {
+	rpc := db.raft.Handler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/raft/") {
+			rpc.ServeHTTP(w, r)
+			return
+		}
+
+		if r.Method == "GET" || r.Method == "HEAD" || db.raft.IsLeader() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		_, leaderURL := db.raft.Leader()
+		if leaderURL == "" {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		http.Redirect(w, r, leaderURL+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	})
+}
+
+// Apply applies a committed command to the copy of the database on this node.
+func (db *DB) Apply(data []byte) interface{} {
+	defer db.notify()
+
+	var cmd command
+	if err := json.Unmarshal(data, &cmd); err != nil {
+		// every node refuses the command the same way
+		return &result{err: err}
+	}
+
+	res := &result{}
+	switch cmd.Op {
+	case opPut:
+		var token memdb.FencingToken
+		opts := memdb.LockOptions{Wait: memdb.NoWait}
+		res.lockId, token, res.err = db.local.PutWithOptions(context.Background(), cmd.Keys[0], cmd.Value, opts)
+		if res.err == nil {
+			res.tokens = map[memdb.Key]memdb.FencingToken{cmd.Keys[0]: token}
+			db.setLease(res.lockId, cmd.Deadline)
+		}
+
+	case opLock:
+		opts := memdb.LockOptions{Wait: memdb.NoWait, Mode: cmd.Mode, Holder: cmd.LockID}
+		res.lockId, res.values, res.tokens, res.err = db.local.GetAndLockManyWithOptions(context.Background(), cmd.Keys, opts)
+		if res.err == nil && cmd.LockID == "" {
+			db.setLease(res.lockId, cmd.Deadline)
+		}
+
+	case opUpdate:
+		res.err = db.local.UpdateWithToken(cmd.LockID, cmd.Keys[0], cmd.Value, cmd.Release, cmd.Token)
+		db.forgetLease(cmd.LockID)
+
+	case opRelease:
+		res.err = db.local.Release(cmd.LockID)
+		db.forgetLease(cmd.LockID)
+
+	case opReleaseKey:
+		res.err = db.local.ReleaseKey(cmd.LockID, cmd.Keys[0])
+		db.forgetLease(cmd.LockID)
+
+	case opDelete:
+		res.err = db.local.Delete(cmd.LockID, cmd.Keys[0])
+		db.forgetLease(cmd.LockID)
+
+	case opCompareAndSwap:
+		res.version, res.err = db.local.CompareAndSwap(cmd.Keys[0], cmd.Version, cmd.Value)
+
+	case opRenew:
+		res.err = db.renew(cmd.LockID, cmd.Deadline)
+
+	case opConfirm:
+		res.err = db.confirm(cmd.LockID, cmd.Deadline)
+
+	case opExpire:
+		db.mu.Lock()
+		deadline, leased := db.leases[cmd.LockID]
+		db.mu.Unlock()
+		if leased && deadline.Equal(cmd.Deadline) {
+			db.local.Release(cmd.LockID)
+			db.forgetLease(cmd.LockID)
+		}
+
+	case opForceRelease:
+		res.infos, res.err = db.local.ForceRelease(cmd.LockID)
+		db.forgetLease(cmd.LockID)
+
+	case opRestore:
+		res.err = db.local.Restore(bytes.NewReader(cmd.Snapshot), cmd.Force)
+		db.mu.Lock()
+		for lockId := range db.leases {
+			if !db.local.Holds(lockId) {
+				delete(db.leases, lockId)
+			}
+		}
+		db.mu.Unlock()
+	}
+	return res
+}
+
+// notify wakes up the lock requests waiting for a change.
+func (db *DB) notify() {
+	db.mu.Lock()
+	close(db.changed)
+	db.changed = make(chan struct{})
+	db.mu.Unlock()
+}
+
+func (db *DB) setLease(lockId memdb.LockID, deadline time.Time) {
+	if deadline.IsZero() {
+		return
+	}
+	db.mu.Lock()
+	db.leases[lockId] = deadline
+	db.mu.Unlock()
+}
+
+// forgetLease drops the lease of lockId if it holds no more keys.
+func (db *DB) forgetLease(lockId memdb.LockID) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if !db.local.Holds(lockId) {
+		delete(db.leases, lockId)
+	}
+}
+
+func (db *DB) renew(lockId memdb.LockID, deadline time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if !db.local.Holds(lockId) {
+		return memdb.ErrLockIdNotFound
+	}
+	if _, leased := db.leases[lockId]; !leased {
+		return memdb.ErrNoLease
+	}
+	db.leases[lockId] = deadline
+	return nil
+}
+
+// confirm drops the grant lease of lockId, unless the lease has ended before.
+func (db *DB) confirm(lockId memdb.LockID, deadline time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if !db.local.Holds(lockId) {
+		return memdb.ErrLockIdNotFound
+	}
+	if current, leased := db.leases[lockId]; !leased || !current.Equal(deadline) {
+		return memdb.ErrNoLease
+	}
+	delete(db.leases, lockId)
+	return nil
+}
+
+// reaper ends the expired leases, only the leader does so.
+func (db *DB) reaper() {
+	defer db.wg.Done()
+
+	ticker := time.NewTicker(memdb.DefaultReapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.done:
+			return
+		case now := <-ticker.C:
+			if !db.raft.IsLeader() {
+				continue
+			}
+
+			db.mu.Lock()
+			expired := make(map[memdb.LockID]time.Time)
+			for lockId, deadline := range db.leases {
+				if !now.Before(deadline) {
+					expired[lockId] = deadline
+				}
+			}
+			db.mu.Unlock()
+
+			for lockId, deadline := range expired {
+				// a failed expiration is proposed again on the next tick
+				db.propose(context.Background(), &command{Op: opExpire, LockID: lockId, Deadline: deadline})
+			}
+		}
+	}
+}
+
+// propose commits cmd and returns the result it had on this node.
+func (db *DB) propose(ctx context.Context, cmd *command) (*result, error) {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, DefaultCommitTimeout)
+	defer cancel()
+
+	out, err := db.raft.Propose(ctx, data)
+	if err != nil {
+		return nil, err
+	}
+	res := out.(*result)
+	return res, res.err
+}
+
+// acquire proposes a lock command until it gets the keys or the wait budget runs out.
+// A new lock without a TTL is confirmed before it's returned, see DefaultGrantLease.
+func (db *DB) acquire(ctx context.Context, cmd *command, opts memdb.LockOptions) (*result, error) {
+	var timeout <-chan time.Time
+	if opts.Wait > 0 {
+		timer := time.NewTimer(opts.Wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		db.mu.Lock()
+		changed := db.changed
+		db.mu.Unlock()
+
+		granted := cmd.LockID == "" && opts.TTL <= 0
+		if opts.TTL > 0 {
+			cmd.Deadline = time.Now().Add(opts.TTL)
+		} else if granted {
+			cmd.Deadline = time.Now().Add(db.grantLease)
+		}
+
+		res, err := db.propose(ctx, cmd)
+		if err == nil && granted {
+			return res, db.confirmGrant(ctx, res.lockId, cmd.Deadline)
+		}
+		if _, locked := err.(*memdb.LockedError); !locked || opts.Wait < 0 {
+			return res, err
+		}
+
+		select {
+		case <-changed:
+		case <-timeout:
+			return res, err
+		case <-ctx.Done():
+			return res, ctx.Err()
+		}
+	}
+}
+
+// confirmGrant drops the grant lease of a new lock the requester still waits for.
+// If that fails, the lock is released, it would end with the lease anyway.
+func (db *DB) confirmGrant(ctx context.Context, lockId memdb.LockID, deadline time.Time) error {
+	err := ctx.Err()
+	if err == nil {
+		// the confirmation is useless once the lease has ended
+		confirmCtx, cancel := context.WithDeadline(context.Background(), deadline)
+		_, err = db.propose(confirmCtx, &command{Op: opConfirm, LockID: lockId, Deadline: deadline})
+		cancel()
+	}
+	if err != nil {
+		db.propose(context.Background(), &command{Op: opRelease, LockID: lockId})
+	}
+	return err
+}
+
+func (db *DB) Name() string {
+	return db.local.Name()
+}
+
+func (db *DB) Put(key memdb.Key, value memdb.Value) memdb.LockID {
+	lockId, _, _ := db.PutWithOptions(context.Background(), key, value, memdb.LockOptions{})
+	return lockId
+}
+
+func (db *DB) PutWithTTL(key memdb.Key, value memdb.Value, ttl time.Duration) memdb.LockID {
+	lockId, _, _ := db.PutWithOptions(context.Background(), key, value, memdb.LockOptions{TTL: ttl})
+	return lockId
+}
+
+func (db *DB) PutContext(ctx context.Context, key memdb.Key, value memdb.Value) (memdb.LockID, error) {
+	lockId, _, err := db.PutWithOptions(ctx, key, value, memdb.LockOptions{})
+	return lockId, err
+}
+
+// PutWithOptions returns memdb.ErrUnsupportedOption if Priority or Holder is given.
+func (db *DB) PutWithOptions(ctx context.Context, key memdb.Key, value memdb.Value, opts memdb.LockOptions) (memdb.LockID, memdb.FencingToken, error) {
+	if opts.Priority != 0 || opts.Holder != "" {
+		return "", 0, memdb.ErrUnsupportedOption
+	}
+
+	res, err := db.acquire(ctx, &command{Op: opPut, Keys: []memdb.Key{key}, Value: value}, opts)
+	if err != nil {
+		return "", 0, err
+	}
+	return res.lockId, res.tokens[key], nil
+}
+
+func (db *DB) GetAndLock(key memdb.Key) (memdb.LockID, memdb.Value, error) {
+	lockId, value, _, err := db.GetAndLockWithOptions(context.Background(), key, memdb.LockOptions{})
+	return lockId, value, err
+}
+
+func (db *DB) GetAndLockWithTTL(key memdb.Key, ttl time.Duration) (memdb.LockID, memdb.Value, error) {
+	lockId, value, _, err := db.GetAndLockWithOptions(context.Background(), key, memdb.LockOptions{TTL: ttl})
+	return lockId, value, err
+}
+
+func (db *DB) GetAndLockContext(ctx context.Context, key memdb.Key) (memdb.LockID, memdb.Value, error) {
+	lockId, value, _, err := db.GetAndLockWithOptions(ctx, key, memdb.LockOptions{})
+	return lockId, value, err
+}
+
+func (db *DB) GetAndRLock(key memdb.Key) (memdb.LockID, memdb.Value, error) {
+	lockId, value, _, err := db.GetAndLockWithOptions(context.Background(), key, memdb.LockOptions{Mode: memdb.Shared})
+	return lockId, value, err
+}
+
+func (db *DB) TryGetAndLock(key memdb.Key) (memdb.LockID, memdb.Value, error) {
+	lockId, value, _, err := db.GetAndLockWithOptions(context.Background(), key, memdb.LockOptions{Wait: memdb.NoWait})
+	return lockId, value, err
+}
+
+func (db *DB) GetAndLockTimeout(key memdb.Key, d time.Duration) (memdb.LockID, memdb.Value, error) {
+	lockId, value, _, err := db.GetAndLockWithOptions(context.Background(), key, memdb.LockOptions{Wait: d})
+	return lockId, value, err
+}
+
+func (db *DB) GetAndLockMany(keys []memdb.Key) (memdb.LockID, map[memdb.Key]memdb.Value, error) {
+	lockId, values, _, err := db.GetAndLockManyWithOptions(context.Background(), keys, memdb.LockOptions{})
+	return lockId, values, err
+}
+
+// GetAndLockWithOptions returns memdb.ErrUnsupportedOption if Priority is given.
+func (db *DB) GetAndLockWithOptions(ctx context.Context, key memdb.Key, opts memdb.LockOptions) (memdb.LockID, memdb.Value, memdb.FencingToken, error) {
+	lockId, values, tokens, err := db.GetAndLockManyWithOptions(ctx, []memdb.Key{key}, opts)
+	if err != nil {
+		return "", memdb.EmptyValue, 0, err
+	}
+	return lockId, values[key], tokens[key], nil
+}
+
+// GetAndLockManyWithOptions returns memdb.ErrUnsupportedOption if Priority is given.
+func (db *DB) GetAndLockManyWithOptions(ctx context.Context, keys []memdb.Key, opts memdb.LockOptions) (memdb.LockID, map[memdb.Key]memdb.Value, map[memdb.Key]memdb.FencingToken, error) {
+	if len(keys) == 0 {
+		return "", nil, nil, memdb.ErrNoKeys
+	}
+	if opts.Priority != 0 {
+		return "", nil, nil, memdb.ErrUnsupportedOption
+	}
+
+	res, err := db.acquire(ctx, &command{Op: opLock, Keys: keys, Mode: opts.Mode, LockID: opts.Holder}, opts)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	return res.lockId, res.values, res.tokens, nil
+}
+
+func (db *DB) Update(lockId memdb.LockID, key memdb.Key, value memdb.Value, releaseLock bool) error {
+	return db.UpdateWithToken(lockId, key, value, releaseLock, 0)
+}
+
+func (db *DB) UpdateWithToken(lockId memdb.LockID, key memdb.Key, value memdb.Value, releaseLock bool, token memdb.FencingToken) error {
+	_, err := db.propose(context.Background(), &command{Op: opUpdate, Keys: []memdb.Key{key}, Value: value, LockID: lockId, Release: releaseLock, Token: token})
+	return err
+}
+
+func (db *DB) Release(lockId memdb.LockID) error {
+	_, err := db.propose(context.Background(), &command{Op: opRelease, LockID: lockId})
+	return err
+}
+
+func (db *DB) ReleaseKey(lockId memdb.LockID, key memdb.Key) error {
+	_, err := db.propose(context.Background(), &command{Op: opReleaseKey, Keys: []memdb.Key{key}, LockID: lockId})
+	return err
+}
+
+func (db *DB) Delete(lockId memdb.LockID, key memdb.Key) error {
+	_, err := db.propose(context.Background(), &command{Op: opDelete, Keys: []memdb.Key{key}, LockID: lockId})
+	return err
+}
+
+func (db *DB) CompareAndSwap(key memdb.Key, expectedVersion memdb.Version, value memdb.Value) (memdb.Version, error) {
+	res, err := db.propose(context.Background(), &command{Op: opCompareAndSwap, Keys: []memdb.Key{key}, Value: value, Version: expectedVersion})
+	if err != nil {
+		return 0, err
+	}
+	return res.version, nil
+}
+
+func (db *DB) Renew(lockId memdb.LockID, extendBy time.Duration) (time.Time, error) {
+	deadline := time.Now().Add(extendBy)
+	if _, err := db.propose(context.Background(), &command{Op: opRenew, LockID: lockId, Deadline: deadline}); err != nil {
+		return time.Time{}, err
+	}
+	return deadline, nil
+}
+
+func (db *DB) ForceRelease(lockId memdb.LockID) ([]memdb.LockInfo, error) {
+	res, err := db.propose(context.Background(), &command{Op: opForceRelease, LockID: lockId})
+	if err != nil {
+		return nil, err
+	}
+	return res.infos, nil
+}
+
+// Restore replaces the values on all the nodes, the snapshot is verified by every node when it's applied.
+// The snapshot is committed in a single command, so a snapshot over about 3/4 of MaxCommandSize
+// (the rest is taken by its encoding) is refused with ErrCommandTooLarge.
+func (db *DB) Restore(r io.Reader, force bool) error {
+	snapshot, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	_, err = db.propose(context.Background(), &command{Op: opRestore, Snapshot: snapshot, Force: force})
+	return err
+}
+
+func (db *DB) Get(lockId memdb.LockID, key memdb.Key) (memdb.Value, error) {
+	return db.local.Get(lockId, key)
+}
+
+func (db *DB) GetWithVersion(lockId memdb.LockID, key memdb.Key) (memdb.Value, memdb.Version, error) {
+	return db.local.GetWithVersion(lockId, key)
+}
+
+// Holds reports whether lockId holds any key in the copy of the database on this node.
+func (db *DB) Holds(lockId memdb.LockID) bool {
+	return db.local.Holds(lockId)
+}
+
+func (db *DB) Peek(key memdb.Key) (memdb.Value, memdb.Version, bool, error) {
+	return db.local.Peek(key)
+}
+
+func (db *DB) Scan(prefix memdb.Key, startAfter memdb.Key, limit int) ([]memdb.Key, bool) {
+	return db.local.Scan(prefix, startAfter, limit)
+}
+
+// Waiters returns no waiters, lock requests wait on the leader outside of the database.
+func (db *DB) Waiters(key memdb.Key) ([]memdb.WaiterInfo, error) {
+	return db.local.Waiters(key)
+}
+
+// Locks returns the held key locks with the ends of their leases.
+func (db *DB) Locks() []memdb.LockInfo {
+	locks := db.local.Locks()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for i := range locks {
+		locks[i].Deadline = db.leases[locks[i].LockID]
+	}
+	return locks
+}
+
+func (db *DB) Snapshot(w io.Writer) error {
+	return db.local.Snapshot(w)
+}
+
+// Compact does nothing, the copy of the database is rebuilt from the Raft log, which isn't compacted either.
+func (db *DB) Compact() error {
+	return memdb.ErrNotPersistent
+}
+
+// Changes returns the changes applied to the copy of the database on this node,
+// a replica may follow any node of the cluster.
+func (db *DB) Changes(seq uint64) ([]memdb.Change, <-chan struct{}, error) {
+	return db.local.Changes(seq)
+}
+
+// ApplyChange refuses the change, the database only changes by the commands of the Raft log.
+func (db *DB) ApplyChange(change memdb.Change) error {
+	return ErrReplicated
+}
+
+func (db *DB) DirectGet(key memdb.Key) (memdb.Value, bool) {
+	return db.local.DirectGet(key)
+}
+
+// Close stops the node.
+func (db *DB) Close() error {
+	close(db.done)
+	db.wg.Wait()
+
+	err := db.raft.Close()
+	if closeErr := db.local.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,254 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"memdb"
+	"net/http"
+	"net/http/httptest"
+	"rest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestDBs runs the nodes of a replicated database in this process and returns them with the leader.
+func newTestDBs(t *testing.T, size int) (map[string]*DB, map[string]*httptest.Server, string) {
+	dbs := make(map[string]*DB)
+	servers := make(map[string]*httptest.Server)
+
+	peers := make(map[string]string)
+	for i := 0; i < size; i++ {
+		id := fmt.Sprintf("node%d", i)
+		servers[id] = httptest.NewUnstartedServer(nil)
+		peers[id] = "http://" + servers[id].Listener.Addr().String()
+	}
+
+	for id, server := range servers {
+		db, err := Open(testConfig(id, peers), rest.NoLog)
+		assert.NoError(t, err)
+		dbs[id] = db
+		server.Config.Handler = db.Handler(rest.NewRestServerWithMemDB(db, rest.NoLog).Router())
+		server.Start()
+	}
+
+	t.Cleanup(func() {
+		for id, db := range dbs {
+			servers[id].CloseClientConnections()
+			servers[id].Close()
+			db.Close()
+		}
+	})
+
+	var leader string
+	assert.Eventually(t, func() bool {
+		leader = ""
+		for _, db := range dbs {
+			if db.Raft().IsLeader() {
+				leader = db.Raft().config.ID
+			}
+		}
+		if leader == "" {
+			return false
+		}
+		for _, db := range dbs {
+			if id, _ := db.Raft().Leader(); id != leader {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+	return dbs, servers, leader
+}
+
+func TestDBReplication(t *testing.T) {
+	dbs, _, leader := newTestDBs(t, 3)
+	db := dbs[leader]
+
+	lockId := db.Put(memdb.Key("key0"), memdb.Value("value0"))
+	assert.NotEqual(t, memdb.LockID(""), lockId)
+	assert.NoError(t, db.Update(lockId, memdb.Key("key0"), memdb.Value("value1"), true))
+
+	version, err := db.CompareAndSwap(memdb.Key("key0"), 2, memdb.Value("value2"))
+	assert.NoError(t, err)
+	assert.Equal(t, memdb.Version(3), version)
+	_, err = db.CompareAndSwap(memdb.Key("key0"), 2, memdb.Value("value3"))
+	assert.Equal(t, memdb.ErrVersionMismatch, err)
+
+	for id, node := range dbs {
+		node := node
+		assert.Eventually(t, func() bool {
+			value, version, reserved, err := node.Peek(memdb.Key("key0"))
+			return err == nil && value == memdb.Value("value2") && version == 3 && !reserved
+		}, 5*time.Second, 10*time.Millisecond)
+
+		if id != leader {
+			_, _, err := node.PutWithOptions(context.Background(), memdb.Key("key1"), memdb.Value("value1"), memdb.LockOptions{})
+			assert.Equal(t, ErrNotLeader, err)
+		}
+	}
+
+	// every node has the same locks
+	lockId, _, err = db.TryGetAndLock(memdb.Key("key0"))
+	assert.NoError(t, err)
+	for _, node := range dbs {
+		node := node
+		assert.Eventually(t, func() bool {
+			locks := node.Locks()
+			return len(locks) == 1 && locks[0].LockID == lockId
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+}
+
+func TestDBLockWait(t *testing.T) {
+	dbs, _, leader := newTestDBs(t, 3)
+	db := dbs[leader]
+
+	lockId := db.Put(memdb.Key("key0"), memdb.Value("value0"))
+
+	_, _, err := db.TryGetAndLock(memdb.Key("key0"))
+	assert.IsType(t, &memdb.LockedError{}, err)
+	_, _, err = db.GetAndLockTimeout(memdb.Key("key0"), 50*time.Millisecond)
+	assert.IsType(t, &memdb.LockedError{}, err)
+
+	type acquired struct {
+		lockId memdb.LockID
+		value  memdb.Value
+		err    error
+	}
+	done := make(chan acquired)
+	go func() {
+		lockId, value, err := db.GetAndLockTimeout(memdb.Key("key0"), 5*time.Second)
+		done <- acquired{lockId, value, err}
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	assert.NoError(t, db.Update(lockId, memdb.Key("key0"), memdb.Value("value1"), true))
+
+	a := <-done
+	assert.NoError(t, a.err)
+	assert.NotEqual(t, lockId, a.lockId)
+	assert.Equal(t, memdb.Value("value1"), a.value)
+}
+
+func TestDBLease(t *testing.T) {
+	dbs, _, leader := newTestDBs(t, 3)
+	db := dbs[leader]
+
+	lockId := db.PutWithTTL(memdb.Key("key0"), memdb.Value("value0"), 300*time.Millisecond)
+	locks := db.Locks()
+	assert.Len(t, locks, 1)
+	assert.False(t, locks[0].Deadline.IsZero())
+
+	deadline, err := db.Renew(lockId, time.Second)
+	assert.NoError(t, err)
+	assert.True(t, deadline.After(locks[0].Deadline))
+
+	lockId1 := db.Put(memdb.Key("key1"), memdb.Value("value1"))
+	_, err = db.Renew(lockId1, time.Second)
+	assert.Equal(t, memdb.ErrNoLease, err)
+
+	// the leader ends the lease on every node
+	for _, node := range dbs {
+		node := node
+		assert.Eventually(t, func() bool {
+			_, _, reserved, err := node.Peek(memdb.Key("key0"))
+			return err == nil && !reserved
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+	assert.Equal(t, memdb.ErrLockIdNotFound, db.Update(lockId, memdb.Key("key0"), memdb.Value("value00"), true))
+}
+
+func TestDBGrantLease(t *testing.T) {
+	dbs, _, leader := newTestDBs(t, 3)
+	db := dbs[leader]
+	db.grantLease = 200 * time.Millisecond
+
+	// the requester got the lock, so it has no lease
+	lockId := db.Put(memdb.Key("key0"), memdb.Value("value0"))
+	locks := db.Locks()
+	assert.Len(t, locks, 1)
+	assert.True(t, locks[0].Deadline.IsZero())
+	time.Sleep(2 * db.grantLease)
+	assert.NoError(t, db.Update(lockId, memdb.Key("key0"), memdb.Value("value1"), true))
+
+	// nobody confirms a lock the requester stopped waiting for
+	cmd := &command{Op: opLock, Keys: []memdb.Key{memdb.Key("key0")}, Deadline: time.Now().Add(db.grantLease)}
+	_, err := db.propose(context.Background(), cmd)
+	assert.NoError(t, err)
+	for _, node := range dbs {
+		node := node
+		assert.Eventually(t, func() bool {
+			return len(node.Locks()) == 0
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	// the requester gave up before the lock was confirmed
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, _, err = db.GetAndLockWithOptions(ctx, memdb.Key("key0"), memdb.LockOptions{})
+	assert.Equal(t, context.Canceled, err)
+	assert.Eventually(t, func() bool {
+		return len(db.Locks()) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestDBUnsupportedOptions(t *testing.T) {
+	dbs, _, leader := newTestDBs(t, 1)
+	db := dbs[leader]
+
+	lockId := db.Put(memdb.Key("key0"), memdb.Value("value0"))
+	_, _, err := db.PutWithOptions(context.Background(), memdb.Key("key1"), memdb.Value("value1"), memdb.LockOptions{Holder: lockId})
+	assert.Equal(t, memdb.ErrUnsupportedOption, err)
+	_, _, err = db.PutWithOptions(context.Background(), memdb.Key("key1"), memdb.Value("value1"), memdb.LockOptions{Priority: 1})
+	assert.Equal(t, memdb.ErrUnsupportedOption, err)
+	_, _, _, err = db.GetAndLockWithOptions(context.Background(), memdb.Key("key0"), memdb.LockOptions{Priority: 1})
+	assert.Equal(t, memdb.ErrUnsupportedOption, err)
+	_, _, _, err = db.GetAndLockManyWithOptions(context.Background(), []memdb.Key{memdb.Key("key0")}, memdb.LockOptions{Priority: 1})
+	assert.Equal(t, memdb.ErrUnsupportedOption, err)
+
+	// nothing has been locked
+	assert.Len(t, db.Locks(), 1)
+}
+
+func TestDBRedirect(t *testing.T) {
+	dbs, servers, leader := newTestDBs(t, 3)
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	var follower string
+	for id := range dbs {
+		if id != leader {
+			follower = id
+		}
+	}
+
+	req0, err0 := http.NewRequest("PUT", servers[follower].URL+"/values/key0?ttl=10s", bytes.NewReader([]byte("value0")))
+	assert.Nil(t, err0)
+	resp0, err0 := client.Do(req0)
+	assert.Nil(t, err0)
+	resp0.Body.Close()
+	assert.Equal(t, http.StatusTemporaryRedirect, resp0.StatusCode)
+	assert.Equal(t, servers[leader].URL+"/values/key0?ttl=10s", resp0.Header.Get("Location"))
+
+	// the default client follows the redirect
+	req1, err1 := http.NewRequest("PUT", servers[follower].URL+"/values/key0", bytes.NewReader([]byte("value0")))
+	assert.Nil(t, err1)
+	resp1, err1 := http.DefaultClient.Do(req1)
+	assert.Nil(t, err1)
+	resp1.Body.Close()
+	assert.Equal(t, http.StatusOK, resp1.StatusCode)
+
+	// reads are served by the follower
+	assert.Eventually(t, func() bool {
+		resp, err := client.Get(servers[follower].URL + "/values/key0")
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond)
+}
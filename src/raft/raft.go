@@ -0,0 +1,652 @@
+// Package raft replicates memdb across a cluster of nodes with the Raft consensus algorithm.
+//
+// Raft keeps a log of commands which is the same on every node: the leader appends the commands,
+// replicates them to the followers and commits them once a majority of the nodes has them.
+// Committed commands are applied to a StateMachine in the log order on every node.
+// DB is the memdb.MemDB built on top of it.
+//
+// The log is never compacted, it grows with every write and a node applies it from the start
+// when it restarts or joins. A snapshot of memdb can't replace a prefix of the log,
+// it leaves out the locks which the following commands depend on.
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotLeader       = errors.New("Not the leader")
+	ErrLeadershipLost  = errors.New("Leadership lost, the command may or may not be committed")
+	ErrClosed          = errors.New("Raft is closed")
+	ErrEmptyCommand    = errors.New("Command is empty")
+	ErrCommandTooLarge = errors.New("Command is too large")
+	ErrReplicated      = errors.New("Database is replicated by Raft")
+)
+
+const (
+	// DefaultHeartbeatInterval is how often the leader contacts the followers when there's nothing to replicate.
+	DefaultHeartbeatInterval = 50 * time.Millisecond
+
+	// DefaultElectionTimeout is how long a follower waits for the leader before it starts an election.
+	DefaultElectionTimeout = 500 * time.Millisecond
+)
+
+// MaxCommandSize limits the size of a command, the entry must reach the followers within the election timeout.
+const MaxCommandSize = 256 << 10
+
+// maxBatch limits the number of entries sent in one AppendEntries request,
+// maxBatchSize limits the size of their commands, a larger command is sent alone.
+const (
+	maxBatch     = 256
+	maxBatchSize = 256 << 10
+)
+
+// State is the role of a node in the cluster.
+type State int
+
+const (
+	Follower State = iota
+	Candidate
+	Leader
+)
+
+func (s State) String() string {
+	switch s {
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	}
+	return "follower"
+}
+
+// Config configures a node of the cluster.
+type Config struct {
+	// ID of this node, it must be one of Peers
+	ID string
+
+	// Peers maps IDs of all the nodes of the cluster, this one included, to their base URLs, e.g. http://127.0.0.1:8081
+	Peers map[string]string
+
+	// Dir keeps the term, the vote and the whole log of the node. Empty Dir keeps them in memory only,
+	// such a node must not rejoin the cluster after a restart.
+	Dir string
+
+	// HeartbeatInterval is how often the leader contacts the followers, zero means DefaultHeartbeatInterval
+	HeartbeatInterval time.Duration
+
+	// ElectionTimeout is the shortest time without the leader before an election, the actual timeout
+	// is picked randomly up to its double. Zero means DefaultElectionTimeout
+	ElectionTimeout time.Duration
+}
+
+// Addr returns the host and port this node listens on, taken from its URL.
+func (c Config) Addr() (string, error) {
+	u, err := url.Parse(c.Peers[c.ID])
+	if err != nil {
+		return "", err
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("URL of node %q has no host", c.ID)
+	}
+	return u.Host, nil
+}
+
+// ParsePeers parses the peers of a cluster given as comma separated ID=URL pairs,
+// e.g. a=http://127.0.0.1:8081,b=http://127.0.0.1:8082,c=http://127.0.0.1:8083
+func ParsePeers(s string) (map[string]string, error) {
+	peers := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		id, peerURL, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if !found || id == "" || peerURL == "" {
+			return nil, fmt.Errorf("Peer %q is not ID=URL", pair)
+		}
+		if _, exists := peers[id]; exists {
+			return nil, fmt.Errorf("Peer %q is given twice", id)
+		}
+		peers[id] = strings.TrimSuffix(peerURL, "/")
+	}
+	return peers, nil
+}
+
+// StateMachine applies the committed commands, every node applies the same commands in the same order.
+// Apply must be deterministic, its result is returned by Propose on the leader.
+type StateMachine interface {
+	Apply(command []byte) interface{}
+}
+
+// Entry is an entry of the log, an entry without command is appended by every new leader.
+type Entry struct {
+	Term    uint64 `json:"term"`
+	Command []byte `json:"command,omitempty"`
+}
+
+// Status describes the node, see GET /raft/status.
+type Status struct {
+	ID          string `json:"id"`
+	State       string `json:"state"`
+	Term        uint64 `json:"term"`
+	Leader      string `json:"leader"`
+	LastIndex   uint64 `json:"last_index"`
+	CommitIndex uint64 `json:"commit_index"`
+	LastApplied uint64 `json:"last_applied"`
+}
+
+// outcome is the result of a proposed command.
+type outcome struct {
+	result interface{}
+	err    error
+}
+
+// proposal waits for the command the leader appended to the log in term.
+type proposal struct {
+	term   uint64
+	result chan outcome
+}
+
+// Raft is a node of the cluster.
+type Raft struct {
+	mu      sync.Mutex
+	config  Config
+	fsm     StateMachine
+	logger  *log.Logger
+	storage *storage
+	client  *http.Client
+
+	// persistent state, log[0] is a sentinel so that the index of an entry is its position
+	term     uint64
+	votedFor string
+	log      []Entry
+
+	state            State
+	leader           string
+	commitIndex      uint64
+	lastApplied      uint64
+	electionDeadline time.Time
+	lastBroadcast    time.Time
+
+	// leader state
+	nextIndex   map[string]uint64
+	matchIndex  map[string]uint64
+	replicating map[string]bool
+	pending     map[uint64]*proposal
+
+	applyCond *sync.Cond
+	closed    bool
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// New starts the node, it joins the cluster as a follower. Commands committed before
+// a restart are applied to fsm again once the node learns they're committed.
+func New(config Config, fsm StateMachine, logger *log.Logger) (*Raft, error) {
+	if _, exists := config.Peers[config.ID]; !exists {
+		return nil, fmt.Errorf("Node %q is not one of the peers", config.ID)
+	}
+	if config.HeartbeatInterval <= 0 {
+		config.HeartbeatInterval = DefaultHeartbeatInterval
+	}
+	if config.ElectionTimeout <= 0 {
+		config.ElectionTimeout = DefaultElectionTimeout
+	}
+
+	r := &Raft{
+		config:      config,
+		fsm:         fsm,
+		logger:      logger,
+		client:      &http.Client{Timeout: config.ElectionTimeout},
+		log:         []Entry{{}},
+		nextIndex:   make(map[string]uint64),
+		matchIndex:  make(map[string]uint64),
+		replicating: make(map[string]bool),
+		pending:     make(map[uint64]*proposal),
+		done:        make(chan struct{}),
+	}
+	r.applyCond = sync.NewCond(&r.mu)
+
+	if config.Dir != "" {
+		storage, term, votedFor, entries, err := openStorage(config.Dir)
+		if err != nil {
+			return nil, err
+		}
+		r.storage = storage
+		r.term = term
+		r.votedFor = votedFor
+		r.log = append(r.log, entries...)
+	}
+
+	r.resetElectionDeadline()
+
+	r.wg.Add(2)
+	go r.ticker()
+	go r.applier()
+	return r, nil
+}
+
+// Propose appends command to the log and waits until it's committed and applied on this node,
+// it returns the result of StateMachine.Apply. Only the leader accepts commands, the others
+// return ErrNotLeader. If the leader is replaced in the meantime, ErrLeadershipLost is returned.
+// A command larger than MaxCommandSize is refused with ErrCommandTooLarge.
+func (r *Raft) Propose(ctx context.Context, command []byte) (interface{}, error) {
+	if len(command) == 0 {
+		return nil, ErrEmptyCommand
+	}
+	if len(command) > MaxCommandSize {
+		return nil, ErrCommandTooLarge
+	}
+
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if r.state != Leader {
+		r.mu.Unlock()
+		return nil, ErrNotLeader
+	}
+
+	if err := r.appendEntries(Entry{Term: r.term, Command: command}); err != nil {
+		r.mu.Unlock()
+		return nil, err
+	}
+	index := r.lastIndex()
+	p := &proposal{term: r.term, result: make(chan outcome, 1)}
+	r.pending[index] = p
+
+	r.advanceCommitIndex()
+	r.broadcast()
+	r.mu.Unlock()
+
+	select {
+	case o := <-p.result:
+		return o.result, o.err
+	case <-ctx.Done():
+		r.mu.Lock()
+		if r.pending[index] == p {
+			delete(r.pending, index)
+		}
+		r.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// IsLeader reports whether this node is the leader as far as it knows.
+func (r *Raft) IsLeader() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.state == Leader
+}
+
+// Leader returns ID and URL of the current leader, they're empty if it's not known.
+func (r *Raft) Leader() (string, string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.leader, r.config.Peers[r.leader]
+}
+
+func (r *Raft) Status() Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return Status{
+		ID:          r.config.ID,
+		State:       r.state.String(),
+		Term:        r.term,
+		Leader:      r.leader,
+		LastIndex:   r.lastIndex(),
+		CommitIndex: r.commitIndex,
+		LastApplied: r.lastApplied,
+	}
+}
+
+// Close stops the node, pending proposals fail with ErrClosed.
+func (r *Raft) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	close(r.done)
+	r.failPending(ErrClosed)
+	r.applyCond.Broadcast()
+	r.mu.Unlock()
+
+	r.wg.Wait()
+
+	if r.storage != nil {
+		return r.storage.Close()
+	}
+	return nil
+}
+
+// The caller must hold r.mu.
+func (r *Raft) lastIndex() uint64 {
+	return uint64(len(r.log) - 1)
+}
+
+// The caller must hold r.mu.
+func (r *Raft) quorum() int {
+	return len(r.config.Peers)/2 + 1
+}
+
+// The caller must hold r.mu.
+func (r *Raft) resetElectionDeadline() {
+	timeout := r.config.ElectionTimeout + time.Duration(rand.Int63n(int64(r.config.ElectionTimeout)))
+	r.electionDeadline = time.Now().Add(timeout)
+}
+
+// setTerm persists the term and the vote before they're used.
+// The caller must hold r.mu.
+func (r *Raft) setTerm(term uint64, votedFor string) error {
+	if r.storage != nil {
+		if err := r.storage.SaveState(term, votedFor); err != nil {
+			return err
+		}
+	}
+	r.term = term
+	r.votedFor = votedFor
+	return nil
+}
+
+// appendEntries persists entries at the end of the log before they're used.
+// The caller must hold r.mu.
+func (r *Raft) appendEntries(entries ...Entry) error {
+	if r.storage != nil {
+		if err := r.storage.Append(entries); err != nil {
+			return err
+		}
+	}
+	r.log = append(r.log, entries...)
+	return nil
+}
+
+// truncateLog removes the entries from index on, they're never committed ones.
+// The caller must hold r.mu.
+func (r *Raft) truncateLog(index uint64) error {
+	if r.storage != nil {
+		if err := r.storage.Truncate(index); err != nil {
+			return err
+		}
+	}
+	r.log = r.log[:index]
+	return nil
+}
+
+// stepDown makes the node a follower of term.
+// The caller must hold r.mu.
+func (r *Raft) stepDown(term uint64) error {
+	if term > r.term {
+		if err := r.setTerm(term, ""); err != nil {
+			return err
+		}
+		r.leader = ""
+	}
+
+	if r.state == Leader {
+		r.logger.Printf("Raft %s: stepping down in term %d", r.config.ID, r.term)
+		r.failPending(ErrLeadershipLost)
+	}
+	r.state = Follower
+	return nil
+}
+
+// failPending fails all the proposals still waiting for their commands.
+// The caller must hold r.mu.
+func (r *Raft) failPending(err error) {
+	for index, p := range r.pending {
+		p.result <- outcome{err: err}
+		delete(r.pending, index)
+	}
+}
+
+func (r *Raft) ticker() {
+	defer r.wg.Done()
+
+	interval := r.config.HeartbeatInterval / 5
+	if interval > 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case now := <-ticker.C:
+			r.mu.Lock()
+			if r.state == Leader {
+				if now.Sub(r.lastBroadcast) >= r.config.HeartbeatInterval {
+					r.broadcast()
+				}
+			} else if now.After(r.electionDeadline) {
+				r.startElection()
+			}
+			r.mu.Unlock()
+		}
+	}
+}
+
+// startElection asks the other nodes to vote for this one in a new term.
+// The caller must hold r.mu.
+func (r *Raft) startElection() {
+	r.resetElectionDeadline()
+	if err := r.setTerm(r.term+1, r.config.ID); err != nil {
+		r.logger.Printf("Raft %s: can't start an election: %v", r.config.ID, err)
+		return
+	}
+	r.state = Candidate
+	r.leader = ""
+
+	term := r.term
+	args := &voteRequest{
+		Term:         term,
+		CandidateID:  r.config.ID,
+		LastLogIndex: r.lastIndex(),
+		LastLogTerm:  r.log[r.lastIndex()].Term,
+	}
+
+	votes := 1
+	if votes >= r.quorum() {
+		r.becomeLeader()
+		return
+	}
+
+	for peer := range r.config.Peers {
+		if peer == r.config.ID {
+			continue
+		}
+
+		go func(peer string) {
+			var reply voteReply
+			if err := r.call(peer, votePath, args, &reply); err != nil {
+				return
+			}
+
+			r.mu.Lock()
+			defer r.mu.Unlock()
+
+			if reply.Term > r.term {
+				r.stepDown(reply.Term)
+				return
+			}
+			if r.state != Candidate || r.term != term || !reply.VoteGranted {
+				return
+			}
+
+			votes++
+			if votes >= r.quorum() {
+				r.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// becomeLeader takes over the cluster, the entry it appends lets it commit the entries of the former leaders.
+// The caller must hold r.mu.
+func (r *Raft) becomeLeader() {
+	r.state = Leader
+	r.leader = r.config.ID
+	for peer := range r.config.Peers {
+		r.nextIndex[peer] = r.lastIndex() + 1
+		r.matchIndex[peer] = 0
+	}
+	r.logger.Printf("Raft %s: leader in term %d", r.config.ID, r.term)
+
+	if err := r.appendEntries(Entry{Term: r.term}); err != nil {
+		r.logger.Printf("Raft %s: can't append to the log: %v", r.config.ID, err)
+		r.stepDown(r.term)
+		return
+	}
+	r.advanceCommitIndex()
+	r.broadcast()
+}
+
+// broadcast replicates the log to the followers which aren't busy with the previous request.
+// The caller must hold r.mu.
+func (r *Raft) broadcast() {
+	r.lastBroadcast = time.Now()
+	for peer := range r.config.Peers {
+		if peer != r.config.ID && !r.replicating[peer] {
+			r.replicating[peer] = true
+			go r.replicate(peer)
+		}
+	}
+}
+
+// replicate sends the entries the follower is missing, or just a heartbeat.
+func (r *Raft) replicate(peer string) {
+	r.mu.Lock()
+	if r.state != Leader || r.closed {
+		r.replicating[peer] = false
+		r.mu.Unlock()
+		return
+	}
+
+	term := r.term
+	prevIndex := r.nextIndex[peer] - 1
+	last, size := prevIndex, 0
+	for last < r.lastIndex() && last-prevIndex < maxBatch {
+		size += len(r.log[last+1].Command)
+		if last > prevIndex && size > maxBatchSize {
+			break
+		}
+		last++
+	}
+	args := &appendRequest{
+		Term:         term,
+		LeaderID:     r.config.ID,
+		PrevLogIndex: prevIndex,
+		PrevLogTerm:  r.log[prevIndex].Term,
+		Entries:      append([]Entry(nil), r.log[prevIndex+1:last+1]...),
+		LeaderCommit: r.commitIndex,
+	}
+	r.mu.Unlock()
+
+	var reply appendReply
+	err := r.call(peer, appendPath, args, &reply)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.replicating[peer] = false
+
+	if err != nil {
+		return
+	}
+	if reply.Term > r.term {
+		r.stepDown(reply.Term)
+		return
+	}
+	if r.state != Leader || r.term != term || r.closed {
+		return
+	}
+
+	if reply.Success {
+		if match := prevIndex + uint64(len(args.Entries)); match > r.matchIndex[peer] {
+			r.matchIndex[peer] = match
+			r.nextIndex[peer] = match + 1
+			r.advanceCommitIndex()
+		}
+	} else if reply.ConflictIndex > 0 && reply.ConflictIndex < r.nextIndex[peer] {
+		r.nextIndex[peer] = reply.ConflictIndex
+	} else if r.nextIndex[peer] > 1 {
+		r.nextIndex[peer]--
+	}
+
+	// catch up without waiting for the next heartbeat
+	if r.nextIndex[peer] <= r.lastIndex() {
+		r.replicating[peer] = true
+		go r.replicate(peer)
+	}
+}
+
+// advanceCommitIndex commits the entries of the current term stored by a majority of the nodes,
+// with them all the entries before.
+// The caller must hold r.mu.
+func (r *Raft) advanceCommitIndex() {
+	for index := r.lastIndex(); index > r.commitIndex; index-- {
+		if r.log[index].Term != r.term {
+			// entries of the former terms are committed only by an entry of this term
+			break
+		}
+
+		count := 1
+		for peer, match := range r.matchIndex {
+			if peer != r.config.ID && match >= index {
+				count++
+			}
+		}
+
+		if count >= r.quorum() {
+			r.commitIndex = index
+			r.applyCond.Broadcast()
+			break
+		}
+	}
+}
+
+// applier applies the committed entries to the state machine in the log order.
+func (r *Raft) applier() {
+	defer r.wg.Done()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for {
+		for !r.closed && r.lastApplied >= r.commitIndex {
+			r.applyCond.Wait()
+		}
+		if r.closed {
+			return
+		}
+
+		index := r.lastApplied + 1
+		entry := r.log[index]
+
+		var result interface{}
+		if len(entry.Command) > 0 {
+			r.mu.Unlock()
+			result = r.fsm.Apply(entry.Command)
+			r.mu.Lock()
+		}
+		r.lastApplied = index
+
+		if p, exists := r.pending[index]; exists {
+			delete(r.pending, index)
+			if p.term == entry.Term {
+				p.result <- outcome{result: result}
+			} else {
+				p.result <- outcome{err: ErrLeadershipLost}
+			}
+		}
+	}
+}
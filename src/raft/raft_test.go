@@ -0,0 +1,273 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"rest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recorder is a state machine which remembers the applied commands.
+type recorder struct {
+	mu       sync.Mutex
+	commands []string
+}
+
+func (f *recorder) Apply(command []byte) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.commands = append(f.commands, string(command))
+	return len(f.commands)
+}
+
+func (f *recorder) Commands() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.commands...)
+}
+
+// testCluster runs the nodes in this process, each of them behind its own HTTP server.
+type testCluster struct {
+	nodes   map[string]*Raft
+	fsms    map[string]*recorder
+	servers map[string]*httptest.Server
+}
+
+func testConfig(id string, peers map[string]string) Config {
+	return Config{ID: id, Peers: peers, HeartbeatInterval: 20 * time.Millisecond, ElectionTimeout: 150 * time.Millisecond}
+}
+
+func newTestCluster(t *testing.T, size int) *testCluster {
+	c := &testCluster{
+		nodes:   make(map[string]*Raft),
+		fsms:    make(map[string]*recorder),
+		servers: make(map[string]*httptest.Server),
+	}
+
+	peers := make(map[string]string)
+	for i := 0; i < size; i++ {
+		id := fmt.Sprintf("node%d", i)
+		c.servers[id] = httptest.NewUnstartedServer(nil)
+		peers[id] = "http://" + c.servers[id].Listener.Addr().String()
+	}
+
+	for id, server := range c.servers {
+		c.fsms[id] = &recorder{}
+		node, err := New(testConfig(id, peers), c.fsms[id], rest.NoLog)
+		assert.NoError(t, err)
+		c.nodes[id] = node
+		server.Config.Handler = node.Handler()
+		server.Start()
+	}
+
+	t.Cleanup(func() {
+		for id := range c.nodes {
+			c.stop(id)
+		}
+	})
+	return c
+}
+
+// stop cuts the node off the cluster and stops it.
+func (c *testCluster) stop(id string) {
+	c.servers[id].CloseClientConnections()
+	c.servers[id].Close()
+	c.nodes[id].Close()
+}
+
+// leader waits until the running nodes agree on a leader.
+func (c *testCluster) leader(t *testing.T, running ...string) string {
+	if len(running) == 0 {
+		for id := range c.nodes {
+			running = append(running, id)
+		}
+	}
+
+	var leader string
+	assert.Eventually(t, func() bool {
+		leader = ""
+		isRunning := false
+		for _, id := range running {
+			status := c.nodes[id].Status()
+			if status.Leader == "" || (leader != "" && status.Leader != leader) {
+				return false
+			}
+			leader = status.Leader
+			isRunning = isRunning || id == leader
+		}
+		return isRunning && c.nodes[leader].IsLeader()
+	}, 5*time.Second, 10*time.Millisecond)
+	return leader
+}
+
+func TestRaftSingleNode(t *testing.T) {
+	c := newTestCluster(t, 1)
+	leader := c.leader(t)
+
+	result, err := c.nodes[leader].Propose(context.Background(), []byte("command0"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, result)
+	assert.Equal(t, []string{"command0"}, c.fsms[leader].Commands())
+
+	_, err = c.nodes[leader].Propose(context.Background(), nil)
+	assert.Equal(t, ErrEmptyCommand, err)
+}
+
+func TestRaftReplication(t *testing.T) {
+	c := newTestCluster(t, 3)
+	leader := c.leader(t)
+
+	for id, node := range c.nodes {
+		if id != leader {
+			_, err := node.Propose(context.Background(), []byte("command"))
+			assert.Equal(t, ErrNotLeader, err)
+		}
+	}
+
+	var expected []string
+	for i := 0; i < 20; i++ {
+		command := fmt.Sprintf("command%d", i)
+		expected = append(expected, command)
+
+		result, err := c.nodes[leader].Propose(context.Background(), []byte(command))
+		assert.NoError(t, err)
+		assert.Equal(t, i+1, result)
+	}
+
+	for id := range c.nodes {
+		fsm := c.fsms[id]
+		assert.Eventually(t, func() bool {
+			return len(fsm.Commands()) == len(expected)
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.Equal(t, expected, fsm.Commands())
+	}
+}
+
+func TestRaftLargeCommands(t *testing.T) {
+	c := newTestCluster(t, 3)
+	leader := c.leader(t)
+
+	_, err := c.nodes[leader].Propose(context.Background(), make([]byte, MaxCommandSize+1))
+	assert.Equal(t, ErrCommandTooLarge, err)
+
+	// the commands don't fit in a single request together
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			command := bytes.Repeat([]byte{byte('a' + i)}, MaxCommandSize)
+			_, err := c.nodes[leader].Propose(context.Background(), command)
+			assert.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+
+	for id := range c.nodes {
+		fsm := c.fsms[id]
+		assert.Eventually(t, func() bool {
+			return len(fsm.Commands()) == 6
+		}, 10*time.Second, 10*time.Millisecond)
+	}
+}
+
+func TestRaftLeaderFailure(t *testing.T) {
+	c := newTestCluster(t, 3)
+	leader := c.leader(t)
+
+	_, err := c.nodes[leader].Propose(context.Background(), []byte("command0"))
+	assert.NoError(t, err)
+
+	c.stop(leader)
+	var running []string
+	for id := range c.nodes {
+		if id != leader {
+			running = append(running, id)
+		}
+	}
+
+	newLeader := c.leader(t, running...)
+	assert.NotEqual(t, leader, newLeader)
+
+	// the committed command survives, the cluster still commits with a majority
+	_, err = c.nodes[newLeader].Propose(context.Background(), []byte("command1"))
+	assert.NoError(t, err)
+	for _, id := range running {
+		fsm := c.fsms[id]
+		assert.Eventually(t, func() bool {
+			return len(fsm.Commands()) == 2
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.Equal(t, []string{"command0", "command1"}, fsm.Commands())
+	}
+}
+
+func TestRaftNoQuorum(t *testing.T) {
+	c := newTestCluster(t, 3)
+	leader := c.leader(t)
+
+	for id := range c.nodes {
+		if id != leader {
+			c.stop(id)
+		}
+	}
+
+	// a leader cut off from the majority can't commit
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	_, err := c.nodes[leader].Propose(ctx, []byte("command0"))
+	assert.Error(t, err)
+	assert.Empty(t, c.fsms[leader].Commands())
+}
+
+func TestRaftRestart(t *testing.T) {
+	dir := t.TempDir()
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	peers := map[string]string{"node0": server.URL}
+
+	fsm := &recorder{}
+	node, err := New(Config{ID: "node0", Peers: peers, Dir: dir, ElectionTimeout: 50 * time.Millisecond}, fsm, rest.NoLog)
+	assert.NoError(t, err)
+	assert.Eventually(t, node.IsLeader, 5*time.Second, 10*time.Millisecond)
+
+	_, err = node.Propose(context.Background(), []byte("command0"))
+	assert.NoError(t, err)
+	_, err = node.Propose(context.Background(), []byte("command1"))
+	assert.NoError(t, err)
+	term := node.Status().Term
+	assert.NoError(t, node.Close())
+
+	// the log is applied again after a restart, the term never goes back
+	fsm = &recorder{}
+	node, err = New(Config{ID: "node0", Peers: peers, Dir: dir, ElectionTimeout: 50 * time.Millisecond}, fsm, rest.NoLog)
+	assert.NoError(t, err)
+	defer node.Close()
+
+	assert.Eventually(t, func() bool {
+		return len(fsm.Commands()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"command0", "command1"}, fsm.Commands())
+	assert.True(t, node.Status().Term > term)
+}
+
+func TestParsePeers(t *testing.T) {
+	peers, err := ParsePeers("a=http://127.0.0.1:8081, b=http://127.0.0.1:8082/")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "http://127.0.0.1:8081", "b": "http://127.0.0.1:8082"}, peers)
+
+	addr, err := Config{ID: "b", Peers: peers}.Addr()
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:8082", addr)
+
+	_, err = ParsePeers("a=http://127.0.0.1:8081,b")
+	assert.Error(t, err)
+	_, err = ParsePeers("a=http://127.0.0.1:8081,a=http://127.0.0.1:8082")
+	assert.Error(t, err)
+}
@@ -0,0 +1,207 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	votePath   = "/raft/vote"
+	appendPath = "/raft/append"
+	statusPath = "/raft/status"
+)
+
+type voteRequest struct {
+	Term         uint64 `json:"term"`
+	CandidateID  string `json:"candidate_id"`
+	LastLogIndex uint64 `json:"last_log_index"`
+	LastLogTerm  uint64 `json:"last_log_term"`
+}
+
+type voteReply struct {
+	Term        uint64 `json:"term"`
+	VoteGranted bool   `json:"vote_granted"`
+}
+
+type appendRequest struct {
+	Term         uint64  `json:"term"`
+	LeaderID     string  `json:"leader_id"`
+	PrevLogIndex uint64  `json:"prev_log_index"`
+	PrevLogTerm  uint64  `json:"prev_log_term"`
+	Entries      []Entry `json:"entries"`
+	LeaderCommit uint64  `json:"leader_commit"`
+}
+
+type appendReply struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+	// ConflictIndex is where the leader should continue from when Success is false
+	ConflictIndex uint64 `json:"conflict_index"`
+}
+
+// call sends an RPC to the peer.
+func (r *Raft) call(peer, path string, args, reply interface{}) error {
+	body, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+
+	resp, err := r.client.Post(r.config.Peers[peer]+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Raft %s: %s responded with %s", r.config.ID, peer, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(reply)
+}
+
+// Handler serves the RPCs of the other nodes and GET /raft/status.
+func (r *Raft) Handler() http.Handler {
+	router := mux.NewRouter()
+	router.HandleFunc(votePath, r.handleVote).Methods("POST")
+	router.HandleFunc(appendPath, r.handleAppend).Methods("POST")
+	router.HandleFunc(statusPath, r.handleStatus).Methods("GET")
+	return router
+}
+
+func (r *Raft) handleVote(w http.ResponseWriter, req *http.Request) {
+	var args voteRequest
+	if err := json.NewDecoder(req.Body).Decode(&args); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	reply, err := r.vote(&args)
+	if err != nil {
+		r.logger.Printf("Raft %s: vote for %s failed: %v", r.config.ID, args.CandidateID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reply)
+}
+
+func (r *Raft) handleAppend(w http.ResponseWriter, req *http.Request) {
+	var args appendRequest
+	if err := json.NewDecoder(req.Body).Decode(&args); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	reply, err := r.append(&args)
+	if err != nil {
+		r.logger.Printf("Raft %s: append from %s failed: %v", r.config.ID, args.LeaderID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reply)
+}
+
+func (r *Raft) handleStatus(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r.Status())
+}
+
+// vote grants the vote to a candidate whose log is at least as up-to-date as ours, once per term.
+func (r *Raft) vote(args *voteRequest) (*voteReply, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if args.Term > r.term {
+		if err := r.stepDown(args.Term); err != nil {
+			return nil, err
+		}
+	}
+
+	reply := &voteReply{Term: r.term}
+	if args.Term < r.term || (r.votedFor != "" && r.votedFor != args.CandidateID) {
+		return reply, nil
+	}
+
+	lastTerm := r.log[r.lastIndex()].Term
+	if args.LastLogTerm < lastTerm || (args.LastLogTerm == lastTerm && args.LastLogIndex < r.lastIndex()) {
+		return reply, nil
+	}
+
+	if err := r.setTerm(r.term, args.CandidateID); err != nil {
+		return nil, err
+	}
+	r.resetElectionDeadline()
+	reply.VoteGranted = true
+	return reply, nil
+}
+
+// append stores the entries of the leader, replacing the ones of former leaders which conflict with them.
+func (r *Raft) append(args *appendRequest) (*appendReply, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	reply := &appendReply{Term: r.term}
+	if args.Term < r.term {
+		return reply, nil
+	}
+
+	if args.Term > r.term || r.state != Follower {
+		if err := r.stepDown(args.Term); err != nil {
+			return nil, err
+		}
+		reply.Term = r.term
+	}
+	r.leader = args.LeaderID
+	r.resetElectionDeadline()
+
+	if args.PrevLogIndex > r.lastIndex() {
+		reply.ConflictIndex = r.lastIndex() + 1
+		return reply, nil
+	}
+
+	if conflictTerm := r.log[args.PrevLogIndex].Term; conflictTerm != args.PrevLogTerm {
+		// skip the whole conflicting term
+		index := args.PrevLogIndex
+		for index > 1 && r.log[index-1].Term == conflictTerm {
+			index--
+		}
+		reply.ConflictIndex = index
+		return reply, nil
+	}
+
+	for i, entry := range args.Entries {
+		index := args.PrevLogIndex + 1 + uint64(i)
+		if index <= r.lastIndex() {
+			if r.log[index].Term == entry.Term {
+				continue
+			}
+			if err := r.truncateLog(index); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := r.appendEntries(args.Entries[i:]...); err != nil {
+			return nil, err
+		}
+		break
+	}
+
+	// only the entries known to match the leader's log can be committed
+	commitIndex := args.LeaderCommit
+	if lastNew := args.PrevLogIndex + uint64(len(args.Entries)); lastNew < commitIndex {
+		commitIndex = lastNew
+	}
+	if commitIndex > r.commitIndex {
+		r.commitIndex = commitIndex
+		r.applyCond.Broadcast()
+	}
+
+	reply.Success = true
+	return reply, nil
+}
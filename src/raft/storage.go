@@ -0,0 +1,169 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	stateFileName = "raft-state.json"
+	logFileName   = "raft-log.jsonl"
+)
+
+// persistentState is the term and the vote of the node, they must survive a restart.
+type persistentState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"voted_for"`
+}
+
+// storage keeps the state of the node in dir and its log as a file of JSON lines, an entry per line.
+// Everything is on the disk before it returns.
+type storage struct {
+	dir  string
+	file *os.File
+	// offsets[i] is where the entry with index i+1 starts
+	offsets []int64
+	size    int64
+}
+
+// openStorage opens the storage in dir, dir is created if it doesn't exist. A torn entry at the end
+// of the log, left by a crash in the middle of a write, is cut off.
+func openStorage(dir string) (*storage, uint64, string, []Entry, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, 0, "", nil, err
+	}
+
+	var state persistentState
+	if data, err := os.ReadFile(filepath.Join(dir, stateFileName)); err == nil {
+		if err := json.Unmarshal(data, &state); err != nil {
+			return nil, 0, "", nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, 0, "", nil, err
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, logFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, 0, "", nil, err
+	}
+
+	s := &storage{dir: dir, file: file}
+	var entries []Entry
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// a line without the end is a torn write
+			break
+		} else if err != nil {
+			file.Close()
+			return nil, 0, "", nil, err
+		}
+
+		var entry Entry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			break
+		}
+		entries = append(entries, entry)
+		s.offsets = append(s.offsets, s.size)
+		s.size += int64(len(line))
+	}
+
+	if err := file.Truncate(s.size); err != nil {
+		file.Close()
+		return nil, 0, "", nil, err
+	}
+	return s, state.Term, state.VotedFor, entries, nil
+}
+
+// SaveState atomically replaces the term and the vote.
+func (s *storage) SaveState(term uint64, votedFor string) error {
+	data, err := json.Marshal(&persistentState{Term: term, VotedFor: votedFor})
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(s.dir, stateFileName)
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(s.dir)
+}
+
+// Append writes entries at the end of the log.
+func (s *storage) Append(entries []Entry) error {
+	var buf []byte
+	offsets := make([]int64, len(entries))
+	for i, entry := range entries {
+		line, err := json.Marshal(&entry)
+		if err != nil {
+			return err
+		}
+		offsets[i] = s.size + int64(len(buf))
+		buf = append(append(buf, line...), '\n')
+	}
+
+	if _, err := s.file.WriteAt(buf, s.size); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+
+	s.offsets = append(s.offsets, offsets...)
+	s.size += int64(len(buf))
+	return nil
+}
+
+// Truncate removes the entries from index on.
+func (s *storage) Truncate(index uint64) error {
+	if index > uint64(len(s.offsets)) {
+		return nil
+	}
+
+	size := s.offsets[index-1]
+	if err := s.file.Truncate(size); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+
+	s.offsets = s.offsets[:index-1]
+	s.size = size
+	return nil
+}
+
+func (s *storage) Close() error {
+	return s.file.Close()
+}
+
+// syncDir makes creating and renaming files in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
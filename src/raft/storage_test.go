@@ -0,0 +1,47 @@
+package raft
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStorage(t *testing.T) {
+	dir := t.TempDir()
+
+	s, term, votedFor, entries, err := openStorage(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), term)
+	assert.Equal(t, "", votedFor)
+	assert.Empty(t, entries)
+
+	assert.NoError(t, s.SaveState(2, "node1"))
+	assert.NoError(t, s.Append([]Entry{{Term: 1}, {Term: 1, Command: []byte("command0")}, {Term: 2, Command: []byte("command1")}}))
+
+	// a conflicting entry is replaced
+	assert.NoError(t, s.Truncate(3))
+	assert.NoError(t, s.Append([]Entry{{Term: 2, Command: []byte("command2")}}))
+	assert.NoError(t, s.Close())
+
+	// a torn entry is cut off
+	file, err := os.OpenFile(filepath.Join(dir, logFileName), os.O_WRONLY|os.O_APPEND, 0644)
+	assert.NoError(t, err)
+	file.Write([]byte(`{"term":2,"comm`))
+	file.Close()
+
+	s, term, votedFor, entries, err = openStorage(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), term)
+	assert.Equal(t, "node1", votedFor)
+	assert.Equal(t, []Entry{{Term: 1}, {Term: 1, Command: []byte("command0")}, {Term: 2, Command: []byte("command2")}}, entries)
+
+	assert.NoError(t, s.Append([]Entry{{Term: 3, Command: []byte("command3")}}))
+	assert.NoError(t, s.Close())
+
+	_, _, _, entries, err = openStorage(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 4)
+	assert.Equal(t, []byte("command3"), entries[3].Command)
+}
@@ -0,0 +1,294 @@
+package replica
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"memdb"
+	"net/http"
+	"net/url"
+	"rest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrPromoted = errors.New("Replica is already promoted")
+
+// LagHeader carries the replication lag of a read served by a replica, in seconds.
+const LagHeader = "X-Memdb-Replication-Lag"
+
+const (
+	// DefaultHeartbeatInterval is how often the primary reports its last change while nothing changes.
+	DefaultHeartbeatInterval = 250 * time.Millisecond
+
+	// DefaultRetryInterval is how long to wait before connecting to the primary again.
+	DefaultRetryInterval = time.Second
+)
+
+const (
+	changesPath = "/replication/changes"
+	statusPath  = "/replication/status"
+	promotePath = "/admin/promote"
+)
+
+// Config configures a replica.
+type Config struct {
+	// Primary is the URL of the primary, e.g. http://127.0.0.1:8080
+	Primary string
+
+	// HeartbeatInterval is how often the primary reports its last change, zero means DefaultHeartbeatInterval.
+	// The lag of an idle replica grows up to HeartbeatInterval between the reports.
+	HeartbeatInterval time.Duration
+
+	// RetryInterval is how long to wait before connecting to the primary again, zero means DefaultRetryInterval
+	RetryInterval time.Duration
+}
+
+// Status is the replication status of a replica.
+type Status struct {
+	Primary   string  `json:"primary"`
+	Promoted  bool    `json:"promoted"`
+	Connected bool    `json:"connected"`
+	Seq       uint64  `json:"seq"`
+	Lag       float64 `json:"lag"`
+}
+
+// Replica keeps a database up to date with the changes of a primary. The replica serves reads
+// and redirects writes to the primary until it's promoted, then it serves everything itself.
+//
+// Replication is asynchronous, a read may miss the latest writes of the primary, Lag tells by how much.
+// Locks are not replicated, the clients of the primary lose their locks when the replica is promoted,
+// but the fencing tokens and versions of the promoted replica keep growing from the ones of the primary.
+type Replica struct {
+	config Config
+	db     memdb.MemDB
+	logger *log.Logger
+
+	mu        sync.Mutex
+	seq       uint64
+	syncedAt  time.Time
+	connected bool
+	promoted  bool
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Start starts following the primary, the changes of the primary are applied to db.
+// The replica starts over with all the values of the primary whenever it's started.
+func Start(db memdb.MemDB, config Config, logger *log.Logger) (*Replica, error) {
+	primary, err := url.Parse(config.Primary)
+	if err != nil {
+		return nil, err
+	}
+	if primary.Scheme == "" || primary.Host == "" {
+		return nil, fmt.Errorf("Invalid URL of the primary %q", config.Primary)
+	}
+	config.Primary = strings.TrimSuffix(config.Primary, "/")
+
+	if config.HeartbeatInterval <= 0 {
+		config.HeartbeatInterval = DefaultHeartbeatInterval
+	}
+	if config.RetryInterval <= 0 {
+		config.RetryInterval = DefaultRetryInterval
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &Replica{
+		config:   config,
+		db:       db,
+		logger:   logger,
+		syncedAt: time.Now(),
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	go r.run(ctx)
+	return r, nil
+}
+
+// Lag is how long ago the primary made the last change the replica has applied, or sent the last heartbeat
+// the replica had all the changes for, or how long ago the replica started if it never had them.
+// The time of the primary is compared with the clock of the replica. A promoted replica has no lag.
+func (r *Replica) Lag() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.promoted {
+		return 0
+	}
+	if lag := time.Since(r.syncedAt); lag > 0 {
+		return lag
+	}
+	return 0
+}
+
+// Promoted reports whether the replica has been promoted.
+func (r *Replica) Promoted() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.promoted
+}
+
+func (r *Replica) Status() Status {
+	lag := r.Lag()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return Status{
+		Primary:   r.config.Primary,
+		Promoted:  r.promoted,
+		Connected: r.connected,
+		Seq:       r.seq,
+		Lag:       lag.Seconds(),
+	}
+}
+
+// Promote stops following the primary, the replica accepts writes from now on.
+// Make sure the old primary doesn't accept writes anymore, the replica won't see them.
+func (r *Replica) Promote() error {
+	r.mu.Lock()
+	if r.promoted {
+		r.mu.Unlock()
+		return ErrPromoted
+	}
+	r.promoted = true
+	r.mu.Unlock()
+
+	r.stop()
+	return nil
+}
+
+// Close stops following the primary, it doesn't close the database.
+func (r *Replica) Close() error {
+	r.stop()
+	return nil
+}
+
+func (r *Replica) stop() {
+	r.cancel()
+	<-r.done
+
+	r.mu.Lock()
+	r.connected = false
+	r.mu.Unlock()
+}
+
+// run follows the primary until the replica is stopped, it reconnects whenever the stream breaks.
+func (r *Replica) run(ctx context.Context) {
+	defer close(r.done)
+
+	for {
+		err := r.follow(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		r.mu.Lock()
+		r.connected = false
+		r.mu.Unlock()
+		r.logger.Printf("Replication from %s interrupted: %v", r.config.Primary, err)
+
+		select {
+		case <-time.After(r.config.RetryInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// follow applies the changes streamed by the primary until the stream breaks.
+func (r *Replica) follow(ctx context.Context) error {
+	r.mu.Lock()
+	seq := r.seq
+	r.mu.Unlock()
+
+	query := url.Values{}
+	query.Set("from", strconv.FormatUint(seq, 10))
+	query.Set("heartbeat", r.config.HeartbeatInterval.String())
+	req, err := http.NewRequestWithContext(ctx, "GET", r.config.Primary+changesPath+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected status %s", resp.Status)
+	}
+
+	r.mu.Lock()
+	r.connected = true
+	r.mu.Unlock()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var change rest.ChangeResponse
+		if err := decoder.Decode(&change); err != nil {
+			return err
+		}
+
+		if change.Op == rest.ChangeHeartbeat {
+			r.mu.Lock()
+			if change.Seq == r.seq && change.Time != nil {
+				r.syncedAt = *change.Time
+			}
+			r.mu.Unlock()
+			continue
+		}
+
+		if err := r.db.ApplyChange(change.Change()); err != nil {
+			return err
+		}
+		r.mu.Lock()
+		r.seq = change.Seq
+		if change.Time != nil {
+			r.syncedAt = *change.Time
+		}
+		r.mu.Unlock()
+	}
+}
+
+// Handler serves the replication status and promotion of the replica, other requests go to next.
+// Until the replica is promoted, reads are served with LagHeader and writes are redirected to the primary.
+//
+// GET /replication/status returns Status.
+// POST /admin/promote promotes the replica and returns 204 No Content, or 409 Conflict if it's already promoted.
+func (r *Replica) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.URL.Path == statusPath && req.Method == "GET":
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(r.Status())
+			return
+
+		case req.URL.Path == promotePath && req.Method == "POST":
+			if err := r.Promote(); err != nil {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			r.logger.Printf("AUDIT: replica of %s promoted to primary, requested by %s", r.config.Primary, req.RemoteAddr)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if r.Promoted() {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		if req.Method == "GET" || req.Method == "HEAD" {
+			w.Header().Set(LagHeader, strconv.FormatFloat(r.Lag().Seconds(), 'f', 3, 64))
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		http.Redirect(w, req, r.config.Primary+req.URL.RequestURI(), http.StatusTemporaryRedirect)
+	})
+}
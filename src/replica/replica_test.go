@@ -0,0 +1,182 @@
+package replica
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"memdb"
+	"net/http"
+	"net/http/httptest"
+	"rest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var noRedirect = &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+	return http.ErrUseLastResponse
+}}
+
+// newTestReplica runs a primary and a replica of it, each of them behind its own HTTP server.
+func newTestReplica(t *testing.T) (memdb.MemDB, *httptest.Server, *Replica, *httptest.Server) {
+	primaryDB := memdb.NewMemDB("PrimaryDB", memdb.NewLockIDSeqGenerator())
+	primary := httptest.NewServer(rest.NewRestServerWithMemDB(primaryDB, rest.NoLog).Router())
+
+	replicaDB := memdb.NewMemDB("ReplicaDB", memdb.NewLockIDSeqGenerator())
+	config := Config{Primary: primary.URL, HeartbeatInterval: 10 * time.Millisecond, RetryInterval: 20 * time.Millisecond}
+	rep, err := Start(replicaDB, config, rest.NoLog)
+	assert.NoError(t, err)
+	server := httptest.NewServer(rep.Handler(rest.NewRestServerWithMemDB(replicaDB, rest.NoLog).Router()))
+
+	t.Cleanup(func() {
+		server.Close()
+		rep.Close()
+		primary.CloseClientConnections()
+		primary.Close()
+	})
+	return primaryDB, primary, rep, server
+}
+
+// peek reads the value of the key from the server, the lag is -1 if the server doesn't report it.
+func peek(t *testing.T, url, key string) (rest.ValueResponse, float64, int) {
+	var response rest.ValueResponse
+	resp, err := noRedirect.Get(url + "/values/" + key)
+	if !assert.NoError(t, err) {
+		return response, -1, 0
+	}
+	defer resp.Body.Close()
+
+	lag := -1.0
+	if rawLag := resp.Header.Get(LagHeader); rawLag != "" {
+		lag, err = strconv.ParseFloat(rawLag, 64)
+		assert.NoError(t, err)
+	}
+	json.NewDecoder(resp.Body).Decode(&response)
+	return response, lag, resp.StatusCode
+}
+
+func TestReplica(t *testing.T) {
+	primaryDB, primary, rep, server := newTestReplica(t)
+
+	lockId := primaryDB.Put(memdb.Key("key0"), memdb.Value("value0"))
+	assert.NoError(t, primaryDB.Update(lockId, memdb.Key("key0"), memdb.Value("value1"), true))
+
+	assert.Eventually(t, func() bool {
+		response, lag, code := peek(t, server.URL, "key0")
+		return code == http.StatusOK && response.Value == "value1" && response.Version == 2 && lag >= 0 && lag < 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	status := rep.Status()
+	assert.Equal(t, primary.URL, status.Primary)
+	assert.True(t, status.Connected)
+	assert.False(t, status.Promoted)
+
+	// writes go to the primary
+	req, err := http.NewRequest("PUT", server.URL+"/values/key1?ttl=10s", bytes.NewReader([]byte("value1")))
+	assert.NoError(t, err)
+	resp, err := noRedirect.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	assert.Equal(t, primary.URL+"/values/key1?ttl=10s", resp.Header.Get("Location"))
+
+	// the changes made while the replica is behind are caught up
+	for i := 0; i < 100; i++ {
+		primaryDB.Release(primaryDB.Put(memdb.Key("key1"), memdb.Value(strconv.Itoa(i))))
+	}
+	assert.Eventually(t, func() bool {
+		response, _, code := peek(t, server.URL, "key1")
+		return code == http.StatusOK && response.Value == "99"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestReplicaLag(t *testing.T) {
+	// the primary made the last change a minute ago, the replica has nothing newer
+	changeTime := time.Now().Add(-time.Minute)
+	heartbeat := make(chan time.Time)
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoder := json.NewEncoder(w)
+		encoder.Encode(&rest.ChangeResponse{Seq: 1, Op: string(memdb.ChangeReset), Time: &changeTime})
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case now := <-heartbeat:
+				encoder.Encode(&rest.ChangeResponse{Seq: 1, Op: rest.ChangeHeartbeat, Time: &now})
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	defer primary.Close()
+
+	replicaDB := memdb.NewMemDB("ReplicaDB", memdb.NewLockIDSeqGenerator())
+	rep, err := Start(replicaDB, Config{Primary: primary.URL}, rest.NoLog)
+	assert.NoError(t, err)
+	defer rep.Close()
+
+	assert.Eventually(t, func() bool {
+		return rep.Status().Seq == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, rep.Lag() >= time.Minute)
+
+	// a heartbeat tells the replica is caught up
+	heartbeat <- time.Now()
+	assert.Eventually(t, func() bool {
+		return rep.Lag() < time.Second
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestReplicaPromote(t *testing.T) {
+	primaryDB, primary, rep, server := newTestReplica(t)
+
+	_, token, err := primaryDB.PutWithOptions(context.Background(), memdb.Key("key0"), memdb.Value("value0"), memdb.LockOptions{})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		_, _, code := peek(t, server.URL, "key0")
+		return code == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the lag grows while the primary is gone
+	primary.CloseClientConnections()
+	primary.Close()
+	assert.Eventually(t, func() bool {
+		return !rep.Status().Connected && rep.Lag() > 100*time.Millisecond
+	}, 5*time.Second, 10*time.Millisecond)
+	_, lag, _ := peek(t, server.URL, "key0")
+	assert.True(t, lag >= 0.1)
+
+	resp0, err0 := http.Post(server.URL+"/admin/promote", "", nil)
+	assert.NoError(t, err0)
+	resp0.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp0.StatusCode)
+
+	resp1, err1 := http.Post(server.URL+"/admin/promote", "", nil)
+	assert.NoError(t, err1)
+	resp1.Body.Close()
+	assert.Equal(t, http.StatusConflict, resp1.StatusCode)
+
+	// the promoted replica takes writes, the tokens keep growing
+	req2, err2 := http.NewRequest("POST", server.URL+"/reservations/key0", nil)
+	assert.NoError(t, err2)
+	resp2, err2 := noRedirect.Do(req2)
+	assert.NoError(t, err2)
+	defer resp2.Body.Close()
+	assert.Equal(t, http.StatusOK, resp2.StatusCode)
+
+	var response rest.LockValueResponse
+	assert.NoError(t, json.NewDecoder(resp2.Body).Decode(&response))
+	assert.Equal(t, "value0", response.Value)
+	assert.True(t, response.Token > uint64(token))
+
+	_, lag, _ = peek(t, server.URL, "key0")
+	assert.Equal(t, -1.0, lag)
+	assert.True(t, rep.Status().Promoted)
+}
+
+func TestStartInvalidPrimary(t *testing.T) {
+	_, err := Start(memdb.NewMemDB("ReplicaDB", memdb.NewLockIDSeqGenerator()), Config{Primary: "127.0.0.1:8080"}, rest.NoLog)
+	assert.Error(t, err)
+}
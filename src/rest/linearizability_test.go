@@ -0,0 +1,391 @@
+package rest
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"memdb"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// keyState is the sequential specification of a key: a register guarded by an exclusive lock.
+type keyState struct {
+	value  string
+	holder string
+}
+
+// operation is a request of the history, it took effect at some moment between call and ret.
+// step applies it to the state of its key, it fails if the response can't have come from that state.
+type operation struct {
+	key       string
+	call, ret int64
+	desc      string
+	step      func(s keyState) (keyState, bool)
+}
+
+// history records the operations of concurrent clients, the clock orders their calls and returns.
+type history struct {
+	mu    sync.Mutex
+	clock int64
+	ops   []*operation
+}
+
+func (h *history) now() int64 {
+	return atomic.AddInt64(&h.clock, 1)
+}
+
+func (h *history) add(op *operation) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ops = append(h.ops, op)
+}
+
+// entry is a call or a return of an operation in the list the search runs over.
+type entry struct {
+	op         *operation
+	id         int
+	time       int64
+	match      *entry // the return of a call, nil for returns
+	prev, next *entry
+}
+
+// lift takes the linearized call and its return out of the list.
+func lift(e *entry) {
+	e.prev.next = e.next
+	e.next.prev = e.prev
+	m := e.match
+	m.prev.next = m.next
+	if m.next != nil {
+		m.next.prev = m.prev
+	}
+}
+
+// unlift puts the call and its return back where they were.
+func unlift(e *entry) {
+	m := e.match
+	m.prev.next = m
+	if m.next != nil {
+		m.next.prev = m
+	}
+	e.prev.next = e
+	e.next.prev = e
+}
+
+type bitset []uint64
+
+func (b bitset) set(i int)   { b[i/64] |= 1 << uint(i%64) }
+func (b bitset) clear(i int) { b[i/64] &^= 1 << uint(i%64) }
+
+func (b bitset) String() string {
+	buf := make([]byte, 8*len(b))
+	for i, word := range b {
+		binary.LittleEndian.PutUint64(buf[8*i:], word)
+	}
+	return string(buf)
+}
+
+type cacheKey struct {
+	linearized string
+	state      keyState
+}
+
+// linearizable checks the operations of a single key, starting from init, with the search of Wing & Gong
+// and the memoization of Lowe, as Porcupine and Knossos do: the calls are linearized one by one in every
+// order the real time allows, a return whose call hasn't been linearized yet makes the search backtrack,
+// and a set of linearized calls which has already led to a state isn't searched again.
+func linearizable(ops []*operation, init keyState) bool {
+	var events []*entry
+	for i, op := range ops {
+		ret := &entry{op: op, id: i, time: op.ret}
+		events = append(events, &entry{op: op, id: i, time: op.call, match: ret}, ret)
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].time < events[j].time
+	})
+
+	head := &entry{}
+	prev := head
+	for _, e := range events {
+		prev.next, e.prev = e, prev
+		prev = e
+	}
+
+	type frame struct {
+		e     *entry
+		state keyState
+	}
+	var stack []frame
+	linearized := make(bitset, len(ops)/64+1)
+	cache := make(map[cacheKey]bool)
+	state := init
+
+	e := head.next
+	for head.next != nil {
+		if e.match != nil {
+			if next, ok := e.op.step(state); ok {
+				linearized.set(e.id)
+				key := cacheKey{linearized: linearized.String(), state: next}
+				if !cache[key] {
+					cache[key] = true
+					stack = append(stack, frame{e: e, state: state})
+					state = next
+					lift(e)
+					e = head.next
+					continue
+				}
+				linearized.clear(e.id)
+			}
+			e = e.next
+			continue
+		}
+
+		// the call of this return must have taken effect before it
+		if len(stack) == 0 {
+			return false
+		}
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		e, state = top.e, top.state
+		linearized.clear(e.id)
+		unlift(e)
+		e = e.next
+	}
+	return true
+}
+
+// checkLinearizable checks the history key by key, the keys don't affect each other.
+func checkLinearizable(t *testing.T, ops []*operation, init keyState) {
+	byKey := make(map[string][]*operation)
+	for _, op := range ops {
+		byKey[op.key] = append(byKey[op.key], op)
+	}
+
+	for key, keyOps := range byKey {
+		if !linearizable(keyOps, init) {
+			sort.Slice(keyOps, func(i, j int) bool {
+				return keyOps[i].call < keyOps[j].call
+			})
+			var lines []string
+			for _, op := range keyOps {
+				lines = append(lines, fmt.Sprintf("[%d, %d] %s", op.call, op.ret, op.desc))
+			}
+			t.Errorf("History of %s is not linearizable:\n%s", key, strings.Join(lines, "\n"))
+		}
+	}
+}
+
+// linearClient is a client of the server which records what it does.
+type linearClient struct {
+	t      *testing.T
+	url    string
+	h      *history
+	random *rand.Rand
+}
+
+// request sends the request and records it as an operation, step gets the status and the body of the response.
+func (c *linearClient) request(key, method, path, body string, step func(status int, body []byte) (string, func(s keyState) (keyState, bool))) (int, []byte) {
+	req, err := http.NewRequest(method, c.url+path, strings.NewReader(body))
+	if !assert.NoError(c.t, err) {
+		return 0, nil
+	}
+
+	call := c.h.now()
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.NoError(c.t, err) {
+		return 0, nil
+	}
+	respBody, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	ret := c.h.now()
+	assert.NoError(c.t, err)
+
+	desc, opStep := step(resp.StatusCode, respBody)
+	c.h.add(&operation{key: key, call: call, ret: ret, desc: method + " " + path + " " + body + ": " + desc, step: opStep})
+	return resp.StatusCode, respBody
+}
+
+// acquire reserves the key, with zero wait it only tries once.
+func (c *linearClient) acquire(key, wait string) (string, bool) {
+	var lockId string
+	status, _ := c.request(key, "POST", "/reservations/"+key+"?wait="+wait, "", func(status int, body []byte) (string, func(s keyState) (keyState, bool)) {
+		switch status {
+		case http.StatusOK:
+			var response LockValueResponse
+			assert.NoError(c.t, json.Unmarshal(body, &response))
+			lockId = response.LockId
+			return fmt.Sprintf("%s got %q", lockId, response.Value), func(s keyState) (keyState, bool) {
+				return keyState{value: s.value, holder: response.LockId}, s.holder == "" && s.value == response.Value
+			}
+		case http.StatusConflict:
+			return "locked", func(s keyState) (keyState, bool) {
+				return s, s.holder != ""
+			}
+		}
+		c.t.Errorf("POST /reservations/%s: %d", key, status)
+		return "unexpected", func(s keyState) (keyState, bool) { return s, true }
+	})
+	return lockId, status == http.StatusOK
+}
+
+// update writes the value with lockId, the lock is released with release.
+func (c *linearClient) update(key, lockId, value string, release bool) {
+	path := fmt.Sprintf("/values/%s/%s?release=%v", key, lockId, release)
+	c.request(key, "POST", path, value, func(status int, body []byte) (string, func(s keyState) (keyState, bool)) {
+		switch status {
+		case http.StatusNoContent:
+			return "updated", func(s keyState) (keyState, bool) {
+				next := keyState{value: value, holder: s.holder}
+				if release {
+					next.holder = ""
+				}
+				return next, s.holder == lockId
+			}
+		case http.StatusUnauthorized:
+			return "not held", func(s keyState) (keyState, bool) {
+				return s, s.holder != lockId
+			}
+		}
+		c.t.Errorf("POST %s: %d", path, status)
+		return "unexpected", func(s keyState) (keyState, bool) { return s, true }
+	})
+}
+
+// release gives the key up without changing it.
+func (c *linearClient) release(key, lockId string) {
+	path := fmt.Sprintf("/reservations/%s/%s", key, lockId)
+	c.request(key, "DELETE", path, "", func(status int, body []byte) (string, func(s keyState) (keyState, bool)) {
+		switch status {
+		case http.StatusNoContent:
+			return "released", func(s keyState) (keyState, bool) {
+				return keyState{value: s.value}, s.holder == lockId
+			}
+		case http.StatusUnauthorized:
+			return "not held", func(s keyState) (keyState, bool) {
+				return s, s.holder != lockId
+			}
+		}
+		c.t.Errorf("DELETE %s: %d", path, status)
+		return "unexpected", func(s keyState) (keyState, bool) { return s, true }
+	})
+}
+
+// peek reads the key without locking it.
+func (c *linearClient) peek(key string) {
+	c.request(key, "GET", "/values/"+key, "", func(status int, body []byte) (string, func(s keyState) (keyState, bool)) {
+		var response ValueResponse
+		if !assert.Equal(c.t, http.StatusOK, status) || !assert.NoError(c.t, json.Unmarshal(body, &response)) {
+			return "unexpected", func(s keyState) (keyState, bool) { return s, true }
+		}
+		return fmt.Sprintf("%q reserved %v", response.Value, response.Reserved), func(s keyState) (keyState, bool) {
+			return s, s.value == response.Value && (s.holder != "") == response.Reserved
+		}
+	})
+}
+
+// run reserves random keys, updates and releases them, peeks at them and uses the LockIDs
+// it has given up already.
+func (c *linearClient) run(id int, keys []string, rounds int) {
+	var stale []string
+	for i := 0; i < rounds; i++ {
+		key := keys[c.random.Intn(len(keys))]
+		c.peek(key)
+
+		wait := "0"
+		if c.random.Intn(2) == 0 {
+			wait = "50ms"
+		}
+		lockId, acquired := c.acquire(key, wait)
+		if !acquired {
+			continue
+		}
+
+		for j := c.random.Intn(3); j > 0; j-- {
+			c.update(key, lockId, fmt.Sprintf("client%d.%d.%d", id, i, j), false)
+		}
+		if c.random.Intn(2) == 0 {
+			c.update(key, lockId, fmt.Sprintf("client%d.%d", id, i), true)
+		} else {
+			c.release(key, lockId)
+		}
+
+		// a LockID which has been given up can't change the key anymore
+		stale = append(stale, lockId)
+		if c.random.Intn(4) == 0 {
+			c.update(key, stale[c.random.Intn(len(stale))], "stale", c.random.Intn(2) == 0)
+		}
+	}
+}
+
+// PUT of an existing key waits for the key lock and writes the value after it has got the lock,
+// a reader in between sees the old value reserved. The keys are created before the history starts,
+// the clients reserve them with POST /reservations, which doesn't change the value.
+func TestRestServerLinearizable(t *testing.T) {
+	mdb := memdb.NewMemDB("TestRestServerLinearizable", memdb.NewLockIDSeqGenerator())
+	server := httptest.NewServer(NewRestServerWithMemDB(mdb, NoLog).Router())
+	defer server.Close()
+
+	keys := []string{"key0", "key1", "key2"}
+	for _, key := range keys {
+		assert.NoError(t, mdb.Release(mdb.Put(memdb.Key(key), memdb.Value("init"))))
+	}
+
+	h := &history{}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			c := &linearClient{t: t, url: server.URL, h: h, random: rand.New(rand.NewSource(int64(id)))}
+			c.run(id, keys, 40)
+		}(i)
+	}
+	wg.Wait()
+
+	assert.True(t, len(h.ops) > 8*40)
+	checkLinearizable(t, h.ops, keyState{value: "init"})
+}
+
+func TestLinearizable(t *testing.T) {
+	op := func(call, ret int64, desc string, step func(s keyState) (keyState, bool)) *operation {
+		return &operation{key: "key0", call: call, ret: ret, desc: desc, step: step}
+	}
+	acquire := func(call, ret int64, lockId string) *operation {
+		return op(call, ret, "acquire "+lockId, func(s keyState) (keyState, bool) {
+			return keyState{value: s.value, holder: lockId}, s.holder == ""
+		})
+	}
+	write := func(call, ret int64, lockId, value string) *operation {
+		return op(call, ret, "write "+value, func(s keyState) (keyState, bool) {
+			return keyState{value: value}, s.holder == lockId
+		})
+	}
+	read := func(call, ret int64, value string) *operation {
+		return op(call, ret, "read "+value, func(s keyState) (keyState, bool) {
+			return s, s.value == value
+		})
+	}
+	init := keyState{value: "init"}
+
+	// the acquire called first may take effect last
+	assert.True(t, linearizable([]*operation{acquire(1, 6, "1"), acquire(2, 3, "2"), write(4, 5, "2", "value2")}, init))
+
+	// a read concurrent with the write sees either value
+	assert.True(t, linearizable([]*operation{acquire(1, 2, "1"), read(3, 6, "value1"), write(4, 5, "1", "value1")}, init))
+	assert.True(t, linearizable([]*operation{acquire(1, 2, "1"), read(3, 6, "init"), write(4, 5, "1", "value1")}, init))
+
+	// a read after the write can't see the old value
+	assert.False(t, linearizable([]*operation{acquire(1, 2, "1"), write(3, 4, "1", "value1"), read(5, 6, "init")}, init))
+
+	// the key can't be acquired twice without a release
+	assert.False(t, linearizable([]*operation{acquire(1, 2, "1"), acquire(3, 4, "2")}, init))
+}
@@ -1,25 +1,159 @@
 package rest
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"log"
 	"memdb"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 )
 
 var NoLog = log.New(ioutil.Discard, "", log.Ldate|log.Ltime|log.Lshortfile)
 
+var (
+	errInvalidTTL   = errors.New("TTL must be positive")
+	errInvalidWait  = errors.New("Wait must not be negative")
+	errInvalidMode  = errors.New("Mode must be shared or exclusive")
+	errInvalidETag  = errors.New("ETag must be a quoted version")
+	errInvalidLimit = errors.New("Limit must be positive")
+
+	errInvalidHeartbeat = errors.New("Heartbeat must be positive")
+)
+
+// SnapshotVersionHeader carries the format version of a backup.
+const SnapshotVersionHeader = "X-Memdb-Snapshot-Version"
+
+// ChangeHeartbeat is the op of the entries GET /replication/changes sends when a replica has all the changes,
+// the seq of a heartbeat is the last change of the primary.
+const ChangeHeartbeat = "heartbeat"
+
+// DefaultHeartbeatInterval is how often GET /replication/changes sends a heartbeat without the heartbeat query param.
+const DefaultHeartbeatInterval = time.Second
+
+// DefaultScanLimit is the page size of GET /values without the limit query param.
+const DefaultScanLimit = 100
+
 type LockResponse struct {
 	LockId string `json:"lock_id"`
+	Token  uint64 `json:"token"`
 }
 
 type LockValueResponse struct {
+	LockId  string `json:"lock_id"`
+	Value   string `json:"value"`
+	Version uint64 `json:"version"`
+	Token   uint64 `json:"token"`
+}
+
+type ValueResponse struct {
+	Value    string `json:"value"`
+	Version  uint64 `json:"version"`
+	Reserved bool   `json:"reserved"`
+}
+
+type ScanResponse struct {
+	Keys   []string `json:"keys"`
+	Cursor string   `json:"cursor,omitempty"`
+}
+
+type LockManyRequest struct {
+	Keys []string `json:"keys"`
+}
+
+type LockValuesResponse struct {
+	LockId string            `json:"lock_id"`
+	Values map[string]string `json:"values"`
+	Tokens map[string]uint64 `json:"tokens"`
+}
+
+type LockedResponse struct {
+	Key     string  `json:"key"`
+	HeldFor float64 `json:"held_for"`
+}
+
+type WaitForResponse struct {
 	LockId string `json:"lock_id"`
-	Value  string `json:"value"`
+	Key    string `json:"key"`
+	HeldBy string `json:"held_by"`
+}
+
+type DeadlockResponse struct {
+	Error string            `json:"error"`
+	Cycle []WaitForResponse `json:"cycle"`
+}
+
+type LockInfoResponse struct {
+	LockId     string     `json:"lock_id"`
+	Key        string     `json:"key"`
+	Mode       string     `json:"mode"`
+	AcquiredAt time.Time  `json:"acquired_at"`
+	HeldFor    float64    `json:"held_for"`
+	Token      uint64     `json:"token"`
+	Deadline   *time.Time `json:"deadline,omitempty"`
+	Waiters    int        `json:"waiters"`
+}
+
+type LocksResponse struct {
+	Locks []LockInfoResponse `json:"locks"`
+}
+
+type ChangeResponse struct {
+	Seq     uint64           `json:"seq"`
+	Op      string           `json:"op"`
+	Key     string           `json:"key,omitempty"`
+	Value   string           `json:"value,omitempty"`
+	Version uint64           `json:"version,omitempty"`
+	Token   uint64           `json:"token,omitempty"`
+	Time    *time.Time       `json:"time,omitempty"`
+	Items   []ChangeResponse `json:"items,omitempty"`
+}
+
+func newChangeResponse(change memdb.Change) ChangeResponse {
+	response := ChangeResponse{
+		Seq:     change.Seq,
+		Op:      string(change.Op),
+		Key:     string(change.Key),
+		Value:   string(change.Value),
+		Version: uint64(change.Version),
+		Token:   uint64(change.Token),
+	}
+	if !change.Time.IsZero() {
+		response.Time = &change.Time
+	}
+	for _, item := range change.Items {
+		response.Items = append(response.Items, newChangeResponse(item))
+	}
+	return response
+}
+
+// Change converts the response back to the change a replica applies.
+func (c ChangeResponse) Change() memdb.Change {
+	change := memdb.Change{
+		Seq:     c.Seq,
+		Op:      memdb.ChangeOp(c.Op),
+		Key:     memdb.Key(c.Key),
+		Value:   memdb.Value(c.Value),
+		Version: memdb.Version(c.Version),
+		Token:   memdb.FencingToken(c.Token),
+	}
+	if c.Time != nil {
+		change.Time = *c.Time
+	}
+	for _, item := range c.Items {
+		change.Items = append(change.Items, item.Change())
+	}
+	return change
+}
+
+type RenewResponse struct {
+	LockId   string    `json:"lock_id"`
+	Deadline time.Time `json:"deadline"`
 }
 
 type Server struct {
@@ -29,6 +163,143 @@ type Server struct {
 	logger *log.Logger
 }
 
+// parseTTL parses optional ttl query param (e.g. ?ttl=30s), zero means no lease.
+func parseTTL(r *http.Request) (time.Duration, error) {
+	rawTTL := r.URL.Query().Get("ttl")
+	if rawTTL == "" {
+		return 0, nil
+	}
+
+	ttl, err := time.ParseDuration(rawTTL)
+	if err != nil {
+		return 0, err
+	}
+
+	if ttl <= 0 {
+		return 0, errInvalidTTL
+	}
+
+	return ttl, nil
+}
+
+// parseWait parses optional wait query param (e.g. ?wait=5s), wait=0 means don't wait at all.
+func parseWait(r *http.Request) (time.Duration, error) {
+	rawWait := r.URL.Query().Get("wait")
+	if rawWait == "" {
+		return 0, nil
+	}
+
+	wait, err := time.ParseDuration(rawWait)
+	if err != nil {
+		return 0, err
+	}
+
+	if wait < 0 {
+		return 0, errInvalidWait
+	} else if wait == 0 {
+		return memdb.NoWait, nil
+	}
+
+	return wait, nil
+}
+
+// parseHeartbeat parses optional heartbeat query param (e.g. ?heartbeat=100ms), default is DefaultHeartbeatInterval.
+func parseHeartbeat(r *http.Request) (time.Duration, error) {
+	rawHeartbeat := r.URL.Query().Get("heartbeat")
+	if rawHeartbeat == "" {
+		return DefaultHeartbeatInterval, nil
+	}
+
+	heartbeat, err := time.ParseDuration(rawHeartbeat)
+	if err != nil {
+		return 0, err
+	}
+
+	if heartbeat <= 0 {
+		return 0, errInvalidHeartbeat
+	}
+
+	return heartbeat, nil
+}
+
+// parseMode parses optional mode query param (?mode=shared or ?mode=exclusive), default mode is exclusive.
+func parseMode(r *http.Request) (memdb.LockMode, error) {
+	switch r.URL.Query().Get("mode") {
+	case "", "exclusive":
+		return memdb.Exclusive, nil
+	case "shared":
+		return memdb.Shared, nil
+	}
+	return memdb.Exclusive, errInvalidMode
+}
+
+// parsePriority parses optional priority query param (e.g. ?priority=10), default priority class is 0.
+func parsePriority(r *http.Request) (int, error) {
+	rawPriority := r.URL.Query().Get("priority")
+	if rawPriority == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(rawPriority)
+}
+
+// parseLockOptions parses query params of reservations: ttl, wait, priority, mode and lock_id.
+func parseLockOptions(r *http.Request) (memdb.LockOptions, error) {
+	opts := memdb.LockOptions{Holder: memdb.LockID(r.URL.Query().Get("lock_id"))}
+	var err error
+
+	if opts.TTL, err = parseTTL(r); err != nil {
+		return opts, err
+	}
+	if opts.Wait, err = parseWait(r); err != nil {
+		return opts, err
+	}
+	if opts.Priority, err = parsePriority(r); err != nil {
+		return opts, err
+	}
+	if opts.Mode, err = parseMode(r); err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+// formatETag formats the version of a value as a strong ETag, e.g. "42".
+func formatETag(version memdb.Version) string {
+	return strconv.Quote(strconv.FormatUint(uint64(version), 10))
+}
+
+// parseETag parses an ETag made by formatETag.
+func parseETag(etag string) (memdb.Version, error) {
+	rawVersion, err := strconv.Unquote(etag)
+	if err != nil || len(etag) == 0 || etag[0] != '"' {
+		return 0, errInvalidETag
+	}
+
+	version, err := strconv.ParseUint(rawVersion, 10, 64)
+	if err != nil {
+		return 0, errInvalidETag
+	}
+	return memdb.Version(version), nil
+}
+
+// parseLimit parses optional limit query param (e.g. ?limit=10), default limit is DefaultScanLimit.
+func parseLimit(r *http.Request) (int, error) {
+	rawLimit := r.URL.Query().Get("limit")
+	if rawLimit == "" {
+		return DefaultScanLimit, nil
+	}
+
+	limit, err := strconv.Atoi(rawLimit)
+	if err != nil {
+		return 0, err
+	}
+
+	if limit <= 0 {
+		return 0, errInvalidLimit
+	}
+
+	return limit, nil
+}
+
 func (s *Server) Router() *mux.Router {
 	return s.router
 }
@@ -40,9 +311,20 @@ func (s *Server) Run() {
 }
 
 //
-// POST /reservations/{key}
+// POST /reservations/{key}?ttl={duration}&wait={duration}&priority={int}&mode={exclusive, shared}&lock_id={lock_id}
 //
-// Wait for {key} to be available (ignore cases where the client times out), then acquire a lock on it (and its value).
+// Wait for {key} to be available, then acquire a lock on it (and its value).
+// The response carries the fencing token of the lock, tokens of {key} grow with every new lock,
+// and the version of the value, which is also sent as ETag.
+// Clients get {key} in FIFO order, clients with higher priority (default is 0) go first.
+// With mode=shared many clients can hold {key} at once, they can read it but not update it.
+// If the client goes away while waiting, it leaves the queue for {key}.
+// If ttl is given (e.g. ttl=30s), the lock is released and its lock_id is invalidated when the ttl expires.
+// If wait is given (e.g. wait=5s, wait=0 to not wait at all) and {key} is still locked when it runs out,
+// return 409 Conflict with the age of the current lock.
+// If lock_id is given, {key} is locked by it instead of a new lock_id. Return 401 Unauthorized if lock_id isn't held.
+// If lock_id waiting for {key} would deadlock with other lock holders, return 409 Conflict with the wait-for cycle.
+// If the database doesn't support an option, e.g. priority in a Raft cluster, return 400 Bad Request.
 //
 func (s *Server) GetAndLock(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
@@ -53,11 +335,187 @@ func (s *Server) GetAndLock(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s.logger.Printf("key: %v, %v", rawKey, s.mdb)
+	opts, err := parseLockOptions(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.logger.Printf("key: %v, opts: %+v, %v", rawKey, opts, s.mdb)
 
 	key := memdb.Key(rawKey)
-	lockId, value, err := s.mdb.GetAndLock(key)
+	lockId, value, token, err := s.mdb.GetAndLockWithOptions(r.Context(), key, opts)
 	s.logger.Printf("lockId: %v, Value: %v, Err: %v", lockId, value, err)
+	if lockedErr, ok := err.(*memdb.LockedError); ok {
+		s.writeLocked(w, lockedErr)
+		return
+	} else if deadlockErr, ok := err.(*memdb.DeadlockError); ok {
+		s.writeDeadlock(w, deadlockErr)
+		return
+	} else if err == memdb.ErrKeyNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err == memdb.ErrLockIdNotFound {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	} else if err == memdb.ErrUnsupportedOption {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else if err == context.Canceled || err == context.DeadlineExceeded {
+		w.WriteHeader(http.StatusRequestTimeout)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// the value can't change while the lock is held, so it's read again together with its version
+	value, version, err := s.mdb.GetWithVersion(lockId, key)
+	if err == memdb.ErrLockIdNotFound {
+		// the lock expired in the meantime
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		// the client never learns about the lock, so it's given up here, other keys of lock_id stay locked
+		s.mdb.ReleaseKey(lockId, key)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse := &LockValueResponse{LockId: string(lockId), Value: string(value), Version: uint64(version), Token: uint64(token)}
+	body, err := json.Marshal(jsonResponse)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", formatETag(version))
+	w.Write(body)
+}
+
+//
+// POST /reservations?ttl={duration}&wait={duration}&priority={int}&mode={exclusive, shared}&lock_id={lock_id}
+//
+// Wait for all keys given in the JSON body ({"keys": ["key1", "key2"]}) to be available, then acquire locks on them
+// (and their values) with a single lock_id. Keys are locked in canonical order, so concurrent multi-key reservations
+// never deadlock. Query params have the same meaning as for POST /reservations/{key}.
+//
+// If the body is malformed or has no keys, return 400 Bad Request
+// If any of the keys doesn't exist, return 404 Not Found
+//
+func (s *Server) GetAndLockMany(w http.ResponseWriter, r *http.Request) {
+	opts, err := parseLockOptions(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	jsonRequest := &LockManyRequest{}
+	if err := json.NewDecoder(r.Body).Decode(jsonRequest); err != nil || len(jsonRequest.Keys) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	keys := make([]memdb.Key, len(jsonRequest.Keys))
+	for i, rawKey := range jsonRequest.Keys {
+		keys[i] = memdb.Key(rawKey)
+	}
+
+	s.logger.Printf("keys: %v, opts: %+v, %v", keys, opts, s.mdb)
+
+	lockId, values, tokens, err := s.mdb.GetAndLockManyWithOptions(r.Context(), keys, opts)
+	s.logger.Printf("lockId: %v, Values: %v, Err: %v", lockId, values, err)
+	if lockedErr, ok := err.(*memdb.LockedError); ok {
+		s.writeLocked(w, lockedErr)
+		return
+	} else if deadlockErr, ok := err.(*memdb.DeadlockError); ok {
+		s.writeDeadlock(w, deadlockErr)
+		return
+	} else if err == memdb.ErrKeyNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err == memdb.ErrLockIdNotFound {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	} else if err == memdb.ErrUnsupportedOption {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else if err == context.Canceled || err == context.DeadlineExceeded {
+		w.WriteHeader(http.StatusRequestTimeout)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse := &LockValuesResponse{LockId: string(lockId), Values: make(map[string]string, len(values)),
+		Tokens: make(map[string]uint64, len(tokens))}
+	for key, value := range values {
+		jsonResponse.Values[string(key)] = string(value)
+		jsonResponse.Tokens[string(key)] = uint64(tokens[key])
+	}
+
+	body, err := json.Marshal(jsonResponse)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+func (s *Server) writeLocked(w http.ResponseWriter, lockedErr *memdb.LockedError) {
+	jsonResponse := &LockedResponse{Key: string(lockedErr.Key), HeldFor: lockedErr.HeldFor.Seconds()}
+	body, err := json.Marshal(jsonResponse)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	w.Write(body)
+}
+
+func (s *Server) writeDeadlock(w http.ResponseWriter, deadlockErr *memdb.DeadlockError) {
+	jsonResponse := &DeadlockResponse{Error: deadlockErr.Error()}
+	for _, edge := range deadlockErr.Cycle {
+		jsonResponse.Cycle = append(jsonResponse.Cycle, WaitForResponse{
+			LockId: string(edge.LockID), Key: string(edge.Key), HeldBy: string(edge.HeldBy)})
+	}
+
+	body, err := json.Marshal(jsonResponse)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	w.Write(body)
+}
+
+//
+// GET /values/{key}
+//
+// Return the value of {key}, its version (also sent as ETag) and whether {key} is currently reserved, without waiting for the lock.
+// The value is the last one written, but a reserved {key} may be changed by its lock holder right after it has been read.
+//
+// If {key} doesn't exist, return 404 Not Found
+//
+func (s *Server) Peek(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	// handle key var
+	rawKey, exists := vars["key"]
+	if !exists {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	value, version, reserved, err := s.mdb.Peek(memdb.Key(rawKey))
 	if err == memdb.ErrKeyNotFound {
 		w.WriteHeader(http.StatusNotFound)
 		return
@@ -66,8 +524,46 @@ func (s *Server) GetAndLock(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	jsonResponse := &LockValueResponse{LockId: string(lockId), Value: string(value)}
-	s.logger.Printf("jsonResponse: %v", jsonResponse)
+	jsonResponse := &ValueResponse{Value: string(value), Version: uint64(version), Reserved: reserved}
+	body, err := json.Marshal(jsonResponse)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", formatETag(version))
+	w.Write(body)
+}
+
+//
+// GET /values?prefix={prefix}&limit={int}&cursor={cursor}
+//
+// List keys starting with prefix (all keys by default) in ascending order, at most limit (default is 100) of them.
+// If there are more keys, the response has a cursor, pass it to get the next page.
+// Keys aren't locked, keys created or deleted while paging may be missed.
+//
+// If limit isn't a positive number, return 400 Bad Request
+//
+func (s *Server) Scan(w http.ResponseWriter, r *http.Request) {
+	limit, err := parseLimit(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	prefix := memdb.Key(r.URL.Query().Get("prefix"))
+	cursor := memdb.Key(r.URL.Query().Get("cursor"))
+
+	keys, more := s.mdb.Scan(prefix, cursor, limit)
+
+	jsonResponse := &ScanResponse{Keys: make([]string, len(keys))}
+	for i, key := range keys {
+		jsonResponse.Keys[i] = string(key)
+	}
+	if more {
+		jsonResponse.Cursor = string(keys[len(keys)-1])
+	}
 
 	body, err := json.Marshal(jsonResponse)
 	if err != nil {
@@ -80,10 +576,18 @@ func (s *Server) GetAndLock(w http.ResponseWriter, r *http.Request) {
 }
 
 //
-// PUT /values/{key}
+// PUT /values/{key}?ttl={duration}
 //
-// If {key} already exists, wait until it's available (ignore cases where the client times out) then acquire the lock on it.
+// If {key} already exists, wait until it's available then acquire the lock on it.
+// If the client goes away while waiting, it leaves the queue for {key}.
 // If it doesn't already exist, create it and immediately acquire the lock on it (that operation should never block).
+// The response carries the fencing token of the lock, tokens of {key} grow with every new lock.
+// If ttl is given (e.g. ttl=30s), the lock is released and its lock_id is invalidated when the ttl expires.
+//
+// If the If-Match header is given (an ETag of POST /reservations/{key}), set the value without locking {key},
+// but only if the version of {key} still matches. Return 204 No Content with the new ETag.
+// If {key} doesn't exist or its version has changed, return 412 Precondition Failed.
+// If {key} is reserved, return 409 Conflict with the age of the current lock.
 //
 func (s *Server) PutAndLock(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
@@ -96,6 +600,13 @@ func (s *Server) PutAndLock(w http.ResponseWriter, r *http.Request) {
 	}
 	key := memdb.Key(rawKey)
 
+	// handle ttl query param
+	ttl, err := parseTTL(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
 	// handle POST body
 	rawValue, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -104,11 +615,23 @@ func (s *Server) PutAndLock(w http.ResponseWriter, r *http.Request) {
 	}
 	value := memdb.Value(rawValue)
 
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		s.compareAndSwap(w, key, ifMatch, value)
+		return
+	}
+
 	// store value into the memdb
-	lockid := s.mdb.Put(key, value)
+	lockid, token, err := s.mdb.PutWithOptions(r.Context(), key, value, memdb.LockOptions{TTL: ttl})
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		w.WriteHeader(http.StatusRequestTimeout)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
 	// create response
-	jsonResponse := &LockResponse{LockId: string(lockid)}
+	jsonResponse := &LockResponse{LockId: string(lockid), Token: uint64(token)}
 	body, err := json.Marshal(&jsonResponse)
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
@@ -119,13 +642,39 @@ func (s *Server) PutAndLock(w http.ResponseWriter, r *http.Request) {
 	w.Write(body)
 }
 
+func (s *Server) compareAndSwap(w http.ResponseWriter, key memdb.Key, ifMatch string, value memdb.Value) {
+	expectedVersion, err := parseETag(ifMatch)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	version, err := s.mdb.CompareAndSwap(key, expectedVersion, value)
+	if lockedErr, ok := err.(*memdb.LockedError); ok {
+		s.writeLocked(w, lockedErr)
+		return
+	} else if err == memdb.ErrKeyNotFound || err == memdb.ErrVersionMismatch {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("ETag", formatETag(version))
+	w.WriteHeader(http.StatusNoContent)
+}
+
 //
-// POST /values/{key}/{lock_id}?release={true, false}
+// POST /values/{key}/{lock_id}?release={true, false}&token={fencing token}
 //
 // Attempt to update the value of {key} to the value given in the POST body according to the following rules:
 //
 // If {key} doesn't exist, return 404 Not Found
+// If token is given and {key} has been locked with a newer fencing token since, do no action and respond with 409 Conflict,
+// a holder whose lock has expired learns this way that somebody else got the lock.
 // If {key} exists but {lock_id} doesn't identify the currently held lock, do no action and respond immediately with 401 Unauthorized.
+// If {lock_id} is a shared lock, do no action and respond with 403 Forbidden.
 // If {key} exists, {lock_id} identifies the currently held lock and release=true, set the new value, release the lock and invalidate {lock_id}. Return 204 No Content
 // If {key} exists, {lock_id} identifies the currently held lock and release=false, set the new value but don't release the lock and keep {lock_id} value. Return 204 No Content
 //
@@ -155,6 +704,15 @@ func (s *Server) Update(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// handle token query param
+	var token uint64
+	if rawToken := r.URL.Query().Get("token"); rawToken != "" {
+		if token, err = strconv.ParseUint(rawToken, 10, 64); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
 	// read POST Body
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -163,7 +721,7 @@ func (s *Server) Update(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// try to update...
-	err = s.mdb.Update(lockId, key, memdb.Value(string(body)), release)
+	err = s.mdb.UpdateWithToken(lockId, key, memdb.Value(string(body)), release, memdb.FencingToken(token))
 	if err == memdb.ErrKeyNotFound {
 		w.WriteHeader(http.StatusNotFound)
 		return
@@ -172,25 +730,410 @@ func (s *Server) Update(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 
+	} else if err == memdb.ErrLockIsShared {
+		w.WriteHeader(http.StatusForbidden)
+		return
+
+	} else if err == memdb.ErrStaleToken {
+		w.WriteHeader(http.StatusConflict)
+		return
+
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//
+// DELETE /reservations/{key}/{lock_id}
+//
+// Release the lock on {key} without changing its value. Other keys reserved by {lock_id} stay locked.
+//
+// If {key} doesn't exist, return 404 Not Found
+// If {key} exists but {lock_id} doesn't identify the currently held lock, do no action and respond immediately with 401 Unauthorized.
+// Otherwise release the lock, invalidate {lock_id} if it holds no more keys and return 204 No Content
+//
+func (s *Server) Release(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	// handle key var
+	rawKey, exists := vars["key"]
+	if !exists {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	key := memdb.Key(rawKey)
+
+	// handle lock_id var
+	rawLockId, exists := vars["lock_id"]
+	if !exists {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	lockId := memdb.LockID(rawLockId)
+
+	err := s.mdb.ReleaseKey(lockId, key)
+	if err == memdb.ErrKeyNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+
+	} else if err == memdb.ErrLockIdNotFound {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//
+// DELETE /values/{key}/{lock_id}
+//
+// Delete {key} and its value, {lock_id} must identify the currently held lock on {key}.
+//
+// If {key} doesn't exist, return 404 Not Found
+// If {key} exists but {lock_id} doesn't identify the currently held lock, do no action and respond immediately with 401 Unauthorized.
+// If {lock_id} is a shared lock, do no action and respond with 403 Forbidden.
+// Otherwise delete {key}, invalidate {lock_id} and return 204 No Content. Clients waiting for {key} get 404 Not Found.
+//
+func (s *Server) Delete(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	// handle key var
+	rawKey, exists := vars["key"]
+	if !exists {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	key := memdb.Key(rawKey)
+
+	// handle lock_id var
+	rawLockId, exists := vars["lock_id"]
+	if !exists {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	lockId := memdb.LockID(rawLockId)
+
+	err := s.mdb.Delete(lockId, key)
+	if err == memdb.ErrKeyNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+
+	} else if err == memdb.ErrLockIdNotFound {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+
+	} else if err == memdb.ErrLockIsShared {
+		w.WriteHeader(http.StatusForbidden)
+		return
+
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//
+// POST /locks/{lock_id}/renew?ttl={duration}
+//
+// Extend the lease of {lock_id}, so it expires ttl from now. Return the new deadline.
+//
+// If ttl is missing or invalid, return 400 Bad Request
+// If {lock_id} doesn't identify a currently held lock (e.g. it has been already reaped), respond with 401 Unauthorized.
+// If {lock_id} was acquired without ttl, return 409 Conflict
+//
+func (s *Server) Renew(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	// handle lock_id var
+	rawLockId, exists := vars["lock_id"]
+	if !exists {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	lockId := memdb.LockID(rawLockId)
+
+	// handle ttl query param
+	ttl, err := parseTTL(r)
+	if err != nil || ttl == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	deadline, err := s.mdb.Renew(lockId, ttl)
+	if err == memdb.ErrLockIdNotFound {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+
+	} else if err == memdb.ErrNoLease {
+		w.WriteHeader(http.StatusConflict)
+		return
+
 	} else if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	jsonResponse := &RenewResponse{LockId: string(lockId), Deadline: deadline}
+	body, err := json.Marshal(jsonResponse)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+//
+// GET /admin/locks
+//
+// List all held locks ordered by key: lock_id, key, mode, when it was acquired, its fencing token,
+// lease deadline (if any) and the number of clients waiting for the key.
+//
+func (s *Server) Locks(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	locks := s.mdb.Locks()
+
+	jsonResponse := &LocksResponse{Locks: make([]LockInfoResponse, len(locks))}
+	for i, info := range locks {
+		jsonResponse.Locks[i] = LockInfoResponse{
+			LockId:     string(info.LockID),
+			Key:        string(info.Key),
+			Mode:       info.Mode.String(),
+			AcquiredAt: info.AcquiredAt,
+			HeldFor:    now.Sub(info.AcquiredAt).Seconds(),
+			Token:      uint64(info.Token),
+			Waiters:    info.Waiters,
+		}
+		if !info.Deadline.IsZero() {
+			deadline := info.Deadline
+			jsonResponse.Locks[i].Deadline = &deadline
+		}
+	}
+
+	body, err := json.Marshal(jsonResponse)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+//
+// DELETE /admin/locks/{lock_id}?reason={text}
+//
+// Forcibly release all keys held by {lock_id} and invalidate it, e.g. when its client got stuck.
+// Every forced release is logged as an audit entry with the released keys, the client address and the reason.
+//
+// If {lock_id} doesn't identify a currently held lock, return 404 Not Found
+// Otherwise return 204 No Content
+//
+func (s *Server) ForceRelease(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	// handle lock_id var
+	rawLockId, exists := vars["lock_id"]
+	if !exists {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	lockId := memdb.LockID(rawLockId)
+
+	released, err := s.mdb.ForceRelease(lockId)
+	if err == memdb.ErrLockIdNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	keys := make([]memdb.Key, len(released))
+	for i, info := range released {
+		keys[i] = info.Key
+	}
+	s.logger.Printf("AUDIT: force release of lock_id %s holding keys %v, requested by %s, reason: %q",
+		lockId, keys, r.RemoteAddr, r.URL.Query().Get("reason"))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//
+// GET /admin/backup
+//
+// Stream a checksummed snapshot of all values, the format version is in X-Memdb-Snapshot-Version header.
+// Locks are not part of the backup.
+//
+func (s *Server) Backup(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set(SnapshotVersionHeader, strconv.Itoa(memdb.SnapshotFormatVersion))
+
+	// the status is already sent, a client finds a broken backup by its checksum
+	if err := s.mdb.Snapshot(w); err != nil {
+		s.logger.Printf("Backup requested by %s failed: %v", r.RemoteAddr, err)
+	}
+}
+
+//
+// POST /admin/restore?force={true, false}
+//
+// Replace all values with the snapshot in the body, made by GET /admin/backup. The snapshot is verified
+// before anything is replaced, restored values get new versions. Every restore is logged as an audit entry.
+//
+// If X-Memdb-Snapshot-Version header or the snapshot itself has an unsupported format version, return 400 Bad Request
+// If the snapshot is damaged, return 400 Bad Request
+// If any key is locked and force isn't true, return 409 Conflict
+// Otherwise return 204 No Content. With force=true all locks are broken, their clients get 401 Unauthorized
+// and clients waiting for keys get 404 Not Found.
+//
+func (s *Server) Restore(w http.ResponseWriter, r *http.Request) {
+	// handle force query param
+	force := false
+	if rawForce := r.URL.Query().Get("force"); rawForce != "" {
+		var err error
+		if force, err = strconv.ParseBool(rawForce); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	if version := r.Header.Get(SnapshotVersionHeader); version != "" && version != strconv.Itoa(memdb.SnapshotFormatVersion) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err := s.mdb.Restore(r.Body, force)
+	if err == memdb.ErrCorruptSnapshot || err == memdb.ErrUnsupportedSnapshot {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+
+	} else if err == memdb.ErrLocksHeld {
+		w.WriteHeader(http.StatusConflict)
+		return
+
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	s.logger.Printf("AUDIT: restore from backup, requested by %s, forced: %t", r.RemoteAddr, force)
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
+//
+// GET /replication/changes?from={seq}&heartbeat={duration}
+//
+// Stream the changes of values after the change from (zero by default) as JSON lines, one ChangeResponse each.
+// If the changes after from are no longer kept, the stream starts with a reset holding all the values.
+// When the replica has all the changes, a heartbeat is sent with the seq of the last change, and again every heartbeat
+// (DefaultHeartbeatInterval by default) while nothing changes. The stream ends when the client goes away.
+// Every change and heartbeat carries the time of the primary it was made at, so the replica can tell its lag.
+//
+// If from or heartbeat is invalid, return 400 Bad Request
+// Otherwise return 200 OK and keep streaming
+//
+func (s *Server) Changes(w http.ResponseWriter, r *http.Request) {
+	heartbeat, err := parseHeartbeat(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// handle from query param
+	var seq uint64
+	if rawFrom := r.URL.Query().Get("from"); rawFrom != "" {
+		if seq, err = strconv.ParseUint(rawFrom, 10, 64); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+
+	ticker := time.NewTicker(heartbeat)
+	defer ticker.Stop()
+
+	for {
+		changes, changed, err := s.mdb.Changes(seq)
+		if err != nil {
+			// the status is already sent, the replica reconnects
+			s.logger.Printf("Changes for %s failed: %v", r.RemoteAddr, err)
+			return
+		}
+
+		for _, change := range changes {
+			if err := encoder.Encode(newChangeResponse(change)); err != nil {
+				return
+			}
+			seq = change.Seq
+		}
+		if len(changes) > 0 {
+			// the replica gets every batch right away, even if the next one follows without a pause
+			if flusher != nil {
+				flusher.Flush()
+			}
+			continue
+		}
+
+		now := time.Now()
+		if err := encoder.Encode(&ChangeResponse{Seq: seq, Op: ChangeHeartbeat, Time: &now}); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		select {
+		case <-changed:
+		case <-ticker.C:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
 func NewRestServerWithLogger(logger *log.Logger) *Server {
+	return NewRestServerWithMemDB(memdb.NewMemDB("RestDB", memdb.NewLockIDSeqGenerator()), logger)
+}
+
+// NewRestServerWithMemDB serves the given database, e.g. a persistent one opened by memdb.Open.
+func NewRestServerWithMemDB(mdb memdb.MemDB, logger *log.Logger) *Server {
 
 	server := &Server{
-		mdb:    memdb.NewMemDB("RestDB", memdb.NewLockIDSeqGenerator()),
+		mdb:    mdb,
 		logger: logger,
 	}
 
 	server.router = mux.NewRouter()
 	server.router.HandleFunc("/reservations/{key}", http.HandlerFunc(server.GetAndLock)).Methods("POST")
+	server.router.HandleFunc("/reservations", server.GetAndLockMany).Methods("POST")
+	server.router.HandleFunc("/reservations/{key}/{lock_id}", server.Release).Methods("DELETE")
 	server.router.HandleFunc("/values/{key}/{lock_id}", server.Update).Methods("POST").Queries("release", "{release}")
 	server.router.HandleFunc("/values/{key}", server.PutAndLock).Methods("PUT")
+	server.router.HandleFunc("/values/{key}", server.Peek).Methods("GET")
+	server.router.HandleFunc("/values", server.Scan).Methods("GET")
+	server.router.HandleFunc("/values/{key}/{lock_id}", server.Delete).Methods("DELETE")
+	server.router.HandleFunc("/locks/{lock_id}/renew", server.Renew).Methods("POST")
+	server.router.HandleFunc("/admin/locks", server.Locks).Methods("GET")
+	server.router.HandleFunc("/admin/locks/{lock_id}", server.ForceRelease).Methods("DELETE")
+	server.router.HandleFunc("/admin/backup", server.Backup).Methods("GET")
+	server.router.HandleFunc("/admin/restore", server.Restore).Methods("POST")
+	server.router.HandleFunc("/replication/changes", server.Changes).Methods("GET")
 
 	return server
 }
@@ -1,11 +1,16 @@
 package rest
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"log"
 	"memdb"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -154,3 +159,865 @@ func TestRestServerUpdate(t *testing.T) {
 	server.Router().ServeHTTP(rec8, req8)
 	assert.Equal(t, http.StatusNoContent, rec8.Code)
 }
+
+func TestRestServerDelete(t *testing.T) {
+	server := NewRestServer()
+
+	// try to delete unexists key
+	rec0 := httptest.NewRecorder()
+	req0, err0 := http.NewRequest("DELETE", "http://memdb.devel/values/key0/1", nil)
+	assert.Nil(t, err0)
+	server.Router().ServeHTTP(rec0, req0)
+	assert.Equal(t, http.StatusNotFound, rec0.Code)
+
+	// put new value and get lock
+	rec1 := httptest.NewRecorder()
+	req1, err1 := http.NewRequest("PUT", "http://memdb.devel/values/key0", strings.NewReader("value"))
+	assert.Nil(t, err1)
+	server.Router().ServeHTTP(rec1, req1)
+	jr1 := &LockResponse{}
+	assert.NoError(t, json.Unmarshal(rec1.Body.Bytes(), &jr1))
+	assert.Equal(t, "1", jr1.LockId)
+
+	// try to delete with wrong lock
+	rec2 := httptest.NewRecorder()
+	req2, err2 := http.NewRequest("DELETE", "http://memdb.devel/values/key0/2", nil)
+	assert.Nil(t, err2)
+	server.Router().ServeHTTP(rec2, req2)
+	assert.Equal(t, http.StatusUnauthorized, rec2.Code)
+
+	// delete key
+	rec3 := httptest.NewRecorder()
+	req3, err3 := http.NewRequest("DELETE", "http://memdb.devel/values/key0/1", nil)
+	assert.Nil(t, err3)
+	server.Router().ServeHTTP(rec3, req3)
+	assert.Equal(t, http.StatusNoContent, rec3.Code)
+	_, exists := server.mdb.DirectGet(memdb.Key("key0"))
+	assert.False(t, exists)
+
+	// reservation of deleted key
+	rec4 := httptest.NewRecorder()
+	req4, err4 := http.NewRequest("POST", "http://memdb.devel/reservations/key0", strings.NewReader(""))
+	assert.Nil(t, err4)
+	server.Router().ServeHTTP(rec4, req4)
+	assert.Equal(t, http.StatusNotFound, rec4.Code)
+}
+
+func TestRestServerTTL(t *testing.T) {
+	server := NewRestServer()
+
+	// invalid ttl
+	rec0 := httptest.NewRecorder()
+	req0, err0 := http.NewRequest("PUT", "http://memdb.devel/values/key0?ttl=forever", strings.NewReader("value"))
+	assert.Nil(t, err0)
+	server.Router().ServeHTTP(rec0, req0)
+	assert.Equal(t, http.StatusBadRequest, rec0.Code)
+
+	rec1 := httptest.NewRecorder()
+	req1, err1 := http.NewRequest("POST", "http://memdb.devel/reservations/key0?ttl=-1s", strings.NewReader(""))
+	assert.Nil(t, err1)
+	server.Router().ServeHTTP(rec1, req1)
+	assert.Equal(t, http.StatusBadRequest, rec1.Code)
+
+	// put new value with short lease
+	rec2 := httptest.NewRecorder()
+	req2, err2 := http.NewRequest("PUT", "http://memdb.devel/values/key0?ttl=100ms", strings.NewReader("value"))
+	assert.Nil(t, err2)
+	server.Router().ServeHTTP(rec2, req2)
+	assert.Equal(t, http.StatusOK, rec2.Code)
+	jr2 := &LockResponse{}
+	assert.NoError(t, json.Unmarshal(rec2.Body.Bytes(), &jr2))
+	assert.Equal(t, "1", jr2.LockId)
+
+	// nobody releases lock 1, reservation waits for the lease to expire
+	rec3 := httptest.NewRecorder()
+	req3, err3 := http.NewRequest("POST", "http://memdb.devel/reservations/key0?ttl=1m", strings.NewReader(""))
+	assert.Nil(t, err3)
+	server.Router().ServeHTTP(rec3, req3)
+	assert.Equal(t, http.StatusOK, rec3.Code)
+	jr3 := &LockValueResponse{}
+	assert.NoError(t, json.Unmarshal(rec3.Body.Bytes(), &jr3))
+	assert.Equal(t, "2", jr3.LockId)
+	assert.Equal(t, "value", jr3.Value)
+
+	// expired lock can't be used anymore
+	rec4 := httptest.NewRecorder()
+	req4, err4 := http.NewRequest("POST", "http://memdb.devel/values/key0/1?release=true", strings.NewReader("stale"))
+	assert.Nil(t, err4)
+	server.Router().ServeHTTP(rec4, req4)
+	assert.Equal(t, http.StatusUnauthorized, rec4.Code)
+}
+
+func TestRestServerRenew(t *testing.T) {
+	server := NewRestServer()
+
+	// put new value with lease
+	rec0 := httptest.NewRecorder()
+	req0, err0 := http.NewRequest("PUT", "http://memdb.devel/values/key0?ttl=200ms", strings.NewReader("value"))
+	assert.Nil(t, err0)
+	server.Router().ServeHTTP(rec0, req0)
+	jr0 := &LockResponse{}
+	assert.NoError(t, json.Unmarshal(rec0.Body.Bytes(), &jr0))
+	assert.Equal(t, "1", jr0.LockId)
+
+	// missing ttl
+	rec1 := httptest.NewRecorder()
+	req1, err1 := http.NewRequest("POST", "http://memdb.devel/locks/1/renew", nil)
+	assert.Nil(t, err1)
+	server.Router().ServeHTTP(rec1, req1)
+	assert.Equal(t, http.StatusBadRequest, rec1.Code)
+
+	// renew
+	rec2 := httptest.NewRecorder()
+	req2, err2 := http.NewRequest("POST", "http://memdb.devel/locks/1/renew?ttl=1m", nil)
+	assert.Nil(t, err2)
+	server.Router().ServeHTTP(rec2, req2)
+	assert.Equal(t, http.StatusOK, rec2.Code)
+	jr2 := &RenewResponse{}
+	assert.NoError(t, json.Unmarshal(rec2.Body.Bytes(), &jr2))
+	assert.Equal(t, "1", jr2.LockId)
+	assert.True(t, jr2.Deadline.After(time.Now().Add(50*time.Second)))
+
+	// the lock survives the initial ttl
+	time.Sleep(300 * time.Millisecond)
+	rec3 := httptest.NewRecorder()
+	req3, err3 := http.NewRequest("POST", "http://memdb.devel/values/key0/1?release=false", strings.NewReader("value1"))
+	assert.Nil(t, err3)
+	server.Router().ServeHTTP(rec3, req3)
+	assert.Equal(t, http.StatusNoContent, rec3.Code)
+
+	// renew unknown lock
+	rec4 := httptest.NewRecorder()
+	req4, err4 := http.NewRequest("POST", "http://memdb.devel/locks/2/renew?ttl=1m", nil)
+	assert.Nil(t, err4)
+	server.Router().ServeHTTP(rec4, req4)
+	assert.Equal(t, http.StatusUnauthorized, rec4.Code)
+
+	// renew lock without lease
+	server.mdb.Release(memdb.LockID("1"))
+	rec5 := httptest.NewRecorder()
+	req5, err5 := http.NewRequest("POST", "http://memdb.devel/reservations/key0", nil)
+	assert.Nil(t, err5)
+	server.Router().ServeHTTP(rec5, req5)
+	assert.Equal(t, http.StatusOK, rec5.Code)
+
+	rec6 := httptest.NewRecorder()
+	req6, err6 := http.NewRequest("POST", "http://memdb.devel/locks/2/renew?ttl=1m", nil)
+	assert.Nil(t, err6)
+	server.Router().ServeHTTP(rec6, req6)
+	assert.Equal(t, http.StatusConflict, rec6.Code)
+}
+
+func TestRestServerClientGoesAway(t *testing.T) {
+	server := NewRestServer()
+
+	// put new value and get lock
+	rec0 := httptest.NewRecorder()
+	req0, err0 := http.NewRequest("PUT", "http://memdb.devel/values/key0", strings.NewReader("value"))
+	assert.Nil(t, err0)
+	server.Router().ServeHTTP(rec0, req0)
+	assert.Equal(t, http.StatusOK, rec0.Code)
+
+	// clients waiting for the key disconnect
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	rec1 := httptest.NewRecorder()
+	req1, err1 := http.NewRequest("POST", "http://memdb.devel/reservations/key0", nil)
+	assert.Nil(t, err1)
+	server.Router().ServeHTTP(rec1, req1.WithContext(ctx))
+	assert.Equal(t, http.StatusRequestTimeout, rec1.Code)
+
+	rec2 := httptest.NewRecorder()
+	req2, err2 := http.NewRequest("PUT", "http://memdb.devel/values/key0", strings.NewReader("value2"))
+	assert.Nil(t, err2)
+	server.Router().ServeHTTP(rec2, req2.WithContext(ctx))
+	assert.Equal(t, http.StatusRequestTimeout, rec2.Code)
+
+	// nobody took the lock after release
+	assert.NoError(t, server.mdb.Release(memdb.LockID("1")))
+	rec3 := httptest.NewRecorder()
+	req3, err3 := http.NewRequest("POST", "http://memdb.devel/reservations/key0", nil)
+	assert.Nil(t, err3)
+	server.Router().ServeHTTP(rec3, req3)
+	assert.Equal(t, http.StatusOK, rec3.Code)
+	jr3 := &LockValueResponse{}
+	assert.NoError(t, json.Unmarshal(rec3.Body.Bytes(), &jr3))
+	assert.Equal(t, "2", jr3.LockId)
+	assert.Equal(t, "value", jr3.Value)
+}
+
+func TestRestServerReservationWait(t *testing.T) {
+	server := NewRestServer()
+
+	// put new value and get lock
+	rec0 := httptest.NewRecorder()
+	req0, err0 := http.NewRequest("PUT", "http://memdb.devel/values/key0", strings.NewReader("value"))
+	assert.Nil(t, err0)
+	server.Router().ServeHTTP(rec0, req0)
+	assert.Equal(t, http.StatusOK, rec0.Code)
+
+	// invalid wait
+	rec1 := httptest.NewRecorder()
+	req1, err1 := http.NewRequest("POST", "http://memdb.devel/reservations/key0?wait=-1s", nil)
+	assert.Nil(t, err1)
+	server.Router().ServeHTTP(rec1, req1)
+	assert.Equal(t, http.StatusBadRequest, rec1.Code)
+
+	// don't wait at all
+	rec2 := httptest.NewRecorder()
+	req2, err2 := http.NewRequest("POST", "http://memdb.devel/reservations/key0?wait=0", nil)
+	assert.Nil(t, err2)
+	server.Router().ServeHTTP(rec2, req2)
+	assert.Equal(t, http.StatusConflict, rec2.Code)
+	jr2 := &LockedResponse{}
+	assert.NoError(t, json.Unmarshal(rec2.Body.Bytes(), &jr2))
+	assert.Equal(t, "key0", jr2.Key)
+	assert.True(t, jr2.HeldFor > 0)
+
+	// wait a bit
+	rec3 := httptest.NewRecorder()
+	req3, err3 := http.NewRequest("POST", "http://memdb.devel/reservations/key0?wait=50ms", nil)
+	assert.Nil(t, err3)
+	server.Router().ServeHTTP(rec3, req3)
+	assert.Equal(t, http.StatusConflict, rec3.Code)
+
+	// lock is released in time
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		server.mdb.Release(memdb.LockID("1"))
+	}()
+
+	rec4 := httptest.NewRecorder()
+	req4, err4 := http.NewRequest("POST", "http://memdb.devel/reservations/key0?wait=5s", nil)
+	assert.Nil(t, err4)
+	server.Router().ServeHTTP(rec4, req4)
+	assert.Equal(t, http.StatusOK, rec4.Code)
+	jr4 := &LockValueResponse{}
+	assert.NoError(t, json.Unmarshal(rec4.Body.Bytes(), &jr4))
+	assert.Equal(t, "2", jr4.LockId)
+}
+
+func TestRestServerReservationPriority(t *testing.T) {
+	server := NewRestServer()
+
+	// put new value and get lock
+	rec0 := httptest.NewRecorder()
+	req0, err0 := http.NewRequest("PUT", "http://memdb.devel/values/key0", strings.NewReader("value"))
+	assert.Nil(t, err0)
+	server.Router().ServeHTTP(rec0, req0)
+	assert.Equal(t, http.StatusOK, rec0.Code)
+
+	// invalid priority
+	rec1 := httptest.NewRecorder()
+	req1, err1 := http.NewRequest("POST", "http://memdb.devel/reservations/key0?priority=high", nil)
+	assert.Nil(t, err1)
+	server.Router().ServeHTTP(rec1, req1)
+	assert.Equal(t, http.StatusBadRequest, rec1.Code)
+
+	// low priority client comes first, high priority client gets the key first
+	lockIds := make(chan string, 2)
+	for i, priority := range []string{"0", "5"} {
+		go func(priority string) {
+			rec := httptest.NewRecorder()
+			req, err := http.NewRequest("POST", "http://memdb.devel/reservations/key0?ttl=1s&priority="+priority, nil)
+			assert.Nil(t, err)
+			server.Router().ServeHTTP(rec, req)
+			assert.Equal(t, http.StatusOK, rec.Code)
+			jr := &LockValueResponse{}
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &jr))
+			lockIds <- priority + ":" + jr.LockId
+		}(priority)
+
+		// wait until the client is in the queue
+		for waiters, _ := server.mdb.Waiters(memdb.Key("key0")); len(waiters) <= i; waiters, _ = server.mdb.Waiters(memdb.Key("key0")) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	server.mdb.Release(memdb.LockID("1"))
+	assert.Equal(t, "5:2", <-lockIds)
+	assert.Equal(t, "0:3", <-lockIds)
+}
+
+func TestRestServerSharedReservation(t *testing.T) {
+	server := NewRestServer()
+
+	// put new value and release lock
+	rec0 := httptest.NewRecorder()
+	req0, err0 := http.NewRequest("PUT", "http://memdb.devel/values/key0", strings.NewReader("value"))
+	assert.Nil(t, err0)
+	server.Router().ServeHTTP(rec0, req0)
+	assert.Equal(t, http.StatusOK, rec0.Code)
+	assert.NoError(t, server.mdb.Release(memdb.LockID("1")))
+
+	// invalid mode
+	rec1 := httptest.NewRecorder()
+	req1, err1 := http.NewRequest("POST", "http://memdb.devel/reservations/key0?mode=upgradable", nil)
+	assert.Nil(t, err1)
+	server.Router().ServeHTTP(rec1, req1)
+	assert.Equal(t, http.StatusBadRequest, rec1.Code)
+
+	// two readers at once
+	for _, lockId := range []string{"2", "3"} {
+		rec := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", "http://memdb.devel/reservations/key0?mode=shared&wait=0", nil)
+		assert.Nil(t, err)
+		server.Router().ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		jr := &LockValueResponse{}
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &jr))
+		assert.Equal(t, lockId, jr.LockId)
+		assert.Equal(t, "value", jr.Value)
+	}
+
+	// writer has to wait
+	rec2 := httptest.NewRecorder()
+	req2, err2 := http.NewRequest("POST", "http://memdb.devel/reservations/key0?wait=0", nil)
+	assert.Nil(t, err2)
+	server.Router().ServeHTTP(rec2, req2)
+	assert.Equal(t, http.StatusConflict, rec2.Code)
+
+	// reader can't update
+	rec3 := httptest.NewRecorder()
+	req3, err3 := http.NewRequest("POST", "http://memdb.devel/values/key0/2?release=true", strings.NewReader("value2"))
+	assert.Nil(t, err3)
+	server.Router().ServeHTTP(rec3, req3)
+	assert.Equal(t, http.StatusForbidden, rec3.Code)
+
+	// reader can't delete
+	rec4 := httptest.NewRecorder()
+	req4, err4 := http.NewRequest("DELETE", "http://memdb.devel/values/key0/3", nil)
+	assert.Nil(t, err4)
+	server.Router().ServeHTTP(rec4, req4)
+	assert.Equal(t, http.StatusForbidden, rec4.Code)
+}
+
+func TestRestServerMultiKeyReservation(t *testing.T) {
+	server := NewRestServer()
+
+	for _, key := range []string{"account", "ledger"} {
+		rec := httptest.NewRecorder()
+		req, err := http.NewRequest("PUT", "http://memdb.devel/values/"+key, strings.NewReader(key+"-value"))
+		assert.Nil(t, err)
+		server.Router().ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		jr := &LockResponse{}
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &jr))
+		assert.NoError(t, server.mdb.Release(memdb.LockID(jr.LockId)))
+	}
+
+	// malformed body and no keys
+	for _, body := range []string{"keys", `{"keys": []}`} {
+		rec := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", "http://memdb.devel/reservations", strings.NewReader(body))
+		assert.Nil(t, err)
+		server.Router().ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	}
+
+	// unexists key
+	rec0 := httptest.NewRecorder()
+	req0, err0 := http.NewRequest("POST", "http://memdb.devel/reservations", strings.NewReader(`{"keys": ["account", "missing"]}`))
+	assert.Nil(t, err0)
+	server.Router().ServeHTTP(rec0, req0)
+	assert.Equal(t, http.StatusNotFound, rec0.Code)
+
+	// lock both keys
+	rec1 := httptest.NewRecorder()
+	req1, err1 := http.NewRequest("POST", "http://memdb.devel/reservations?ttl=1m", strings.NewReader(`{"keys": ["ledger", "account"]}`))
+	assert.Nil(t, err1)
+	server.Router().ServeHTTP(rec1, req1)
+	assert.Equal(t, http.StatusOK, rec1.Code)
+	jr1 := &LockValuesResponse{}
+	assert.NoError(t, json.Unmarshal(rec1.Body.Bytes(), &jr1))
+	assert.Equal(t, "3", jr1.LockId)
+	assert.Equal(t, map[string]string{"account": "account-value", "ledger": "ledger-value"}, jr1.Values)
+
+	// keys are locked
+	rec2 := httptest.NewRecorder()
+	req2, err2 := http.NewRequest("POST", "http://memdb.devel/reservations?wait=0", strings.NewReader(`{"keys": ["ledger"]}`))
+	assert.Nil(t, err2)
+	server.Router().ServeHTTP(rec2, req2)
+	assert.Equal(t, http.StatusConflict, rec2.Code)
+
+	// update each key with the same lock
+	for _, key := range []string{"account", "ledger"} {
+		rec := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", "http://memdb.devel/values/"+key+"/3?release=true", strings.NewReader("new"))
+		assert.Nil(t, err)
+		server.Router().ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusNoContent, rec.Code)
+	}
+}
+
+func TestRestServerDeadlock(t *testing.T) {
+	server := NewRestServer()
+
+	for _, key := range []string{"key0", "key1"} {
+		rec := httptest.NewRecorder()
+		req, err := http.NewRequest("PUT", "http://memdb.devel/values/"+key, strings.NewReader("value"))
+		assert.Nil(t, err)
+		server.Router().ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+	}
+
+	// unknown holder
+	rec0 := httptest.NewRecorder()
+	req0, err0 := http.NewRequest("POST", "http://memdb.devel/reservations/key1?lock_id=3", nil)
+	assert.Nil(t, err0)
+	server.Router().ServeHTTP(rec0, req0)
+	assert.Equal(t, http.StatusUnauthorized, rec0.Code)
+
+	// lock 1 waits for key1 held by lock 2
+	done := make(chan int)
+	go func() {
+		rec := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", "http://memdb.devel/reservations/key1?lock_id=1", nil)
+		assert.Nil(t, err)
+		server.Router().ServeHTTP(rec, req)
+		done <- rec.Code
+	}()
+	for waiters, _ := server.mdb.Waiters(memdb.Key("key1")); len(waiters) == 0; waiters, _ = server.mdb.Waiters(memdb.Key("key1")) {
+		time.Sleep(time.Millisecond)
+	}
+
+	// lock 2 waits for key0 held by lock 1
+	rec1 := httptest.NewRecorder()
+	req1, err1 := http.NewRequest("POST", "http://memdb.devel/reservations/key0?lock_id=2", nil)
+	assert.Nil(t, err1)
+	server.Router().ServeHTTP(rec1, req1)
+	assert.Equal(t, http.StatusConflict, rec1.Code)
+	jr1 := &DeadlockResponse{}
+	assert.NoError(t, json.Unmarshal(rec1.Body.Bytes(), &jr1))
+	assert.Equal(t, []WaitForResponse{
+		{LockId: "2", Key: "key0", HeldBy: "1"},
+		{LockId: "1", Key: "key1", HeldBy: "2"},
+	}, jr1.Cycle)
+
+	assert.NoError(t, server.mdb.Release(memdb.LockID("2")))
+	assert.Equal(t, http.StatusOK, <-done)
+}
+
+func TestRestServerFencingToken(t *testing.T) {
+	server := NewRestServer()
+
+	rec0 := httptest.NewRecorder()
+	req0, err0 := http.NewRequest("PUT", "http://memdb.devel/values/key0", strings.NewReader("value"))
+	assert.Nil(t, err0)
+	server.Router().ServeHTTP(rec0, req0)
+	jr0 := &LockResponse{}
+	assert.NoError(t, json.Unmarshal(rec0.Body.Bytes(), &jr0))
+	assert.Equal(t, "1", jr0.LockId)
+	assert.Equal(t, uint64(1), jr0.Token)
+	assert.NoError(t, server.mdb.Release(memdb.LockID("1")))
+
+	rec1 := httptest.NewRecorder()
+	req1, err1 := http.NewRequest("POST", "http://memdb.devel/reservations/key0", nil)
+	assert.Nil(t, err1)
+	server.Router().ServeHTTP(rec1, req1)
+	jr1 := &LockValueResponse{}
+	assert.NoError(t, json.Unmarshal(rec1.Body.Bytes(), &jr1))
+	assert.Equal(t, "2", jr1.LockId)
+	assert.Equal(t, uint64(2), jr1.Token)
+
+	// write with the token of the previous lock
+	rec2 := httptest.NewRecorder()
+	req2, err2 := http.NewRequest("POST", "http://memdb.devel/values/key0/2?release=false&token=1", strings.NewReader("stale"))
+	assert.Nil(t, err2)
+	server.Router().ServeHTTP(rec2, req2)
+	assert.Equal(t, http.StatusConflict, rec2.Code)
+
+	rec3 := httptest.NewRecorder()
+	req3, err3 := http.NewRequest("POST", "http://memdb.devel/values/key0/2?release=false&token=x", strings.NewReader("bad"))
+	assert.Nil(t, err3)
+	server.Router().ServeHTTP(rec3, req3)
+	assert.Equal(t, http.StatusBadRequest, rec3.Code)
+
+	rec4 := httptest.NewRecorder()
+	req4, err4 := http.NewRequest("POST", "http://memdb.devel/values/key0/2?release=true&token=2", strings.NewReader("newValue"))
+	assert.Nil(t, err4)
+	server.Router().ServeHTTP(rec4, req4)
+	assert.Equal(t, http.StatusNoContent, rec4.Code)
+	v4, _ := server.mdb.DirectGet(memdb.Key("key0"))
+	assert.Equal(t, memdb.Value("newValue"), v4)
+
+	rec5 := httptest.NewRecorder()
+	req5, err5 := http.NewRequest("POST", "http://memdb.devel/reservations", strings.NewReader(`{"keys": ["key0"]}`))
+	assert.Nil(t, err5)
+	server.Router().ServeHTTP(rec5, req5)
+	jr5 := &LockValuesResponse{}
+	assert.NoError(t, json.Unmarshal(rec5.Body.Bytes(), &jr5))
+	assert.Equal(t, map[string]uint64{"key0": 3}, jr5.Tokens)
+}
+
+// failingStorage fails a Get once the number of Gets set by failGet have passed.
+type failingStorage struct {
+	memdb.Storage
+	gets int32
+}
+
+func (s *failingStorage) failGet(n int32) {
+	atomic.StoreInt32(&s.gets, n)
+}
+
+func (s *failingStorage) Get(key memdb.Key) (memdb.Value, memdb.Version, error) {
+	if atomic.AddInt32(&s.gets, -1) == 0 {
+		return memdb.EmptyValue, 0, errors.New("Storage failed")
+	}
+	return s.Storage.Get(key)
+}
+
+func TestRestServerGetAndLockStorageFails(t *testing.T) {
+	storage := &failingStorage{Storage: memdb.NewMapStorage()}
+	server := NewRestServerWithMemDB(memdb.NewMemDB("TestRestServerGetAndLockStorageFails", memdb.NewLockIDSeqGenerator(), storage), NoLog)
+	lockId := server.mdb.Put(memdb.Key("key0"), memdb.Value("value"))
+	assert.NoError(t, server.mdb.Release(lockId))
+
+	// the value is read again after the lock is acquired
+	storage.failGet(2)
+	rec := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "http://memdb.devel/reservations/key0", nil)
+	assert.Nil(t, err)
+	server.Router().ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+
+	// the lock nobody knows about is given up
+	_, _, reserved, err := server.mdb.Peek(memdb.Key("key0"))
+	assert.NoError(t, err)
+	assert.False(t, reserved)
+}
+
+func TestRestServerCompareAndSwap(t *testing.T) {
+	server := NewRestServer()
+
+	// no such key
+	rec0 := httptest.NewRecorder()
+	req0, err0 := http.NewRequest("PUT", "http://memdb.devel/values/key0", strings.NewReader("value"))
+	assert.Nil(t, err0)
+	req0.Header.Set("If-Match", `"1"`)
+	server.Router().ServeHTTP(rec0, req0)
+	assert.Equal(t, http.StatusPreconditionFailed, rec0.Code)
+
+	rec1 := httptest.NewRecorder()
+	req1, err1 := http.NewRequest("PUT", "http://memdb.devel/values/key0", strings.NewReader("value"))
+	assert.Nil(t, err1)
+	server.Router().ServeHTTP(rec1, req1)
+	assert.Equal(t, http.StatusOK, rec1.Code)
+
+	// reserved key
+	rec2 := httptest.NewRecorder()
+	req2, err2 := http.NewRequest("PUT", "http://memdb.devel/values/key0", strings.NewReader("value"))
+	assert.Nil(t, err2)
+	req2.Header.Set("If-Match", `"1"`)
+	server.Router().ServeHTTP(rec2, req2)
+	assert.Equal(t, http.StatusConflict, rec2.Code)
+
+	rec3 := httptest.NewRecorder()
+	req3, err3 := http.NewRequest("POST", "http://memdb.devel/values/key0/1?release=true", strings.NewReader("newValue"))
+	assert.Nil(t, err3)
+	server.Router().ServeHTTP(rec3, req3)
+	assert.Equal(t, http.StatusNoContent, rec3.Code)
+
+	rec4 := httptest.NewRecorder()
+	req4, err4 := http.NewRequest("POST", "http://memdb.devel/reservations/key0", nil)
+	assert.Nil(t, err4)
+	server.Router().ServeHTTP(rec4, req4)
+	jr4 := &LockValueResponse{}
+	assert.NoError(t, json.Unmarshal(rec4.Body.Bytes(), &jr4))
+	assert.Equal(t, "newValue", jr4.Value)
+	assert.Equal(t, uint64(2), jr4.Version)
+	assert.Equal(t, `"2"`, rec4.Header().Get("ETag"))
+	assert.NoError(t, server.mdb.Release(memdb.LockID(jr4.LockId)))
+
+	rec5 := httptest.NewRecorder()
+	req5, err5 := http.NewRequest("PUT", "http://memdb.devel/values/key0", strings.NewReader("casValue"))
+	assert.Nil(t, err5)
+	req5.Header.Set("If-Match", rec4.Header().Get("ETag"))
+	server.Router().ServeHTTP(rec5, req5)
+	assert.Equal(t, http.StatusNoContent, rec5.Code)
+	assert.Equal(t, `"3"`, rec5.Header().Get("ETag"))
+	v5, _ := server.mdb.DirectGet(memdb.Key("key0"))
+	assert.Equal(t, memdb.Value("casValue"), v5)
+
+	// stale version
+	rec6 := httptest.NewRecorder()
+	req6, err6 := http.NewRequest("PUT", "http://memdb.devel/values/key0", strings.NewReader("staleValue"))
+	assert.Nil(t, err6)
+	req6.Header.Set("If-Match", rec4.Header().Get("ETag"))
+	server.Router().ServeHTTP(rec6, req6)
+	assert.Equal(t, http.StatusPreconditionFailed, rec6.Code)
+
+	rec7 := httptest.NewRecorder()
+	req7, err7 := http.NewRequest("PUT", "http://memdb.devel/values/key0", strings.NewReader("badValue"))
+	assert.Nil(t, err7)
+	req7.Header.Set("If-Match", "3")
+	server.Router().ServeHTTP(rec7, req7)
+	assert.Equal(t, http.StatusBadRequest, rec7.Code)
+}
+
+func TestRestServerPeek(t *testing.T) {
+	server := NewRestServer()
+
+	rec0 := httptest.NewRecorder()
+	req0, err0 := http.NewRequest("GET", "http://memdb.devel/values/key0", nil)
+	assert.Nil(t, err0)
+	server.Router().ServeHTTP(rec0, req0)
+	assert.Equal(t, http.StatusNotFound, rec0.Code)
+
+	lockId := server.mdb.Put(memdb.Key("key0"), memdb.Value("value"))
+
+	rec1 := httptest.NewRecorder()
+	req1, err1 := http.NewRequest("GET", "http://memdb.devel/values/key0", nil)
+	assert.Nil(t, err1)
+	server.Router().ServeHTTP(rec1, req1)
+	assert.Equal(t, http.StatusOK, rec1.Code)
+	assert.Equal(t, `"1"`, rec1.Header().Get("ETag"))
+	jr1 := &ValueResponse{}
+	assert.NoError(t, json.Unmarshal(rec1.Body.Bytes(), &jr1))
+	assert.Equal(t, ValueResponse{Value: "value", Version: 1, Reserved: true}, *jr1)
+
+	assert.NoError(t, server.mdb.Update(lockId, memdb.Key("key0"), memdb.Value("newValue"), true))
+
+	rec2 := httptest.NewRecorder()
+	req2, err2 := http.NewRequest("GET", "http://memdb.devel/values/key0", nil)
+	assert.Nil(t, err2)
+	server.Router().ServeHTTP(rec2, req2)
+	jr2 := &ValueResponse{}
+	assert.NoError(t, json.Unmarshal(rec2.Body.Bytes(), &jr2))
+	assert.Equal(t, ValueResponse{Value: "newValue", Version: 2, Reserved: false}, *jr2)
+}
+
+func TestRestServerScan(t *testing.T) {
+	server := NewRestServer()
+
+	for _, key := range []string{"b", "a1", "a2", "a3"} {
+		server.mdb.Put(memdb.Key(key), memdb.Value("value"))
+	}
+
+	rec0 := httptest.NewRecorder()
+	req0, err0 := http.NewRequest("GET", "http://memdb.devel/values?prefix=a&limit=2", nil)
+	assert.Nil(t, err0)
+	server.Router().ServeHTTP(rec0, req0)
+	assert.Equal(t, http.StatusOK, rec0.Code)
+	jr0 := &ScanResponse{}
+	assert.NoError(t, json.Unmarshal(rec0.Body.Bytes(), &jr0))
+	assert.Equal(t, ScanResponse{Keys: []string{"a1", "a2"}, Cursor: "a2"}, *jr0)
+
+	rec1 := httptest.NewRecorder()
+	req1, err1 := http.NewRequest("GET", "http://memdb.devel/values?prefix=a&limit=2&cursor=a2", nil)
+	assert.Nil(t, err1)
+	server.Router().ServeHTTP(rec1, req1)
+	jr1 := &ScanResponse{}
+	assert.NoError(t, json.Unmarshal(rec1.Body.Bytes(), &jr1))
+	assert.Equal(t, ScanResponse{Keys: []string{"a3"}}, *jr1)
+
+	rec2 := httptest.NewRecorder()
+	req2, err2 := http.NewRequest("GET", "http://memdb.devel/values", nil)
+	assert.Nil(t, err2)
+	server.Router().ServeHTTP(rec2, req2)
+	jr2 := &ScanResponse{}
+	assert.NoError(t, json.Unmarshal(rec2.Body.Bytes(), &jr2))
+	assert.Equal(t, ScanResponse{Keys: []string{"a1", "a2", "a3", "b"}}, *jr2)
+
+	rec3 := httptest.NewRecorder()
+	req3, err3 := http.NewRequest("GET", "http://memdb.devel/values?limit=0", nil)
+	assert.Nil(t, err3)
+	server.Router().ServeHTTP(rec3, req3)
+	assert.Equal(t, http.StatusBadRequest, rec3.Code)
+}
+
+func TestRestServerAdminLocks(t *testing.T) {
+	auditLog := &bytes.Buffer{}
+	server := NewRestServerWithLogger(log.New(auditLog, "", 0))
+
+	rec0 := httptest.NewRecorder()
+	req0, err0 := http.NewRequest("GET", "http://memdb.devel/admin/locks", nil)
+	assert.Nil(t, err0)
+	server.Router().ServeHTTP(rec0, req0)
+	assert.Equal(t, http.StatusOK, rec0.Code)
+	assert.Equal(t, `{"locks":[]}`, rec0.Body.String())
+
+	server.mdb.PutWithTTL(memdb.Key("key0"), memdb.Value("value"), time.Minute)
+	server.mdb.Put(memdb.Key("key1"), memdb.Value("value"))
+
+	rec1 := httptest.NewRecorder()
+	req1, err1 := http.NewRequest("GET", "http://memdb.devel/admin/locks", nil)
+	assert.Nil(t, err1)
+	server.Router().ServeHTTP(rec1, req1)
+	jr1 := &LocksResponse{}
+	assert.NoError(t, json.Unmarshal(rec1.Body.Bytes(), &jr1))
+	assert.Equal(t, 2, len(jr1.Locks))
+	assert.Equal(t, "1", jr1.Locks[0].LockId)
+	assert.Equal(t, "key0", jr1.Locks[0].Key)
+	assert.Equal(t, "exclusive", jr1.Locks[0].Mode)
+	assert.NotNil(t, jr1.Locks[0].Deadline)
+	assert.Equal(t, "2", jr1.Locks[1].LockId)
+	assert.Nil(t, jr1.Locks[1].Deadline)
+
+	rec2 := httptest.NewRecorder()
+	req2, err2 := http.NewRequest("DELETE", "http://memdb.devel/admin/locks/2?reason=stuck", nil)
+	assert.Nil(t, err2)
+	server.Router().ServeHTTP(rec2, req2)
+	assert.Equal(t, http.StatusNoContent, rec2.Code)
+	assert.Contains(t, auditLog.String(), `AUDIT: force release of lock_id 2 holding keys [key1]`)
+	assert.Contains(t, auditLog.String(), `reason: "stuck"`)
+
+	rec3 := httptest.NewRecorder()
+	req3, err3 := http.NewRequest("DELETE", "http://memdb.devel/admin/locks/2", nil)
+	assert.Nil(t, err3)
+	server.Router().ServeHTTP(rec3, req3)
+	assert.Equal(t, http.StatusNotFound, rec3.Code)
+
+	_, _, err := server.mdb.TryGetAndLock(memdb.Key("key1"))
+	assert.NoError(t, err)
+}
+
+func TestRestServerRelease(t *testing.T) {
+	server := NewRestServer()
+
+	rec0 := httptest.NewRecorder()
+	req0, err0 := http.NewRequest("DELETE", "http://memdb.devel/reservations/key0/1", nil)
+	assert.Nil(t, err0)
+	server.Router().ServeHTTP(rec0, req0)
+	assert.Equal(t, http.StatusNotFound, rec0.Code)
+
+	server.mdb.Put(memdb.Key("key0"), memdb.Value("value"))
+
+	rec1 := httptest.NewRecorder()
+	req1, err1 := http.NewRequest("DELETE", "http://memdb.devel/reservations/key0/2", nil)
+	assert.Nil(t, err1)
+	server.Router().ServeHTTP(rec1, req1)
+	assert.Equal(t, http.StatusUnauthorized, rec1.Code)
+
+	rec2 := httptest.NewRecorder()
+	req2, err2 := http.NewRequest("DELETE", "http://memdb.devel/reservations/key0/1", nil)
+	assert.Nil(t, err2)
+	server.Router().ServeHTTP(rec2, req2)
+	assert.Equal(t, http.StatusNoContent, rec2.Code)
+	v2, _ := server.mdb.DirectGet(memdb.Key("key0"))
+	assert.Equal(t, memdb.Value("value"), v2)
+
+	// released lock_id is invalidated
+	rec3 := httptest.NewRecorder()
+	req3, err3 := http.NewRequest("DELETE", "http://memdb.devel/reservations/key0/1", nil)
+	assert.Nil(t, err3)
+	server.Router().ServeHTTP(rec3, req3)
+	assert.Equal(t, http.StatusUnauthorized, rec3.Code)
+
+	rec4 := httptest.NewRecorder()
+	req4, err4 := http.NewRequest("POST", "http://memdb.devel/reservations/key0?wait=0", nil)
+	assert.Nil(t, err4)
+	server.Router().ServeHTTP(rec4, req4)
+	assert.Equal(t, http.StatusOK, rec4.Code)
+}
+
+func TestRestServerBackupRestore(t *testing.T) {
+	source := NewRestServer()
+	source.mdb.Put(memdb.Key("key0"), memdb.Value("value0"))
+
+	rec0 := httptest.NewRecorder()
+	req0, err0 := http.NewRequest("GET", "http://memdb.devel/admin/backup", nil)
+	assert.Nil(t, err0)
+	source.Router().ServeHTTP(rec0, req0)
+	assert.Equal(t, http.StatusOK, rec0.Code)
+	assert.Equal(t, "1", rec0.Header().Get(SnapshotVersionHeader))
+	backup := rec0.Body.Bytes()
+
+	server := NewRestServer()
+	server.mdb.Put(memdb.Key("key1"), memdb.Value("value1"))
+
+	// reservations are held
+	rec1 := httptest.NewRecorder()
+	req1, err1 := http.NewRequest("POST", "http://memdb.devel/admin/restore", bytes.NewReader(backup))
+	assert.Nil(t, err1)
+	server.Router().ServeHTTP(rec1, req1)
+	assert.Equal(t, http.StatusConflict, rec1.Code)
+
+	// unsupported format version
+	rec2 := httptest.NewRecorder()
+	req2, err2 := http.NewRequest("POST", "http://memdb.devel/admin/restore?force=true", bytes.NewReader(backup))
+	assert.Nil(t, err2)
+	req2.Header.Set(SnapshotVersionHeader, "2")
+	server.Router().ServeHTTP(rec2, req2)
+	assert.Equal(t, http.StatusBadRequest, rec2.Code)
+
+	// damaged snapshot
+	rec3 := httptest.NewRecorder()
+	req3, err3 := http.NewRequest("POST", "http://memdb.devel/admin/restore?force=true", bytes.NewReader(backup[:len(backup)-1]))
+	assert.Nil(t, err3)
+	server.Router().ServeHTTP(rec3, req3)
+	assert.Equal(t, http.StatusBadRequest, rec3.Code)
+
+	rec4 := httptest.NewRecorder()
+	req4, err4 := http.NewRequest("POST", "http://memdb.devel/admin/restore?force=true", bytes.NewReader(backup))
+	assert.Nil(t, err4)
+	req4.Header.Set(SnapshotVersionHeader, "1")
+	server.Router().ServeHTTP(rec4, req4)
+	assert.Equal(t, http.StatusNoContent, rec4.Code)
+
+	v4, exists := server.mdb.DirectGet(memdb.Key("key0"))
+	assert.True(t, exists)
+	assert.Equal(t, memdb.Value("value0"), v4)
+	_, exists = server.mdb.DirectGet(memdb.Key("key1"))
+	assert.False(t, exists)
+}
+
+func TestRestServerChanges(t *testing.T) {
+	server := NewRestServer()
+	server.mdb.Release(server.mdb.Put(memdb.Key("key0"), memdb.Value("value0")))
+
+	for _, query := range []string{"from=x", "heartbeat=0s", "heartbeat=x"} {
+		rec := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "http://memdb.devel/replication/changes?"+query, nil)
+		assert.Nil(t, err)
+		server.Router().ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, query)
+	}
+
+	ts := httptest.NewServer(server.Router())
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", ts.URL+"/replication/changes?heartbeat=10ms", nil)
+	assert.Nil(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	decoder := json.NewDecoder(resp.Body)
+
+	// a new replica starts with all the values
+	var reset ChangeResponse
+	assert.Nil(t, decoder.Decode(&reset))
+	assert.Equal(t, string(memdb.ChangeReset), reset.Op)
+	assert.Equal(t, []ChangeResponse{{Op: string(memdb.ChangeSet), Key: "key0", Value: "value0", Version: 1}}, reset.Items)
+
+	var heartbeat ChangeResponse
+	assert.Nil(t, decoder.Decode(&heartbeat))
+	assert.Equal(t, reset.Seq, heartbeat.Seq)
+	assert.Equal(t, ChangeHeartbeat, heartbeat.Op)
+	if assert.NotNil(t, heartbeat.Time) {
+		assert.WithinDuration(t, time.Now(), *heartbeat.Time, time.Second)
+	}
+
+	// the following changes are streamed as they happen
+	lockId := server.mdb.Put(memdb.Key("key0"), memdb.Value("value1"))
+	assert.Nil(t, server.mdb.Delete(lockId, memdb.Key("key0")))
+
+	var changes []memdb.Change
+	for len(changes) < 2 {
+		var change ChangeResponse
+		assert.Nil(t, decoder.Decode(&change))
+		if change.Op != ChangeHeartbeat {
+			changes = append(changes, change.Change())
+		}
+	}
+	for i := range changes {
+		assert.WithinDuration(t, time.Now(), changes[i].Time, time.Second)
+		changes[i].Time = time.Time{}
+	}
+	assert.Equal(t, memdb.Change{Seq: reset.Seq + 1, Op: memdb.ChangeSet, Key: memdb.Key("key0"), Value: memdb.Value("value1"), Version: 2}, changes[0])
+	assert.Equal(t, memdb.Change{Seq: reset.Seq + 2, Op: memdb.ChangeDelete, Key: memdb.Key("key0")}, changes[1])
+}
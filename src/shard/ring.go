@@ -0,0 +1,98 @@
+package shard
+
+import (
+	"hash/fnv"
+	"memdb"
+	"sort"
+	"strconv"
+)
+
+// DefaultVirtualNodes is how many points every node has on the ring, more points spread the keys more evenly.
+const DefaultVirtualNodes = 64
+
+type point struct {
+	hash uint64
+	id   string
+}
+
+// Ring assigns keys to nodes by consistent hashing. Every node owns the keys hashed between its points
+// and the points before them, so a node joining or leaving the ring only moves the keys of its own points.
+// A Ring is never changed, a change of the nodes makes a new Ring.
+type Ring struct {
+	nodes  map[string]string
+	points []point
+}
+
+// NewRing makes a ring of the nodes given as ID to URL.
+func NewRing(nodes map[string]string) *Ring {
+	r := &Ring{nodes: make(map[string]string, len(nodes))}
+	for id, url := range nodes {
+		r.nodes[id] = url
+		for i := 0; i < DefaultVirtualNodes; i++ {
+			r.points = append(r.points, point{hash: hashString(id + "#" + strconv.Itoa(i)), id: id})
+		}
+	}
+
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash == r.points[j].hash {
+			return r.points[i].id < r.points[j].id
+		}
+		return r.points[i].hash < r.points[j].hash
+	})
+	return r
+}
+
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+
+	// similar strings get similar hashes from fnv alone, the finalizer of splitmix64 spreads them over the ring
+	x := h.Sum64()
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// Owner returns the ID of the node which owns the key, an empty ring has no owners.
+func (r *Ring) Owner(key memdb.Key) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+
+	hash := hashString(string(key))
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= hash
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].id
+}
+
+// URL returns the URL of the node, or an empty string if the node is not on the ring.
+func (r *Ring) URL(id string) string {
+	return r.nodes[id]
+}
+
+// Nodes returns the nodes of the ring as ID to URL.
+func (r *Ring) Nodes() map[string]string {
+	nodes := make(map[string]string, len(r.nodes))
+	for id, url := range r.nodes {
+		nodes[id] = url
+	}
+	return nodes
+}
+
+// with returns a copy of the ring with the node added or its URL changed.
+func (r *Ring) with(id, url string) *Ring {
+	nodes := r.Nodes()
+	nodes[id] = url
+	return NewRing(nodes)
+}
+
+// without returns a copy of the ring without the node.
+func (r *Ring) without(id string) *Ring {
+	nodes := r.Nodes()
+	delete(nodes, id)
+	return NewRing(nodes)
+}
@@ -0,0 +1,62 @@
+package shard
+
+import (
+	"fmt"
+	"memdb"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRing(t *testing.T) {
+	assert.Equal(t, "", NewRing(nil).Owner(memdb.Key("key0")))
+
+	nodes := map[string]string{"node0": "http://127.0.0.1:8081", "node1": "http://127.0.0.1:8082", "node2": "http://127.0.0.1:8083"}
+	ring := NewRing(nodes)
+	assert.Equal(t, nodes, ring.Nodes())
+	assert.Equal(t, "http://127.0.0.1:8082", ring.URL("node1"))
+	assert.Equal(t, "", ring.URL("node3"))
+
+	owners := make(map[memdb.Key]string)
+	counts := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		key := memdb.Key(fmt.Sprintf("key%d", i))
+		owners[key] = ring.Owner(key)
+		counts[owners[key]]++
+	}
+
+	// every node gets a fair share of the keys
+	for id := range nodes {
+		assert.True(t, counts[id] > 600, "node %s owns %d keys", id, counts[id])
+	}
+
+	// a joining node only takes keys, the other keys stay where they are
+	joined := ring.with("node3", "http://127.0.0.1:8084")
+	moved := 0
+	for key, owner := range owners {
+		if newOwner := joined.Owner(key); newOwner != owner {
+			assert.Equal(t, "node3", newOwner)
+			moved++
+		}
+	}
+	assert.True(t, moved > 0 && moved < 1500, "%d keys moved", moved)
+
+	// a leaving node only gives its keys away
+	left := ring.without("node2")
+	for key, owner := range owners {
+		if owner != "node2" {
+			assert.Equal(t, owner, left.Owner(key))
+		} else {
+			assert.NotEqual(t, "node2", left.Owner(key))
+		}
+	}
+}
+
+func TestLockIDGenerator(t *testing.T) {
+	gen := NewLockIDGenerator("node.0")
+	assert.Equal(t, memdb.LockID("node.0.1"), gen.Next())
+	assert.Equal(t, memdb.LockID("node.0.2"), gen.Next())
+
+	assert.Equal(t, "node.0", lockNode("node.0.2"))
+	assert.Equal(t, "", lockNode("2"))
+}
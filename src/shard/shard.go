@@ -0,0 +1,658 @@
+package shard
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"memdb"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"rest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	ErrUnknownNode   = errors.New("Node is not in the cluster")
+	ErrLastNode      = errors.New("Last node can't leave the cluster")
+	ErrMixedNodes    = errors.New("Keys belong to different nodes")
+	ErrHolderNode    = errors.New("Keys belong to another node than the lock holder")
+	ErrClockVersions = errors.New("Database can't take its versions from the clock")
+
+	errNewerCopy = errors.New("Node has a newer copy of the key")
+)
+
+// ForwardedHeader marks a request sent by another node of the cluster, it carries the ID of that node.
+// Such a request is never sent on, so nodes which don't agree on the ring yet can't send a request
+// back and forth. A change of the cluster marked by it is trusted only if it comes from the address
+// of that node, see fromNode.
+const ForwardedHeader = "X-Memdb-Forwarded-By"
+
+// DefaultRebalanceInterval is how often the keys which couldn't be moved to their owner are tried again.
+const DefaultRebalanceInterval = time.Second
+
+// rebalanceBatch is how many keys are scanned at once by Rebalance.
+const rebalanceBatch = 100
+
+const (
+	transferPath = "/shard/keys/"
+	nodesPath    = "/admin/nodes"
+)
+
+// Config configures a node of a sharded cluster.
+type Config struct {
+	// ID of this node, it must be one of Nodes
+	ID string
+
+	// Nodes are all nodes of the cluster as ID to URL
+	Nodes map[string]string
+
+	// Redirect makes the node answer requests for the keys of other nodes with 307 Temporary Redirect
+	// to the owner instead of forwarding them
+	Redirect bool
+
+	// RebalanceInterval is how often the keys which couldn't be moved are tried again, zero means DefaultRebalanceInterval
+	RebalanceInterval time.Duration
+}
+
+// Addr returns the host:port part of the URL of this node, the node listens on it.
+func (c Config) Addr() (string, error) {
+	rawURL, exists := c.Nodes[c.ID]
+	if !exists {
+		return "", ErrUnknownNode
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("Invalid URL of node %s: %q", c.ID, rawURL)
+	}
+	return u.Host, nil
+}
+
+type lockIdGenerator struct {
+	id        string
+	currentId uint64
+}
+
+func (g *lockIdGenerator) Next() memdb.LockID {
+	g.currentId++
+	return memdb.LockID(g.id + "." + strconv.FormatUint(g.currentId, 10))
+}
+
+func (g *lockIdGenerator) Seq() uint64 {
+	return g.currentId
+}
+
+func (g *lockIdGenerator) Skip(seq uint64) {
+	if seq > g.currentId {
+		g.currentId = seq
+	}
+}
+
+// NewLockIDGenerator makes LockIDs which tell the node that issued them, e.g. node0.42,
+// so the requests of a lock holder reach the node which has the lock. It's a memdb.LockIDSequence,
+// a node persisted by memdb.Open doesn't hand out a LockID of an earlier run.
+func NewLockIDGenerator(id string) memdb.LockIDGenerator {
+	return &lockIdGenerator{id: id}
+}
+
+// lockNode returns the ID of the node which issued lockId, or an empty string if lockId has no node.
+func lockNode(lockId string) string {
+	i := strings.LastIndex(lockId, ".")
+	if i < 0 {
+		return ""
+	}
+	return lockId[:i]
+}
+
+type transferRequest struct {
+	Value   string `json:"value"`
+	Version uint64 `json:"version"`
+}
+
+type NodesResponse struct {
+	ID    string            `json:"id"`
+	Nodes map[string]string `json:"nodes"`
+}
+
+// Node is a node of a cluster which splits the keys between its nodes by consistent hashing.
+// Every key lives on the node which owns it, requests for the keys of other nodes are forwarded
+// or redirected to them. The holder of a lock keeps talking to the node which issued the lock.
+//
+// When a node joins or leaves the cluster, the keys move to their new owners, but a reserved key stays
+// where it is until it's released. Until then the new owner doesn't have the key: reads miss it, and if
+// the key is created there again, the cluster has two copies of it. The versions of all nodes
+// follow the clock, so the copy with the newer version is kept and the other one is dropped.
+// Multi-key reservations only work for keys of the same node, and a holder only adds the keys of the node
+// which issued its lock. Scans and admin requests only see the keys
+// of the node they're sent to.
+type Node struct {
+	config Config
+	db     memdb.MemDB
+	logger *log.Logger
+
+	mu   sync.RWMutex
+	ring *Ring
+
+	rebalance chan struct{}
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// New starts a node of the cluster on top of db, the LockIDs of db should come from NewLockIDGenerator.
+// The versions of db follow the clock from now on, so the versions of the copies of a key on different nodes
+// tell which copy is newer. The keys db has which belong to other nodes are moved to them in the background.
+func New(db memdb.MemDB, config Config, logger *log.Logger) (*Node, error) {
+	if _, exists := config.Nodes[config.ID]; !exists {
+		return nil, ErrUnknownNode
+	}
+	if !memdb.UseClockVersions(db) {
+		return nil, ErrClockVersions
+	}
+	if config.RebalanceInterval <= 0 {
+		config.RebalanceInterval = DefaultRebalanceInterval
+	}
+
+	n := &Node{
+		config:    config,
+		db:        db,
+		logger:    logger,
+		ring:      NewRing(config.Nodes),
+		rebalance: make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+
+	n.wg.Add(1)
+	go n.rebalancer()
+	n.triggerRebalance()
+	return n, nil
+}
+
+// Ring returns the current ring of the cluster as this node knows it.
+func (n *Node) Ring() *Ring {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.ring
+}
+
+// Join adds the node to the ring, or changes its URL, and moves the keys the node now owns to it.
+func (n *Node) Join(id, url string) {
+	n.mu.Lock()
+	n.ring = n.ring.with(id, url)
+	n.mu.Unlock()
+
+	n.triggerRebalance()
+}
+
+// Leave removes the node from the ring and moves the keys it owned to the other nodes.
+// When this node leaves, all its keys are moved away.
+func (n *Node) Leave(id string) error {
+	n.mu.Lock()
+	if n.ring.URL(id) == "" {
+		n.mu.Unlock()
+		return ErrUnknownNode
+	}
+	if len(n.ring.nodes) == 1 {
+		n.mu.Unlock()
+		return ErrLastNode
+	}
+	n.ring = n.ring.without(id)
+	n.mu.Unlock()
+
+	n.triggerRebalance()
+	return nil
+}
+
+// Close stops moving the keys, it doesn't close the database.
+func (n *Node) Close() error {
+	close(n.done)
+	n.wg.Wait()
+	return nil
+}
+
+func (n *Node) triggerRebalance() {
+	select {
+	case n.rebalance <- struct{}{}:
+	default:
+	}
+}
+
+// rebalancer moves the keys whenever the ring changes, and tries again while some of them are left.
+func (n *Node) rebalancer() {
+	defer n.wg.Done()
+
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-n.rebalance:
+		case <-retry:
+		case <-n.done:
+			return
+		}
+
+		moved, pending, err := n.Rebalance()
+		if moved > 0 || err != nil {
+			n.logger.Printf("Rebalance moved %d keys, %d keys are left, error: %v", moved, pending, err)
+		}
+
+		retry = nil
+		if pending > 0 {
+			retry = time.After(n.config.RebalanceInterval)
+		}
+	}
+}
+
+// Rebalance moves the keys of this node which are owned by other nodes to their owners.
+// A reserved key, or a key which failed to move, is left, pending is how many keys are left.
+func (n *Node) Rebalance() (moved, pending int, err error) {
+	ring := n.Ring()
+
+	var startAfter memdb.Key
+	for {
+		keys, more := n.db.Scan("", startAfter, rebalanceBatch)
+		for _, key := range keys {
+			owner := ring.Owner(key)
+			if owner == n.config.ID || owner == "" {
+				continue
+			}
+
+			moveErr := n.move(key, ring.URL(owner))
+			if moveErr == nil {
+				moved++
+			} else if moveErr != memdb.ErrKeyNotFound {
+				pending++
+				if _, locked := moveErr.(*memdb.LockedError); !locked && err == nil {
+					err = moveErr
+				}
+			}
+		}
+
+		if !more {
+			return moved, pending, err
+		}
+		startAfter = keys[len(keys)-1]
+	}
+}
+
+// move locks the key, so nobody changes it while it's moved, hands it over to the node at url and deletes it here.
+// The key is deleted once the node has stored it, or if the node has a newer copy of it.
+func (n *Node) move(key memdb.Key, url string) error {
+	lockId, value, err := n.db.TryGetAndLock(key)
+	if err != nil {
+		return err
+	}
+
+	_, version, err := n.db.GetWithVersion(lockId, key)
+	if err == nil {
+		err = n.transfer(url, key, value, version)
+	}
+	if err == errNewerCopy {
+		err = nil
+	}
+	if err != nil {
+		n.db.Release(lockId)
+		return err
+	}
+
+	return n.db.Delete(lockId, key)
+}
+
+// transfer stores the key on the node at url. It returns errNewerCopy if the node keeps its newer copy,
+// and *memdb.LockedError if the node's older copy is reserved.
+func (n *Node) transfer(nodeURL string, key memdb.Key, value memdb.Value, version memdb.Version) error {
+	body, err := json.Marshal(&transferRequest{Value: string(value), Version: uint64(version)})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", nodeURL+transferPath+url.PathEscape(string(key)), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(ForwardedHeader, n.config.ID)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return nil
+	case http.StatusPreconditionFailed:
+		return errNewerCopy
+	case http.StatusConflict:
+		return &memdb.LockedError{Key: key}
+	}
+	return fmt.Errorf("Transfer of key %s to %s failed: %s", key, nodeURL, resp.Status)
+}
+
+// Handler serves the requests of the cluster and sends the requests for the keys of other nodes to them,
+// other requests go to next. A request forwarded by another node for a key this node doesn't own either,
+// which happens while the nodes don't agree on the ring, is answered with 421 Misdirected Request.
+func (n *Node) Handler(next http.Handler) http.Handler {
+	router := mux.NewRouter()
+	router.HandleFunc(transferPath+"{key}", n.Transfer).Methods("POST")
+	router.HandleFunc(nodesPath, n.Nodes).Methods("GET")
+	router.HandleFunc(nodesPath+"/{id}", n.AddNode).Methods("PUT")
+	router.HandleFunc(nodesPath+"/{id}", n.RemoveNode).Methods("DELETE")
+	router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n.route(w, r, next)
+	})
+	return router
+}
+
+// route serves the request here if this node owns its key, otherwise it forwards or redirects the request to the owner.
+// A request forwarded by another node for a key this node doesn't own is refused.
+func (n *Node) route(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	ring := n.Ring()
+	owner, err := n.owner(ring, r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	ownerURL := ring.URL(owner)
+	if owner == n.config.ID || ownerURL == "" {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	if r.Header.Get(ForwardedHeader) != "" {
+		// the nodes don't agree on the owner yet, the client tries again once they do
+		w.WriteHeader(http.StatusMisdirectedRequest)
+		return
+	}
+
+	if n.config.Redirect {
+		http.Redirect(w, r, ownerURL+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+		return
+	}
+
+	target, err := url.Parse(ownerURL)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = target.Scheme
+			req.URL.Host = target.Host
+			req.Host = target.Host
+			req.Header.Set(ForwardedHeader, n.config.ID)
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			n.logger.Printf("Forward of %s %s to node %s failed: %v", req.Method, req.URL.Path, owner, err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+		// waiting reservations answer late, nothing to buffer
+		FlushInterval: -1,
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+// owner returns the ID of the node which serves the request, or an empty string if any node does.
+func (n *Node) owner(ring *Ring, r *http.Request) (string, error) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 2 && parts[0] == "reservations" && r.Method == "POST":
+		return holderOwner(ring, r, []memdb.Key{memdb.Key(parts[1])})
+
+	case len(parts) == 2 && (parts[0] == "values" || parts[0] == "reservations"):
+		return ring.Owner(memdb.Key(parts[1])), nil
+
+	case len(parts) == 3 && (parts[0] == "values" || parts[0] == "reservations"):
+		// the holder reaches the lock even if the key has a new owner
+		return lockNode(parts[2]), nil
+
+	case len(parts) == 3 && parts[0] == "locks":
+		return lockNode(parts[1]), nil
+
+	case len(parts) == 3 && parts[0] == "admin" && parts[1] == "locks":
+		return lockNode(parts[2]), nil
+
+	case len(parts) == 1 && parts[0] == "reservations" && r.Method == "POST":
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return "", err
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		// a malformed request is refused by the node it's sent to
+		var request rest.LockManyRequest
+		if json.Unmarshal(body, &request) != nil || len(request.Keys) == 0 {
+			return "", nil
+		}
+
+		keys := make([]memdb.Key, len(request.Keys))
+		for i, key := range request.Keys {
+			keys[i] = memdb.Key(key)
+		}
+		return holderOwner(ring, r, keys)
+	}
+
+	return "", nil
+}
+
+// holderOwner returns the owner of the keys a reservation locks, they must belong to the same node.
+// A holder given by lock_id has its lock on the node which issued it, so the keys must belong to that node.
+func holderOwner(ring *Ring, r *http.Request, keys []memdb.Key) (string, error) {
+	owner := ring.Owner(keys[0])
+	for _, key := range keys[1:] {
+		if ring.Owner(key) != owner {
+			return "", ErrMixedNodes
+		}
+	}
+
+	// a LockID of no node is refused by the owner
+	if node := lockNode(r.URL.Query().Get("lock_id")); node != "" && node != owner {
+		return "", ErrHolderNode
+	}
+	return owner, nil
+}
+
+//
+// POST /shard/keys/{key}
+//
+// Store the key moved from another node with its value and version, the body is transferRequest.
+// The versions of all nodes follow the clock, so the copy of the key with the newer version is kept.
+//
+// If the body is malformed, return 400 Bad Request
+// If the key has the same or a newer version here, keep it and return 412 Precondition Failed, the moved copy is outdated
+// If the key has an older version here but it's reserved, return 409 Conflict, the key is moved again once it's released
+// Otherwise return 204 No Content
+//
+func (n *Node) Transfer(w http.ResponseWriter, r *http.Request) {
+	key := memdb.Key(mux.Vars(r)["key"])
+
+	var request transferRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err := n.db.ApplyChange(memdb.Change{Op: memdb.ChangeMove, Key: key, Value: memdb.Value(request.Value), Version: memdb.Version(request.Version)})
+	if err == memdb.ErrKeyExists {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+
+	} else if _, locked := err.(*memdb.LockedError); locked {
+		w.WriteHeader(http.StatusConflict)
+		return
+
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//
+// GET /admin/nodes
+//
+// Return the ID of this node and all nodes of the cluster as this node knows them, see NodesResponse.
+//
+func (n *Node) Nodes(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&NodesResponse{ID: n.config.ID, Nodes: n.Ring().Nodes()})
+}
+
+//
+// PUT /admin/nodes/{id}
+//
+// Add the node with the URL in the body to the cluster, or change its URL. The change is sent to all nodes
+// of the cluster, the keys the node now owns move to it in the background.
+//
+// If the URL is invalid, return 400 Bad Request
+// If the request is marked by ForwardedHeader, but it doesn't come from that node, return 403 Forbidden
+// If any other node couldn't be told about the change, return 502 Bad Gateway, the change stays on the rest of the nodes
+// Otherwise return 204 No Content
+//
+func (n *Node) AddNode(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	nodeURL := strings.TrimSuffix(strings.TrimSpace(string(body)), "/")
+	if u, err := url.Parse(nodeURL); err != nil || u.Scheme == "" || u.Host == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	forwarded := r.Header.Get(ForwardedHeader) != ""
+	if forwarded && !n.fromNode(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	n.Join(id, nodeURL)
+	if forwarded {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	n.logger.Printf("AUDIT: node %s joined the cluster at %s, requested by %s", id, nodeURL, r.RemoteAddr)
+	n.broadcast(w, "PUT", nodesPath+"/"+url.PathEscape(id), body, n.Ring().Nodes())
+}
+
+//
+// DELETE /admin/nodes/{id}
+//
+// Remove the node from the cluster. The change is sent to all nodes of the cluster and the removed node,
+// the keys of the removed node move to the other nodes in the background.
+//
+// If the request is marked by ForwardedHeader, but it doesn't come from that node, return 403 Forbidden
+// If the node is not in the cluster, return 404 Not Found
+// If it's the last node of the cluster, return 409 Conflict
+// If any other node couldn't be told about the change, return 502 Bad Gateway, the change stays on the rest of the nodes
+// Otherwise return 204 No Content
+//
+func (n *Node) RemoveNode(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	forwarded := r.Header.Get(ForwardedHeader) != ""
+	if forwarded && !n.fromNode(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	nodes := n.Ring().Nodes()
+	err := n.Leave(id)
+	if err == ErrUnknownNode {
+		w.WriteHeader(http.StatusNotFound)
+		return
+
+	} else if err == ErrLastNode {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	if forwarded {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	n.logger.Printf("AUDIT: node %s left the cluster, requested by %s", id, r.RemoteAddr)
+	n.broadcast(w, "DELETE", nodesPath+"/"+url.PathEscape(id), nil, nodes)
+}
+
+// fromNode reports whether the request comes from the node of the cluster named by ForwardedHeader:
+// the node must be in the ring and the request must come from an address of the host in its URL.
+func (n *Node) fromNode(r *http.Request) bool {
+	nodeURL := n.Ring().URL(r.Header.Get(ForwardedHeader))
+	if nodeURL == "" {
+		return false
+	}
+
+	u, err := url.Parse(nodeURL)
+	if err != nil {
+		return false
+	}
+	remoteHost, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	addrs, err := net.LookupHost(u.Hostname())
+	if err != nil {
+		return false
+	}
+
+	for _, addr := range addrs {
+		if net.ParseIP(addr).Equal(net.ParseIP(remoteHost)) {
+			return true
+		}
+	}
+	return false
+}
+
+// broadcast sends a change of the cluster to the other nodes and answers the request of the change.
+func (n *Node) broadcast(w http.ResponseWriter, method, path string, body []byte, nodes map[string]string) {
+	failed := false
+	for id, nodeURL := range nodes {
+		if id == n.config.ID {
+			continue
+		}
+
+		req, err := http.NewRequest(method, nodeURL+path, bytes.NewReader(body))
+		if err != nil {
+			failed = true
+			continue
+		}
+		req.Header.Set(ForwardedHeader, n.config.ID)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			n.logger.Printf("Cluster change %s %s not sent to node %s: %v", method, path, id, err)
+			failed = true
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			n.logger.Printf("Cluster change %s %s refused by node %s: %s", method, path, id, resp.Status)
+			failed = true
+		}
+	}
+
+	if failed {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
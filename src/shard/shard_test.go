@@ -0,0 +1,379 @@
+package shard
+
+import (
+	"encoding/json"
+	"fmt"
+	"memdb"
+	"net/http"
+	"net/http/httptest"
+	"rest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var noRedirect = &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+	return http.ErrUseLastResponse
+}}
+
+// testCluster runs the nodes in this process, each of them behind its own HTTP server.
+type testCluster struct {
+	dbs     map[string]memdb.MemDB
+	nodes   map[string]*Node
+	servers map[string]*httptest.Server
+	urls    map[string]string
+}
+
+func newTestCluster(t *testing.T, size int, redirect bool) *testCluster {
+	c := &testCluster{
+		dbs:     make(map[string]memdb.MemDB),
+		nodes:   make(map[string]*Node),
+		servers: make(map[string]*httptest.Server),
+		urls:    make(map[string]string),
+	}
+
+	for i := 0; i < size; i++ {
+		id := fmt.Sprintf("node%d", i)
+		c.servers[id] = httptest.NewUnstartedServer(nil)
+		c.urls[id] = "http://" + c.servers[id].Listener.Addr().String()
+	}
+
+	for id := range c.servers {
+		c.start(t, id, c.urls, redirect)
+	}
+
+	t.Cleanup(func() {
+		for id, server := range c.servers {
+			server.Close()
+			c.nodes[id].Close()
+		}
+	})
+	return c
+}
+
+// start starts the node with the nodes it knows about and itself.
+func (c *testCluster) start(t *testing.T, id string, known map[string]string, redirect bool) {
+	if c.servers[id] == nil {
+		c.servers[id] = httptest.NewUnstartedServer(nil)
+		c.urls[id] = "http://" + c.servers[id].Listener.Addr().String()
+	}
+	nodes := map[string]string{id: c.urls[id]}
+	for other, url := range known {
+		nodes[other] = url
+	}
+
+	c.dbs[id] = memdb.NewMemDB(id, NewLockIDGenerator(id))
+	node, err := New(c.dbs[id], Config{ID: id, Nodes: nodes, Redirect: redirect, RebalanceInterval: 20 * time.Millisecond}, rest.NoLog)
+	assert.NoError(t, err)
+	c.nodes[id] = node
+	c.servers[id].Config.Handler = node.Handler(rest.NewRestServerWithMemDB(c.dbs[id], rest.NoLog).Router())
+	c.servers[id].Start()
+}
+
+func request(t *testing.T, client *http.Client, method, url, body string, v interface{}) *http.Response {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	assert.NoError(t, err)
+	resp, err := client.Do(req)
+	if !assert.NoError(t, err) {
+		return &http.Response{}
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(v))
+	}
+	return resp
+}
+
+// where returns the nodes which have the key.
+func (c *testCluster) where(key string) []string {
+	var ids []string
+	for id, db := range c.dbs {
+		if _, exists := db.DirectGet(memdb.Key(key)); exists {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func TestShardForward(t *testing.T) {
+	c := newTestCluster(t, 3, false)
+	ring := c.nodes["node0"].Ring()
+
+	// every key lives on its owner, whichever node it's sent to
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("key%d", i)
+		var lock rest.LockResponse
+		resp := request(t, http.DefaultClient, "PUT", c.urls["node0"]+"/values/"+key, "value0", &lock)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, ring.Owner(memdb.Key(key)), lockNode(lock.LockId))
+		assert.Equal(t, []string{ring.Owner(memdb.Key(key))}, c.where(key))
+
+		// the lock holder reaches the lock through any node
+		resp = request(t, http.DefaultClient, "POST", c.urls["node1"]+"/values/"+key+"/"+lock.LockId+"?release=true", "value1", nil)
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+		var value rest.ValueResponse
+		resp = request(t, http.DefaultClient, "GET", c.urls["node2"]+"/values/"+key, "", &value)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "value1", value.Value)
+	}
+
+	// keys of a multi-key reservation must belong to the same node
+	var keys []string
+	for i := 0; len(keys) < 2; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if len(keys) == 0 || ring.Owner(memdb.Key(key)) != ring.Owner(memdb.Key(keys[0])) {
+			keys = append(keys, key)
+		}
+	}
+	body, _ := json.Marshal(&rest.LockManyRequest{Keys: keys})
+	resp := request(t, http.DefaultClient, "POST", c.urls["node0"]+"/reservations", string(body), nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	body, _ = json.Marshal(&rest.LockManyRequest{Keys: keys[:1]})
+	var locked rest.LockValuesResponse
+	resp = request(t, http.DefaultClient, "POST", c.urls["node0"]+"/reservations", string(body), &locked)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "value1", locked.Values[keys[0]])
+
+	// a holder only adds the keys of the node which has its lock
+	resp = request(t, http.DefaultClient, "POST", c.urls["node0"]+"/reservations/"+keys[1]+"?lock_id="+locked.LockId, "", nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	body, _ = json.Marshal(&rest.LockManyRequest{Keys: keys[1:]})
+	resp = request(t, http.DefaultClient, "POST", c.urls["node0"]+"/reservations?lock_id="+locked.LockId, string(body), nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	var key string
+	for i := 0; key == ""; i++ {
+		if k := fmt.Sprintf("key%d", i); k != keys[0] && ring.Owner(memdb.Key(k)) == ring.Owner(memdb.Key(keys[0])) {
+			key = k
+		}
+	}
+	var added rest.LockValueResponse
+	resp = request(t, http.DefaultClient, "POST", c.urls["node1"]+"/reservations/"+key+"?lock_id="+locked.LockId, "", &added)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, locked.LockId, added.LockId)
+}
+
+func TestShardForwardedHeader(t *testing.T) {
+	c := newTestCluster(t, 3, false)
+	ring := c.nodes["node0"].Ring()
+
+	// a client can't skip the owner by marking its request as forwarded
+	var key string
+	for i := 0; key == ""; i++ {
+		if k := fmt.Sprintf("key%d", i); ring.Owner(memdb.Key(k)) != "node0" {
+			key = k
+		}
+	}
+	req, err := http.NewRequest("PUT", c.urls["node0"]+"/values/"+key, strings.NewReader("value0"))
+	assert.NoError(t, err)
+	req.Header.Set(ForwardedHeader, ring.Owner(memdb.Key(key)))
+	resp, err := http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusMisdirectedRequest, resp.StatusCode)
+	}
+	assert.Empty(t, c.where(key))
+
+	// nor change the cluster on this node only
+	req, err = http.NewRequest("PUT", c.urls["node0"]+"/admin/nodes/node3", strings.NewReader("http://127.0.0.1:1"))
+	assert.NoError(t, err)
+	req.Header.Set(ForwardedHeader, "node9")
+	resp, err = http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+
+	req, err = http.NewRequest("DELETE", c.urls["node0"]+"/admin/nodes/node1", nil)
+	assert.NoError(t, err)
+	req.Header.Set(ForwardedHeader, "node9")
+	resp, err = http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+	assert.Equal(t, c.urls, c.nodes["node0"].Ring().Nodes())
+}
+
+func TestShardRedirect(t *testing.T) {
+	c := newTestCluster(t, 2, true)
+	ring := c.nodes["node0"].Ring()
+
+	var key string
+	for i := 0; key == ""; i++ {
+		if ring.Owner(memdb.Key(fmt.Sprintf("key%d", i))) == "node1" {
+			key = fmt.Sprintf("key%d", i)
+		}
+	}
+
+	resp := request(t, noRedirect, "PUT", c.urls["node0"]+"/values/"+key+"?ttl=10s", "value0", nil)
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	assert.Equal(t, c.urls["node1"]+"/values/"+key+"?ttl=10s", resp.Header.Get("Location"))
+
+	var lock rest.LockResponse
+	resp = request(t, http.DefaultClient, "PUT", c.urls["node0"]+"/values/"+key, "value0", &lock)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = request(t, noRedirect, "POST", c.urls["node0"]+"/locks/"+lock.LockId+"/renew?ttl=10s", "", nil)
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+}
+
+func TestShardRebalance(t *testing.T) {
+	c := newTestCluster(t, 2, false)
+	nodes := c.nodes["node0"].Ring().Nodes()
+
+	var locks []rest.LockResponse
+	for i := 0; i < 50; i++ {
+		var lock rest.LockResponse
+		resp := request(t, http.DefaultClient, "PUT", c.urls["node0"]+fmt.Sprintf("/values/key%d", i), "value0", &lock)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		locks = append(locks, lock)
+	}
+
+	// all keys but one are released
+	for i, lock := range locks[1:] {
+		resp := request(t, http.DefaultClient, "DELETE", c.urls["node0"]+fmt.Sprintf("/reservations/key%d/%s", i+1, lock.LockId), "", nil)
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	}
+
+	// a new node takes its keys from the others
+	c.start(t, "node2", nodes, false)
+	resp := request(t, http.DefaultClient, "PUT", c.urls["node0"]+"/admin/nodes/node2", c.urls["node2"], nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	var list NodesResponse
+	resp = request(t, http.DefaultClient, "GET", c.urls["node1"]+"/admin/nodes", "", &list)
+	assert.Equal(t, "node1", list.ID)
+	assert.Equal(t, c.urls, list.Nodes)
+
+	ring := c.nodes["node0"].Ring()
+	reservedOwner := ring.Owner(memdb.Key("key0"))
+	assert.Eventually(t, func() bool {
+		for i := 1; i < 50; i++ {
+			key := fmt.Sprintf("key%d", i)
+			if where := c.where(key); len(where) != 1 || where[0] != ring.Owner(memdb.Key(key)) {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the reserved key moves once it's released
+	resp = request(t, http.DefaultClient, "POST", c.urls["node2"]+"/values/key0/"+locks[0].LockId+"?release=true", "value1", nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Eventually(t, func() bool {
+		where := c.where("key0")
+		return len(where) == 1 && where[0] == reservedOwner
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// a leaving node gives all its keys away
+	resp = request(t, http.DefaultClient, "DELETE", c.urls["node0"]+"/admin/nodes/node1", "", nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Eventually(t, func() bool {
+		for i := 0; i < 50; i++ {
+			if where := c.where(fmt.Sprintf("key%d", i)); len(where) != 1 || where[0] == "node1" {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	var value rest.ValueResponse
+	resp = request(t, http.DefaultClient, "GET", c.urls["node1"]+"/values/key0", "", &value)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "value1", value.Value)
+
+	resp = request(t, http.DefaultClient, "DELETE", c.urls["node0"]+"/admin/nodes/node1", "", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestShardTransfer(t *testing.T) {
+	c := newTestCluster(t, 1, false)
+
+	body := `{"value":"value0","version":42}`
+	resp := request(t, http.DefaultClient, "POST", c.urls["node0"]+"/shard/keys/key0", body, nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	_, version, _, err := c.dbs["node0"].Peek(memdb.Key("key0"))
+	assert.NoError(t, err)
+	assert.Equal(t, memdb.Version(42), version)
+
+	// the same copy moved again, e.g. when the response got lost, is outdated
+	resp = request(t, http.DefaultClient, "POST", c.urls["node0"]+"/shard/keys/key0", body, nil)
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+
+	// a newer copy replaces the key, unless it's reserved
+	lockId, _, err := c.dbs["node0"].GetAndLock(memdb.Key("key0"))
+	assert.NoError(t, err)
+	body = `{"value":"value1","version":43}`
+	resp = request(t, http.DefaultClient, "POST", c.urls["node0"]+"/shard/keys/key0", body, nil)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	assert.NoError(t, c.dbs["node0"].Release(lockId))
+	resp = request(t, http.DefaultClient, "POST", c.urls["node0"]+"/shard/keys/key0", body, nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	value, _, _, err := c.dbs["node0"].Peek(memdb.Key("key0"))
+	assert.NoError(t, err)
+	assert.Equal(t, memdb.Value("value1"), value)
+
+	// a write gets its version from the clock
+	before := memdb.Version(time.Now().UnixNano())
+	resp = request(t, http.DefaultClient, "PUT", c.urls["node0"]+"/values/key1", "value1", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	_, version, _, err = c.dbs["node0"].Peek(memdb.Key("key1"))
+	assert.NoError(t, err)
+	assert.True(t, version > before)
+
+	resp = request(t, http.DefaultClient, "POST", c.urls["node0"]+"/shard/keys/key1", "value", nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = request(t, http.DefaultClient, "DELETE", c.urls["node0"]+"/admin/nodes/node0", "", nil)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+}
+
+func TestShardRebalanceConflict(t *testing.T) {
+	c := newTestCluster(t, 2, false)
+	ring := c.nodes["node0"].Ring()
+
+	var keys []memdb.Key
+	for i := 0; len(keys) < 2; i++ {
+		if key := memdb.Key(fmt.Sprintf("key%d", i)); ring.Owner(key) == "node0" {
+			keys = append(keys, key)
+		}
+	}
+
+	// node1 has an outdated copy of keys[0], the owner writes it later
+	assert.NoError(t, c.dbs["node1"].Release(c.dbs["node1"].Put(keys[0], memdb.Value("old"))))
+	var lock rest.LockResponse
+	resp := request(t, http.DefaultClient, "PUT", c.urls["node0"]+"/values/"+string(keys[0]), "new", &lock)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = request(t, http.DefaultClient, "DELETE", c.urls["node0"]+"/reservations/"+string(keys[0])+"/"+lock.LockId, "", nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	// the owner has a reserved outdated copy of keys[1], node1 writes it later
+	resp = request(t, http.DefaultClient, "PUT", c.urls["node0"]+"/values/"+string(keys[1]), "old", &lock)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NoError(t, c.dbs["node1"].Release(c.dbs["node1"].Put(keys[1], memdb.Value("new"))))
+
+	// the outdated copy is dropped, the newer one waits until the owner's copy is released
+	assert.Eventually(t, func() bool {
+		_, pending, _ := c.nodes["node1"].Rebalance()
+		where := c.where(string(keys[0]))
+		return pending == 1 && len(where) == 1 && where[0] == "node0"
+	}, 5*time.Second, 10*time.Millisecond)
+	value, _ := c.dbs["node0"].DirectGet(keys[0])
+	assert.Equal(t, memdb.Value("new"), value)
+	assert.Len(t, c.where(string(keys[1])), 2)
+
+	resp = request(t, http.DefaultClient, "DELETE", c.urls["node0"]+"/reservations/"+string(keys[1])+"/"+lock.LockId, "", nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Eventually(t, func() bool {
+		c.nodes["node1"].Rebalance()
+		where := c.where(string(keys[1]))
+		return len(where) == 1 && where[0] == "node0"
+	}, 5*time.Second, 10*time.Millisecond)
+	value, _ = c.dbs["node0"].DirectGet(keys[1])
+	assert.Equal(t, memdb.Value("new"), value)
+}